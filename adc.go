@@ -0,0 +1,142 @@
+package main
+
+import (
+    "errors"
+    "math"
+)
+
+// Saturation reports whether an ADC conversion hit one of the rails.
+type Saturation int8
+
+const (
+    NotSaturated Saturation = iota
+    SaturatedLow            // Input below code 0
+    SaturatedHigh           // Input above the full-scale code
+)
+
+func (s Saturation) String() string {
+    switch s {
+    case SaturatedLow:
+        return "low"
+    case SaturatedHigh:
+        return "high"
+    default:
+        return "none"
+    }
+}
+
+// ADCConfig describes the non-ideal behaviour of a sensor's converter.
+// All fields are optional; the zero value is an ideal converter whose
+// input is already expressed in counts.
+type ADCConfig struct {
+    // Full-scale reference voltage. When set, the sensor equation is taken
+    // to produce volts, which are converted to counts with the LSB size.
+    ReferenceVoltage float64 `json:"reference_voltage,omitempty"`
+    // Volts per count; defaults to reference_voltage / 2^resolution_bits.
+    LSBVolts         float64 `json:"lsb_volts,omitempty"`
+    // Offset error, in LSB, added to every conversion.
+    OffsetLSB        float64 `json:"offset_lsb,omitempty"`
+    // Gain error as a fraction of full scale, e.g. 0.01 for +1%.
+    GainError        float64 `json:"gain_error,omitempty"`
+    // Peak integral non-linearity in LSB (bow shaped, worst at mid-scale).
+    INLLSB           float64 `json:"inl_lsb,omitempty"`
+    // Peak differential non-linearity in LSB (fixed per-code pattern).
+    DNLLSB           float64 `json:"dnl_lsb,omitempty"`
+}
+
+var ErrNotANumber = errors.New("sensor value is not a number")
+
+// ADC converts an analog value into an N-bit code.
+// It is a small value type, built once per sensor and passed by value.
+type ADC struct {
+    minCode float64
+    maxCode float64
+    lsb     float64
+    config  ADCConfig
+}
+
+// NewADC returns the converter for a sensor. A resolution of 0 keeps the
+// historical behaviour of an unbounded (int32) reading.
+func NewADC(bits int32, config *ADCConfig) ADC {
+    a := ADC{lsb: 1}
+    if config != nil {
+        a.config = *config
+    }
+    if bits <= 0 || bits > 31 {
+        a.minCode = math.MinInt32
+        a.maxCode = math.MaxInt32
+    } else {
+        a.maxCode = float64(int64(1)<<bits - 1)
+    }
+
+    switch {
+    case a.config.LSBVolts > 0:
+        a.lsb = a.config.LSBVolts
+    case a.config.ReferenceVoltage > 0 && bits > 0 && bits <= 31:
+        a.lsb = a.config.ReferenceVoltage / float64(int64(1)<<bits)
+    }
+    return a
+}
+
+// Convert quantizes analog into a code, clamping to [0, 2^bits-1] and
+// reporting which rail (if any) the conversion saturated on.
+func (a ADC) Convert(analog float64) (int32, Saturation, error) {
+    if math.IsNaN(analog) {
+        return 0, NotSaturated, ErrNotANumber
+    }
+    code := analog / a.lsb
+
+    // Gain and offset errors act on the ideal transfer line.
+    code = code*(1+a.config.GainError) + a.config.OffsetLSB
+
+    // INL: a parabolic bow that is zero at both ends of the range.
+    if a.config.INLLSB != 0 && a.minCode == 0 {
+        u := code / a.maxCode
+        if u > 0 && u < 1 {
+            code += a.config.INLLSB * 4 * u * (1 - u)
+        }
+    }
+
+    // DNL: every code transition is shifted by a fixed amount, so some
+    // codes are wider than one LSB and their neighbours narrower.
+    if a.config.DNLLSB != 0 && !math.IsInf(code, 0) {
+        code += a.config.DNLLSB * dnlPattern(int64(math.Floor(code)))
+    }
+
+    // Code k covers [k, k+1) LSB, the same truncation the simulator has
+    // always applied to positive readings.
+    out, sat := a.Clamp(math.Floor(code))
+    return out, sat, nil
+}
+
+// Clamp limits a code to the converter's range and reports saturation.
+func (a ADC) Clamp(code float64) (int32, Saturation) {
+    switch {
+    case code < a.minCode:
+        return int32(a.minCode), SaturatedLow
+    case code > a.maxCode:
+        return int32(a.maxCode), SaturatedHigh
+    }
+    return int32(code), NotSaturated
+}
+
+// FullScale returns the highest code the converter can produce.
+func (a ADC) FullScale() int32 {
+    return int32(a.maxCode)
+}
+
+// ZeroScale returns the lowest code the converter can produce.
+func (a ADC) ZeroScale() int32 {
+    return int32(a.minCode)
+}
+
+// dnlPattern maps a code onto a repeatable offset in [-0.5, 0.5).
+// A hash (SplitMix64) is used instead of a table because a 24-bit
+// converter would need 16M entries.
+func dnlPattern(code int64) float64 {
+    z := uint64(code) + 0x9E3779B97F4A7C15
+    z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+    z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+    z ^= z >> 31
+    return float64(z>>11)/(1<<53) - 0.5
+}
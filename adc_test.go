@@ -0,0 +1,85 @@
+package main
+
+import (
+    "math"
+    "testing"
+)
+
+func TestADCClamp(t *testing.T) {
+    adc := NewADC(8, nil)
+
+    tests := []struct {
+        in   float64
+        code int32
+        sat  Saturation
+    }{
+        {100.7, 100, NotSaturated},
+        {255.2, 255, NotSaturated},
+        {256, 255, SaturatedHigh},
+        {-0.5, 0, SaturatedLow},
+    }
+    for _, tc := range tests {
+        code, sat, err := adc.Convert(tc.in)
+        if err != nil {
+            t.Fatalf("Convert(%g) failed: %v", tc.in, err)
+        }
+        if code != tc.code || sat != tc.sat {
+            t.Errorf("Convert(%g): expected %d (%s), got %d (%s)",
+                     tc.in, tc.code, tc.sat, code, sat)
+        }
+    }
+}
+
+func TestADCReferenceVoltage(t *testing.T) {
+    // 8 bits over 2.56V gives a 10mV LSB
+    adc := NewADC(8, &ADCConfig{ReferenceVoltage: 2.56})
+    if code, _, _ := adc.Convert(1.005); code != 100 {
+        t.Errorf("Expected code 100 for 1.005V, got %d", code)
+    }
+
+    // An explicit LSB overrides the reference-derived one
+    adc = NewADC(8, &ADCConfig{ReferenceVoltage: 2.56, LSBVolts: 0.02})
+    if code, _, _ := adc.Convert(1.005); code != 50 {
+        t.Errorf("Expected code 50 with 20mV LSB, got %d", code)
+    }
+}
+
+func TestADCOffsetGainError(t *testing.T) {
+    adc := NewADC(8, &ADCConfig{OffsetLSB: 2, GainError: 0.1})
+    // 100 * 1.1 + 2 = 112
+    if code, _, _ := adc.Convert(100); code != 112 {
+        t.Errorf("Expected 112, got %d", code)
+    }
+}
+
+func TestADCNonLinearity(t *testing.T) {
+    // INL is zero at the ends of the range and peaks at mid-scale
+    adc := NewADC(8, &ADCConfig{INLLSB: 3})
+    if code, _, _ := adc.Convert(0); code != 0 {
+        t.Errorf("Expected no INL at zero, got %d", code)
+    }
+    if code, _, _ := adc.Convert(127.5); code != 130 {
+        t.Errorf("Expected +3 LSB at mid-scale, got %d", code)
+    }
+
+    // DNL is a fixed pattern: the same input always gives the same code
+    // and the error never exceeds half the configured DNL.
+    adc = NewADC(8, &ADCConfig{DNLLSB: 1})
+    for in := 1.0; in < 250; in += 0.37 {
+        a, _, _ := adc.Convert(in)
+        b, _, _ := adc.Convert(in)
+        if a != b {
+            t.Fatalf("DNL not repeatable at %g: %d vs %d", in, a, b)
+        }
+        if d := float64(a) - in; d > 1 || d < -2 {
+            t.Errorf("DNL error too large at %g: code %d", in, a)
+        }
+    }
+}
+
+func TestADCNaN(t *testing.T) {
+    adc := NewADC(8, nil)
+    if _, _, err := adc.Convert(math.NaN()); err != ErrNotANumber {
+        t.Errorf("Expected ErrNotANumber, got %v", err)
+    }
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "math/cmplx"
+)
+
+// Analog prototypes of the biquad designs.
+const (
+    DesignButterworth = "butterworth"
+    DesignBessel      = "bessel"
+)
+
+// Responses of the biquad designs.
+const (
+    ResponseLowPass  = "low_pass"
+    ResponseHighPass = "high_pass"
+    ResponseBandPass = "band_pass"
+    ResponseNotch    = "notch"
+)
+
+// Structures the biquad sections run in.
+const (
+    // Direct Form I: two input and two output samples of state, as
+    // fixed-point firmware with a single accumulator runs them
+    FormDF1  = "df1"
+    // Direct Form II transposed: two states, the better in floating point
+    FormDF2T = "df2t"
+)
+
+// maxBiquadOrder bounds the order of a biquad design.
+const maxBiquadOrder = 8
+
+// BiquadSection is a second-order section of an IIR filter:
+//
+//     H(z) = (b0 + b1 z^-1 + b2 z^-2) / (1 + a1 z^-1 + a2 z^-2)
+//
+// A first-order section has b2 and a2 zero.
+type BiquadSection struct {
+    B0 float64 `json:"b0"`
+    B1 float64 `json:"b1"`
+    B2 float64 `json:"b2"`
+    A1 float64 `json:"a1"`
+    A2 float64 `json:"a2"`
+}
+
+// stable reports whether the poles of the section are inside the unit
+// circle (the stability triangle of a1, a2).
+func (s BiquadSection) stable() bool {
+    return math.Abs(s.A2) < 1 && math.Abs(s.A1) < 1+s.A2
+}
+
+// BiquadConfig is a stage of an IIR biquad cascade: explicit sections, or
+// a design of the given order from an analog Butterworth or Bessel
+// prototype, moved to the sensor's frequency_hz by the bilinear transform
+// with the cutoff prewarped. An order n low- or high-pass takes (n+1)/2
+// sections; a band-pass or notch of order n takes n.
+type BiquadConfig struct {
+    // Explicit sections; or
+    Sections    []BiquadSection `json:"sections,omitempty"`
+    // a design: "butterworth" (default) or "bessel",
+    Design      string          `json:"design,omitempty"`
+    // "low_pass" (default), "high_pass", "band_pass" or "notch",
+    Response    string          `json:"response,omitempty"`
+    // -3 dB frequency, the center for band_pass and notch,
+    CutoffHz    float64         `json:"cutoff_hz,omitempty"`
+    // -3 dB width of band_pass and notch
+    BandwidthHz float64         `json:"bandwidth_hz,omitempty"`
+    Order       int             `json:"order,omitempty"`
+    // "df2t" (default) or "df1"
+    Form        string          `json:"form,omitempty"`
+}
+
+// Validate checks the constraints of a stage for a sensor sampled at
+// rateHz.
+func (bc BiquadConfig) Validate(rateHz float64) error {
+    _, _, err := bc.design(rateHz)
+    return err
+}
+
+// design returns the sections of the stage, and the frequency of its
+// passband in radians per sample.
+func (bc BiquadConfig) design(rateHz float64) ([]BiquadSection,
+                                               float64, error) {
+    switch bc.Form {
+    case "", FormDF1, FormDF2T:
+    default:
+        return nil, 0, fmt.Errorf("biquad form must be 'df2t' or 'df1', "+
+            "got %s", bc.Form)
+    }
+    if bc.Sections != nil {
+        if bc.Design != "" || bc.Response != "" || bc.CutoffHz != 0 ||
+            bc.BandwidthHz != 0 || bc.Order != 0 {
+            return nil, 0, fmt.Errorf("biquad takes sections or a design " +
+                "(design, response, cutoff_hz, bandwidth_hz, order), " +
+                "not both")
+        }
+        if len(bc.Sections) == 0 {
+            return nil, 0, fmt.Errorf("biquad needs at least one section")
+        }
+        for i, s := range bc.Sections {
+            for _, c := range []float64{s.B0, s.B1, s.B2, s.A1, s.A2} {
+                if math.IsNaN(c) || math.IsInf(c, 0) {
+                    return nil, 0, fmt.Errorf("biquad sections[%d] has a "+
+                        "non-finite coefficient", i)
+                }
+            }
+            if !s.stable() {
+                return nil, 0, fmt.Errorf("biquad sections[%d] is unstable: "+
+                    "a1 %g, a2 %g", i, s.A1, s.A2)
+            }
+        }
+        return bc.Sections, 0, nil
+    }
+
+    if bc.Order < 1 || bc.Order > maxBiquadOrder {
+        return nil, 0, fmt.Errorf("biquad order must be 1 to %d, got %d",
+            maxBiquadOrder, bc.Order)
+    }
+    var prototype []complex128
+    switch bc.Design {
+    case "", DesignButterworth:
+        prototype = butterworthPoles(bc.Order)
+    case DesignBessel:
+        prototype = besselPoles(bc.Order)
+    default:
+        return nil, 0, fmt.Errorf("biquad design must be 'butterworth' "+
+            "or 'bessel', got %s", bc.Design)
+    }
+    if !(rateHz > 0) {
+        return nil, 0, fmt.Errorf("biquad cutoff_hz needs the sensor's " +
+            "frequency_hz")
+    }
+    nyquist := rateHz / 2
+    if !(bc.CutoffHz > 0 && bc.CutoffHz < nyquist) {
+        return nil, 0, fmt.Errorf("biquad cutoff_hz must be between 0 and "+
+            "the Nyquist frequency %g Hz, got %g", nyquist, bc.CutoffHz)
+    }
+
+    // Prewarped analog frequencies, and the bilinear transform
+    fs2 := 2 * rateHz
+    warp := func(hz float64) float64 {
+        return fs2 * math.Tan(math.Pi*hz/rateHz)
+    }
+    bilinear := func(s complex128) complex128 {
+        return (complex(fs2, 0) + s) / (complex(fs2, 0) - s)
+    }
+    var sections []BiquadSection
+    var ref float64
+    add := func(p1, p2, z1, z2 complex128) {
+        sections = append(sections,
+                          biquadSection(bilinear(p1), bilinear(p2), z1, z2,
+                                        ref))
+    }
+
+    switch bc.Response {
+    case "", ResponseLowPass, ResponseHighPass:
+        if bc.BandwidthHz != 0 {
+            return nil, 0, fmt.Errorf("biquad bandwidth_hz is only for " +
+                "band_pass and notch")
+        }
+        wc := complex(warp(bc.CutoffHz), 0)
+        // Low-pass: s -> s/wc, zeros at z = -1; high-pass: s -> wc/s,
+        // zeros at z = 1 and the passband at Nyquist
+        scale := func(p complex128) complex128 { return p * wc }
+        zero := complex(-1, 0)
+        if bc.Response == ResponseHighPass {
+            scale = func(p complex128) complex128 { return wc / p }
+            zero, ref = 1, math.Pi
+        }
+        for _, p := range prototype {
+            if imag(p) == 0 {
+                // A first-order section: its second pole and zero at 0
+                // leave b2 and a2 zero
+                sections = append(sections,
+                                  biquadSection(bilinear(scale(p)), 0,
+                                                zero, 0, ref))
+                continue
+            }
+            s := scale(p)
+            add(s, cmplx.Conj(s), zero, zero)
+        }
+
+    case ResponseBandPass, ResponseNotch:
+        if !(bc.BandwidthHz > 0 && bc.BandwidthHz < nyquist) {
+            return nil, 0, fmt.Errorf("biquad bandwidth_hz must be between "+
+                "0 and the Nyquist frequency %g Hz, got %g", nyquist,
+                bc.BandwidthHz)
+        }
+        low, high := bandEdges(rateHz, bc.CutoffHz, bc.BandwidthHz)
+        w0, bw := warp(bc.CutoffHz), warp(high)-warp(low)
+        center := 2 * math.Pi * bc.CutoffHz / rateHz
+        // Band-pass: s -> (s^2 + w0^2) / (bw s), zeros at z = 1 and -1;
+        // notch: s -> bw s / (s^2 + w0^2), zeros on the circle at w0
+        z1, z2 := complex(1, 0), complex(-1, 0)
+        ref = center
+        if bc.Response == ResponseNotch {
+            z1 = cmplx.Rect(1, center)
+            z2 = cmplx.Conj(z1)
+            ref = 0
+        }
+        // Each prototype pole p gives the roots of s^2 - k s + w0^2
+        roots := func(p complex128) (complex128, complex128) {
+            k := p * complex(bw, 0)
+            if bc.Response == ResponseNotch {
+                k = complex(bw, 0) / p
+            }
+            d := cmplx.Sqrt(k*k - complex(4*w0*w0, 0))
+            return (k + d) / 2, (k - d) / 2
+        }
+        for _, p := range prototype {
+            q1, q2 := roots(p)
+            if imag(p) == 0 {
+                // Both real, or a conjugate pair
+                add(q1, q2, z1, z2)
+                continue
+            }
+            add(q1, cmplx.Conj(q1), z1, z2)
+            add(q2, cmplx.Conj(q2), z1, z2)
+        }
+
+    default:
+        return nil, 0, fmt.Errorf("biquad response must be 'low_pass', "+
+            "'high_pass', 'band_pass' or 'notch', got %s", bc.Response)
+    }
+    return sections, ref, nil
+}
+
+// bandEdges returns the -3 dB edges, width apart, of a band centered on
+// center Hz: prewarped, their geometric mean is the prewarped center.
+func bandEdges(rateHz, center, width float64) (low, high float64) {
+    warp := func(hz float64) float64 { return math.Tan(math.Pi * hz / rateHz) }
+    target := warp(center) * warp(center)
+    lo, hi := 0.0, rateHz/2-width
+    for i := 0; i < 100; i++ {
+        low = (lo + hi) / 2
+        if warp(low)*warp(low+width) < target {
+            lo = low
+        } else {
+            hi = low
+        }
+    }
+    return low, low + width
+}
+
+// biquadSection returns the section of poles p1, p2 and zeros z1, z2 (each
+// a conjugate pair or both real) with a gain of one at w radians per
+// sample.
+func biquadSection(p1, p2, z1, z2 complex128, w float64) BiquadSection {
+    s := BiquadSection{
+        B0: 1,
+        B1: -real(z1 + z2),
+        B2: real(z1 * z2),
+        A1: -real(p1 + p2),
+        A2: real(p1 * p2),
+    }
+    g := cmplx.Abs(s.response(w))
+    s.B0, s.B1, s.B2 = s.B0/g, s.B1/g, s.B2/g
+    return s
+}
+
+// response returns H at w radians per sample.
+func (s BiquadSection) response(w float64) complex128 {
+    z1 := cmplx.Rect(1, -w)
+    z2 := z1 * z1
+    return (complex(s.B0, 0) + complex(s.B1, 0)*z1 + complex(s.B2, 0)*z2) /
+        (1 + complex(s.A1, 0)*z1 + complex(s.A2, 0)*z2)
+}
+
+// groupDelay returns the group delay of the section at w radians per
+// sample, in samples.
+func (s BiquadSection) groupDelay(w float64) float64 {
+    // For P(z) = sum c_k z^-k, the delay is Re(sum k c_k z^-k / P)
+    delay := func(c0, c1, c2 float64) float64 {
+        z1 := cmplx.Rect(1, -w)
+        z2 := z1 * z1
+        p := complex(c0, 0) + complex(c1, 0)*z1 + complex(c2, 0)*z2
+        return real((complex(c1, 0)*z1 + complex(2*c2, 0)*z2) / p)
+    }
+    return delay(s.B0, s.B1, s.B2) - delay(1, s.A1, s.A2)
+}
+
+// butterworthPoles returns the poles of the analog Butterworth low-pass of
+// order n and cutoff 1 rad/s in the upper half plane, one of each
+// conjugate pair, then the real pole of an odd order.
+func butterworthPoles(n int) []complex128 {
+    var poles []complex128
+    for k := 0; k < n/2; k++ {
+        poles = append(poles,
+                       cmplx.Rect(1, math.Pi*float64(2*k+n+1)/float64(2*n)))
+    }
+    if n%2 == 1 {
+        poles = append(poles, -1)
+    }
+    return poles
+}
+
+// besselPoles returns the poles of the analog Bessel low-pass of order n,
+// -3 dB at 1 rad/s, as butterworthPoles does: the roots of the reverse
+// Bessel polynomial, scaled from its unit delay to the cutoff.
+func besselPoles(n int) []complex128 {
+    // theta_n(s) = sum a_k s^k, a_k = (2n-k)! / (2^(n-k) k! (n-k)!), monic
+    factorial := func(k int) float64 {
+        f := 1.0
+        for i := 2; i <= k; i++ {
+            f *= float64(i)
+        }
+        return f
+    }
+    coef := make([]float64, n+1)
+    for k := range coef {
+        coef[k] = factorial(2*n-k) /
+            (math.Ldexp(1, n-k) * factorial(k) * factorial(n-k))
+    }
+    roots := polynomialRoots(coef)
+
+    // |H(jw)|^2 = 1/2 at the cutoff, found by bisection
+    gain := func(w float64) float64 {
+        h := complex(1, 0)
+        for _, p := range roots {
+            h *= -p / (complex(0, w) - p)
+        }
+        return cmplx.Abs(h)
+    }
+    lo, hi := 0.0, 10.0
+    for i := 0; i < 100; i++ {
+        mid := (lo + hi) / 2
+        if gain(mid) > math.Sqrt2/2 {
+            lo = mid
+        } else {
+            hi = mid
+        }
+    }
+    var poles []complex128
+    var axis complex128
+    for _, p := range roots {
+        p /= complex(lo, 0)
+        switch {
+        case math.Abs(imag(p)) < 1e-9:
+            axis = complex(real(p), 0)
+        case imag(p) > 0:
+            poles = append(poles, p)
+        }
+    }
+    if n%2 == 1 {
+        poles = append(poles, axis)
+    }
+    return poles
+}
+
+// polynomialRoots returns the roots of the monic polynomial sum c_k x^k by
+// the Durand-Kerner iteration.
+func polynomialRoots(c []float64) []complex128 {
+    n := len(c) - 1
+    roots := make([]complex128, n)
+    for i := range roots {
+        roots[i] = cmplx.Pow(complex(0.4, 0.9), complex(float64(i), 0))
+    }
+    eval := func(x complex128) complex128 {
+        y := complex(c[n], 0)
+        for k := n - 1; k >= 0; k-- {
+            y = y*x + complex(c[k], 0)
+        }
+        return y
+    }
+    for iter := 0; iter < 500; iter++ {
+        for i, r := range roots {
+            d := complex(1, 0)
+            for j, s := range roots {
+                if j != i {
+                    d *= r - s
+                }
+            }
+            roots[i] = r - eval(r)/d
+        }
+    }
+    return roots
+}
+
+// biquadStage is a stage of sections with the state of their form.
+type biquadStage struct {
+    sections []BiquadSection
+    df1      bool
+    // Per section: x[n-1], x[n-2], y[n-1], y[n-2] in Direct Form I, the
+    // two states in the first two in Direct Form II transposed
+    state    [][4]float64
+}
+
+// BiquadFilter is an IIR filter: a cascade of stages of second-order
+// sections (see BiquadConfig), computed in float64 on the integer samples
+// and rounded to the nearest count at the output.
+type BiquadFilter struct {
+    stages      []biquadStage
+    ref         float64 // passband frequency, radians per sample
+    initialized bool
+}
+
+// NewBiquadFilter designs the stages of a sensor sampled at rateHz, which
+// only the designs need, in order.
+func NewBiquadFilter(stages []BiquadConfig,
+                     rateHz float64) (*BiquadFilter, error) {
+    if len(stages) == 0 {
+        return nil, fmt.Errorf("biquad filter needs at least one stage")
+    }
+    f := &BiquadFilter{}
+    for i, bc := range stages {
+        sections, ref, err := bc.design(rateHz)
+        if err != nil {
+            return nil, fmt.Errorf("biquads[%d]: %w", i, err)
+        }
+        // The passband of a high- or band-pass stage is that of the
+        // cascade
+        if f.ref == 0 {
+            f.ref = ref
+        }
+        f.stages = append(f.stages, biquadStage{
+            sections: sections,
+            df1:      bc.Form == FormDF1,
+            state:    make([][4]float64, len(sections)),
+        })
+    }
+    return f, nil
+}
+
+// Sections returns the number of second-order sections in the cascade.
+func (f *BiquadFilter) Sections() int {
+    n := 0
+    for _, st := range f.stages {
+        n += len(st.sections)
+    }
+    return n
+}
+
+// GroupDelay returns the delay of the cascade in its passband (at DC
+// unless a stage is a high- or band-pass), in samples.
+func (f *BiquadFilter) GroupDelay() float64 {
+    delay := 0.0
+    for _, st := range f.stages {
+        for _, s := range st.sections {
+            delay += s.groupDelay(f.ref)
+        }
+    }
+    return delay
+}
+
+// Initialize settles every section on a steady input of value.
+func (f *BiquadFilter) Initialize(value int32) {
+    x := float64(value)
+    for _, st := range f.stages {
+        for i, s := range st.sections {
+            // Output of the steady input, through the DC gain
+            y := x * (s.B0 + s.B1 + s.B2) / (1 + s.A1 + s.A2)
+            if st.df1 {
+                st.state[i] = [4]float64{x, x, y, y}
+            } else {
+                st.state[i] = [4]float64{(s.B1+s.B2)*x - (s.A1+s.A2)*y,
+                                         s.B2*x - s.A2*y}
+            }
+            x = y
+        }
+    }
+    f.initialized = true
+}
+
+// Process runs one sample through every stage and section, in order.
+func (f *BiquadFilter) Process(value int32) int32 {
+    if !f.initialized {
+        f.Initialize(value)
+    }
+    x := float64(value)
+    for _, st := range f.stages {
+        for i, s := range st.sections {
+            v := &st.state[i]
+            var y float64
+            if st.df1 {
+                y = s.B0*x + s.B1*v[0] + s.B2*v[1] - s.A1*v[2] - s.A2*v[3]
+                v[1], v[0], v[3], v[2] = v[0], x, v[2], y
+            } else {
+                y = s.B0*x + v[0]
+                v[0] = s.B1*x - s.A1*y + v[1]
+                v[1] = s.B2*x - s.A2*y
+            }
+            x = y
+        }
+    }
+    return int32(math.Max(math.MinInt32, math.Min(math.MaxInt32,
+                                                  math.Round(x))))
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+    "math"
+    "math/cmplx"
+    "math/rand"
+    "strings"
+    "testing"
+)
+
+// cascadeResponse returns H of the sections at w radians per sample.
+func cascadeResponse(sections []BiquadSection, w float64) complex128 {
+    h := complex(1, 0)
+    for _, s := range sections {
+        h *= s.response(w)
+    }
+    return h
+}
+
+func TestBiquadButterworth(t *testing.T) {
+    // scipy.signal.butter(2, 0.2)
+    sections, _, err := BiquadConfig{CutoffHz: 10, Order: 2}.design(100)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := BiquadSection{0.06745527, 0.13491055, 0.06745527,
+                          -1.1429805, 0.4128016}
+    got := sections[0]
+    for i, pair := range [][2]float64{{got.B0, want.B0}, {got.B1, want.B1},
+                                      {got.B2, want.B2}, {got.A1, want.A1},
+                                      {got.A2, want.A2}} {
+        if math.Abs(pair[0]-pair[1]) > 1e-7 {
+            t.Errorf("Coefficient %d: expected %g, got %g", i, pair[1],
+                pair[0])
+        }
+    }
+}
+
+func TestBesselPoles(t *testing.T) {
+    // scipy.signal.besselap(2, norm="mag")
+    poles := besselPoles(2)
+    if len(poles) != 1 ||
+        cmplx.Abs(poles[0]-complex(-1.10160133, 0.63600982)) > 1e-7 {
+        t.Errorf("Expected -1.1016+0.6360i, got %v", poles)
+    }
+    for n := 1; n <= maxBiquadOrder; n++ {
+        if got := len(besselPoles(n)); got != (n+1)/2 {
+            t.Errorf("Order %d: expected %d poles, got %d", n, (n+1)/2, got)
+        }
+    }
+}
+
+func TestBiquadDesigns(t *testing.T) {
+    const rate = 100.0
+    w := func(hz float64) float64 { return 2 * math.Pi * hz / rate }
+    half := math.Sqrt2 / 2
+    for _, design := range []string{DesignButterworth, DesignBessel} {
+        for order := 1; order <= maxBiquadOrder; order++ {
+            for _, response := range []string{ResponseLowPass,
+                                              ResponseHighPass,
+                                              ResponseBandPass,
+                                              ResponseNotch} {
+                bc := BiquadConfig{Design: design, Response: response,
+                                   CutoffHz: 20, Order: order}
+                // Magnitudes expected at frequencies in Hz
+                checks := map[float64]float64{20: half}
+                switch response {
+                case ResponseLowPass:
+                    checks[0] = 1
+                case ResponseHighPass:
+                    checks[50] = 1
+                case ResponseBandPass, ResponseNotch:
+                    bc.BandwidthHz = 10
+                    low, high := bandEdges(rate, 20, 10)
+                    checks = map[float64]float64{low: half, high: half}
+                    if response == ResponseNotch {
+                        checks[0], checks[50] = 1, 1
+                    }
+                }
+                sections, ref, err := bc.design(rate)
+                if err != nil {
+                    t.Fatalf("%+v: %v", bc, err)
+                }
+                for _, s := range sections {
+                    if !s.stable() {
+                        t.Errorf("%+v: unstable section %+v", bc, s)
+                    }
+                }
+                if response == ResponseNotch {
+                    h := cmplx.Abs(cascadeResponse(sections, w(20)))
+                    if h > 1e-9 {
+                        t.Errorf("%+v: expected a null at 20 Hz, got %g",
+                            bc, h)
+                    }
+                } else {
+                    g := cmplx.Abs(cascadeResponse(sections, ref))
+                    if math.Abs(g-1) > 1e-9 {
+                        t.Errorf("%+v: expected a passband gain of 1, "+
+                            "got %g", bc, g)
+                    }
+                }
+                if response == ResponseBandPass && ref != w(20) {
+                    t.Errorf("%+v: expected the passband at 20 Hz, got %g",
+                        bc, ref)
+                }
+                for hz, want := range checks {
+                    g := cmplx.Abs(cascadeResponse(sections, w(hz)))
+                    if math.Abs(g-want) > 1e-6 {
+                        t.Errorf("%+v: expected a gain of %g at %g Hz, "+
+                            "got %g", bc, want, hz, g)
+                    }
+                }
+            }
+        }
+    }
+}
+
+func TestBiquadGroupDelay(t *testing.T) {
+    for _, bc := range []BiquadConfig{
+        {Design: DesignBessel, CutoffHz: 5, Order: 4},
+        {Response: ResponseHighPass, CutoffHz: 5, Order: 3},
+        {Response: ResponseBandPass, CutoffHz: 20, BandwidthHz: 4,
+         Order: 2},
+    } {
+        f, err := NewBiquadFilter([]BiquadConfig{bc}, 100)
+        if err != nil {
+            t.Fatal(err)
+        }
+        // Against the derivative of the phase
+        sections := f.stages[0].sections
+        const dw = 1e-5
+        phase := cmplx.Phase(cascadeResponse(sections, f.ref+dw) /
+                             cascadeResponse(sections, f.ref-dw))
+        want := -phase / (2 * dw)
+        if got := f.GroupDelay(); math.Abs(got-want) > 1e-4 {
+            t.Errorf("%+v: expected a group delay of %g, got %g", bc, want,
+                got)
+        }
+    }
+
+    // A Bessel low-pass delays its passband evenly; a Butterworth less so
+    flatness := func(design string) float64 {
+        sections, _, _ := BiquadConfig{Design: design, CutoffHz: 5,
+                                       Order: 4}.design(100)
+        var at0, at2 float64
+        for _, s := range sections {
+            at0 += s.groupDelay(0)
+            at2 += s.groupDelay(2 * math.Pi * 2 / 100)
+        }
+        return math.Abs(at2-at0) / at0
+    }
+    if b, bw := flatness(DesignBessel),
+        flatness(DesignButterworth); !(b < 0.02 && bw > 2*b) {
+        t.Errorf("Expected a flatter Bessel delay: %g vs Butterworth %g",
+            b, bw)
+    }
+}
+
+func TestBiquadFilter(t *testing.T) {
+    stages := func(form string) []BiquadConfig {
+        return []BiquadConfig{
+            {CutoffHz: 10, Order: 3, Form: form},
+            {Response: ResponseNotch, CutoffHz: 25, BandwidthHz: 4, Order: 1,
+             Form: form},
+        }
+    }
+    df1, err := NewBiquadFilter(stages(FormDF1), 100)
+    if err != nil {
+        t.Fatal(err)
+    }
+    df2t, _ := NewBiquadFilter(stages(FormDF2T), 100)
+    if n := df1.Sections(); n != 3 {
+        t.Errorf("Expected 3 sections, got %d", n)
+    }
+
+    // Both forms compute the same cascade; a steady input passes
+    df1.Initialize(5000)
+    df2t.Initialize(5000)
+    for i := 0; i < 10; i++ {
+        if a, b := df1.Process(5000), df2t.Process(5000); a != 5000 ||
+            b != 5000 {
+            t.Fatalf("Expected a steady 5000, got %d and %d", a, b)
+        }
+    }
+    rng := rand.New(rand.NewSource(1))
+    for i := 0; i < 1000; i++ {
+        x := int32(5000 + rng.Intn(2001) - 1000)
+        if a, b := df1.Process(x), df2t.Process(x); a-b > 1 || b-a > 1 {
+            t.Fatalf("Sample %d: DF-I %d and DF-II transposed %d differ",
+                i, a, b)
+        }
+    }
+
+    // The notch removes its tone
+    notch, _ := NewBiquadFilter([]BiquadConfig{
+        {Response: ResponseNotch, CutoffHz: 25, BandwidthHz: 4, Order: 2},
+    }, 100)
+    peak := 0.0
+    for n := 0; n < 400; n++ {
+        x := 10000 * math.Sin(2*math.Pi*25*float64(n)/100+0.3)
+        y := float64(notch.Process(int32(math.Round(x))))
+        if n >= 200 {
+            peak = math.Max(peak, math.Abs(y))
+        }
+    }
+    if peak > 2 {
+        t.Errorf("Expected the notch to remove the 25 Hz tone, got %g", peak)
+    }
+
+    // A high-pass settles a steady input to zero
+    hp, _ := NewBiquadFilter([]BiquadConfig{
+        {Response: ResponseHighPass, CutoffHz: 1, Order: 2},
+    }, 100)
+    if got := hp.Process(7000); got != 0 {
+        t.Errorf("Expected a high-pass of a steady input to be 0, got %d",
+            got)
+    }
+}
+
+func TestBiquadConfigValidate(t *testing.T) {
+    for _, bc := range []BiquadConfig{
+        {},
+        {CutoffHz: 10, Order: maxBiquadOrder + 1},
+        {CutoffHz: 50, Order: 2},
+        {CutoffHz: 10, Order: 2, Design: "chebyshev"},
+        {CutoffHz: 10, Order: 2, Response: "all_pass"},
+        {CutoffHz: 10, Order: 2, Form: "df2"},
+        {CutoffHz: 10, Order: 2, BandwidthHz: 2},
+        {CutoffHz: 10, Order: 2, Response: ResponseBandPass},
+        {CutoffHz: 20, Order: 2, Response: ResponseNotch, BandwidthHz: 50},
+        {Sections: []BiquadSection{}},
+        {Sections: []BiquadSection{{B0: 1, A1: -2, A2: 1}}},
+        {Sections: []BiquadSection{{B0: math.Inf(1)}}},
+        {Sections: []BiquadSection{{B0: 1}}, Order: 2},
+    } {
+        if err := bc.Validate(100); err == nil {
+            t.Errorf("Expected %+v to be rejected", bc)
+        }
+    }
+    bc := BiquadConfig{Sections: []BiquadSection{{B0: 0.5, A1: -0.5}}}
+    if err := bc.Validate(0); err != nil {
+        t.Errorf("Sections rejected without a sample rate: %v", err)
+    }
+}
+
+func TestValidateBiquadFilter(t *testing.T) {
+    config := validTestConfig()
+    config.Processing.Filters = []FilterConfig{
+        {Type: "biquad", Target: "flow", Biquads: []BiquadConfig{
+            {Design: DesignBessel, CutoffHz: 10, Order: 4},
+            {Response: ResponseNotch, CutoffHz: 25, BandwidthHz: 5,
+             Order: 1},
+        }},
+    }
+    if err := config.Validate(); err != nil {
+        t.Fatalf("Valid config rejected: %v", err)
+    }
+    p := newTestProcessor(t, config.Processing)
+    if _, ok := p.Filters["flow"][0].(*BiquadFilter); !ok {
+        t.Errorf("Expected a biquad filter on flow, got %v",
+            p.Filters["flow"])
+    }
+
+    // dp is sampled at 10 Hz
+    for _, fc := range []FilterConfig{
+        {Type: "biquad", Target: "flow"},
+        {Type: "biquad", Target: "dp",
+         Biquads: []BiquadConfig{{CutoffHz: 10, Order: 2}}},
+    } {
+        config := validTestConfig()
+        config.Processing.Filters = []FilterConfig{fc}
+        err := config.Validate()
+        if err == nil || !strings.HasPrefix(err.Error(),
+                                            "processing.filters[0]") {
+            t.Errorf("%+v: expected a filters[0] error, got %v", fc, err)
+        }
+    }
+}
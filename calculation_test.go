@@ -2,6 +2,7 @@ package main
 
 import (
     "math"
+    "strings"
     "testing"
 )
 
@@ -69,12 +70,12 @@ func TestCalculateFlowAccuracy(t *testing.T) {
         FlowEquation: equation,
         Filters:      []FilterConfig{},
     }
-    processor := NewProcessor(config)
+    processor := newTestProcessor(t, config)
 
     for _, tc := range tests {
         t.Run(tc.name, func(t *testing.T) {
-            processor.LatestPressure = tc.pressure
-            processor.LatestTemperature = tc.temperature
+            processor.Latest["pressure"] = tc.pressure
+            processor.Latest["temperature"] = tc.temperature
 
             result, err := processor.CalculateFlow(config.FlowEquation,
                                                    tc.flow,
@@ -112,7 +113,7 @@ func TestCalculateFlowWithFilters(t *testing.T) {
             {Type: "low_pass", Target: "pressure", Alpha: 0.5},
         },
     }
-    processor := NewProcessor(config)
+    processor := newTestProcessor(t, config)
     
     refF := int32(8000000)
     refP := int32(100)
@@ -120,19 +121,19 @@ func TestCalculateFlowWithFilters(t *testing.T) {
 
     // Set Temperature to reference point (100)
     // so it doesn't affect calculation
-    processor.LatestTemperature = 100
+    processor.Latest["temperature"] = 100
 
     // 1. Update Pressure with 100 (Reference) -> Stored 100
-    processor.UpdatePressure(100)
+    processor.Update("pressure", 100)
     
     // 2. Update Pressure with 200. 
     // Filter: Prev=100, New=200. Alpha=0.5.
     //         Result = 100 + 0.5*(200-100) = 150
-    processor.UpdatePressure(200)
+    processor.Update("pressure", 200)
 
-    if processor.LatestPressure != 150 {
+    if processor.Latest["pressure"] != 150 {
         t.Errorf("Filter expected to dampen pressure to 150, got %d",
-                 processor.LatestPressure)
+                 processor.Latest["pressure"])
     }
 
     // Calculate Flow: F=1000, P=150, T=100
@@ -164,25 +165,25 @@ func TestCalculateFlowWithTempFilter(t *testing.T) {
             {Type: "low_pass", Target: "temperature", Alpha: 0.5},
         },
     }
-    processor := NewProcessor(config)
+    processor := newTestProcessor(t, config)
     
     refF := int32(8000000)
     refP := int32(100)
     refT := int32(100)
 
     // Set Pressure to reference point (100)
-    processor.LatestPressure = 100
+    processor.Latest["pressure"] = 100
 
     // 1. Update Temperature with 100 (Reference) -> Stored 100
-    processor.UpdateTemperature(100)
+    processor.Update("temperature", 100)
     
     // 2. Update Temperature with 200. 
     // Filter: Prev=100, New=200. Alpha=0.5. Result = 100 + 0.5*(200-100) = 150
-    processor.UpdateTemperature(200)
+    processor.Update("temperature", 200)
 
-    if processor.LatestTemperature != 150 {
+    if processor.Latest["temperature"] != 150 {
         t.Errorf("Filter expected to dampen temperature to 150, got %d",
-                 processor.LatestTemperature)
+                 processor.Latest["temperature"])
     }
 
     // Calculate Flow: F=1000, P=100, T=150
@@ -206,3 +207,67 @@ func TestCalculateFlowWithTempFilter(t *testing.T) {
     }
 }
 
+
+func TestCalculateFlowNamedSensors(t *testing.T) {
+    // Any sensor is visible to the flow equation under its own name
+    config := ProcessingConfig{
+        FlowEquation: "F + dp * density - temperature2",
+        Filters: []FilterConfig{
+            {Type: "low_pass", Target: "dp", Alpha: 0.5},
+        },
+    }
+    processor := newTestProcessor(t, config)
+    processor.InitializeFilters(map[string]int32{"dp": 10})
+
+    processor.Update("dp", 30)       // filtered to 20
+    processor.Update("density", 3)
+    processor.Update("temperature2", 5)
+
+    result, err := processor.CalculateFlow(config.FlowEquation,
+                                           1000,
+                                           0,
+                                           0,
+                                           0,
+                                           0)
+    if err != nil {
+        t.Fatalf("Calculation error: %v", err)
+    }
+    // 1000 + 20 * 3 - 5
+    if result != 1055 {
+        t.Errorf("Expected 1055, got %d", result)
+    }
+    if processor.Latest["flow"] != 1000 {
+        t.Errorf("Expected primary sensor state 1000, got %d",
+                 processor.Latest["flow"])
+    }
+}
+
+func TestNewProcessorRejectsFilters(t *testing.T) {
+    // A filter that can't be built is an error, not a filter less
+    for _, fc := range []FilterConfig{
+        {Type: "fir", Target: "flow"},
+        {Type: "biquad", Target: "flow"},
+        {Type: "kalman", Target: "flow"},
+        {Type: "moving_average", Target: "flow"},
+    } {
+        config := ProcessingConfig{Filters: []FilterConfig{
+            {Type: "low_pass", Target: "flow", Alpha: 0.5},
+            fc,
+        }}
+        p, err := NewProcessor(config)
+        if err == nil || p != nil ||
+            !strings.HasPrefix(err.Error(), "processing.filters[1]: ") {
+            t.Errorf("%s: expected a filters[1] error, got %v", fc.Type, err)
+        }
+    }
+}
+
+// newTestProcessor creates a Processor, failing the test if it can't.
+func newTestProcessor(tb testing.TB, config ProcessingConfig) *Processor {
+    tb.Helper()
+    p, err := NewProcessor(config)
+    if err != nil {
+        tb.Fatalf("NewProcessor failed: %v", err)
+    }
+    return p
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "sort"
+)
+
+// Calibration types.
+const (
+    CalibrationPolynomial = "polynomial" // value = c0 + c1*x + c2*x^2 ...
+    CalibrationTable      = "table"      // piecewise linear through points
+    CalibrationZeroSpan   = "zero_span"  // two-point, zero and span
+)
+
+// CalibrationConfig converts a sensor's (filtered) ADC counts into
+// engineering units. The flow equation then sees the sensor, and its Ref
+// alias, in those units, so an equation written for counts (the default
+// one divides by 255) has to be rewritten for calibrated sensors.
+type CalibrationConfig struct {
+    // "polynomial", "table" or "zero_span"
+    Type         string             `json:"type"`
+    // Engineering unit, e.g. "kPa", "degC", "m3/h"
+    Unit         string             `json:"unit"`
+    // polynomial: c0, c1, c2, ... in ascending powers of the counts
+    Coefficients []float64          `json:"coefficients,omitempty"`
+    // table: points in increasing counts; the end segments extrapolate
+    Table        []CalibrationPoint `json:"table,omitempty"`
+    // zero_span: counts read at the zero and span references, and the
+    // engineering values of those references
+    ZeroRaw      float64            `json:"zero_raw,omitempty"`
+    ZeroValue    float64            `json:"zero_value,omitempty"`
+    SpanRaw      float64            `json:"span_raw,omitempty"`
+    SpanValue    float64            `json:"span_value,omitempty"`
+}
+
+// CalibrationPoint is one row of a calibration table.
+type CalibrationPoint struct {
+    Raw   float64 `json:"raw"`
+    Value float64 `json:"value"`
+}
+
+// Validate checks the constraints of a calibration.
+func (c CalibrationConfig) Validate() error {
+    if c.Unit == "" {
+        return fmt.Errorf("calibration unit must be set")
+    }
+    switch c.Type {
+    case CalibrationPolynomial:
+        if len(c.Coefficients) == 0 {
+            return fmt.Errorf("polynomial calibration needs coefficients")
+        }
+        for i, k := range c.Coefficients {
+            if math.IsNaN(k) || math.IsInf(k, 0) {
+                return fmt.Errorf("coefficients[%d] is not finite", i)
+            }
+        }
+    case CalibrationTable:
+        if len(c.Table) < 2 {
+            return fmt.Errorf("table calibration needs at least 2 points, "+
+                "got %d", len(c.Table))
+        }
+        for i := 1; i < len(c.Table); i++ {
+            if !(c.Table[i].Raw > c.Table[i-1].Raw) {
+                return fmt.Errorf("table raw counts must be strictly "+
+                    "increasing at point %d", i)
+            }
+        }
+    case CalibrationZeroSpan:
+        if c.SpanRaw == c.ZeroRaw {
+            return fmt.Errorf("zero_raw and span_raw must differ")
+        }
+    default:
+        return fmt.Errorf("calibration type must be 'polynomial', "+
+            "'table' or 'zero_span', got %s", c.Type)
+    }
+    return nil
+}
+
+// Apply converts counts to engineering units. A nil calibration leaves
+// the counts as they are.
+func (c *CalibrationConfig) Apply(raw float64) float64 {
+    if c == nil {
+        return raw
+    }
+    switch c.Type {
+    case CalibrationPolynomial:
+        // Horner
+        v := 0.0
+        for i := len(c.Coefficients) - 1; i >= 0; i-- {
+            v = v*raw + c.Coefficients[i]
+        }
+        return v
+    case CalibrationTable:
+        // Segment whose upper point is the first above raw, clamped to the
+        // end segments
+        i := sort.Search(len(c.Table), func(i int) bool {
+            return c.Table[i].Raw > raw
+        })
+        i = max(1, min(i, len(c.Table)-1))
+        return line(c.Table[i-1], c.Table[i], raw)
+    case CalibrationZeroSpan:
+        return line(CalibrationPoint{c.ZeroRaw, c.ZeroValue},
+                    CalibrationPoint{c.SpanRaw, c.SpanValue},
+                    raw)
+    }
+    return raw
+}
+
+// line evaluates the straight line through a and b at raw.
+func line(a, b CalibrationPoint, raw float64) float64 {
+    return a.Value + (raw-a.Raw)*(b.Value-a.Value)/(b.Raw-a.Raw)
+}
+
+// Units returns the engineering unit of each calibrated sensor.
+func (sc SensorsConfig) Units() map[string]string {
+    units := map[string]string{}
+    for name, s := range sc {
+        if s.Calibration != nil {
+            units[name] = s.Calibration.Unit
+        }
+    }
+    return units
+}
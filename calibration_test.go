@@ -0,0 +1,94 @@
+package main
+
+import (
+    "math"
+    "testing"
+)
+
+func TestCalibrationApply(t *testing.T) {
+    poly := &CalibrationConfig{Type: CalibrationPolynomial,
+        Coefficients: []float64{1, 2, 0.5}}
+    table := &CalibrationConfig{Type: CalibrationTable,
+        Table: []CalibrationPoint{{0, 0}, {100, 50}, {200, 150}}}
+    zeroSpan := &CalibrationConfig{Type: CalibrationZeroSpan,
+        ZeroRaw: 20, SpanRaw: 220, SpanValue: 100}
+    tests := []struct {
+        name     string
+        c        *CalibrationConfig
+        raw      float64
+        expected float64
+    }{
+        {"polynomial", poly, 2, 7},
+        {"table", table, 50, 25},
+        {"table knot", table, 100, 50},
+        {"table upper", table, 150, 100},
+        {"table extrapolated above", table, 250, 200},
+        {"table extrapolated below", table, -100, -50},
+        {"zero_span", zeroSpan, 120, 50},
+        {"uncalibrated", nil, 42, 42},
+    }
+    for _, tc := range tests {
+        if v := tc.c.Apply(tc.raw); math.Abs(v-tc.expected) > 1e-12 {
+            t.Errorf("%s: expected %g, got %g", tc.name, tc.expected, v)
+        }
+    }
+}
+
+func TestCalibrationValidate(t *testing.T) {
+    for _, c := range []CalibrationConfig{
+        {Type: CalibrationPolynomial, Coefficients: []float64{1}},
+        {Type: CalibrationPolynomial, Unit: "kPa"},
+        {Type: CalibrationTable, Unit: "kPa",
+            Table: []CalibrationPoint{{10, 0}, {10, 1}}},
+        {Type: CalibrationZeroSpan, Unit: "kPa", ZeroRaw: 5, SpanRaw: 5},
+        {Type: "cubic", Unit: "kPa"},
+    } {
+        if err := c.Validate(); err == nil {
+            t.Errorf("Expected %+v to be rejected", c)
+        }
+    }
+}
+
+func TestCalculateFlowCalibrated(t *testing.T) {
+    processor := newTestProcessor(t, ProcessingConfig{})
+    processor.SetSensors(SensorsConfig{
+        "pressure": {Calibration: &CalibrationConfig{
+            Type: CalibrationZeroSpan, Unit: "kPa",
+            SpanRaw: 255, SpanValue: 510}},
+    })
+    processor.Latest["pressure"] = 100
+    processor.Latest["temperature"] = 100
+
+    // P and RefP in kPa, T still in counts
+    result, err := processor.CalculateFlow("F + P - RefP + T", 1000, 0,
+                                           0, 50, 0)
+    if err != nil {
+        t.Fatalf("Calculation error: %v", err)
+    }
+    if result != 1000+200-100+100 {
+        t.Errorf("Expected 1200, got %d", result)
+    }
+    if processor.Flow != 1200 {
+        t.Errorf("Expected a flow value of 1200, got %g", processor.Flow)
+    }
+
+    // The unit of the flow carries fractions past the truncated counts
+    result, err = processor.CalculateFlow("P / 400", 1000, 0, 0, 50, 0)
+    if err != nil || result != 0 || processor.Flow != 0.5 {
+        t.Errorf("Expected 0 counts and 0.5, got %d and %g (%v)", result,
+                 processor.Flow, err)
+    }
+    _, err = processor.CalculateFlow("(F * 1e308 * 10) - (F * 1e308 * 10)",
+                                     1000, 0, 0, 50, 0)
+    if err != ErrFlowNaN {
+        t.Errorf("Expected ErrFlowNaN, got %v", err)
+    }
+
+    if processor.Latest["pressure"] != 100 {
+        t.Errorf("Raw counts should be kept, got %d",
+                 processor.Latest["pressure"])
+    }
+    if v := processor.Values(); len(v) != 1 || v["pressure"] != 200 {
+        t.Errorf("Expected pressure 200 kPa, got %v", v)
+    }
+}
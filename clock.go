@@ -0,0 +1,223 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "time"
+)
+
+// Clock modes accepted by simulation.clock_mode and the --clock flag.
+const (
+    ClockReal        = "real"
+    ClockAccelerated = "accelerated"
+    ClockDiscrete    = "discrete"
+)
+
+// Clock abstracts the passage of time for the whole simulation.
+// StartSensor, readSensorValue and the main loop all take their notion of
+// "now" from the same Clock, so a run can be played back in real time,
+// accelerated, or computed as a discrete-event simulation without changing
+// any of the sensor or processing logic.
+type Clock interface {
+    // Now returns the current simulated time.
+    Now() time.Time
+    // After delivers the simulated time once d of simulated time elapsed.
+    After(d time.Duration) <-chan time.Time
+}
+
+// NewClock is a factory function returning the clock for the given mode.
+// factor is the speed-up used by the accelerated mode (e.g. 50 for 50x).
+func NewClock(mode string, factor float64) (Clock, error) {
+    switch mode {
+    case "", ClockReal:
+        return NewRealClock(), nil
+    case ClockAccelerated:
+        if factor <= 0 {
+            return nil, fmt.Errorf("speed factor must be positive, got %g",
+                factor)
+        }
+        return NewScaledClock(factor), nil
+    case ClockDiscrete:
+        return NewDiscreteClock(), nil
+    default:
+        return nil, fmt.Errorf("unknown clock mode %q", mode)
+    }
+}
+
+// scaledClock maps wall-clock time onto simulated time with a constant
+// speed-up factor. A factor of 1 is plain real time.
+type scaledClock struct {
+    factor float64
+    start  time.Time
+}
+
+// NewRealClock returns a clock that follows the wall clock.
+func NewRealClock() Clock {
+    return NewScaledClock(1)
+}
+
+// NewScaledClock returns a clock running factor times faster than the wall
+// clock, e.g. factor 50 plays 100 simulated seconds in 2 real seconds.
+func NewScaledClock(factor float64) Clock {
+    return &scaledClock{factor: factor, start: time.Now()}
+}
+
+func (c *scaledClock) Now() time.Time {
+    wall := time.Since(c.start)
+    return c.start.Add(time.Duration(float64(wall) * c.factor))
+}
+
+// wall converts a simulated duration into the wall-clock duration to wait.
+func (c *scaledClock) wall(d time.Duration) time.Duration {
+    w := time.Duration(float64(d) / c.factor)
+    if w <= 0 {
+        // A wait too short for the factor is the shortest timer
+        w = 1
+    }
+    return w
+}
+
+func (c *scaledClock) After(d time.Duration) <-chan time.Time {
+    // AfterFunc instead of a goroutine waiting on a timer, so an abandoned
+    // timeout holds no goroutine. Buffered so the send never blocks.
+    ch := make(chan time.Time, 1)
+    time.AfterFunc(c.wall(d), func() {
+        ch <- c.Now()
+    })
+    return ch
+}
+
+// discreteEpoch is the fixed start instant of discrete-event runs, so that
+// every timestamp of a run depends only on the configuration and seed.
+var discreteEpoch = time.Unix(0, 0).UTC()
+
+// DiscreteClock is a virtual clock for discrete-event simulation.
+// Its tickers never sleep: they produce their next simulated instant as soon
+// as the consumer asks for it. Simulated time only advances when
+// MergeSensors hands the next event (in timestamp order) to the consumer.
+type DiscreteClock struct {
+    mu      sync.Mutex
+    now     time.Time
+    waiters []discreteWaiter
+}
+
+type discreteWaiter struct {
+    deadline time.Time
+    ch       chan time.Time
+}
+
+// NewDiscreteClock returns a discrete-event clock starting at a fixed epoch.
+func NewDiscreteClock() *DiscreteClock {
+    return &DiscreteClock{now: discreteEpoch}
+}
+
+func (c *DiscreteClock) Now() time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.now
+}
+
+// advance moves simulated time forward to t and fires expired waiters.
+// Time never moves backwards.
+func (c *DiscreteClock) advance(t time.Time) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if t.After(c.now) {
+        c.now = t
+    }
+    pending := c.waiters[:0]
+    for _, w := range c.waiters {
+        if w.deadline.After(c.now) {
+            pending = append(pending, w)
+            continue
+        }
+        w.ch <- c.now
+    }
+    c.waiters = pending
+}
+
+func (c *DiscreteClock) After(d time.Duration) <-chan time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    // Buffered so that advance never blocks on a reader.
+    ch := make(chan time.Time, 1)
+    c.waiters = append(c.waiters, discreteWaiter{
+        deadline: c.now.Add(d),
+        ch:       ch,
+    })
+    return ch
+}
+
+// MergeSensors fans several sensor channels into one.
+// With a DiscreteClock the events are merged in simulated-timestamp order
+// (ties go to the earlier channel in chans), which makes a run with a fixed
+// seed fully reproducible. With a wall clock the channels are simply
+// forwarded as samples arrive, as the hardware interrupts would.
+// The output is closed once every input is closed; cancelling ctx stops
+// forwarding so the merge never blocks on a consumer that has gone away.
+func MergeSensors(ctx context.Context,
+                  clock Clock,
+                  chans ...<-chan SensorData) <-chan SensorData {
+    out := make(chan SensorData)
+    if dc, ok := clock.(*DiscreteClock); ok {
+        go mergeOrdered(ctx, dc, chans, out)
+        return out
+    }
+
+    var wg sync.WaitGroup
+    for _, ch := range chans {
+        wg.Add(1)
+        go func(ch <-chan SensorData) {
+            defer wg.Done()
+            for data := range ch {
+                select {
+                case out <- data:
+                case <-ctx.Done():
+                    return
+                }
+            }
+        }(ch)
+    }
+    go func() {
+        wg.Wait()
+        close(out)
+    }()
+    return out
+}
+
+// mergeOrdered performs a k-way merge: it holds the next event of every
+// channel and always forwards the earliest one.
+func mergeOrdered(ctx context.Context,
+                  clock *DiscreteClock,
+                  chans []<-chan SensorData,
+                  out chan<- SensorData) {
+    defer close(out)
+    heads := make([]SensorData, len(chans))
+    open := make([]bool, len(chans))
+    for i, ch := range chans {
+        heads[i], open[i] = <-ch
+    }
+
+    for {
+        next := -1
+        for i := range heads {
+            if !open[i] {
+                continue
+            }
+            if next < 0 || heads[i].Timestamp.Before(heads[next].Timestamp) {
+                next = i
+            }
+        }
+        if next < 0 {
+            return
+        }
+        clock.advance(heads[next].Timestamp)
+        select {
+        case out <- heads[next]:
+        case <-ctx.Done():
+            return
+        }
+        heads[next], open[next] = <-chans[next]
+    }
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestMergeSensorsOrdered(t *testing.T) {
+    ctx := context.Background()
+    clock := NewDiscreteClock()
+    fast := StartSensor(ctx, clock, FlowSensor,
+        SensorConfig{FrequencyHz: 100, Equation: "1"}, nil, 0)
+    slow := StartSensor(ctx, clock, PressureSensor,
+        SensorConfig{FrequencyHz: 10, Equation: "2"}, nil, 1)
+
+    events := MergeSensors(ctx, clock, slow, fast)
+    var last time.Time
+    flows := 0
+    for i := 0; i < 22; i++ {
+        data := <-events
+        if data.Timestamp.Before(last) {
+            t.Fatalf("Event %d out of order: %v before %v",
+                     i, data.Timestamp, last)
+        }
+        last = data.Timestamp
+        if data.Type == FlowSensor {
+            flows++
+        }
+        // The merge advances the simulated clock before delivering an
+        // event (it may already be preparing the next one).
+        if clock.Now().Before(data.Timestamp) {
+            t.Errorf("Clock at %v, behind event at %v",
+                     clock.Now(), data.Timestamp)
+        }
+    }
+    // 0.1s holds 10 flow samples and one pressure sample, twice.
+    if flows != 20 {
+        t.Errorf("Expected 20 flow events, got %d", flows)
+    }
+}
+
+func TestMergeSensorsDrainsStoppedSensors(t *testing.T) {
+    // Stopping the sensors leaves what they queued to the merge, which
+    // runs on a context of its own
+    sensorCtx, stop := context.WithCancel(context.Background())
+    clock := NewScaledClock(1000)
+    ch := StartSensor(sensorCtx, clock, FlowSensor, SensorConfig{
+        FrequencyHz: 1000,
+        Equation:    "1",
+        FIFO:        &FIFOConfig{Depth: 100},
+    }, nil, 0)
+    events := MergeSensors(context.Background(), clock, ch)
+    // Let the FIFO fill up, unread
+    time.Sleep(200 * time.Millisecond)
+    stop()
+    n := 0
+    for range events {
+        n++
+    }
+    if n < 100 {
+        t.Errorf("Expected the 100 queued samples, got %d", n)
+    }
+}
+
+func TestDiscreteAfter(t *testing.T) {
+    clock := NewDiscreteClock()
+    timeout := clock.After(time.Second)
+
+    clock.advance(clock.Now().Add(500 * time.Millisecond))
+    select {
+    case <-timeout:
+        t.Fatal("Timeout fired before its deadline")
+    default:
+    }
+
+    clock.advance(clock.Now().Add(500 * time.Millisecond))
+    select {
+    case <-timeout:
+    default:
+        t.Error("Timeout did not fire at its deadline")
+    }
+}
+
+func TestNewClock(t *testing.T) {
+    if _, err := NewClock(ClockAccelerated, 0); err == nil {
+        t.Error("Expected error for non-positive speed factor")
+    }
+    if _, err := NewClock("warp", 1); err == nil {
+        t.Error("Expected error for unknown clock mode")
+    }
+    clock, err := NewClock(ClockDiscrete, 0)
+    if err != nil {
+        t.Fatalf("NewClock failed: %v", err)
+    }
+    if _, ok := clock.(*DiscreteClock); !ok {
+        t.Errorf("Expected *DiscreteClock, got %T", clock)
+    }
+}
@@ -3,55 +3,135 @@ package main
 import (
     "fmt"
     "github.com/go-json-experiment/json"
+    "math"
     "os"
+    "regexp"
+    "sort"
+    "strings"
 )
 
 // Config represents the top-level configuration structure.
 type Config struct {
-    Simulation SimulationConfig `json:"simulation"`
-    Sensors    SensorsConfig    `json:"sensors"`
-    Processing ProcessingConfig `json:"processing"`
-    Output     OutputConfig     `json:"output"`
+    Simulation       SimulationConfig       `json:"simulation"`
+    Sensors          SensorsConfig          `json:"sensors"`
+    Processing       ProcessingConfig       `json:"processing"`
+    Output           OutputConfig           `json:"output"`
+    // Jointly distributed noise across sensors (optional)
+    NoiseCorrelation *CorrelationConfig     `json:"noise_correlation,omitempty"`
+    // Lookup tables of interp1 and interp2, by name
+    Tables           map[string]TableConfig `json:"tables,omitempty"`
+
+    // Tables prepared by Validate
+    tables           map[string]*Table
 }
 
 type SimulationConfig struct {
-    DefaultSamples     int32 `json:"default_samples"`
-    DefaultPressure    int32 `json:"default_pressure"`
-    DefaultTemperature int32 `json:"default_temperature"`
-    DefaultFlow        int32 `json:"default_flow"`
+    DefaultSamples     int32   `json:"default_samples"`
+    DefaultPressure    int32   `json:"default_pressure"`
+    DefaultTemperature int32   `json:"default_temperature"`
+    DefaultFlow        int32   `json:"default_flow"`
+    // "real" (default), "accelerated" or "discrete"
+    ClockMode          string  `json:"clock_mode,omitempty"`
+    // Speed-up for the "accelerated" clock, e.g. 50 for 50x
+    SpeedFactor        float64 `json:"speed_factor,omitempty"`
+    // Scenario file of timestamped events applied during the run
+    Scenario           string  `json:"scenario,omitempty"`
 }
 
-type SensorsConfig struct {
-    Flow        SensorConfig `json:"flow"`
-    Pressure    SensorConfig `json:"pressure"`
-    Temperature SensorConfig `json:"temperature"`
+// SensorsConfig declares the meter's sensors by name. Each name is how the
+// sensor's filtered value appears in the flow equation, so it must be a
+// valid identifier, e.g. "flow", "pressure", "dp", "temperature2".
+type SensorsConfig map[string]SensorConfig
+
+// Names returns the sensor names in a stable order: the classic flow,
+// pressure and temperature sensors first (keeping their historical seeds),
+// then the others alphabetically.
+func (sc SensorsConfig) Names() []string {
+    var names []string
+    for _, name := range []string{"flow", "pressure", "temperature"} {
+        if _, ok := sc[name]; ok {
+            names = append(names, name)
+        }
+    }
+    var others []string
+    for name := range sc {
+        switch name {
+        case "flow", "pressure", "temperature":
+        default:
+            others = append(others, name)
+        }
+    }
+    sort.Strings(others)
+    return append(names, others...)
 }
 
 type SensorConfig struct {
-    FrequencyHz       int32   `json:"frequency_hz"`
-    ResolutionBits    int32   `json:"resolution_bits"`
-    Equation          string  `json:"equation"`
-    NoiseAmplitude    float64 `json:"noise_amplitude"`
+    // Sample rate; may be fractional, e.g. 0.5 or 12.5
+    FrequencyHz       float64            `json:"frequency_hz"`
+    ResolutionBits    int32              `json:"resolution_bits"`
+    Equation          string             `json:"equation"`
+    NoiseAmplitude    float64            `json:"noise_amplitude"`
     // "uniform" (default) or "normal"
-    NoiseDistribution string  `json:"noise_distribution,omitempty"`
+    NoiseDistribution string             `json:"noise_distribution,omitempty"`
+    // Additional noise models (pink, ar1, mains, burst, ...)
+    NoiseModels       []NoiseConfig      `json:"noise_models,omitempty"`
+    // Optional converter model (reference voltage, LSB, INL/DNL, ...)
+    ADC               *ADCConfig         `json:"adc,omitempty"`
+    // Injected faults (stuck, dropout, spike, drift, ...)
+    Faults            []FaultConfig      `json:"faults,omitempty"`
+    // Phase offset, interrupt jitter and clock drift of the samples
+    Schedule          *ScheduleConfig    `json:"schedule,omitempty"`
+    // Sample FIFO depth and overflow policy
+    FIFO              *FIFOConfig        `json:"fifo,omitempty"`
+    // Recorded capture replayed in place of the equation
+    Replay            *ReplayConfig      `json:"replay,omitempty"`
+    // Counts to engineering units, for the flow equation and output
+    Calibration       *CalibrationConfig `json:"calibration,omitempty"`
+    // Pulse output (turbine, positive displacement) of the flow profile
+    Pulse             *PulseConfig       `json:"pulse,omitempty"`
+    // Filter and latest-value seed before the first sample arrives, and
+    // the equation's prev before its first sample
+    InitialValue      *int32             `json:"initial_value,omitempty"`
 }
 
 type ProcessingConfig struct {
-    FlowEquation      string         `json:"flow_equation"`
+    FlowEquation      string                      `json:"flow_equation"`
+    // Unit of the flow equation's result, e.g. "m3/h"; see OutputColumns
+    FlowUnit          string                      `json:"flow_unit,omitempty"`
+    // Sensor driving the flow calculation, "flow" by default
+    PrimarySensor     string                      `json:"primary_sensor,omitempty"`
     // "low_pass" or "median"
-    DefaultFilterType string         `json:"default_filter_type"`
-    Filters           []FilterConfig `json:"filters"`
+    DefaultFilterType string                      `json:"default_filter_type"`
+    Filters           []FilterConfig              `json:"filters"`
+    // Logical sensors voted from redundant physical ones, by name
+    Redundancy        map[string]RedundancyConfig `json:"redundancy,omitempty"`
+    // Evaluates the flow equation in fixed point (optional)
+    FixedPoint        *FixedPointConfig           `json:"fixed_point,omitempty"`
+
+    // FlowEquation compiled by Config.Validate, and to fixed point
+    flow              *Equation
+    fixedFlow         *FixedEquation
 }
 
 type FilterConfig struct {
-    // e.g., "low_pass", "median"
-    Type       string  `json:"type"`
+    // e.g., "low_pass", "median", "fir", "biquad", "kalman"
+    Type       string         `json:"type"`
     // e.g., "pressure"
-    Target     string  `json:"target"`
+    Target     string         `json:"target"`
     // For Low Pass
-    Alpha      float64 `json:"alpha,omitempty"`
+    Alpha      float64        `json:"alpha,omitempty"`
     // For Median
-    WindowSize int     `json:"window_size,omitempty"`
+    WindowSize int            `json:"window_size,omitempty"`
+    // For FIR
+    FIR        *FIRConfig     `json:"fir,omitempty"`
+    // For Biquad: the stages of the cascade, in order
+    Biquads    []BiquadConfig `json:"biquads,omitempty"`
+    // For Kalman
+    Kalman     *KalmanConfig  `json:"kalman,omitempty"`
+
+    // Sample rate and noise of the target, set by Config.Validate
+    rateHz     float64
+    noiseSD    float64
 }
 
 type OutputConfig struct {
@@ -59,6 +139,15 @@ type OutputConfig struct {
     Target string `json:"target"` // e.g., filename or URL
 }
 
+// sensorNamePattern matches the identifiers the expression engine accepts.
+var sensorNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedNames are equation variables that a sensor name would shadow.
+var reservedNames = map[string]bool{
+    "t": true, "F": true, "P": true, "T": true,
+    "RefF": true, "RefP": true, "RefT": true, PrevVariable: true,
+}
+
 // LoadConfig reads and parses the config.json file.
 func LoadConfig(filename string) (*Config, error) {
     file, err := os.ReadFile(filename)
@@ -96,6 +185,129 @@ func (c *Config) Validate() error {
         return fmt.Errorf("default_flow must be within 24-bit range, got %d",
             c.Simulation.DefaultFlow)
     }
+    for _, name := range c.Sensors.Names() {
+        if !sensorNamePattern.MatchString(name) || reservedNames[name] {
+            return fmt.Errorf("sensors.%s: sensor name must be an "+
+                "identifier other than t, F, P, T, RefF, RefP, RefT, prev",
+                name)
+        }
+        if err := c.Sensors[name].Validate(); err != nil {
+            return fmt.Errorf("sensors.%s: %w", name, err)
+        }
+    }
+    c.tables = map[string]*Table{}
+    for name, tc := range c.Tables {
+        if err := tc.Validate(); err != nil {
+            return fmt.Errorf("tables.%s: %w", name, err)
+        }
+        c.tables[name] = NewTable(tc)
+    }
+    // Sensor equations may read each other, but not in a loop
+    if _, err := c.Sensors.Dependencies(c.tables); err != nil {
+        return err
+    }
+    if c.NoiseCorrelation != nil {
+        if err := c.NoiseCorrelation.Validate(c.Sensors); err != nil {
+            return fmt.Errorf("noise_correlation: %w", err)
+        }
+    }
+    channels := map[string]string{}
+    for name, rc := range c.Processing.Redundancy {
+        if _, ok := c.Sensors[name]; ok || reservedNames[name] ||
+            !sensorNamePattern.MatchString(name) {
+            return fmt.Errorf("redundancy.%s: name must be an identifier "+
+                "other than the sensor names and t, F, P, T, RefF, RefP, "+
+                "RefT, prev", name)
+        }
+        if err := rc.Validate(c.Sensors); err != nil {
+            return fmt.Errorf("redundancy.%s: %w", name, err)
+        }
+        for _, ch := range rc.Channels {
+            if other, ok := channels[ch]; ok {
+                return fmt.Errorf("redundancy.%s: channel %q already backs "+
+                    "%s", name, ch, other)
+            }
+            channels[ch] = name
+        }
+    }
+    primary := c.Processing.PrimarySensor
+    if primary == "" {
+        primary = DefaultPrimarySensor
+    }
+    _, sensor := c.Sensors[primary]
+    _, redundant := c.Processing.Redundancy[primary]
+    if !sensor && !redundant {
+        return fmt.Errorf("primary sensor %q is not declared in sensors "+
+            "or redundancy", primary)
+    }
+    if logical, ok := channels[primary]; ok {
+        return fmt.Errorf("primary sensor %q is a channel of %s; use %s",
+            primary, logical, logical)
+    }
+    flow, err := compileEquation(c.Processing.FlowEquation,
+                                 equationScope{
+                                     variables: c.flowVariables(),
+                                     tables:    c.tables,
+                                 })
+    if err != nil {
+        return fmt.Errorf("processing.flow_equation: %w", err)
+    }
+    c.Processing.flow = flow
+    if fc := c.Processing.FixedPoint; fc != nil {
+        format, err := fc.QFormat()
+        if err != nil {
+            return fmt.Errorf("processing.fixed_point: %w", err)
+        }
+        fixed, err := compileFixedEquation(c.Processing.FlowEquation,
+                                           equationScope{
+                                               variables: c.flowVariables(),
+                                               tables:    c.tables,
+                                               fixed:     &format,
+                                           })
+        if err != nil {
+            return fmt.Errorf("processing.flow_equation: %w", err)
+        }
+        c.Processing.fixedFlow = fixed
+    }
+    if err := c.trialEquations(); err != nil {
+        return err
+    }
+    switch c.Simulation.ClockMode {
+    case "", ClockReal, ClockDiscrete:
+    case ClockAccelerated:
+        if c.Simulation.SpeedFactor <= 0 {
+            return fmt.Errorf("speed_factor must be positive for the "+
+                "accelerated clock, got %g", c.Simulation.SpeedFactor)
+        }
+    default:
+        return fmt.Errorf("clock_mode must be 'real', 'accelerated' or "+
+            "'discrete', got %s", c.Simulation.ClockMode)
+    }
+    for i := range c.Processing.Filters {
+        fc := &c.Processing.Filters[i]
+        target := c.targetSensor(fc.Target)
+        fc.rateHz, fc.noiseSD = target.FrequencyHz, target.noiseSD()
+        var err error
+        switch fc.Type {
+        case "fir":
+            if fc.FIR == nil {
+                return fmt.Errorf("processing.filters[%d]: fir filter "+
+                    "needs its fir section", i)
+            }
+            err = fc.FIR.Validate(fc.rateHz)
+        case "biquad":
+            _, err = NewBiquadFilter(fc.Biquads, fc.rateHz)
+        case "kalman":
+            if fc.Kalman == nil {
+                return fmt.Errorf("processing.filters[%d]: kalman filter "+
+                    "needs its kalman section", i)
+            }
+            err = fc.Kalman.Validate(fc.rateHz, fc.noiseSD)
+        }
+        if err != nil {
+            return fmt.Errorf("processing.filters[%d]: %w", i, err)
+        }
+    }
     if c.Processing.DefaultFilterType != "" {
         if c.Processing.DefaultFilterType != "low_pass" &&
             c.Processing.DefaultFilterType != "median" {
@@ -107,3 +319,103 @@ func (c *Config) Validate() error {
     return nil
 }
 
+// targetSensor returns the sensor a filter targets, the first channel of
+// a redundant sensor, or a zero SensorConfig if there is none.
+func (c *Config) targetSensor(target string) SensorConfig {
+    for name, rc := range c.Processing.Redundancy {
+        if strings.EqualFold(name, target) && len(rc.Channels) > 0 {
+            target = rc.Channels[0]
+        }
+    }
+    for name, s := range c.Sensors {
+        if strings.EqualFold(name, target) {
+            return s
+        }
+    }
+    return SensorConfig{}
+}
+
+// flowVariables returns the variables the flow equation may read: t, the
+// sensors and redundant sensors by name, their F, P and T aliases and the
+// reference parameters.
+func (c *Config) flowVariables() []string {
+    vars := append([]string{"t", "F"}, ReferenceParameters...)
+    for _, alias := range []struct{ name, sensor string }{
+        {"P", string(PressureSensor)},
+        {"T", string(TemperatureSensor)},
+    } {
+        _, sensor := c.Sensors[alias.sensor]
+        _, redundant := c.Processing.Redundancy[alias.sensor]
+        if sensor || redundant {
+            vars = append(vars, alias.name)
+        }
+    }
+    vars = append(vars, c.Sensors.Names()...)
+    for name := range c.Processing.Redundancy {
+        vars = append(vars, name)
+    }
+    return vars
+}
+
+// Validate checks the constraints of a single sensor.
+func (s SensorConfig) Validate() error {
+    if s.ResolutionBits < 0 || s.ResolutionBits > 31 {
+        return fmt.Errorf("resolution_bits must be 0-31, got %d",
+            s.ResolutionBits)
+    }
+    if s.ADC != nil {
+        if s.ADC.ReferenceVoltage < 0 || s.ADC.LSBVolts < 0 {
+            return fmt.Errorf("adc reference_voltage and lsb_volts " +
+                "must not be negative")
+        }
+        if s.ADC.GainError <= -1 {
+            return fmt.Errorf("adc gain_error must be above -1, got %g",
+                s.ADC.GainError)
+        }
+    }
+    if s.Replay != nil {
+        if s.Equation != "" {
+            return fmt.Errorf("equation and replay are mutually exclusive")
+        }
+        if err := s.Replay.Validate(); err != nil {
+            return err
+        }
+    } else if !(s.FrequencyHz > 0) || math.IsInf(s.FrequencyHz, 1) {
+        return fmt.Errorf("frequency_hz must be positive, got %g",
+            s.FrequencyHz)
+    }
+    if s.Schedule != nil {
+        if err := s.Schedule.Validate(); err != nil {
+            return err
+        }
+    }
+    if s.FIFO != nil {
+        if err := s.FIFO.Validate(); err != nil {
+            return err
+        }
+    }
+    if s.Calibration != nil {
+        if err := s.Calibration.Validate(); err != nil {
+            return err
+        }
+    }
+    if s.Pulse != nil {
+        if s.Replay != nil || s.ADC != nil || len(s.Faults) > 0 {
+            return fmt.Errorf("pulse sensors take no replay, adc or faults")
+        }
+        if err := s.Pulse.Validate(); err != nil {
+            return err
+        }
+    }
+    for i, n := range s.NoiseModels {
+        if err := n.Validate(); err != nil {
+            return fmt.Errorf("noise_models[%d]: %w", i, err)
+        }
+    }
+    for i, f := range s.Faults {
+        if err := f.Validate(); err != nil {
+            return fmt.Errorf("faults[%d]: %w", i, err)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func validTestConfig() Config {
+    return Config{
+        Simulation: SimulationConfig{
+            DefaultPressure:    100,
+            DefaultTemperature: 100,
+            DefaultFlow:        1000,
+        },
+        Sensors: SensorsConfig{
+            "flow":     {FrequencyHz: 100, Equation: "RefF"},
+            "dp":       {FrequencyHz: 10, Equation: "50"},
+            "alpha":    {FrequencyHz: 10, Equation: "1"},
+            "pressure": {FrequencyHz: 10, Equation: "RefP"},
+        },
+        Processing: ProcessingConfig{FlowEquation: "F"},
+    }
+}
+
+func TestSensorsConfigNames(t *testing.T) {
+    config := validTestConfig()
+    got := strings.Join(config.Sensors.Names(), ",")
+    if got != "flow,pressure,alpha,dp" {
+        t.Errorf("Unexpected sensor order %s", got)
+    }
+}
+
+func TestValidateSensorNames(t *testing.T) {
+    config := validTestConfig()
+    if err := config.Validate(); err != nil {
+        t.Fatalf("Valid config rejected: %v", err)
+    }
+
+    for _, name := range []string{"T", "2nd", "d-p"} {
+        config := validTestConfig()
+        config.Sensors[name] = SensorConfig{FrequencyHz: 1, Equation: "1"}
+        if err := config.Validate(); err == nil {
+            t.Errorf("Expected sensor name %q to be rejected", name)
+        }
+    }
+
+    config = validTestConfig()
+    delete(config.Sensors, "flow")
+    if err := config.Validate(); err == nil {
+        t.Error("Expected error for missing primary sensor")
+    }
+}
+
+func TestValidateFlowEquation(t *testing.T) {
+    for _, equation := range []string{"F * dp / P", "t + RefT"} {
+        config := validTestConfig()
+        config.Processing.FlowEquation = equation
+        if err := config.Validate(); err != nil {
+            t.Errorf("%s rejected: %v", equation, err)
+        }
+    }
+
+    // No temperature sensor, so no T alias
+    for _, equation := range []string{"F * T", "F * flo", "F +", "cosh(F)"} {
+        config := validTestConfig()
+        config.Processing.FlowEquation = equation
+        err := config.Validate()
+        if err == nil || !strings.HasPrefix(err.Error(),
+                                            "processing.flow_equation") {
+            t.Errorf("%s: expected a flow_equation error, got %v",
+                equation, err)
+        }
+    }
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+    "fmt"
+    "math"
+)
+
+// CorrelationConfig makes the noise of several sensors jointly Gaussian,
+// e.g. pressure and temperature sharing a ground or a thermal path.
+// Give either a correlation matrix, scaled by each sensor's
+// noise_amplitude, or a full covariance matrix in counts^2.
+// For the listed sensors this replaces the white noise set by
+// noise_amplitude / noise_distribution; noise_models still add on top.
+type CorrelationConfig struct {
+    Sensors     []string    `json:"sensors"`
+    Correlation [][]float64 `json:"correlation,omitempty"`
+    Covariance  [][]float64 `json:"covariance,omitempty"`
+    // Rate of the shared noise process; defaults to the fastest sensor
+    GridHz      float64     `json:"grid_hz,omitempty"`
+}
+
+// covariance returns the covariance matrix described by the config.
+func (cc CorrelationConfig) covariance(sensors SensorsConfig) [][]float64 {
+    if cc.Covariance != nil {
+        return cc.Covariance
+    }
+    n := len(cc.Sensors)
+    cov := make([][]float64, n)
+    for i := range cov {
+        cov[i] = make([]float64, n)
+        si := sensors[cc.Sensors[i]].NoiseAmplitude
+        for j := range cov[i] {
+            sj := sensors[cc.Sensors[j]].NoiseAmplitude
+            cov[i][j] = cc.Correlation[i][j] * si * sj
+        }
+    }
+    return cov
+}
+
+// Validate checks the matrix against the declared sensors.
+func (cc CorrelationConfig) Validate(sensors SensorsConfig) error {
+    n := len(cc.Sensors)
+    if n < 2 {
+        return fmt.Errorf("needs at least two sensors")
+    }
+    seen := map[string]bool{}
+    for _, name := range cc.Sensors {
+        if _, ok := sensors[name]; !ok {
+            return fmt.Errorf("unknown sensor %q", name)
+        }
+        if seen[name] {
+            return fmt.Errorf("sensor %q listed twice", name)
+        }
+        seen[name] = true
+    }
+    if (cc.Correlation == nil) == (cc.Covariance == nil) {
+        return fmt.Errorf("give exactly one of correlation or covariance")
+    }
+
+    m := cc.Correlation
+    if m == nil {
+        m = cc.Covariance
+    }
+    if len(m) != n {
+        return fmt.Errorf("matrix must be %dx%d", n, n)
+    }
+    for i := range m {
+        if len(m[i]) != n {
+            return fmt.Errorf("matrix must be %dx%d", n, n)
+        }
+        for j := range m[i] {
+            if math.Abs(m[i][j]-m[j][i]) > 1e-9 {
+                return fmt.Errorf("matrix is not symmetric at [%d][%d]", i, j)
+            }
+        }
+        if cc.Correlation != nil && m[i][i] != 1 {
+            return fmt.Errorf("correlation diagonal must be 1, got %g at "+
+                "[%d][%d]", m[i][i], i, i)
+        }
+    }
+    if cc.GridHz < 0 {
+        return fmt.Errorf("grid_hz must not be negative, got %g", cc.GridHz)
+    }
+    if _, err := Cholesky(cc.covariance(sensors)); err != nil {
+        return err
+    }
+    return nil
+}
+
+// Cholesky returns the lower-triangular L with L*L^T = m.
+// Positive semi-definite matrices are accepted (a perfectly correlated
+// pair gives a zero pivot), anything with a negative pivot is rejected.
+func Cholesky(m [][]float64) ([][]float64, error) {
+    n := len(m)
+    l := make([][]float64, n)
+    for i := range l {
+        l[i] = make([]float64, n)
+    }
+    for j := 0; j < n; j++ {
+        d := m[j][j]
+        for k := 0; k < j; k++ {
+            d -= l[j][k] * l[j][k]
+        }
+        if d < -1e-9*math.Max(1, math.Abs(m[j][j])) {
+            return nil, fmt.Errorf("matrix is not positive semi-definite")
+        }
+        if d > 0 {
+            l[j][j] = math.Sqrt(d)
+        }
+        for i := j + 1; i < n; i++ {
+            s := m[i][j]
+            for k := 0; k < j; k++ {
+                s -= l[i][k] * l[j][k]
+            }
+            if l[j][j] > 0 {
+                l[i][j] = s / l[j][j]
+            }
+        }
+    }
+    return l, nil
+}
+
+// CorrelatedNoise generates jointly distributed Gaussian noise for a group
+// of sensors. Time is divided into slots of a shared grid; every slot has
+// one independent normal vector w, and sensor i reads (L*w)[i] for the slot
+// its sample falls in. Sensors sampled at the same instant therefore see
+// correlated noise, while each keeps its own sample rate.
+//
+// The vector of a slot is a pure function of the seed and the slot number
+// (counter-based, like the DNL pattern), not of a shared random stream, so
+// the result doesn't depend on the order in which the sensor goroutines
+// happen to run, and no locking is needed.
+type CorrelatedNoise struct {
+    index map[string]int
+    l     [][]float64
+    grid  float64
+    seed  int64
+}
+
+// NewCorrelatedNoise builds the generator from a validated config.
+func NewCorrelatedNoise(cc CorrelationConfig,
+                        sensors SensorsConfig,
+                        seed int64) (*CorrelatedNoise, error) {
+    l, err := Cholesky(cc.covariance(sensors))
+    if err != nil {
+        return nil, err
+    }
+    cn := &CorrelatedNoise{
+        index: map[string]int{},
+        l:     l,
+        grid:  cc.GridHz,
+        seed:  seed,
+    }
+    for i, name := range cc.Sensors {
+        cn.index[name] = i
+        if f := sensors[name].FrequencyHz; f > cn.grid &&
+            cc.GridHz == 0 {
+            cn.grid = f
+        }
+    }
+    if cn.grid <= 0 {
+        cn.grid = 1
+    }
+    return cn, nil
+}
+
+// Model returns the noise model of one sensor, or nil if the sensor is not
+// part of the group.
+func (cn *CorrelatedNoise) Model(name string) NoiseModel {
+    if cn == nil {
+        return nil
+    }
+    i, ok := cn.index[name]
+    if !ok {
+        return nil
+    }
+    return correlatedComponent{noise: cn, index: i}
+}
+
+// Value returns component i of the joint noise vector at time t.
+func (cn *CorrelatedNoise) Value(i int, t float64) float64 {
+    slot := int64(math.Round(t * cn.grid))
+    var v float64
+    for k := 0; k <= i; k++ {
+        if cn.l[i][k] != 0 {
+            v += cn.l[i][k] * cn.normal(slot, k)
+        }
+    }
+    return v
+}
+
+// normal returns the k-th standard normal of a slot (Box-Muller on two
+// hashed uniforms).
+func (cn *CorrelatedNoise) normal(slot int64, k int) float64 {
+    base := mixSeed(cn.seed, slot)
+    h1 := uint64(mixSeed(base, int64(2*k+1)))
+    h2 := uint64(mixSeed(base, int64(2*k+2)))
+    // u1 in (0, 1] so the logarithm stays finite
+    u1 := (float64(h1>>11) + 1) / (1 << 53)
+    u2 := float64(h2>>11) / (1 << 53)
+    return math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2)
+}
+
+// correlatedComponent is one sensor's view of a CorrelatedNoise.
+type correlatedComponent struct {
+    noise *CorrelatedNoise
+    index int
+}
+
+func (c correlatedComponent) Next(t float64) float64 {
+    return c.noise.Value(c.index, t)
+}
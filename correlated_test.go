@@ -0,0 +1,107 @@
+package main
+
+import (
+    "math"
+    "testing"
+)
+
+func TestCholesky(t *testing.T) {
+    m := [][]float64{
+        {4, 2, 0.4},
+        {2, 5, 1},
+        {0.4, 1, 3},
+    }
+    l, err := Cholesky(m)
+    if err != nil {
+        t.Fatalf("Cholesky failed: %v", err)
+    }
+    for i := range m {
+        for j := range m {
+            var v float64
+            for k := range m {
+                v += l[i][k] * l[j][k]
+            }
+            if math.Abs(v-m[i][j]) > 1e-12 {
+                t.Errorf("L*L^T[%d][%d] = %g, expected %g", i, j, v, m[i][j])
+            }
+        }
+    }
+
+    if _, err := Cholesky([][]float64{{1, 2}, {2, 1}}); err == nil {
+        t.Error("Expected indefinite matrix to be rejected")
+    }
+    // Perfect correlation is semi-definite and allowed
+    if _, err := Cholesky([][]float64{{1, 1}, {1, 1}}); err != nil {
+        t.Errorf("Semi-definite matrix rejected: %v", err)
+    }
+}
+
+func TestCorrelatedNoise(t *testing.T) {
+    sensors := SensorsConfig{
+        "pressure":    {FrequencyHz: 10, NoiseAmplitude: 5},
+        "temperature": {FrequencyHz: 100, NoiseAmplitude: 2},
+    }
+    cc := CorrelationConfig{
+        Sensors:     []string{"pressure", "temperature"},
+        Correlation: [][]float64{{1, 0.8}, {0.8, 1}},
+    }
+    if err := cc.Validate(sensors); err != nil {
+        t.Fatalf("Validate failed: %v", err)
+    }
+    cn, err := NewCorrelatedNoise(cc, sensors, 7)
+    if err != nil {
+        t.Fatalf("NewCorrelatedNoise failed: %v", err)
+    }
+    p := cn.Model("pressure")
+    temp := cn.Model("temperature")
+    if cn.Model("flow") != nil {
+        t.Error("Sensor outside the group should get no model")
+    }
+
+    // Sample both at the 10 Hz instants the pressure sensor uses.
+    const n = 20000
+    var sp, st, spt float64
+    for i := 0; i < n; i++ {
+        ts := float64(i) / 10
+        a, b := p.Next(ts), temp.Next(ts)
+        sp += a * a
+        st += b * b
+        spt += a * b
+    }
+    stdP, stdT := math.Sqrt(sp/n), math.Sqrt(st/n)
+    corr := spt / n / (stdP * stdT)
+    if math.Abs(stdP-5) > 0.25 || math.Abs(stdT-2) > 0.1 {
+        t.Errorf("Expected std 5 and 2, got %g and %g", stdP, stdT)
+    }
+    if math.Abs(corr-0.8) > 0.03 {
+        t.Errorf("Expected correlation 0.8, got %g", corr)
+    }
+
+    // The value depends only on the instant, not the call order.
+    if temp.Next(1.23) != temp.Next(1.23) {
+        t.Error("Correlated noise is not a function of time")
+    }
+}
+
+func TestCorrelationConfigValidate(t *testing.T) {
+    sensors := SensorsConfig{
+        "pressure":    {FrequencyHz: 10, NoiseAmplitude: 5},
+        "temperature": {FrequencyHz: 10, NoiseAmplitude: 2},
+    }
+    bad := []CorrelationConfig{
+        {Sensors: []string{"pressure", "dp"},
+            Correlation: [][]float64{{1, 0}, {0, 1}}},
+        {Sensors: []string{"pressure", "temperature"},
+            Correlation: [][]float64{{1, 0.5}, {0.4, 1}}},
+        {Sensors: []string{"pressure", "temperature"},
+            Correlation: [][]float64{{1, 1.5}, {1.5, 1}}},
+        {Sensors: []string{"pressure", "temperature"},
+            Correlation: [][]float64{{2, 0}, {0, 1}}},
+        {Sensors: []string{"pressure", "temperature"}},
+    }
+    for i, cc := range bad {
+        if err := cc.Validate(sensors); err == nil {
+            t.Errorf("Case %d: expected an error", i)
+        }
+    }
+}
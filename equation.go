@@ -0,0 +1,1027 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Equation is an equation compiled once, when the configuration is loaded,
+// and evaluated on every sample without parsing or allocating.
+//
+// The syntax is govaluate's, with its precedence and left-to-right
+// associativity (2 ** 3 ** 2 is 64): numbers, variables (also [escaped]),
+// function calls, + - * / % ** (power), bitwise & | ^ << >> on int64 and
+// unary ~, unary - + !, comparisons, && || (giving 1 or 0), true and
+// false, the ternary a ? b : c and ?? (govaluate's nil, of a ? b without
+// ": c", is NaN), and x IN (a, b, ...). Strings are constants: they
+// compare, concatenate with + and match =~ !~ regular expressions, and
+// those reading as a date are its Unix time. Unary operators bind tighter
+// than **, so -2 ** 2 is 4, as in govaluate.
+//
+// Variables get a slot each, in order of first appearance (see Vars); the
+// caller fills a []float64 by slot and calls Eval.
+type Equation struct {
+    source string
+    vars   []string
+    root   evalNode
+    state  *equationState
+}
+
+// equationState is the state an Equation's evaluations share: the seed of
+// its noise() calls and the first failed argument check of the current
+// evaluation.
+type equationState struct {
+    seed int64
+    err  error
+}
+
+// fail records err, unless the evaluation already failed.
+func (st *equationState) fail(err error) {
+    if st.err == nil {
+        st.err = err
+    }
+}
+
+// equationNoiseSalt separates the noise() draws of an equation from the
+// other streams of its seed.
+const equationNoiseSalt = 0xe0a7e
+
+// evalNode evaluates a compiled sub-expression against the variable slots.
+type evalNode func(vars []float64) float64
+
+// EquationError locates a problem in an equation's source.
+type EquationError struct {
+    Pos int // byte offset in the source
+    Msg string
+}
+
+func (e *EquationError) Error() string {
+    return fmt.Sprintf("%s at position %d", e.Msg, e.Pos+1)
+}
+
+// CompileEquation parses source and checks that it calls only known
+// functions, with the right number of arguments, and reads only the given
+// variables (any variable, if variables is nil).
+func CompileEquation(source string, variables []string) (*Equation, error) {
+    return compileEquation(source, equationScope{variables: variables})
+}
+
+// equationScope is what an equation may refer to besides the functions.
+type equationScope struct {
+    // Variables it may read; any, if nil
+    variables []string
+    // Lookup tables of interp1 and interp2, by name
+    tables    map[string]*Table
+    // A checked equation also fails an evaluation where an operator or
+    // function turns finite operands into an infinity or NaN, or in fixed
+    // point where a variable or operator overflows the format (see
+    // trialEquations), at the position of the culprit.
+    checked   bool
+    // Compiles to fixed point in this format instead (see FixedEquation)
+    fixed     *QFormat
+}
+
+func compileEquation(source string,
+                     scope equationScope) (*Equation, error) {
+    p, root, err := parseEquation(source, scope)
+    if err != nil {
+        return nil, err
+    }
+    return &Equation{
+        source: source,
+        vars:   p.vars,
+        root:   root.eval(),
+        state:  p.state,
+    }, nil
+}
+
+// parseEquation parses source into the tree of its compiled root node.
+func parseEquation(source string,
+                   scope equationScope) (*equationParser, exprNode, error) {
+    tokens, err := lexEquation(source)
+    if err != nil {
+        return nil, exprNode{}, err
+    }
+    p := &equationParser{
+        tokens:  tokens,
+        slots:   map[string]int{},
+        state:   &equationState{seed: mixSeed(0, equationNoiseSalt)},
+        tables:  scope.tables,
+        checked: scope.checked,
+        fixed:   scope.fixed,
+    }
+    if scope.variables != nil {
+        p.allowed = map[string]bool{}
+        for _, v := range scope.variables {
+            p.allowed[v] = true
+        }
+    }
+    root, err := p.ternary()
+    if err == nil {
+        err = number(root)
+    }
+    if err != nil {
+        return nil, root, err
+    }
+    if tok := p.peek(); tok.kind != tokenEOF {
+        return nil, root, &EquationError{tok.pos,
+            fmt.Sprintf("unexpected %s", tok)}
+    }
+    return p, root, nil
+}
+
+// Source returns the equation as written.
+func (e *Equation) Source() string {
+    return e.source
+}
+
+// Vars returns the variables the equation reads, in slot order.
+func (e *Equation) Vars() []string {
+    return e.vars
+}
+
+// SetSeed seeds the equation's noise() calls. Each call site draws its own
+// stream, a new value per evaluation.
+func (e *Equation) SetSeed(seed int64) {
+    e.state.seed = mixSeed(seed, equationNoiseSalt)
+}
+
+// Eval evaluates the equation; values[i] holds the variable Vars()[i]. It
+// fails only when a function's argument is out of its domain, e.g. log(x)
+// with x <= 0.
+func (e *Equation) Eval(values []float64) (float64, error) {
+    x := e.root(values)
+    if err := e.state.err; err != nil {
+        e.state.err = nil
+        return x, err
+    }
+    return x, nil
+}
+
+// Evaluate evaluates the equation with named parameters. It is meant for
+// one-off evaluations; the per-sample paths fill slots and call Eval.
+func (e *Equation) Evaluate(parameters map[string]interface{}) (float64,
+                                                                 error) {
+    values := make([]float64, len(e.vars))
+    for i, name := range e.vars {
+        v, ok := parameters[name]
+        if !ok {
+            return 0, fmt.Errorf("no value for variable %q", name)
+        }
+        f, ok := toFloat(v)
+        if !ok {
+            return 0, fmt.Errorf("variable %q is a %T, not a number", name, v)
+        }
+        values[i] = f
+    }
+    return e.Eval(values)
+}
+
+// toFloat converts a numeric parameter to float64.
+func toFloat(v interface{}) (float64, bool) {
+    switch x := v.(type) {
+    case float64:
+        return x, true
+    case float32:
+        return float64(x), true
+    case int:
+        return float64(x), true
+    case int32:
+        return float64(x), true
+    case int64:
+        return float64(x), true
+    case bool:
+        return boolFloat(x), true
+    }
+    return 0, false
+}
+
+func boolFloat(b bool) float64 {
+    if b {
+        return 1
+    }
+    return 0
+}
+
+// Lexer
+
+type tokenKind int
+
+const (
+    tokenEOF tokenKind = iota
+    tokenNumber
+    tokenIdent
+    tokenOp
+    tokenString
+    tokenEscaped // [variable name]
+)
+
+type token struct {
+    kind tokenKind
+    text string
+    num  float64
+    pos  int
+}
+
+// equationOperators are the operator tokens, longest first so that "**"
+// isn't read as two "*". The operator in is spelled like a name.
+var equationOperators = []string{
+    "**", "==", "!=", "<=", ">=", "&&", "||", "??", "=~", "!~", "<<", ">>",
+    "+", "-", "*", "/", "%", "<", ">", "!", "?", ":", "(", ")", ",", "&",
+    "|", "^", "~",
+}
+
+func lexEquation(source string) ([]token, error) {
+    var tokens []token
+    i := 0
+    for i < len(source) {
+        c := source[i]
+        switch {
+        case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+            i++
+        case isDigit(c) || c == '.':
+            start := i
+            for i < len(source) && (isDigit(source[i]) || source[i] == '.') {
+                i++
+            }
+            // Exponent, e.g. 1.5e-3
+            if i < len(source) && (source[i] == 'e' || source[i] == 'E') {
+                j := i + 1
+                if j < len(source) && (source[j] == '+' || source[j] == '-') {
+                    j++
+                }
+                if j < len(source) && isDigit(source[j]) {
+                    for i = j; i < len(source) && isDigit(source[i]); i++ {
+                    }
+                }
+            }
+            text := source[start:i]
+            num, err := strconv.ParseFloat(text, 64)
+            if err != nil {
+                return nil, &EquationError{start,
+                    fmt.Sprintf("invalid number %q", text)}
+            }
+            tokens = append(tokens, token{tokenNumber, text, num, start})
+        case c == '"' || c == '\'' || c == '[':
+            // Strings, e.g. the table of interp1("cd_table", Re), and
+            // escaped variable names. As in govaluate, either quote ends a
+            // string and a backslash escapes the next character.
+            kind, end, what := tokenString, "\"'", "string"
+            if c == '[' {
+                kind, end, what = tokenEscaped, "]", "variable name"
+            }
+            start := i
+            var text strings.Builder
+            for i++; i < len(source); i++ {
+                if strings.IndexByte(end, source[i]) >= 0 {
+                    break
+                }
+                if source[i] == '\\' && i+1 < len(source) {
+                    i++
+                }
+                text.WriteByte(source[i])
+            }
+            if i == len(source) {
+                return nil, &EquationError{start, "unterminated " + what}
+            }
+            i++
+            tokens = append(tokens, token{kind, text.String(), 0, start})
+        case isIdentStart(c):
+            start := i
+            for i < len(source) && (isIdentStart(source[i]) ||
+                isDigit(source[i])) {
+                i++
+            }
+            text := source[start:i]
+            if text == "in" || text == "IN" {
+                tokens = append(tokens, token{tokenOp, "in", 0, start})
+                continue
+            }
+            tokens = append(tokens, token{tokenIdent, text, 0, start})
+        default:
+            op := ""
+            for _, o := range equationOperators {
+                if strings.HasPrefix(source[i:], o) {
+                    op = o
+                    break
+                }
+            }
+            if op == "" {
+                return nil, &EquationError{i,
+                    fmt.Sprintf("unexpected character %q", c)}
+            }
+            tokens = append(tokens, token{tokenOp, op, 0, i})
+            i += len(op)
+        }
+    }
+    return append(tokens, token{tokenEOF, "end of equation", 0, i}), nil
+}
+
+// String describes the token in error messages.
+func (t token) String() string {
+    if t.kind == tokenEOF {
+        return t.text
+    }
+    return strconv.Quote(t.text)
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+    return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Parser
+
+// exprNode is a parsed sub-expression. Constant sub-expressions are folded
+// while parsing, so "x / (2 * 127.5)" divides by a single constant.
+type exprNode struct {
+    fn       evalNode
+    // Instead of fn, when compiling to fixed point
+    fx       fixedNode
+    constant bool
+    value    float64
+    // A string constant instead, and where it starts
+    isString bool
+    str      string
+    pos      int
+}
+
+func constNode(v float64) exprNode {
+    return exprNode{constant: true, value: v}
+}
+
+func stringNode(s string, pos int) exprNode {
+    return exprNode{isString: true, str: s, pos: pos}
+}
+
+// number fails on string nodes, which only operators between constants
+// take (see stringBinary).
+func number(nodes ...exprNode) error {
+    for _, n := range nodes {
+        if n.isString {
+            return &EquationError{n.pos,
+                fmt.Sprintf("string %q where a number is needed", n.str)}
+        }
+    }
+    return nil
+}
+
+// eval returns the node's evaluator.
+func (n exprNode) eval() evalNode {
+    if n.constant {
+        v := n.value
+        return func([]float64) float64 { return v }
+    }
+    return n.fn
+}
+
+type equationParser struct {
+    tokens  []token
+    next    int
+    allowed map[string]bool
+    slots   map[string]int
+    vars    []string
+    // Shared with the compiled equation, and the number of call sites of
+    // functions with state
+    state   *equationState
+    sites   int
+    tables  map[string]*Table
+    checked bool
+    fixed   *QFormat
+}
+
+func (p *equationParser) peek() token {
+    return p.tokens[p.next]
+}
+
+// accept consumes the next token if it is the operator op.
+func (p *equationParser) accept(op string) bool {
+    if tok := p.peek(); tok.kind == tokenOp && tok.text == op {
+        p.next++
+        return true
+    }
+    return false
+}
+
+func (p *equationParser) expect(op string) error {
+    if !p.accept(op) {
+        tok := p.peek()
+        return &EquationError{tok.pos,
+            fmt.Sprintf("expected %q, got %s", op, tok)}
+    }
+    return nil
+}
+
+// ternary: or (("?" or (":" ternary)?) | ("??" or))*
+//
+// As in govaluate, a ? b without ": c" gives nothing (NaN) when a is false,
+// and a ?? b gives b when a is nothing.
+func (p *equationParser) ternary() (exprNode, error) {
+    cond, err := p.binary(0)
+    for err == nil {
+        op := p.peek()
+        var right, no exprNode
+        switch {
+        case p.accept("?"):
+            right, err = p.binary(0)
+            no = constNode(math.NaN())
+            if err == nil && p.accept(":") {
+                no, err = p.ternary()
+            }
+            if err == nil {
+                cond, err = p.ternaryNode(op, cond, right, no)
+            }
+        case p.accept("??"):
+            if right, err = p.binary(0); err == nil {
+                cond, err = p.coalesceNode(op, cond, right)
+            }
+        default:
+            return cond, nil
+        }
+    }
+    return cond, err
+}
+
+// ternaryNode chooses yes or no by cond, folding a constant cond.
+func (p *equationParser) ternaryNode(tok token,
+                                     cond, yes, no exprNode) (exprNode,
+                                                              error) {
+    if err := number(cond, yes, no); err != nil {
+        return cond, err
+    }
+    if cond.constant {
+        if cond.value != 0 {
+            return yes, nil
+        }
+        return no, nil
+    }
+    if p.fixed != nil {
+        if no.constant && math.IsNaN(no.value) {
+            return cond, notFixed(tok)
+        }
+        return p.fixedTernary(cond, yes, no), nil
+    }
+    c, y, n := cond.eval(), yes.eval(), no.eval()
+    return exprNode{fn: func(v []float64) float64 {
+        if c(v) != 0 {
+            return y(v)
+        }
+        return n(v)
+    }}, nil
+}
+
+// coalesceNode gives x, or y when x is NaN, folding a constant x.
+func (p *equationParser) coalesceNode(tok token,
+                                      x, y exprNode) (exprNode, error) {
+    if err := number(x, y); err != nil {
+        return x, err
+    }
+    if x.constant {
+        if math.IsNaN(x.value) {
+            return y, nil
+        }
+        return x, nil
+    }
+    if p.fixed != nil {
+        return x, notFixed(tok)
+    }
+    a, b := x.eval(), y.eval()
+    return exprNode{fn: func(v []float64) float64 {
+        if r := a(v); !math.IsNaN(r) {
+            return r
+        }
+        return b(v)
+    }}, nil
+}
+
+// binaryLevels are govaluate's binary operators from the loosest to the
+// tightest binding, all left-associative.
+var binaryLevels = [][]string{
+    {"||"},
+    {"&&"},
+    {"==", "!=", "<", "<=", ">", ">=", "=~", "!~", "in"},
+    {"&", "|", "^"},
+    {"<<", ">>"},
+    {"+", "-"},
+    {"*", "/", "%"},
+    {"**"},
+}
+
+// binary parses the left-associative operators of binaryLevels[level].
+func (p *equationParser) binary(level int) (exprNode, error) {
+    if level == len(binaryLevels) {
+        return p.unary()
+    }
+    left, err := p.binary(level + 1)
+    if err != nil {
+        return left, err
+    }
+    for {
+        op := p.peek()
+        found := false
+        for _, o := range binaryLevels[level] {
+            if found = p.accept(o); found {
+                break
+            }
+        }
+        if !found {
+            return left, nil
+        }
+        if op.text == "in" {
+            if left, err = p.in(op, left); err != nil {
+                return left, err
+            }
+            continue
+        }
+        right, err := p.binary(level + 1)
+        if err != nil {
+            return left, err
+        }
+        if left, err = p.binaryNode(op, left, right); err != nil {
+            return left, err
+        }
+    }
+}
+
+// in parses the list of x in (a, b, ...), its "in" consumed: 1 if x equals
+// one of them. A string equals only the same string.
+func (p *equationParser) in(tok token, x exprNode) (exprNode, error) {
+    if err := p.expect("("); err != nil {
+        return x, err
+    }
+    var list []exprNode
+    for {
+        item, err := p.ternary()
+        if err != nil {
+            return item, err
+        }
+        list = append(list, item)
+        if p.accept(")") {
+            break
+        }
+        if err := p.expect(","); err != nil {
+            return item, err
+        }
+    }
+    eq := token{tokenOp, "==", 0, tok.pos}
+    found := constNode(0)
+    var items []exprNode
+    for _, item := range list {
+        if !x.isString && !item.isString && !(x.constant && item.constant) {
+            items = append(items, item)
+            continue
+        }
+        // Folds; a string and a variable are never equal
+        r, err := p.binaryNode(eq, x, item)
+        if err != nil {
+            return r, err
+        }
+        if r.value != 0 {
+            found = r
+        }
+    }
+    if len(items) == 0 || found.value != 0 {
+        return found, nil
+    }
+    if err := number(x); err != nil {
+        return x, err
+    }
+    if p.fixed != nil {
+        q, a := *p.fixed, x.fixed(*p.fixed)
+        evals := make([]fixedNode, len(items))
+        for i, item := range items {
+            evals[i] = item.fixed(q)
+        }
+        return exprNode{fx: func(v []Fixed) Fixed {
+            x := a(v)
+            for _, e := range evals {
+                if e(v) == x {
+                    return q.One()
+                }
+            }
+            return 0
+        }}, nil
+    }
+    a := x.eval()
+    evals := make([]evalNode, len(items))
+    for i, item := range items {
+        evals[i] = item.eval()
+    }
+    return exprNode{fn: func(v []float64) float64 {
+        x := a(v)
+        for _, e := range evals {
+            if e(v) == x {
+                return 1
+            }
+        }
+        return 0
+    }}, nil
+}
+
+// unary: ("-" | "+" | "!" | "~") unary | primary
+func (p *equationParser) unary() (exprNode, error) {
+    tok := p.peek()
+    var f func(float64) float64
+    switch {
+    case p.accept("-"):
+        f = func(a float64) float64 { return -a }
+    case p.accept("+"):
+        f = func(a float64) float64 { return a }
+    case p.accept("!"):
+        f = func(a float64) float64 { return boolFloat(a == 0) }
+    case p.accept("~"):
+        f = func(a float64) float64 { return float64(^int64(a)) }
+    default:
+        return p.primary()
+    }
+    x, err := p.unary()
+    if err == nil {
+        err = number(x)
+    }
+    if err != nil {
+        return x, err
+    }
+    if tok.text == "+" {
+        return x, nil
+    }
+    if tok.text == "~" && p.fixed != nil && !x.constant {
+        return x, notFixed(tok)
+    }
+    return p.unaryNode(tok.text, f, x), nil
+}
+
+// primary: number | string | true | false | variable |
+//          function "(" args ")" | "(" ternary ")"
+func (p *equationParser) primary() (exprNode, error) {
+    tok := p.peek()
+    switch tok.kind {
+    case tokenNumber:
+        p.next++
+        return constNode(tok.num), nil
+    case tokenString:
+        p.next++
+        // As in govaluate, a string reading as a date is its Unix time
+        if t, ok := parseEquationTime(tok.text); ok {
+            return constNode(float64(t.Unix())), nil
+        }
+        return stringNode(tok.text, tok.pos), nil
+    case tokenEscaped:
+        p.next++
+        return p.variable(tok)
+    case tokenIdent:
+        p.next++
+        if p.accept("(") {
+            return p.call(tok)
+        }
+        switch tok.text {
+        case "true":
+            return constNode(1), nil
+        case "false":
+            return constNode(0), nil
+        }
+        return p.variable(tok)
+    }
+    if p.accept("(") {
+        x, err := p.ternary()
+        if err != nil {
+            return x, err
+        }
+        return x, p.expect(")")
+    }
+    return exprNode{}, &EquationError{tok.pos,
+        fmt.Sprintf("unexpected %s", tok)}
+}
+
+// equationTimeFormats are the date formats of govaluate's string literals.
+var equationTimeFormats = []string{
+    time.ANSIC,
+    time.UnixDate,
+    time.RubyDate,
+    time.Kitchen,
+    time.RFC3339,
+    time.RFC3339Nano,
+    "2006-01-02",
+    "2006-01-02 15:04",
+    "2006-01-02 15:04:05",
+    "2006-01-02 15:04:05-07:00",
+    "2006-01-02T15Z0700",
+    "2006-01-02T15:04Z0700",
+    "2006-01-02T15:04:05Z0700",
+    "2006-01-02T15:04:05.999999999Z0700",
+}
+
+// parseEquationTime reads s as a date in local time, if it is one.
+func parseEquationTime(s string) (time.Time, bool) {
+    for _, format := range equationTimeFormats {
+        if t, err := time.ParseInLocation(format, s, time.Local); err == nil {
+            return t, true
+        }
+    }
+    return time.Time{}, false
+}
+
+func (p *equationParser) variable(tok token) (exprNode, error) {
+    // A name can be both, like prev in sensor equations; [sin] is only a
+    // variable
+    _, ok := equationFunctions[tok.text]
+    if ok && tok.kind == tokenIdent && !p.allowed[tok.text] {
+        return exprNode{}, &EquationError{tok.pos,
+            fmt.Sprintf("function %s needs arguments", tok.text)}
+    }
+    if p.allowed != nil && !p.allowed[tok.text] {
+        return exprNode{}, &EquationError{tok.pos,
+            fmt.Sprintf("unknown variable %q", tok.text)}
+    }
+    slot := p.slot(tok.text)
+    if p.fixed != nil && p.checked {
+        // Values out of the format's range saturated on conversion
+        q, st := *p.fixed, p.state
+        return exprNode{fx: func(v []Fixed) Fixed {
+            if v[slot] == q.Max() || v[slot] == q.Min() {
+                st.fail(&EquationError{tok.pos,
+                    fmt.Sprintf("%s overflows %s", tok.text, q)})
+            }
+            return v[slot]
+        }}, nil
+    }
+    if p.fixed != nil {
+        return exprNode{fx: func(v []Fixed) Fixed { return v[slot] }}, nil
+    }
+    return exprNode{fn: func(v []float64) float64 { return v[slot] }}, nil
+}
+
+// slot returns the slot of a variable, giving it one on first use.
+func (p *equationParser) slot(name string) int {
+    slot, ok := p.slots[name]
+    if !ok {
+        slot = len(p.vars)
+        p.slots[name] = slot
+        p.vars = append(p.vars, name)
+    }
+    return slot
+}
+
+// call parses the arguments of a function call, its "(" consumed.
+func (p *equationParser) call(name token) (exprNode, error) {
+    f, ok := equationFunctions[name.text]
+    if !ok {
+        return exprNode{}, &EquationError{name.pos,
+            fmt.Sprintf("unknown function %q", name.text)}
+    }
+    var table *Table
+    if f.table > 0 {
+        var err error
+        if table, err = p.table(name, f.table); err != nil {
+            return exprNode{}, err
+        }
+    }
+    var args []exprNode
+    if !p.accept(")") {
+        for {
+            arg, err := p.ternary()
+            if err != nil {
+                return arg, err
+            }
+            args = append(args, arg)
+            if p.accept(")") {
+                break
+            }
+            if err := p.expect(","); err != nil {
+                return arg, err
+            }
+        }
+    }
+    if err := number(args...); err != nil {
+        return exprNode{}, err
+    }
+    if len(args) < f.minArgs || (f.maxArgs >= 0 && len(args) > f.maxArgs) {
+        return exprNode{}, &EquationError{name.pos,
+            fmt.Sprintf("%s takes %s, got %d", name.text, f.arity(),
+                len(args))}
+    }
+    if table != nil {
+        return p.tableNode(name, table, args)
+    }
+    return f.node(p, name, args)
+}
+
+// table parses the quoted table name a lookup function takes first, and
+// its ",".
+func (p *equationParser) table(name token, dims int) (*Table, error) {
+    tok := p.peek()
+    if tok.kind != tokenString {
+        return nil, &EquationError{tok.pos,
+            fmt.Sprintf("%s takes a table name first, in quotes", name.text)}
+    }
+    p.next++
+    table, ok := p.tables[tok.text]
+    if !ok {
+        return nil, &EquationError{tok.pos,
+            fmt.Sprintf("unknown table %q", tok.text)}
+    }
+    if table.Dims() != dims {
+        return nil, &EquationError{tok.pos,
+            fmt.Sprintf("table %q is %d-D, %s takes a %d-D one", tok.text,
+                table.Dims(), name.text, dims)}
+    }
+    return table, p.expect(",")
+}
+
+// unaryNode applies the operator op, computing f, to x, folding a
+// constant.
+func (p *equationParser) unaryNode(op string,
+                                   f func(float64) float64,
+                                   x exprNode) exprNode {
+    if x.constant {
+        return constNode(f(x.value))
+    }
+    if p.fixed != nil {
+        return p.fixedUnary(op, x)
+    }
+    a := x.fn
+    return exprNode{fn: func(v []float64) float64 { return f(a(v)) }}
+}
+
+// binaryNode applies the binary operator of tok, folding constants; a
+// constant that isn't finite, like 1 / 0, is an error. Each operator gets
+// its own closure, so evaluation makes no indirect call for op.
+func (p *equationParser) binaryNode(tok token,
+                                    left, right exprNode) (exprNode, error) {
+    op := tok.text
+    if left.isString || right.isString || op == "=~" || op == "!~" {
+        return stringBinary(tok, left, right)
+    }
+    if left.constant && right.constant {
+        x, y := left.value, right.value
+        r := binaryOp(op, x, y)
+        if err := arithmeticError(tok, x, y, r); err != nil {
+            return exprNode{}, err
+        }
+        return constNode(r), nil
+    }
+    if p.fixed != nil {
+        return p.fixedBinary(tok, left, right)
+    }
+    a, b := left.eval(), right.eval()
+    if p.checked {
+        st := p.state
+        return exprNode{fn: func(v []float64) float64 {
+            x, y := a(v), b(v)
+            r := binaryOp(op, x, y)
+            if err := arithmeticError(tok, x, y, r); err != nil {
+                st.fail(err)
+            }
+            return r
+        }}, nil
+    }
+    var fn evalNode
+    switch op {
+    case "+":
+        fn = func(v []float64) float64 { return a(v) + b(v) }
+    case "-":
+        fn = func(v []float64) float64 { return a(v) - b(v) }
+    case "*":
+        fn = func(v []float64) float64 { return a(v) * b(v) }
+    case "/":
+        fn = func(v []float64) float64 { return a(v) / b(v) }
+    case "%":
+        fn = func(v []float64) float64 { return math.Mod(a(v), b(v)) }
+    case "**":
+        fn = func(v []float64) float64 { return math.Pow(a(v), b(v)) }
+    case "&&":
+        fn = func(v []float64) float64 {
+            return boolFloat(a(v) != 0 && b(v) != 0)
+        }
+    case "||":
+        fn = func(v []float64) float64 {
+            return boolFloat(a(v) != 0 || b(v) != 0)
+        }
+    default:
+        fn = func(v []float64) float64 { return binaryOp(op, a(v), b(v)) }
+    }
+    return exprNode{fn: fn}, nil
+}
+
+// stringBinary applies the binary operator of tok to string constants, as
+// govaluate does: == and != compare, + concatenates with numbers too, the
+// other comparisons are lexicographic and =~ !~ match the regular
+// expression on the right. A string is never equal to a number.
+func stringBinary(tok token, left, right exprNode) (exprNode, error) {
+    op := tok.text
+    switch op {
+    case "==", "!=":
+        eq := left.isString && right.isString && left.str == right.str
+        return constNode(boolFloat(eq == (op == "=="))), nil
+    case "+":
+        if !left.constant && !left.isString ||
+            !right.constant && !right.isString {
+            return exprNode{}, &EquationError{tok.pos,
+                "+ of a string takes constants"}
+        }
+        return stringNode(fmt.Sprint(left.text()) + fmt.Sprint(right.text()),
+                          tok.pos), nil
+    }
+    if !left.isString || !right.isString {
+        return exprNode{}, &EquationError{tok.pos,
+            fmt.Sprintf("%s takes two strings", op)}
+    }
+    x, y := left.str, right.str
+    switch op {
+    case "<":
+        return constNode(boolFloat(x < y)), nil
+    case "<=":
+        return constNode(boolFloat(x <= y)), nil
+    case ">":
+        return constNode(boolFloat(x > y)), nil
+    case ">=":
+        return constNode(boolFloat(x >= y)), nil
+    case "=~", "!~":
+        re, err := regexp.Compile(y)
+        if err != nil {
+            return exprNode{}, &EquationError{right.pos,
+                fmt.Sprintf("invalid regular expression: %v", err)}
+        }
+        return constNode(boolFloat(re.MatchString(x) == (op == "=~"))), nil
+    }
+    return exprNode{}, number(left, right)
+}
+
+// text returns the value of a constant, string or number.
+func (n exprNode) text() interface{} {
+    if n.isString {
+        return n.str
+    }
+    return n.value
+}
+
+// arithmeticError reports an operator turning finite operands x and y into
+// a result r that isn't.
+func arithmeticError(tok token, x, y, r float64) error {
+    if isFinite(r) || !isFinite(x) || !isFinite(y) {
+        return nil
+    }
+    msg := fmt.Sprintf("%g %s %g is %g", x, tok.text, y, r)
+    switch {
+    case tok.text == "/" && y == 0:
+        msg = "division by zero"
+    case tok.text == "%" && y == 0:
+        msg = "modulo by zero"
+    }
+    return &EquationError{tok.pos, msg}
+}
+
+func isFinite(x float64) bool {
+    return !math.IsNaN(x) && !math.IsInf(x, 0)
+}
+
+func binaryOp(op string, a, b float64) float64 {
+    switch op {
+    case "+":
+        return a + b
+    case "-":
+        return a - b
+    case "*":
+        return a * b
+    case "/":
+        return a / b
+    case "%":
+        return math.Mod(a, b)
+    case "**":
+        return math.Pow(a, b)
+    case "==":
+        return boolFloat(a == b)
+    case "!=":
+        return boolFloat(a != b)
+    case "<":
+        return boolFloat(a < b)
+    case "<=":
+        return boolFloat(a <= b)
+    case ">":
+        return boolFloat(a > b)
+    case ">=":
+        return boolFloat(a >= b)
+    case "&&":
+        return boolFloat(a != 0 && b != 0)
+    case "||":
+        return boolFloat(a != 0 || b != 0)
+    // Bitwise, on int64 as in govaluate
+    case "&":
+        return float64(int64(a) & int64(b))
+    case "|":
+        return float64(int64(a) | int64(b))
+    case "^":
+        return float64(int64(a) ^ int64(b))
+    case "<<":
+        return float64(uint64(a) << uint64(b))
+    case ">>":
+        return float64(uint64(a) >> uint64(b))
+    }
+    panic("unknown operator " + op)
+}
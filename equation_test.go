@@ -0,0 +1,219 @@
+package main
+
+import (
+    "errors"
+    "math"
+    "strings"
+    "testing"
+
+    "github.com/Knetic/govaluate"
+)
+
+// defaultFlowEquation is the flow_equation of config.json.
+const defaultFlowEquation = "F + F * ((P - RefP) / 255) * ((T - RefT) / 255)"
+
+func TestCompileEquation(t *testing.T) {
+    tests := []struct {
+        equation string
+        params   map[string]interface{}
+        expected float64
+    }{
+        {"1 + 2 * 3", nil, 7},
+        {"(1 + 2) * 3", nil, 9},
+        {"2 ** 3 ** 2", nil, 64},
+        {"-2 ** 2", nil, 4},
+        {"7 % 4 - 10 / 4", nil, 0.5},
+        {"x > 1 ? x * 2 : -x", map[string]interface{}{"x": 3}, 6},
+        {"x > 1 ? x * 2 : -x", map[string]interface{}{"x": 0.5}, -0.5},
+        {"x >= 1 && !(x == 2) || x < 0", map[string]interface{}{"x": 2}, 0},
+        {"sqrt(x) + sin(0)", map[string]interface{}{"x": 16.0}, 4},
+    }
+    for _, tc := range tests {
+        eq, err := CompileEquation(tc.equation, nil)
+        if err != nil {
+            t.Fatalf("%s: %v", tc.equation, err)
+        }
+        got, err := eq.Evaluate(tc.params)
+        if err != nil {
+            t.Fatalf("%s: %v", tc.equation, err)
+        }
+        if math.Abs(got-tc.expected) > 1e-12 {
+            t.Errorf("%s: expected %g, got %g", tc.equation, tc.expected, got)
+        }
+    }
+
+    // Variables get one slot each, in order of first appearance
+    eq, err := CompileEquation("b * a + b", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := strings.Join(eq.Vars(), ","); got != "b,a" {
+        t.Errorf("expected slots b,a, got %s", got)
+    }
+    if got, _ := eq.Eval([]float64{2, 3}); got != 8 {
+        t.Errorf("expected 8, got %g", got)
+    }
+}
+
+func TestCompileEquationErrors(t *testing.T) {
+    allowed := []string{"t", "F"}
+    tests := []struct {
+        equation string
+        msg      string
+        pos      int
+    }{
+        {"F + ", "unexpected end of equation", 4},
+        {"F + G", `unknown variable "G"`, 4},
+        {"F + cosh(t)", `unknown function "cosh"`, 4},
+        {"sin(t, F)", "sin takes 1 argument", 0},
+        {"F + sin", "function sin needs arguments", 4},
+        {"(F + 1", `expected ")"`, 6},
+        {"F # 2", "unexpected character '#'", 2},
+        {"F 2", `unexpected "2"`, 2},
+        {"sin('a')", `string "a" where a number is needed`, 4},
+        {"'a' + F", "+ of a string takes constants", 4},
+        {"F =~ 'a'", "=~ takes two strings", 2},
+        {"'a' =~ '('", "invalid regular expression", 7},
+        {"[G] + F", `unknown variable "G"`, 0},
+        {"F IN (1", `expected ","`, 7},
+    }
+    for _, tc := range tests {
+        _, err := CompileEquation(tc.equation, allowed)
+        var eqErr *EquationError
+        if !errors.As(err, &eqErr) {
+            t.Errorf("%s: expected an EquationError, got %v", tc.equation, err)
+            continue
+        }
+        if !strings.Contains(eqErr.Msg, tc.msg) || eqErr.Pos != tc.pos {
+            t.Errorf("%s: expected %q at %d, got %q at %d", tc.equation,
+                tc.msg, tc.pos, eqErr.Msg, eqErr.Pos)
+        }
+    }
+}
+
+func TestCompileEquationGovaluateCompatibility(t *testing.T) {
+    // Equations written for govaluate give the same results
+    functions := map[string]govaluate.ExpressionFunction{}
+    for name, f := range map[string]func(float64) float64{
+        "sin": math.Sin, "cos": math.Cos, "tan": math.Tan, "sqrt": math.Sqrt,
+    } {
+        f := f
+        functions[name] = func(args ...interface{}) (interface{}, error) {
+            return f(args[0].(float64)), nil
+        }
+    }
+    params := map[string]interface{}{"F": 3.0, "P": 2.5, "T": -1.5}
+    for _, equation := range []string{
+        "F + P * T", "F - P - T", "F / P / T", "F % 2", "2 ** 3 ** 2",
+        "-2 ** 2", "-F ** 2", "(F + P) * T", "F ** P ** 0.5",
+        "1 + 2 << 1", "F << 2 >> 1", "6 & 3 | 8", "F & 1", "F | 4", "F ^ 1",
+        "~F", "~(-F)", "3 & 1 == 1", "F > P && P > T", "F < P || !(T < 0)",
+        "F >= 3 == true", "F == 3 ? P : T", "F != 3 ? P : T",
+        "F > 5 ? 1", "(F > 5 ? 1) ?? 7", "(F > 1 ? 1) ?? 7", "F IN (1, 2, 3)",
+        "F IN (1, P)", "'abc' =~ 'b'", "'abc' !~ '^b'", "'a' + 'b' == 'ab'",
+        "'a' + 3 == 'a3'", "'b' > 'a'", "'a' == 1", "'3' != F",
+        "'2014-01-02' - 0", "'2014-01-02 15:04' > '2014-01-02'", "[F] * 2",
+        "true && F > 1", "false || F > 1", "sqrt(F * F + P * P)",
+        "sin(T) + cos(P) - tan(F)", "'a\\'b' + \"c\" == 'a\\'bc'",
+    } {
+        expression, err := govaluate.NewEvaluableExpressionWithFunctions(
+            equation, functions)
+        if err != nil {
+            t.Fatalf("govaluate rejected %s: %v", equation, err)
+        }
+        r, err := expression.Evaluate(params)
+        if err != nil {
+            t.Fatalf("govaluate failed %s: %v", equation, err)
+        }
+        want := math.NaN()
+        switch x := r.(type) {
+        case float64:
+            want = x
+        case bool:
+            want = boolFloat(x)
+        }
+        e, err := CompileEquation(equation, nil)
+        if err != nil {
+            t.Errorf("%s: %v", equation, err)
+            continue
+        }
+        got, err := e.Evaluate(params)
+        if err != nil || !(got == want || math.IsNaN(got) && math.IsNaN(want)) {
+            t.Errorf("%s: got %g, %v, govaluate gives %v", equation, got,
+                err, r)
+        }
+    }
+}
+
+// BenchmarkFlowEquationGovaluate is the evaluation before equations were
+// compiled: a parse and a parameter map per sample.
+func BenchmarkFlowEquationGovaluate(b *testing.B) {
+    for i := 0; i < b.N; i++ {
+        expression, err := govaluate.NewEvaluableExpression(
+            defaultFlowEquation)
+        if err != nil {
+            b.Fatal(err)
+        }
+        params := map[string]interface{}{
+            "F": 1000.0, "P": 120.0, "T": 90.0,
+            "RefF": 8000000.0, "RefP": 100.0, "RefT": 100.0,
+        }
+        if _, err := expression.Evaluate(params); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+// BenchmarkFlowEquationGovaluateParsed parses once, as a fair baseline for
+// the compiled equation: what remains is the parameter map per sample.
+func BenchmarkFlowEquationGovaluateParsed(b *testing.B) {
+    expression, err := govaluate.NewEvaluableExpression(defaultFlowEquation)
+    if err != nil {
+        b.Fatal(err)
+    }
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        params := map[string]interface{}{
+            "F": 1000.0, "P": 120.0, "T": 90.0,
+            "RefF": 8000000.0, "RefP": 100.0, "RefT": 100.0,
+        }
+        if _, err := expression.Evaluate(params); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+func BenchmarkFlowEquationCompiled(b *testing.B) {
+    eq, err := CompileEquation(defaultFlowEquation, nil)
+    if err != nil {
+        b.Fatal(err)
+    }
+    values := map[string]float64{
+        "F": 1000, "P": 120, "T": 90, "RefF": 8000000, "RefP": 100,
+        "RefT": 100,
+    }
+    slots := make([]float64, len(eq.Vars()))
+    for i, name := range eq.Vars() {
+        slots[i] = values[name]
+    }
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        eq.Eval(slots)
+    }
+}
+
+func BenchmarkCalculateFlow(b *testing.B) {
+    processor := newTestProcessor(b, ProcessingConfig{})
+    processor.Latest["pressure"] = 120
+    processor.Latest["temperature"] = 90
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        _, err := processor.CalculateFlow(defaultFlowEquation, 1000, 0,
+                                          8000000, 100, 100)
+        if err != nil {
+            b.Fatal(err)
+        }
+    }
+}
@@ -3,51 +3,393 @@ package main
 import (
     "fmt"
     "math"
-
-    "github.com/Knetic/govaluate"
+    "strings"
 )
 
-// getFunctions returns a map of supported math functions for govaluate.
-func getFunctions() map[string]govaluate.ExpressionFunction {
-    return map[string]govaluate.ExpressionFunction{
-        "sin": func(args ...interface{}) (interface{}, error) {
-            val := args[0].(float64)
-            return math.Sin(val), nil
-        },
-        "cos": func(args ...interface{}) (interface{}, error) {
-            val := args[0].(float64)
-            return math.Cos(val), nil
-        },
-        "tan": func(args ...interface{}) (interface{}, error) {
-            val := args[0].(float64)
-            return math.Tan(val), nil
-        },
-        "sqrt": func(args ...interface{}) (interface{}, error) {
-            val := args[0].(float64)
-            return math.Sqrt(val), nil
-        },
-    }
-}
-
-// EvaluateEquation parses and evaluates an equation with the given parameters.
-func EvaluateEquation(equation string,
-    parameters map[string]interface{}) (float64, error) {
-    functions := getFunctions()
-    expression, err := govaluate.NewEvaluableExpressionWithFunctions(
-        equation, functions)
-    if err != nil {
-        return 0, err
+// equationFunction is a function equations may call. Calls are checked
+// against minArgs and maxArgs when an equation is compiled, and against
+// check (when set) with constant arguments then, or on every evaluation
+// otherwise; a failed check is an error of the evaluation, not a NaN.
+type equationFunction struct {
+    minArgs int
+    maxArgs int // -1 for any number
+    // One of these is set; f1 and f2 avoid an argument slice
+    f1      func(float64) float64
+    f2      func(a, b float64) float64
+    fn      func(args []float64) float64
+    // Domain of the arguments
+    check   func(args []float64) error
+    // Instead of fn, a function with its own state per call site (see
+    // equationState); its calls are never folded. With timed, it is given
+    // the equation's t at each call.
+    site    func(st *equationState, id int) siteFunc
+    timed   bool
+    // Lookup functions take the quoted name of a table of this many
+    // dimensions first (see Table); minArgs and maxArgs count the others
+    table   int
+}
+
+// siteFunc evaluates one call site of a function with state, at time t.
+type siteFunc func(t float64, args []float64) float64
+
+// equationFunctions are the functions available to equations. Waveforms
+// take the time first (usually t) and are periodic in period seconds.
+var equationFunctions = map[string]equationFunction{
+    "sin":   fn1(math.Sin),
+    "cos":   fn1(math.Cos),
+    "tan":   fn1(math.Tan),
+    "sqrt":  checked(fn1(math.Sqrt), atLeast(0, 0)),
+    "abs":   fn1(math.Abs),
+    "exp":   fn1(math.Exp),
+    "log":   checked(fn1(math.Log), positive(0)),
+    "log10": checked(fn1(math.Log10), positive(0)),
+    "floor": fn1(math.Floor),
+    "ceil":  fn1(math.Ceil),
+    "round": fn1(math.Round),
+    "min":   {minArgs: 2, maxArgs: -1, fn: minOf},
+    "max":   {minArgs: 2, maxArgs: -1, fn: maxOf},
+    "pow":   checked(fn2(math.Pow), checkPow),
+    "atan2": fn2(math.Atan2),
+    // clamp(x, lo, hi)
+    "clamp": {minArgs: 3, maxArgs: 3, fn: clamp, check: checkClamp},
+
+    // square(t, period[, duty]): 1 for the first duty (0.5) of each
+    // period, then -1
+    "square": {minArgs: 2, maxArgs: 3, fn: square, check: checkSquare},
+    // sawtooth(t, period): rises from -1 to 1 over each period
+    "sawtooth": checked(fn2(sawtooth), positive(1)),
+    // triangle(t, period): rises from -1 to 1 at mid-period, and back
+    "triangle": checked(fn2(triangle), positive(1)),
+    // pulse(t, period, width): 1 for the first width seconds of each
+    // period, then 0
+    "pulse": {minArgs: 3, maxArgs: 3, fn: pulse, check: checkPulse},
+    // step(t, at): 0 before at, then 1
+    "step": fn2(func(t, at float64) float64 { return boolFloat(t >= at) }),
+    // ramp(t, at, duration): 0 before at, rising to 1 over duration
+    "ramp": {minArgs: 3, maxArgs: 3, fn: ramp, check: positive(2)},
+
+    // noise(amplitude): uniform in +/- amplitude, a new draw on every
+    // evaluation; reproducible from the equation's seed (see SetSeed)
+    "noise": {minArgs: 1, maxArgs: 1, site: noiseSite,
+              check: atLeast(0, 0)},
+
+    // Functions of the history of x at this call site (see stateful.go)
+    "prev":  {minArgs: 1, maxArgs: 1, site: prevSite},
+    "deriv": {minArgs: 1, maxArgs: 1, site: derivSite, timed: true},
+    "integ": {minArgs: 1, maxArgs: 1, site: integSite, timed: true},
+    // delay(x, seconds)
+    "delay": {minArgs: 2, maxArgs: 2, site: delaySite, timed: true,
+              check: atLeast(1, 0)},
+    // ema(x, alpha)
+    "ema":   {minArgs: 2, maxArgs: 2, site: emaSite, check: checkAlpha},
+
+    // interp1("table", x) and interp2("table", x, y) look up the tables
+    // of the config (see TableConfig)
+    "interp1": {minArgs: 1, maxArgs: 1, table: 1},
+    "interp2": {minArgs: 2, maxArgs: 2, table: 2},
+}
+
+func fn1(f func(float64) float64) equationFunction {
+    return equationFunction{minArgs: 1, maxArgs: 1, f1: f}
+}
+
+func fn2(f func(a, b float64) float64) equationFunction {
+    return equationFunction{minArgs: 2, maxArgs: 2, f2: f}
+}
+
+// checked adds a domain check to f.
+func checked(f equationFunction,
+             check func(args []float64) error) equationFunction {
+    f.check = check
+    return f
+}
+
+// Argument checks
+
+// positive requires args[i] > 0.
+func positive(i int) func(args []float64) error {
+    return func(args []float64) error {
+        if !(args[i] > 0) {
+            return fmt.Errorf("%s must be positive, got %g", argName(i),
+                args[i])
+        }
+        return nil
     }
+}
 
-    result, err := expression.Evaluate(parameters)
-    if err != nil {
-        return 0, err
+// atLeast requires args[i] >= lo.
+func atLeast(i int, lo float64) func(args []float64) error {
+    return func(args []float64) error {
+        if !(args[i] >= lo) {
+            return fmt.Errorf("%s must be at least %g, got %g", argName(i),
+                lo, args[i])
+        }
+        return nil
+    }
+}
+
+func argName(i int) string {
+    return [...]string{"first", "second", "third"}[i] + " argument"
+}
+
+func checkPow(args []float64) error {
+    x, y := args[0], args[1]
+    if x < 0 && y != math.Trunc(y) {
+        return fmt.Errorf("negative base %g with fractional exponent %g",
+            x, y)
+    }
+    if x == 0 && y < 0 {
+        return fmt.Errorf("zero base with negative exponent %g", y)
+    }
+    return nil
+}
+
+func checkClamp(args []float64) error {
+    if !(args[1] <= args[2]) {
+        return fmt.Errorf("lower bound %g is above upper bound %g",
+            args[1], args[2])
+    }
+    return nil
+}
+
+func checkSquare(args []float64) error {
+    if err := positive(1)(args); err != nil {
+        return err
+    }
+    if len(args) == 3 && !(args[2] >= 0 && args[2] <= 1) {
+        return fmt.Errorf("duty must be in [0, 1], got %g", args[2])
+    }
+    return nil
+}
+
+func checkPulse(args []float64) error {
+    if err := positive(1)(args); err != nil {
+        return err
+    }
+    if !(args[2] >= 0 && args[2] <= args[1]) {
+        return fmt.Errorf("width must be in [0, period], got %g", args[2])
+    }
+    return nil
+}
+
+// Functions
+
+func minOf(args []float64) float64 {
+    m := args[0]
+    for _, x := range args[1:] {
+        m = math.Min(m, x)
+    }
+    return m
+}
+
+func maxOf(args []float64) float64 {
+    m := args[0]
+    for _, x := range args[1:] {
+        m = math.Max(m, x)
+    }
+    return m
+}
+
+func clamp(args []float64) float64 {
+    return math.Max(args[1], math.Min(args[2], args[0]))
+}
+
+// phase returns the fraction of the period elapsed at t, in [0, 1).
+func phase(t, period float64) float64 {
+    x := t / period
+    return x - math.Floor(x)
+}
+
+func square(args []float64) float64 {
+    duty := 0.5
+    if len(args) == 3 {
+        duty = args[2]
+    }
+    if phase(args[0], args[1]) < duty {
+        return 1
+    }
+    return -1
+}
+
+func sawtooth(t, period float64) float64 {
+    return 2*phase(t, period) - 1
+}
+
+func triangle(t, period float64) float64 {
+    return 1 - 4*math.Abs(phase(t, period)-0.5)
+}
+
+func pulse(args []float64) float64 {
+    return boolFloat(phase(args[0], args[1])*args[1] < args[2])
+}
+
+func ramp(args []float64) float64 {
+    return math.Max(0, math.Min(1, (args[0]-args[1])/args[2]))
+}
+
+// noiseSite draws the noise of one noise() call site: draw n is a hash of
+// the seed, the site and n, like the sampling jitter (see Schedule).
+func noiseSite(st *equationState, id int) siteFunc {
+    var n int64
+    return func(_ float64, args []float64) float64 {
+        n++
+        h := mixSeed(mixSeed(st.seed, int64(id)), n)
+        return (2*unitFloat(h) - 1) * args[0]
     }
+}
 
-    // Helper to convert result to float64 safely
-    if val, ok := result.(float64); ok {
-        return val, nil
+// arity describes the number of arguments, for error messages.
+func (f equationFunction) arity() string {
+    var s string
+    switch {
+    case f.maxArgs < 0:
+        s = fmt.Sprintf("at least %d arguments", f.minArgs)
+    case f.minArgs == f.maxArgs && f.minArgs == 1:
+        s = "1 argument"
+    case f.minArgs == f.maxArgs:
+        s = fmt.Sprintf("%d arguments", f.minArgs)
+    default:
+        s = fmt.Sprintf("%d to %d arguments", f.minArgs, f.maxArgs)
     }
-    return 0, fmt.Errorf("equation result is not a float64")
+    if f.table > 0 {
+        return "a table name and " + s
+    }
+    return s
 }
 
+// node compiles a call of the function named by name, with checked
+// arguments, folding constant ones.
+func (f equationFunction) node(p *equationParser,
+                               name token,
+                               args []exprNode) (exprNode, error) {
+    constant := true
+    for _, a := range args {
+        constant = constant && a.constant
+    }
+    if constant {
+        values := make([]float64, len(args))
+        for i, a := range args {
+            values[i] = a.value
+        }
+        if f.check != nil {
+            if err := f.check(values); err != nil {
+                return exprNode{}, callError(name, err)
+            }
+        }
+        if f.site == nil {
+            r := f.call(values)
+            if err := resultError(name, values, r); err != nil {
+                return exprNode{}, err
+            }
+            return constNode(r), nil
+        }
+    }
+    if p.fixed != nil {
+        return f.fixedCall(p, name, args)
+    }
+
+    switch {
+    case f.check != nil || p.checked:
+    case f.f1 != nil:
+        a, op := args[0].eval(), f.f1
+        return exprNode{fn: func(v []float64) float64 {
+            return op(a(v))
+        }}, nil
+    case f.f2 != nil:
+        a, b, op := args[0].eval(), args[1].eval(), f.f2
+        return exprNode{fn: func(v []float64) float64 {
+            return op(a(v), b(v))
+        }}, nil
+    }
+    evals := make([]evalNode, len(args))
+    for i, a := range args {
+        evals[i] = a.eval()
+    }
+    // Argument buffer of this call site; an Equation is evaluated by one
+    // goroutine at a time
+    buf := make([]float64, len(args))
+    op := func(_ float64, args []float64) float64 { return f.call(args) }
+    if f.site != nil {
+        op = f.site(p.state, p.sites)
+        p.sites++
+    }
+    // Timed functions read the time from the equation's t
+    t := -1
+    if f.timed {
+        if p.allowed != nil && !p.allowed["t"] {
+            return exprNode{}, &EquationError{name.pos,
+                fmt.Sprintf("%s needs the time t, which this equation "+
+                    "can't read", name.text)}
+        }
+        t = p.slot("t")
+    }
+    check, st, checked := f.check, p.state, p.checked
+    return exprNode{fn: func(v []float64) float64 {
+        for i, e := range evals {
+            buf[i] = e(v)
+        }
+        if check != nil {
+            if err := check(buf); err != nil {
+                st.fail(callError(name, err))
+                return math.NaN()
+            }
+        }
+        var now float64
+        if t >= 0 {
+            now = v[t]
+        }
+        r := op(now, buf)
+        if checked {
+            if err := resultError(name, buf, r); err != nil {
+                st.fail(err)
+            }
+        }
+        return r
+    }}, nil
+}
+
+// call applies the function to argument values.
+func (f equationFunction) call(args []float64) float64 {
+    switch {
+    case f.f1 != nil:
+        return f.f1(args[0])
+    case f.f2 != nil:
+        return f.f2(args[0], args[1])
+    }
+    return f.fn(args)
+}
+
+// resultError reports a function turning finite arguments into a result r
+// that isn't, like exp(1000).
+func resultError(name token, args []float64, r float64) error {
+    if isFinite(r) {
+        return nil
+    }
+    values := make([]string, len(args))
+    for i, x := range args {
+        if !isFinite(x) {
+            return nil
+        }
+        values[i] = fmt.Sprintf("%g", x)
+    }
+    return &EquationError{name.pos, fmt.Sprintf("%s(%s) is %g", name.text,
+                                                strings.Join(values, ", "),
+                                                r)}
+}
+
+// callError locates a failed argument check at the call.
+func callError(name token, err error) error {
+    return &EquationError{name.pos, fmt.Sprintf("%s: %v", name.text, err)}
+}
+
+// EvaluateEquation compiles and evaluates an equation with the given
+// parameters. It is meant for one-off evaluations; code evaluating an
+// equation repeatedly compiles it once (see CompileEquation).
+func EvaluateEquation(equation string,
+    parameters map[string]interface{}) (float64, error) {
+    compiled, err := CompileEquation(equation, nil)
+    if err != nil {
+        return 0, err
+    }
+    return compiled.Evaluate(parameters)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "errors"
+    "math"
+    "slices"
+    "testing"
+)
+
+func TestEquationFunctions(t *testing.T) {
+    tests := []struct {
+        equation string
+        x        float64
+        expected float64
+    }{
+        {"abs(x)", -2.5, 2.5},
+        {"min(x, 3, -1)", 2, -1},
+        {"max(x, 3, -1)", 4, 4},
+        {"pow(x, 3)", -2, -8},
+        {"exp(x)", 0, 1},
+        {"log(x)", math.E, 1},
+        {"log10(x)", 1000, 3},
+        {"floor(x) + ceil(x)", 2.5, 5},
+        {"round(x)", -2.5, -3},
+        {"clamp(x, 0, 10)", 12, 10},
+        {"clamp(x, 0, 10)", -1, 0},
+        {"atan2(x, 1)", 1, math.Pi / 4},
+        {"square(x, 2)", 0.5, 1},
+        {"square(x, 2)", 1.5, -1},
+        {"square(x, 2, 0.25)", 0.75, -1},
+        {"sawtooth(x, 4)", 5, -0.5},
+        {"triangle(x, 4)", 2, 1},
+        {"triangle(x, 4)", 3, 0},
+        {"pulse(x, 10, 1)", 20.5, 1},
+        {"pulse(x, 10, 1)", 21.5, 0},
+        {"step(x, 3)", 3, 1},
+        {"step(x, 3)", 2.9, 0},
+        {"ramp(x, 1, 4)", 2, 0.25},
+        {"ramp(x, 1, 4)", 9, 1},
+    }
+    for _, tc := range tests {
+        eq, err := CompileEquation(tc.equation, []string{"x"})
+        if err != nil {
+            t.Fatalf("%s: %v", tc.equation, err)
+        }
+        got, err := eq.Eval([]float64{tc.x})
+        if err != nil {
+            t.Fatalf("%s at x=%g: %v", tc.equation, tc.x, err)
+        }
+        if math.Abs(got-tc.expected) > 1e-12 {
+            t.Errorf("%s at x=%g: expected %g, got %g", tc.equation, tc.x,
+                tc.expected, got)
+        }
+    }
+}
+
+func TestEquationFunctionErrors(t *testing.T) {
+    // Constant arguments are checked when compiling
+    for _, equation := range []string{
+        "x + log(0)", "x + sqrt(-1)", "pow(-8, 1 / 3) * x",
+        "x * clamp(0, 2, 1)", "x * square(1, 0)", "x * pulse(1, 1, 2)",
+        "x * ramp(1, 0, 0)", "noise(-1) * x", "min(x)",
+    } {
+        _, err := CompileEquation(equation, []string{"x"})
+        var eqErr *EquationError
+        if !errors.As(err, &eqErr) {
+            t.Errorf("%s: expected an EquationError, got %v", equation, err)
+        }
+    }
+
+    // Others on every evaluation, without a panic
+    eq, err := CompileEquation("1 + log(x)", []string{"x"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = eq.Eval([]float64{-1})
+    if err == nil || err.Error() !=
+        "log: first argument must be positive, got -1 at position 5" {
+        t.Errorf("Unexpected error %v", err)
+    }
+    // The failure doesn't stick to the next evaluation
+    if got, err := eq.Eval([]float64{1}); err != nil || got != 1 {
+        t.Errorf("Expected 1, got %g (%v)", got, err)
+    }
+}
+
+func TestEquationNoise(t *testing.T) {
+    draws := func(seed int64) []float64 {
+        eq, err := CompileEquation("noise(2) + 10 * noise(0)", nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        eq.SetSeed(seed)
+        var values []float64
+        for i := 0; i < 100; i++ {
+            v, err := eq.Eval(nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if v < -2 || v >= 2 {
+                t.Fatalf("noise(2) out of range: %g", v)
+            }
+            values = append(values, v)
+        }
+        return values
+    }
+    a, b, c := draws(7), draws(7), draws(8)
+    if !slices.Equal(a, b) {
+        t.Error("Same seed gave different noise")
+    }
+    if a[0] == a[1] || a[0] == c[0] {
+        t.Error("Expected a new draw per evaluation and per seed")
+    }
+}
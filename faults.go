@@ -0,0 +1,206 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "math/rand"
+    "strings"
+)
+
+// Fault types accepted in a sensor's "faults" section.
+const (
+    FaultStuck       = "stuck"
+    FaultDropout     = "dropout"
+    FaultSpike       = "spike"
+    FaultDrift       = "drift"
+    FaultOpenCircuit = "open_circuit"
+    FaultGlitch      = "glitch"
+)
+
+// FaultConfig describes one injected sensor fault.
+//
+// A fault is scheduled either by simulated time or by probability:
+//   - probability 0: active from start_s for duration_s seconds
+//     (duration_s 0 means until the end of the run).
+//   - probability > 0: after start_s, every sample triggers the fault with
+//     that probability, and each occurrence lasts duration_s seconds
+//     (0 means just the triggering sample).
+//
+// end_s, when set, retires the fault for good at that simulated time
+// whatever its schedule; scenario clear_fault events use it.
+type FaultConfig struct {
+    // "stuck", "dropout", "spike", "drift", "open_circuit" or "glitch"
+    Type        string   `json:"type"`
+    StartS      float64  `json:"start_s,omitempty"`
+    DurationS   float64  `json:"duration_s,omitempty"`
+    EndS        float64  `json:"end_s,omitempty"`
+    Probability float64  `json:"probability,omitempty"`
+    // Stuck-at or open-circuit code; stuck holds the last reading if unset
+    Value       *float64 `json:"value,omitempty"`
+    // Spike height in counts (the sign is random)
+    Amplitude   float64  `json:"amplitude,omitempty"`
+    // Drift rate in counts per second
+    RatePerS    float64  `json:"rate_per_s,omitempty"`
+    // Open-circuit rail, "high" (default) or "low"
+    Rail        string   `json:"rail,omitempty"`
+}
+
+// Validate checks the constraints of a single fault.
+func (f FaultConfig) Validate() error {
+    switch f.Type {
+    case FaultStuck, FaultDropout, FaultSpike, FaultDrift, FaultGlitch:
+    case FaultOpenCircuit:
+        if f.Rail != "" && f.Rail != "high" && f.Rail != "low" {
+            return fmt.Errorf("open_circuit rail must be 'high' or 'low', "+
+                "got %s", f.Rail)
+        }
+    default:
+        return fmt.Errorf("unknown fault type %q", f.Type)
+    }
+    if f.StartS < 0 || f.DurationS < 0 || f.EndS < 0 {
+        return fmt.Errorf("%s fault start_s, duration_s and end_s must "+
+            "not be negative", f.Type)
+    }
+    if f.Probability < 0 || f.Probability > 1 {
+        return fmt.Errorf("%s fault probability must be 0-1, got %g",
+            f.Type, f.Probability)
+    }
+    return nil
+}
+
+// fault is the runtime state of one configured fault.
+type fault struct {
+    config  FaultConfig
+    active  bool
+    // Simulated time the current occurrence began and ends (probabilistic)
+    onset   float64
+    until   float64
+    // Code held by a stuck fault without an explicit value
+    held    int32
+    holding bool
+}
+
+// update decides whether the fault is active for the sample at elapsed.
+func (f *fault) update(elapsed float64, r *rand.Rand) {
+    wasActive := f.active
+    c := f.config
+    switch {
+    case elapsed < c.StartS, c.EndS > 0 && elapsed >= c.EndS:
+        f.active = false
+    case c.Probability == 0:
+        f.onset = c.StartS
+        f.active = c.DurationS == 0 || elapsed < c.StartS+c.DurationS
+    case f.active && elapsed < f.until:
+        // Still inside a triggered occurrence
+    default:
+        f.active = r.Float64() < c.Probability
+        f.onset = elapsed
+        f.until = elapsed + c.DurationS
+    }
+    if f.active && !wasActive {
+        f.holding = false
+    }
+}
+
+// FaultInjector applies a sensor's configured faults to its samples.
+// It keeps its own random source, seeded from the sensor's seed, so adding
+// a fault does not change the noise sequence of the rest of the run.
+type FaultInjector struct {
+    faults  []*fault
+    r       *rand.Rand
+    // Previous output code, once there is one
+    last    int32
+    hasLast bool
+}
+
+// NewFaultInjector creates the injector for a sensor. It returns nil when
+// the sensor has no faults, which Apply treats as a no-op.
+func NewFaultInjector(configs []FaultConfig, seed int64) *FaultInjector {
+    if len(configs) == 0 {
+        return nil
+    }
+    fi := &FaultInjector{
+        r: rand.New(rand.NewSource(seed ^ 0x5eed_fa17)),
+    }
+    for _, c := range configs {
+        fi.faults = append(fi.faults, &fault{config: c})
+    }
+    return fi
+}
+
+// Apply runs one converted sample through the active faults.
+// It returns the faulted code, its saturation, the names of the active
+// faults joined by "+" (empty when healthy) and false when the sample is
+// lost to a dropout.
+func (fi *FaultInjector) Apply(elapsed float64,
+                               code int32,
+                               sat Saturation,
+                               adc ADC) (int32, Saturation, string, bool) {
+    if fi == nil {
+        return code, sat, "", true
+    }
+
+    var names []string
+    emit := true
+    value := float64(code)
+    for _, f := range fi.faults {
+        f.update(elapsed, fi.r)
+        if !f.active {
+            continue
+        }
+        names = append(names, f.config.Type)
+
+        switch f.config.Type {
+        case FaultDropout:
+            emit = false
+        case FaultSpike:
+            if fi.r.Intn(2) == 0 {
+                value -= f.config.Amplitude
+            } else {
+                value += f.config.Amplitude
+            }
+        case FaultDrift:
+            value += f.config.RatePerS * (elapsed - f.onset)
+        case FaultGlitch:
+            // A corrupted conversion: any code in the converter range.
+            lo := float64(adc.ZeroScale())
+            hi := float64(adc.FullScale())
+            value = lo + fi.r.Float64()*(hi-lo)
+        case FaultStuck:
+            switch {
+            case f.config.Value != nil:
+                value = *f.config.Value
+            default:
+                if !f.holding {
+                    // Stuck from the first sample: hold that one
+                    f.held = code
+                    if fi.hasLast {
+                        f.held = fi.last
+                    }
+                    f.holding = true
+                }
+                value = float64(f.held)
+            }
+        case FaultOpenCircuit:
+            switch {
+            case f.config.Value != nil:
+                value = *f.config.Value
+            case f.config.Rail == "low":
+                value = float64(adc.ZeroScale())
+            default:
+                value = float64(adc.FullScale())
+            }
+        }
+    }
+    if len(names) == 0 {
+        fi.last, fi.hasLast = code, true
+        return code, sat, "", true
+    }
+
+    // Only a fault that changed the reading changes its saturation.
+    if value != float64(code) {
+        code, sat = adc.Clamp(math.Floor(value))
+    }
+    fi.last, fi.hasLast = code, true
+    return code, sat, strings.Join(names, "+"), emit
+}
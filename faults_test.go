@@ -0,0 +1,172 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestFaultSchedule(t *testing.T) {
+    stuckAt := 42.0
+    fi := NewFaultInjector([]FaultConfig{
+        {Type: FaultStuck, StartS: 1, DurationS: 1, Value: &stuckAt},
+        {Type: FaultDrift, StartS: 3, RatePerS: 10},
+    }, 0)
+    adc := NewADC(8, nil)
+
+    tests := []struct {
+        elapsed float64
+        code    int32
+        fault   string
+    }{
+        {0.5, 100, ""},
+        {1.0, 42, FaultStuck},
+        {1.9, 42, FaultStuck},
+        {2.0, 100, ""},
+        {3.5, 105, FaultDrift},
+        {100, 255, FaultDrift}, // drift runs into the rail
+    }
+    for _, tc := range tests {
+        code, _, fault, emit := fi.Apply(tc.elapsed, 100, NotSaturated, adc)
+        if !emit {
+            t.Fatalf("t=%g: unexpected dropout", tc.elapsed)
+        }
+        if code != tc.code || fault != tc.fault {
+            t.Errorf("t=%g: expected %d (%q), got %d (%q)",
+                     tc.elapsed, tc.code, tc.fault, code, fault)
+        }
+    }
+}
+
+func TestFaultStuckHoldsLastValue(t *testing.T) {
+    fi := NewFaultInjector([]FaultConfig{
+        {Type: FaultStuck, StartS: 1},
+    }, 0)
+    adc := NewADC(8, nil)
+
+    fi.Apply(0.5, 77, NotSaturated, adc)
+    for _, in := range []int32{10, 200, 3} {
+        if code, _, _, _ := fi.Apply(2, in, NotSaturated, adc); code != 77 {
+            t.Errorf("Expected stuck at 77, got %d", code)
+        }
+    }
+}
+
+func TestFaultStuckFromStart(t *testing.T) {
+    // Stuck from the first sample, with no previous code: holds that one
+    fi := NewFaultInjector([]FaultConfig{
+        {Type: FaultStuck, StartS: 0},
+    }, 0)
+    adc := NewADC(8, nil)
+
+    for _, in := range []int32{77, 10, 200} {
+        if code, _, _, _ := fi.Apply(0, in, NotSaturated, adc); code != 77 {
+            t.Errorf("Expected stuck at 77, got %d", code)
+        }
+    }
+}
+
+func TestFaultOpenCircuit(t *testing.T) {
+    fi := NewFaultInjector([]FaultConfig{
+        {Type: FaultOpenCircuit},
+    }, 0)
+    code, sat, _, _ := fi.Apply(0, 100, NotSaturated, NewADC(8, nil))
+    if code != 255 {
+        t.Errorf("Expected high rail 255, got %d", code)
+    }
+    if sat != NotSaturated {
+        t.Errorf("Rail value is in range, got saturation %s", sat)
+    }
+}
+
+func TestFaultProbability(t *testing.T) {
+    fi := NewFaultInjector([]FaultConfig{
+        {Type: FaultSpike, Probability: 0.1, Amplitude: 50},
+    }, 0)
+    adc := NewADC(8, nil)
+
+    spikes := 0
+    for i := 0; i < 10000; i++ {
+        code, _, fault, _ := fi.Apply(float64(i)/100, 100, NotSaturated, adc)
+        if fault == "" {
+            continue
+        }
+        spikes++
+        if code != 50 && code != 150 {
+            t.Fatalf("Spike should move 100 by 50, got %d", code)
+        }
+    }
+    if spikes < 800 || spikes > 1200 {
+        t.Errorf("Expected about 1000 spikes, got %d", spikes)
+    }
+}
+
+func TestStartSensorDropout(t *testing.T) {
+    config := SensorConfig{
+        FrequencyHz:    10,
+        ResolutionBits: 8,
+        Equation:       "50",
+        Faults: []FaultConfig{
+            {Type: FaultDropout, StartS: 0.15, DurationS: 0.3},
+        },
+    }
+    clock := NewDiscreteClock()
+    start := clock.Now()
+    ch := StartSensor(context.Background(),
+                      clock,
+                      PressureSensor,
+                      config,
+                      nil,
+                      0)
+
+    // Samples at 0.2, 0.3 and 0.4s fall inside the dropout; the discrete
+    // clock still sends their placeholders
+    for ms := time.Duration(100); ms <= 600; ms += 100 {
+        data := <-ch
+        if got := data.Timestamp.Sub(start); got != ms*time.Millisecond {
+            t.Errorf("Expected sample at %dms, got %v", ms, got)
+        }
+        if missing := ms >= 200 && ms <= 400; data.Missing != missing {
+            t.Errorf("Sample at %dms: expected missing %v", ms, missing)
+        }
+        if data.Fault != "" {
+            t.Errorf("Unexpected fault %q at %v", data.Fault, data.Timestamp)
+        }
+    }
+}
+
+func TestMergeSensorsPermanentDropout(t *testing.T) {
+    // A sensor that drops out for good must not stall the ordered merge
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    clock := NewDiscreteClock()
+    dead := StartSensor(ctx, clock, PressureSensor, SensorConfig{
+        FrequencyHz: 10,
+        Equation:    "50",
+        Faults:      []FaultConfig{{Type: FaultDropout, StartS: 0.5}},
+    }, nil, 1)
+    flow := StartSensor(ctx, clock, FlowSensor,
+        SensorConfig{FrequencyHz: 100, Equation: "1"}, nil, 0)
+    events := MergeSensors(ctx, clock, dead, flow)
+
+    flows, pressures := 0, 0
+    deadline := time.After(5 * time.Second)
+    for flows < 200 {
+        select {
+        case data := <-events:
+            switch {
+            case data.Missing:
+            case data.Type == FlowSensor:
+                flows++
+            default:
+                pressures++
+            }
+        case <-deadline:
+            t.Fatalf("Merge stalled after %d flow samples", flows)
+        }
+    }
+    // Pressure samples at 0.1 to 0.4 s, then nothing
+    if pressures != 4 {
+        t.Errorf("Expected 4 pressure samples, got %d", pressures)
+    }
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "context"
+    "fmt"
+)
+
+// FIFO policies for a full sensor FIFO.
+const (
+    FIFOBlock      = "block"       // the sensor waits (its samples run late)
+    FIFODropOldest = "drop_oldest" // the oldest queued sample is discarded
+    FIFODropNewest = "drop_newest" // the new sample is discarded
+)
+
+// FIFOConfig models the sample FIFO between a sensor's ADC interrupt and
+// the processing loop. Without one a sensor hands over each sample
+// directly and simply waits for a slow consumer.
+//
+// Overflow only happens on the real and accelerated clocks: on the
+// discrete clock the consumer never lags behind in simulated time, so
+// the FIFO is bypassed.
+type FIFOConfig struct {
+    // Number of samples the FIFO holds
+    Depth  int    `json:"depth"`
+    // "block" (default), "drop_oldest" or "drop_newest"
+    Policy string `json:"policy,omitempty"`
+}
+
+// Validate checks the constraints of a sensor FIFO.
+func (fc FIFOConfig) Validate() error {
+    if fc.Depth < 1 {
+        return fmt.Errorf("fifo depth must be at least 1, got %d", fc.Depth)
+    }
+    switch fc.Policy {
+    case "", FIFOBlock, FIFODropOldest, FIFODropNewest:
+    default:
+        return fmt.Errorf("fifo policy must be 'block', 'drop_oldest' or "+
+            "'drop_newest', got %s", fc.Policy)
+    }
+    return nil
+}
+
+// sampleFIFO is the producer side of a sensor's channel. It applies the
+// overflow policy and tags the next queued sample with the overruns and
+// drops that happened since the previous one, so a consumer can tell
+// where the gaps are.
+type sampleFIFO struct {
+    ch       chan SensorData
+    policy   string
+    overruns int64
+    dropped  int64
+}
+
+// newSampleFIFO returns the FIFO of a sensor; config nil (or a discrete
+// clock) gives a plain unbuffered hand-over.
+func newSampleFIFO(config *FIFOConfig, clock Clock) *sampleFIFO {
+    if _, discrete := clock.(*DiscreteClock); discrete || config == nil {
+        return &sampleFIFO{ch: make(chan SensorData)}
+    }
+    policy := config.Policy
+    if policy == "" {
+        policy = FIFOBlock
+    }
+    return &sampleFIFO{
+        ch:     make(chan SensorData, config.Depth),
+        policy: policy,
+    }
+}
+
+// push queues a sample. It returns false once ctx is cancelled.
+// End-of-stream markers are never dropped.
+func (f *sampleFIFO) push(ctx context.Context, data SensorData) bool {
+    if f.policy == "" || data.EndOfStream {
+        select {
+        case f.ch <- data:
+            return true
+        case <-ctx.Done():
+            return false
+        }
+    }
+
+    overrun := false
+    for {
+        data.Overruns, data.Dropped = f.overruns, f.dropped
+        select {
+        case f.ch <- data:
+            f.overruns, f.dropped = 0, 0
+            return true
+        default:
+        }
+
+        // Full
+        if !overrun {
+            overrun = true
+            f.overruns++
+        }
+        switch f.policy {
+        case FIFODropNewest:
+            f.dropped++
+            return true
+        case FIFODropOldest:
+            // The consumer may have made room meanwhile; either way the
+            // next attempt finds a free slot.
+            // The discarded sample's own tags carry over.
+            select {
+            case old := <-f.ch:
+                f.overruns += old.Overruns
+                f.dropped += old.Dropped + 1
+            default:
+            }
+        default:
+            data.Overruns = f.overruns
+            select {
+            case f.ch <- data:
+                f.overruns, f.dropped = 0, 0
+                return true
+            case <-ctx.Done():
+                return false
+            }
+        }
+    }
+}
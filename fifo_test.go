@@ -0,0 +1,75 @@
+package main
+
+import (
+    "context"
+    "testing"
+)
+
+func TestSampleFIFOPolicies(t *testing.T) {
+    ctx := context.Background()
+    clock := NewRealClock()
+    tests := []struct {
+        policy   string
+        values   []int32 // values left in the FIFO, in order
+        overruns int64   // summed tags of them
+        dropped  int64
+    }{
+        {FIFODropNewest, []int32{1, 2}, 0, 0},
+        {FIFODropOldest, []int32{4, 5}, 3, 3},
+    }
+    for _, tc := range tests {
+        f := newSampleFIFO(&FIFOConfig{Depth: 2, Policy: tc.policy}, clock)
+        for v := int32(1); v <= 5; v++ {
+            if !f.push(ctx, SensorData{Value: v}) {
+                t.Fatalf("%s: push %d failed", tc.policy, v)
+            }
+        }
+        first := <-f.ch
+        second := <-f.ch
+        if first.Value != tc.values[0] || second.Value != tc.values[1] {
+            t.Errorf("%s: expected %v, got %d, %d",
+                     tc.policy, tc.values, first.Value, second.Value)
+        }
+        // No loss goes unreported, whichever sample carries it
+        overruns := first.Overruns + second.Overruns
+        dropped := first.Dropped + second.Dropped
+        if overruns != tc.overruns || dropped != tc.dropped {
+            t.Errorf("%s: expected tags %d/%d, got %d/%d",
+                     tc.policy, tc.overruns, tc.dropped, overruns, dropped)
+        }
+        // drop_newest reports its losses on the next sample through
+        if tc.policy == FIFODropNewest {
+            f.push(ctx, SensorData{Value: 6})
+            if next := <-f.ch; next.Overruns != 3 || next.Dropped != 3 {
+                t.Errorf("%s: expected tags 3/3, got %d/%d",
+                         tc.policy, next.Overruns, next.Dropped)
+            }
+        }
+    }
+
+    // block waits for room, until cancelled, and only counts the overrun
+    f := newSampleFIFO(&FIFOConfig{Depth: 1}, clock)
+    f.push(ctx, SensorData{Value: 1})
+    cancelled, cancel := context.WithCancel(ctx)
+    cancel()
+    if f.push(cancelled, SensorData{Value: 2}) {
+        t.Errorf("block: push into a full FIFO should wait")
+    }
+    <-f.ch
+    f.push(ctx, SensorData{Value: 3})
+    if next := <-f.ch; next.Overruns != 1 || next.Dropped != 0 {
+        t.Errorf("block: expected tags 1/0, got %d/%d",
+                 next.Overruns, next.Dropped)
+    }
+}
+
+func TestFIFOConfigValidate(t *testing.T) {
+    for _, fc := range []FIFOConfig{
+        {Depth: 0},
+        {Depth: 4, Policy: "drop_all"},
+    } {
+        if err := fc.Validate(); err == nil {
+            t.Errorf("Expected %+v to be rejected", fc)
+        }
+    }
+}
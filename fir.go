@@ -0,0 +1,229 @@
+package main
+
+import (
+    "fmt"
+    "math"
+)
+
+// Windows of the windowed-sinc FIR design.
+const (
+    WindowRectangular = "rectangular"
+    WindowHann        = "hann"
+    WindowHamming     = "hamming"
+    WindowBlackman    = "blackman"
+)
+
+// DefaultTapBits is the number of fractional bits of FIR taps unless set.
+const DefaultTapBits = 15
+
+// maxFIRTaps bounds the length of a FIR filter.
+const maxFIRTaps = 1024
+
+// FIRConfig is a finite impulse response filter: explicit coefficients, or
+// a low-pass windowed-sinc design of taps coefficients with its cutoff in
+// Hz at the sample rate of the filtered sensor. Coefficients are rounded
+// to integer taps of tap_bits fractional bits, as the firmware holds them.
+type FIRConfig struct {
+    // Explicit coefficients, newest sample first; or
+    Coefficients []float64 `json:"coefficients,omitempty"`
+    // a design: cutoff below half the sensor's frequency_hz, the number of
+    // taps and "hamming" (default), "hann", "blackman" or "rectangular"
+    CutoffHz     float64   `json:"cutoff_hz,omitempty"`
+    Taps         int       `json:"taps,omitempty"`
+    Window       string    `json:"window,omitempty"`
+    // Fractional bits of the taps, 15 by default
+    TapBits      int       `json:"tap_bits,omitempty"`
+}
+
+// Validate checks the constraints of a FIR filter of a sensor sampled at
+// rateHz.
+func (fc FIRConfig) Validate(rateHz float64) error {
+    _, err := NewFIRFilter(fc, rateHz)
+    return err
+}
+
+// design returns the coefficients of the filter.
+func (fc FIRConfig) design(rateHz float64) ([]float64, error) {
+    if fc.TapBits < 0 || fc.TapBits > 30 {
+        return nil, fmt.Errorf("fir tap_bits must be 0 (default) or 1 to "+
+            "30, got %d",
+            fc.TapBits)
+    }
+    if fc.Coefficients != nil {
+        if fc.CutoffHz != 0 || fc.Taps != 0 || fc.Window != "" {
+            return nil, fmt.Errorf("fir takes coefficients or a design " +
+                "(cutoff_hz, taps, window), not both")
+        }
+        if len(fc.Coefficients) == 0 || len(fc.Coefficients) > maxFIRTaps {
+            return nil, fmt.Errorf("fir needs 1 to %d coefficients, got %d",
+                maxFIRTaps, len(fc.Coefficients))
+        }
+        limit := math.Ldexp(1, 31-fc.tapBits())
+        for i, c := range fc.Coefficients {
+            if !(math.Abs(c) < limit) {
+                return nil, fmt.Errorf("fir coefficients[%d] %g doesn't fit "+
+                    "Q%d.%d taps", i, c, 32-fc.tapBits(), fc.tapBits())
+            }
+        }
+        return fc.Coefficients, nil
+    }
+
+    if fc.Taps < 1 || fc.Taps > maxFIRTaps {
+        return nil, fmt.Errorf("fir taps must be 1 to %d, got %d",
+            maxFIRTaps, fc.Taps)
+    }
+    if !(rateHz > 0) {
+        return nil, fmt.Errorf("fir cutoff_hz needs the sensor's " +
+            "frequency_hz")
+    }
+    if !(fc.CutoffHz > 0 && fc.CutoffHz < rateHz/2) {
+        return nil, fmt.Errorf("fir cutoff_hz must be between 0 and the "+
+            "Nyquist frequency %g Hz, got %g", rateHz/2, fc.CutoffHz)
+    }
+    window, ok := firWindows[fc.Window]
+    if !ok {
+        return nil, fmt.Errorf("fir window must be 'hamming', 'hann', "+
+            "'blackman' or 'rectangular', got %s", fc.Window)
+    }
+
+    // h[i] = 2 fc sinc(2 fc (i - M)) w(i), normalized to a DC gain of 1
+    n := fc.Taps
+    cutoff := fc.CutoffHz / rateHz
+    middle := float64(n-1) / 2
+    h := make([]float64, n)
+    sum := 0.0
+    for i := range h {
+        x := 2 * cutoff * (float64(i) - middle)
+        h[i] = 2 * cutoff
+        if x != 0 {
+            h[i] *= math.Sin(math.Pi*x) / (math.Pi * x)
+        }
+        if n > 1 {
+            h[i] *= window(float64(i) / float64(n-1))
+        }
+        sum += h[i]
+    }
+    for i := range h {
+        h[i] /= sum
+    }
+    return h, nil
+}
+
+func (fc FIRConfig) tapBits() int {
+    if fc.TapBits == 0 {
+        return DefaultTapBits
+    }
+    return fc.TapBits
+}
+
+// firWindows are the design windows, of the position x in [0, 1] across
+// the taps.
+var firWindows = map[string]func(x float64) float64{
+    "":                func(x float64) float64 { return hamming(x) },
+    WindowHamming:     func(x float64) float64 { return hamming(x) },
+    WindowRectangular: func(float64) float64 { return 1 },
+    WindowHann: func(x float64) float64 {
+        return 0.5 - 0.5*math.Cos(2*math.Pi*x)
+    },
+    WindowBlackman: func(x float64) float64 {
+        return 0.42 - 0.5*math.Cos(2*math.Pi*x) + 0.08*math.Cos(4*math.Pi*x)
+    },
+}
+
+func hamming(x float64) float64 {
+    return 0.54 - 0.46*math.Cos(2*math.Pi*x)
+}
+
+// FIRFilter is a FIR filter on integer taps: each output is the sum of the
+// latest samples times their taps, accumulated exactly in 64 bits and
+// rounded once (see Acc), as firmware computes it.
+type FIRFilter struct {
+    format      QFormat
+    taps        []Fixed
+    history     []int32 // ring buffer of the latest samples
+    head        int     // where the next sample goes
+    initialized bool
+}
+
+// NewFIRFilter designs the filter of a sensor sampled at rateHz, which
+// only a design needs.
+func NewFIRFilter(config FIRConfig, rateHz float64) (*FIRFilter, error) {
+    h, err := config.design(rateHz)
+    if err != nil {
+        return nil, err
+    }
+    f := &FIRFilter{
+        format:  QFormat{FracBits: config.tapBits(), Rounding: RoundNearest},
+        taps:    make([]Fixed, len(h)),
+        history: make([]int32, len(h)),
+    }
+    // Summed in 64 bits: taps that each fit can add up past int32
+    var sum int64
+    var gain float64
+    largest := 0
+    for i, c := range h {
+        f.taps[i] = f.format.FromFloat(c)
+        sum += int64(f.taps[i])
+        gain += c
+        if math.Abs(c) > math.Abs(h[largest]) {
+            largest = i
+        }
+    }
+    // Rounding each tap moves the DC gain; the largest tap takes it back
+    target := int64(math.Round(math.Ldexp(gain, f.format.FracBits)))
+    tap := int64(f.taps[largest]) + target - sum
+    if tap > math.MaxInt32 || tap < math.MinInt32 {
+        return nil, fmt.Errorf("fir coefficients[%d] %g overflows Q%d.%d "+
+            "taps when corrected for the rounded gain", largest, h[largest],
+            32-f.format.FracBits, f.format.FracBits)
+    }
+    f.taps[largest] = Fixed(tap)
+    return f, nil
+}
+
+// Taps returns the integer taps, newest sample first, and their format.
+func (f *FIRFilter) Taps() ([]Fixed, QFormat) {
+    return f.taps, f.format
+}
+
+// GroupDelay returns the delay of the filter at low frequencies, in
+// samples: the centroid of its taps, (taps - 1) / 2 for a symmetric
+// (linear-phase) design.
+func (f *FIRFilter) GroupDelay() float64 {
+    var moment, sum float64
+    for i, tap := range f.taps {
+        moment += float64(i) * float64(tap)
+        sum += float64(tap)
+    }
+    if sum == 0 {
+        return 0
+    }
+    return moment / sum
+}
+
+func (f *FIRFilter) Initialize(value int32) {
+    for i := range f.history {
+        f.history[i] = value
+    }
+    f.initialized = true
+}
+
+// Process filters one sample through the taps, newest sample first.
+func (f *FIRFilter) Process(value int32) int32 {
+    if !f.initialized {
+        f.Initialize(value)
+    }
+    f.history[f.head] = value
+    // Newest sample first: taps[i] multiplies the sample i steps back
+    var acc Acc
+    i := f.head
+    for _, tap := range f.taps {
+        acc = f.format.MulAcc(acc, tap, Fixed(f.history[i]))
+        if i--; i < 0 {
+            i = len(f.history) - 1
+        }
+    }
+    f.head = (f.head + 1) % len(f.history)
+    // The samples are whole, so the sum has the taps' fractional bits
+    return int32(f.format.Narrow(acc, f.format.FracBits))
+}
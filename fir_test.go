@@ -0,0 +1,168 @@
+package main
+
+import (
+    "math"
+    "strings"
+    "testing"
+)
+
+func TestFIRConfigValidate(t *testing.T) {
+    for _, fc := range []FIRConfig{
+        {},
+        {Coefficients: []float64{}},
+        {Coefficients: []float64{1}, Taps: 3},
+        {Coefficients: []float64{math.NaN()}},
+        {Coefficients: []float64{1 << 16}},
+        {Coefficients: []float64{1}, TapBits: 31},
+        // Each tap fits, the correction of the rounded gain doesn't
+        {Coefficients: []float64{1.999999999, 4e-10, 4e-10, 4e-10},
+         TapBits: 30},
+        {CutoffHz: 10, Taps: 0},
+        {CutoffHz: 10, Taps: maxFIRTaps + 1},
+        {CutoffHz: 0, Taps: 11},
+        {CutoffHz: 50, Taps: 11},
+        {CutoffHz: 10, Taps: 11, Window: "kaiser"},
+    } {
+        if err := fc.Validate(100); err == nil {
+            t.Errorf("Expected %+v to be rejected", fc)
+        }
+    }
+    if err := (FIRConfig{CutoffHz: 10, Taps: 11}).Validate(0); err == nil {
+        t.Error("Expected a design without a sample rate to be rejected")
+    }
+    if err := (FIRConfig{Coefficients: []float64{1}}).Validate(0); err != nil {
+        t.Errorf("Coefficients rejected without a sample rate: %v", err)
+    }
+}
+
+func TestFIRCoefficients(t *testing.T) {
+    // Newest sample first: the second tap delays by one sample
+    f, err := NewFIRFilter(FIRConfig{Coefficients: []float64{0, 1}}, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Initialize(0)
+    var out []int32
+    for _, x := range []int32{5, 7, 9} {
+        out = append(out, f.Process(x))
+    }
+    if out[0] != 0 || out[1] != 5 || out[2] != 7 {
+        t.Errorf("Expected 0, 5, 7, got %v", out)
+    }
+    if d := f.GroupDelay(); d != 1 {
+        t.Errorf("Expected a group delay of 1, got %g", d)
+    }
+
+    // Taps that add up past int32 keep their gain
+    f, err = NewFIRFilter(FIRConfig{Coefficients: []float64{1.5, 1.5},
+                                    TapBits: 30}, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Initialize(0)
+    if got := f.Process(10); got != 15 {
+        t.Errorf("Expected 10 * 1.5 on the first tap, got %d", got)
+    }
+
+    // The sum rounds once, to nearest: 3 * 0.5 is 1.5, then 2
+    f, err = NewFIRFilter(FIRConfig{Coefficients: []float64{0.25, 0.25},
+                                    TapBits: 2}, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := f.Process(3); got != 2 {
+        t.Errorf("Expected 3 * 0.5 to round to 2, got %d", got)
+    }
+    if got := f.Process(-3); got != 0 {
+        t.Errorf("Expected (3 - 3) / 4 to be 0, got %d", got)
+    }
+}
+
+func TestFIRDesign(t *testing.T) {
+    const rate = 100.0
+    for _, window := range []string{"", WindowHann, WindowBlackman,
+                                    WindowRectangular} {
+        config := FIRConfig{CutoffHz: 10, Taps: 31, Window: window}
+        f, err := NewFIRFilter(config, rate)
+        if err != nil {
+            t.Fatalf("%s: %v", window, err)
+        }
+        taps, q := f.Taps()
+        var sum Fixed
+        for i, tap := range taps {
+            sum += tap
+            if tap != taps[len(taps)-1-i] {
+                t.Errorf("%s: taps %d and %d differ", window, i,
+                    len(taps)-1-i)
+            }
+        }
+        // A DC gain of exactly one
+        if sum != q.One() {
+            t.Errorf("%s: taps sum to %d, not %d", window, sum, q.One())
+        }
+        if d := f.GroupDelay(); d != 15 {
+            t.Errorf("%s: expected a group delay of 15, got %g", window, d)
+        }
+    }
+
+    // Output amplitude of a sine through a fresh Hamming design, past its
+    // transient
+    amplitude := func(hz float64) float64 {
+        f, _ := NewFIRFilter(FIRConfig{CutoffHz: 10, Taps: 31}, rate)
+        peak := 0.0
+        for n := 0; n < 500; n++ {
+            x := 10000 * math.Sin(2*math.Pi*hz*float64(n)/rate)
+            y := float64(f.Process(int32(math.Round(x))))
+            if n >= 100 {
+                peak = math.Max(peak, math.Abs(y))
+            }
+        }
+        return peak / 10000
+    }
+    if a := amplitude(2); math.Abs(a-1) > 0.01 {
+        t.Errorf("Expected a gain of 1 at 2 Hz, got %g", a)
+    }
+    // The Hamming window's stopband is below -50 dB
+    if a := amplitude(30); a > 0.003 {
+        t.Errorf("Expected a gain below 0.003 at 30 Hz, got %g", a)
+    }
+
+    f, _ := NewFIRFilter(FIRConfig{CutoffHz: 10, Taps: 31}, rate)
+    f.Initialize(1000)
+    if got := f.Process(1000); got != 1000 {
+        t.Errorf("Expected a steady 1000 to pass unchanged, got %d", got)
+    }
+}
+
+func TestValidateFIRFilter(t *testing.T) {
+    config := validTestConfig()
+    config.Processing.Filters = []FilterConfig{
+        {Type: "low_pass", Target: "pressure", Alpha: 0.5},
+        {Type: "fir", Target: "Flow",
+         FIR: &FIRConfig{CutoffHz: 10, Taps: 15}},
+    }
+    if err := config.Validate(); err != nil {
+        t.Fatalf("Valid config rejected: %v", err)
+    }
+    p := newTestProcessor(t, config.Processing)
+    if _, ok := p.Filters["flow"][0].(*FIRFilter); !ok {
+        t.Errorf("Expected a FIR filter on flow, got %v", p.Filters["flow"])
+    }
+
+    // Flow is sampled at 100 Hz, dp at 10 Hz
+    for _, fc := range []FilterConfig{
+        {Type: "fir", Target: "flow"},
+        {Type: "fir", Target: "flow", FIR: &FIRConfig{CutoffHz: 60, Taps: 15}},
+        {Type: "fir", Target: "dp", FIR: &FIRConfig{CutoffHz: 10, Taps: 15}},
+        {Type: "fir", Target: "nothing",
+         FIR: &FIRConfig{CutoffHz: 10, Taps: 15}},
+    } {
+        config := validTestConfig()
+        config.Processing.Filters = []FilterConfig{fc}
+        err := config.Validate()
+        if err == nil || !strings.HasPrefix(err.Error(),
+                                            "processing.filters[0]") {
+            t.Errorf("%+v: expected a filters[0] error, got %v", fc, err)
+        }
+    }
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "math/big"
+    "strconv"
+    "strings"
+)
+
+// Fixed is a fixed-point number: an int32 scaled by 2^FracBits of its
+// QFormat, as firmware without an FPU computes.
+type Fixed int32
+
+// Rounding is how an operation drops fractional bits.
+type Rounding int
+
+const (
+    RoundFloor   Rounding = iota // towards minus infinity: a plain shift
+    RoundNearest                 // to nearest, ties upwards: add half, shift
+    RoundZero                    // towards zero, like C's integer division
+)
+
+// Overflow is what an operation does with a result out of range.
+type Overflow int
+
+const (
+    OverflowSaturate Overflow = iota // the nearest end of the range
+    OverflowWrap                     // two's complement wrap, like C
+)
+
+// QFormat is a signed 32-bit Qm.n format, m integer bits (sign included)
+// and n = FracBits fractional ones: Q16.16 spans [-32768, 32768) in steps
+// of 1/65536. Its operations are built on the overflow-checked ones of
+// safemath.go, with its Rounding and Overflow; the zero values floor and
+// saturate.
+//
+// Conversions from float64 round to nearest and saturate whatever the
+// modes: they are made by the host, not by the firmware.
+type QFormat struct {
+    FracBits int
+    Rounding Rounding
+    Overflow Overflow
+}
+
+// DefaultQFormat is the format of fixed-point evaluations unless set.
+const DefaultQFormat = "Q16.16"
+
+// ParseQFormat parses a format like "Q16.16" or "Q24.8"; the two numbers
+// add up to 32.
+func ParseQFormat(s string) (QFormat, error) {
+    m, n, ok := strings.Cut(strings.TrimPrefix(s, "Q"), ".")
+    integer, err1 := strconv.Atoi(m)
+    frac, err2 := strconv.Atoi(n)
+    if !strings.HasPrefix(s, "Q") || !ok || err1 != nil || err2 != nil {
+        return QFormat{}, fmt.Errorf("format must be like Q16.16, got %q",
+            s)
+    }
+    if integer+frac != 32 || integer < 2 || frac < 0 {
+        return QFormat{}, fmt.Errorf("format %s must have 2 to 32 integer "+
+            "bits and 32 bits in all", s)
+    }
+    return QFormat{FracBits: frac}, nil
+}
+
+// Names of the modes in the configuration.
+var (
+    roundingNames = map[string]Rounding{
+        "floor": RoundFloor, "nearest": RoundNearest, "zero": RoundZero,
+    }
+    overflowNames = map[string]Overflow{
+        "saturate": OverflowSaturate, "wrap": OverflowWrap,
+    }
+)
+
+func (q QFormat) String() string {
+    return fmt.Sprintf("Q%d.%d", 32-q.FracBits, q.FracBits)
+}
+
+// One returns 1 in the format.
+func (q QFormat) One() Fixed {
+    return Fixed(1) << q.FracBits
+}
+
+// Max and Min return the ends of the format's range.
+func (q QFormat) Max() Fixed { return math.MaxInt32 }
+func (q QFormat) Min() Fixed { return math.MinInt32 }
+
+// Conversions
+
+// FromFloat converts x to the nearest value of the format, saturating; NaN
+// converts to 0.
+func (q QFormat) FromFloat(x float64) Fixed {
+    scaled := math.Round(math.Ldexp(x, q.FracBits))
+    switch {
+    case math.IsNaN(scaled):
+        return 0
+    case scaled >= math.MaxInt32:
+        return q.Max()
+    case scaled <= math.MinInt32:
+        return q.Min()
+    }
+    return Fixed(scaled)
+}
+
+// Holds reports whether x is within the range of the format, so that it
+// converts without saturating.
+func (q QFormat) Holds(x float64) bool {
+    return x >= q.Float(q.Min()) && x <= q.Float(q.Max())
+}
+
+// Float converts x to float64, exactly.
+func (q QFormat) Float(x Fixed) float64 {
+    return math.Ldexp(float64(x), -q.FracBits)
+}
+
+// FromInt converts a whole number to the format.
+func (q QFormat) FromInt(i int32) Fixed {
+    return q.narrow(int64(i) << q.FracBits)
+}
+
+// Int returns the integer part of x, truncated towards zero like the
+// conversion of a float64 to int32.
+func (q QFormat) Int(x Fixed) int32 {
+    return int32(x) / int32(q.One())
+}
+
+// Convert converts x from the format from to q, rounding off the
+// fractional bits q lacks.
+func (q QFormat) Convert(x Fixed, from QFormat) Fixed {
+    return q.narrow(q.shift(int64(x), from.FracBits-q.FracBits))
+}
+
+// shift divides v by 2^bits with the format's rounding, or multiplies it
+// by 2^-bits for a negative bits.
+func (q QFormat) shift(v int64, bits int) int64 {
+    if bits <= 0 {
+        return v << -bits
+    }
+    switch q.Rounding {
+    case RoundNearest:
+        // floor(v / 2^bits + 1/2), without overflowing v + 2^(bits-1)
+        return v>>bits + (v>>(bits-1))&1
+    case RoundZero:
+        if v < 0 {
+            // The ceiling
+            return (v + 1<<bits - 1) >> bits
+        }
+    }
+    return v >> bits
+}
+
+// narrow returns v in 32 bits, with the format's overflow.
+func (q QFormat) narrow(v int64) Fixed {
+    if v > math.MaxInt32 || v < math.MinInt32 {
+        return q.overflow(v > 0, int32(v))
+    }
+    return Fixed(v)
+}
+
+// overflow returns the result of an operation that overflowed, towards
+// positive or negative; wrapped is its low 32 bits.
+func (q QFormat) overflow(positive bool, wrapped int32) Fixed {
+    switch {
+    case q.Overflow == OverflowWrap:
+        return Fixed(wrapped)
+    case positive:
+        return q.Max()
+    }
+    return q.Min()
+}
+
+// Arithmetic
+
+// Add returns a + b.
+func (q QFormat) Add(a, b Fixed) Fixed {
+    r, err := SafeAdd32(int32(a), int32(b))
+    if err != nil {
+        return q.overflow(b > 0, int32(a)+int32(b))
+    }
+    return Fixed(r)
+}
+
+// Sub returns a - b.
+func (q QFormat) Sub(a, b Fixed) Fixed {
+    r, err := SafeSub32(int32(a), int32(b))
+    if err != nil {
+        return q.overflow(b < 0, int32(a)-int32(b))
+    }
+    return Fixed(r)
+}
+
+// Neg returns -a (-Min is Max, or Min wrapped).
+func (q QFormat) Neg(a Fixed) Fixed {
+    return q.Sub(0, a)
+}
+
+// Mul returns a * b. With a = hi * 2^n + lo, hi truncated towards zero so
+// that lo has the sign of a, the product is hi * b + lo * b / 2^n: an
+// overflow-checked 32-bit multiply and add of terms of the same sign, and
+// a 32x32->64 bit multiply whose rounded shift is no larger than b.
+func (q QFormat) Mul(a, b Fixed) Fixed {
+    hi := int32(a) / int32(q.One())
+    lo := int64(int32(a) - hi<<q.FracBits)
+    part := int32(q.shift(lo*int64(b), q.FracBits))
+    whole, err := SafeMul32(hi, int32(b))
+    if err != nil {
+        return q.overflow((hi < 0) == (b < 0), hi*int32(b)+part)
+    }
+    r, err := SafeAdd32(whole, part)
+    if err != nil {
+        return q.overflow(part > 0, whole+part)
+    }
+    return Fixed(r)
+}
+
+// Div returns a / b. It fails on a zero b.
+func (q QFormat) Div(a, b Fixed) (Fixed, error) {
+    if b == 0 {
+        return 0, fmt.Errorf("division by zero")
+    }
+    // a * 2^n doesn't fit 32 bits; firmware calls a 64-bit divide here
+    return q.narrow(q.divide(int64(a)<<q.FracBits, int64(b))), nil
+}
+
+// divide returns num / den with the format's rounding; |num| < 2^62.
+func (q QFormat) divide(num, den int64) int64 {
+    if den < 0 {
+        num, den = -num, -den
+    }
+    if q.Rounding == RoundNearest {
+        // floor((num + den/2) / den), in halves
+        num, den = 2*num+den, 2*den
+    }
+    r := num / den
+    if num%den != 0 && num < 0 && q.Rounding != RoundZero {
+        r--
+    }
+    return r
+}
+
+// Mod returns the remainder of a / b, with the sign of a like math.Mod.
+// It fails on a zero b.
+func (q QFormat) Mod(a, b Fixed) (Fixed, error) {
+    if b == 0 {
+        return 0, fmt.Errorf("modulo by zero")
+    }
+    return a % b, nil
+}
+
+// Pow returns a raised to the whole power n by squaring; a negative n
+// divides 1 by the power.
+func (q QFormat) Pow(a Fixed, n int) (Fixed, error) {
+    r, negative := q.One(), n < 0
+    if negative {
+        n = -n
+    }
+    for ; n > 0; n >>= 1 {
+        if n&1 != 0 {
+            r = q.Mul(r, a)
+        }
+        if n > 1 {
+            a = q.Mul(a, a)
+        }
+    }
+    if negative {
+        return q.Div(q.One(), r)
+    }
+    return r, nil
+}
+
+// Abs returns |a|.
+func (q QFormat) Abs(a Fixed) Fixed {
+    if a < 0 {
+        return q.Neg(a)
+    }
+    return a
+}
+
+// Floor, Ceil and Round round a to a whole number; Round rounds halves
+// away from zero, like math.Round.
+func (q QFormat) Floor(a Fixed) Fixed {
+    return a &^ (q.One() - 1)
+}
+
+func (q QFormat) Ceil(a Fixed) Fixed {
+    return q.Floor(q.Add(a, q.One()-1))
+}
+
+func (q QFormat) Round(a Fixed) Fixed {
+    half := q.One() >> 1
+    if a < 0 {
+        return q.Neg(q.Floor(q.Add(q.Neg(a), half)))
+    }
+    return q.Floor(q.Add(a, half))
+}
+
+// Sqrt returns the square root of a, that of a * 2^n as an integer, by
+// the digit-by-digit method. It fails on a negative a.
+func (q QFormat) Sqrt(a Fixed) (Fixed, error) {
+    if a < 0 {
+        return 0, fmt.Errorf("square root of negative %g", q.Float(a))
+    }
+    v := uint64(a) << q.FracBits
+    var r uint64
+    for bit := uint64(1) << 62; bit > 0; bit >>= 2 {
+        if v >= r+bit {
+            v -= r + bit
+            r = r>>1 + bit
+        } else {
+            r >>= 1
+        }
+    }
+    // v is now the remainder a * 2^n - r^2; past r, the root is nearer
+    // r + 1
+    if q.Rounding == RoundNearest && v > r {
+        r++
+    }
+    return q.narrow(int64(r)), nil
+}
+
+// Trigonometry
+
+// cordicBits is the precision of the CORDIC rotations: Q4.60 in an int64,
+// well past the 30 fractional bits of the finest format.
+const cordicBits = 60
+
+// piDigits is Pi to the precision of math.Pi's constant.
+const piDigits = "3.14159265358979323846264338327950288419716939937510582097494459"
+
+var (
+    // atan(2^-i), and the gain of the rotations' lengths, in Q4.60
+    cordicAtan [cordicBits]int64
+    cordicGain int64
+    // Pi / 2 in Q(n+31) for each format's n, to reduce angles in, and the
+    // rest of it in 32 more bits (Cody and Waite's reduction)
+    cordicHalfPi     [31]int64
+    cordicHalfPiRest [31]int64
+)
+
+func init() {
+    gain := 1.0
+    for i := range cordicAtan {
+        cordicAtan[i] = int64(math.Round(math.Ldexp(math.Atan(
+            math.Ldexp(1, -i)), cordicBits)))
+        gain /= math.Sqrt(1 + math.Ldexp(1, -2*i))
+    }
+    cordicGain = int64(math.Round(math.Ldexp(gain, cordicBits)))
+
+    pi, _ := new(big.Float).SetPrec(256).SetString(piDigits)
+    round := func(x *big.Float) int64 {
+        i, _ := new(big.Float).Add(x, big.NewFloat(0.5)).Int(nil)
+        for x.Sign() < 0 && new(big.Float).SetInt(i).Cmp(x) > 0 {
+            i.Sub(i, big.NewInt(1))
+        }
+        return i.Int64()
+    }
+    for n := range cordicHalfPi {
+        halfPi := new(big.Float).SetMantExp(pi, n+30)
+        cordicHalfPi[n] = round(halfPi)
+        rest := halfPi.Sub(halfPi, new(big.Float).SetInt64(cordicHalfPi[n]))
+        cordicHalfPiRest[n] = round(rest.SetMantExp(rest, 32))
+    }
+}
+
+// SinCos returns the sine and cosine of a, in radians. The angle is
+// reduced to [-Pi/4, Pi/4] and a quadrant in 64 bits, then rotated by
+// CORDIC: shifts and adds only.
+func (q QFormat) SinCos(a Fixed) (Fixed, Fixed) {
+    // sin(-a) = -sin(a)
+    negative := a < 0
+    x := int64(a)
+    if negative {
+        x = -x
+    }
+    // a - k Pi/2 in Q(n+31); |a| * 2^31 < 2^62
+    halfPi := cordicHalfPi[q.FracBits]
+    x <<= 31
+    k := (x + halfPi/2) / halfPi
+    r := x - k*halfPi - k*cordicHalfPiRest[q.FracBits]>>32
+    if d := cordicBits - q.FracBits - 31; d >= 0 {
+        r <<= d
+    } else {
+        r >>= -d
+    }
+
+    cos, sin, z := cordicGain, int64(0), r
+    for i, atan := range cordicAtan {
+        dx, dy := sin>>i, cos>>i
+        if z >= 0 {
+            cos, sin, z = cos-dx, sin+dy, z-atan
+        } else {
+            cos, sin, z = cos+dx, sin-dy, z+atan
+        }
+    }
+    switch k % 4 {
+    case 1:
+        sin, cos = cos, -sin
+    case 2:
+        sin, cos = -sin, -cos
+    case 3:
+        sin, cos = -cos, sin
+    }
+    if negative {
+        sin = -sin
+    }
+    bits := cordicBits - q.FracBits
+    return q.narrow(q.shift(sin, bits)), q.narrow(q.shift(cos, bits))
+}
+
+// Sin and Cos return the sine and cosine of a, in radians.
+func (q QFormat) Sin(a Fixed) Fixed {
+    sin, _ := q.SinCos(a)
+    return sin
+}
+
+func (q QFormat) Cos(a Fixed) Fixed {
+    _, cos := q.SinCos(a)
+    return cos
+}
+
+// Accumulation
+
+// Acc is a 64-bit accumulator, as in the multiply-accumulate of a DSP: it
+// sums the exact products of Fixed values, 2n fractional bits for two
+// values of the format, and is rounded once at the end (see Narrow).
+type Acc int64
+
+// Wide returns a in the accumulator's 2n fractional bits, to start or
+// offset a sum of products.
+func (q QFormat) Wide(a Fixed) Acc {
+    return Acc(int64(a) << q.FracBits)
+}
+
+// MulAcc returns acc + a * b, the product exact. The accumulator
+// saturates or wraps at 64 bits.
+func (q QFormat) MulAcc(acc Acc, a, b Fixed) Acc {
+    return q.AddAcc(acc, Acc(int64(a)*int64(b)))
+}
+
+// AddAcc returns x + y.
+func (q QFormat) AddAcc(x, y Acc) Acc {
+    _, err := SafeAdd64(int64(x), int64(y))
+    switch {
+    case err == nil || q.Overflow == OverflowWrap:
+        return x + y
+    case y > 0:
+        return math.MaxInt64
+    }
+    return math.MinInt64
+}
+
+// Narrow rounds bits fractional bits off acc and returns it in 32 bits:
+// Narrow(acc, n) for products of two values of the format, or the
+// fractional bits of the one Fixed operand in products with integers.
+func (q QFormat) Narrow(acc Acc, bits int) Fixed {
+    return q.narrow(q.shift(int64(acc), bits))
+}
+
+// Result returns a sum of products of two values of the format in it.
+func (q QFormat) Result(acc Acc) Fixed {
+    return q.Narrow(acc, q.FracBits)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+    "fmt"
+    "math"
+)
+
+// FixedPointConfig evaluates the flow equation in fixed point, as the
+// firmware of a meter without an FPU would: the calculated flow comes from
+// the fixed-point path, and the float64 path runs alongside it for the
+// comparison reported at the end of the run (see FixedComparison).
+type FixedPointConfig struct {
+    // "Q16.16" (default), "Q24.8"...; see QFormat
+    Format   string `json:"format,omitempty"`
+    // "floor" (default), "nearest" or "zero"
+    Rounding string `json:"rounding,omitempty"`
+    // "saturate" (default) or "wrap"
+    Overflow string `json:"overflow,omitempty"`
+}
+
+// QFormat returns the configured format.
+func (fc FixedPointConfig) QFormat() (QFormat, error) {
+    format := fc.Format
+    if format == "" {
+        format = DefaultQFormat
+    }
+    q, err := ParseQFormat(format)
+    if err != nil {
+        return q, err
+    }
+    var ok bool
+    if fc.Rounding != "" {
+        if q.Rounding, ok = roundingNames[fc.Rounding]; !ok {
+            return q, fmt.Errorf("rounding must be 'floor', 'nearest' or "+
+                "'zero', got %s", fc.Rounding)
+        }
+    }
+    if fc.Overflow != "" {
+        if q.Overflow, ok = overflowNames[fc.Overflow]; !ok {
+            return q, fmt.Errorf("overflow must be 'saturate' or 'wrap', "+
+                "got %s", fc.Overflow)
+        }
+    }
+    return q, nil
+}
+
+// fixedNode evaluates a sub-expression compiled to fixed point.
+type fixedNode func(vars []Fixed) Fixed
+
+// FixedEquation is an equation compiled to fixed point: variables,
+// constants and every intermediate result are Fixed values of one
+// QFormat, and the operators its integer operations. Constant
+// sub-expressions are still folded in float64, once, as the host tool
+// computing a firmware's constants would.
+//
+// Functions without a fixed-point version (see fixedFunctions), lookup
+// tables and functions with state are compile errors, unless their
+// arguments are constant. So are ** without a constant whole exponent, and
+// the bitwise operators, ~, ? without ":" and ?? on variables.
+// Overflows saturate or wrap, and dropped bits round, as the QFormat says.
+type FixedEquation struct {
+    source string
+    vars   []string
+    format QFormat
+    root   fixedNode
+    state  *equationState
+}
+
+// CompileFixedEquation compiles source to fixed point in format, reading
+// only the given variables (any variable, if variables is nil).
+func CompileFixedEquation(source string,
+                          variables []string,
+                          format QFormat) (*FixedEquation, error) {
+    return compileFixedEquation(source, equationScope{variables: variables,
+                                                      fixed: &format})
+}
+
+func compileFixedEquation(source string,
+                          scope equationScope) (*FixedEquation, error) {
+    p, root, err := parseEquation(source, scope)
+    if err != nil {
+        return nil, err
+    }
+    return &FixedEquation{
+        source: source,
+        vars:   p.vars,
+        format: *scope.fixed,
+        root:   root.fixed(*scope.fixed),
+        state:  p.state,
+    }, nil
+}
+
+// Source returns the equation as written.
+func (e *FixedEquation) Source() string {
+    return e.source
+}
+
+// Vars returns the variables the equation reads, in slot order; the same
+// as those of the Equation compiled from the same source.
+func (e *FixedEquation) Vars() []string {
+    return e.vars
+}
+
+// Format returns the format the equation computes in.
+func (e *FixedEquation) Format() QFormat {
+    return e.format
+}
+
+// Eval evaluates the equation; values[i] holds the variable Vars()[i]. It
+// fails on a division or modulo by zero, or a function argument out of its
+// domain.
+func (e *FixedEquation) Eval(values []Fixed) (Fixed, error) {
+    x := e.root(values)
+    if err := e.state.err; err != nil {
+        e.state.err = nil
+        return x, err
+    }
+    return x, nil
+}
+
+// fixed returns the node's fixed-point evaluator.
+func (n exprNode) fixed(q QFormat) fixedNode {
+    if n.constant {
+        v := q.FromFloat(n.value)
+        return func([]Fixed) Fixed { return v }
+    }
+    return n.fx
+}
+
+func (p *equationParser) fixedTernary(cond, yes, no exprNode) exprNode {
+    q := *p.fixed
+    c, y, n := cond.fixed(q), yes.fixed(q), no.fixed(q)
+    return exprNode{fx: func(v []Fixed) Fixed {
+        if c(v) != 0 {
+            return y(v)
+        }
+        return n(v)
+    }}
+}
+
+func (p *equationParser) fixedUnary(op string, x exprNode) exprNode {
+    q, a := *p.fixed, x.fx
+    if op == "-" {
+        return exprNode{fx: func(v []Fixed) Fixed { return q.Neg(a(v)) }}
+    }
+    return exprNode{fx: func(v []Fixed) Fixed {
+        return fixedBool(q, a(v) == 0)
+    }}
+}
+
+// fixedBinary applies the binary operator of tok in fixed point. Like the
+// float64 operators, comparisons and logic give 1 or 0.
+func (p *equationParser) fixedBinary(tok token,
+                                     left, right exprNode) (exprNode, error) {
+    q, st := *p.fixed, p.state
+    a, b := left.fixed(q), right.fixed(q)
+    // A checked equation evaluates the operands first, so that the result
+    // can be compared with the exact one of the same operands
+    var x, y Fixed
+    if p.checked {
+        for _, n := range []exprNode{left, right} {
+            if n.constant && !q.Holds(n.value) {
+                return exprNode{}, &EquationError{tok.pos,
+                    fmt.Sprintf("constant %g overflows %s", n.value, q)}
+            }
+        }
+        a = func([]Fixed) Fixed { return x }
+        b = func([]Fixed) Fixed { return y }
+    }
+    // Division and modulo by zero fail the evaluation
+    checked := func(op func(x, y Fixed) (Fixed, error)) fixedNode {
+        return func(v []Fixed) Fixed {
+            r, err := op(a(v), b(v))
+            if err != nil {
+                st.fail(&EquationError{tok.pos, err.Error()})
+            }
+            return r
+        }
+    }
+
+    var fx fixedNode
+    switch tok.text {
+    case "+":
+        fx = func(v []Fixed) Fixed { return q.Add(a(v), b(v)) }
+    case "-":
+        fx = func(v []Fixed) Fixed { return q.Sub(a(v), b(v)) }
+    case "*":
+        fx = func(v []Fixed) Fixed { return q.Mul(a(v), b(v)) }
+    case "/":
+        fx = checked(q.Div)
+    case "%":
+        fx = checked(q.Mod)
+    case "**":
+        n := right.value
+        if !right.constant || n != math.Trunc(n) || math.Abs(n) > 64 {
+            return exprNode{}, &EquationError{tok.pos,
+                "** takes a constant whole exponent up to 64 in fixed point"}
+        }
+        fx = checked(func(x, _ Fixed) (Fixed, error) {
+            return q.Pow(x, int(n))
+        })
+    case "==":
+        fx = func(v []Fixed) Fixed { return fixedBool(q, a(v) == b(v)) }
+    case "!=":
+        fx = func(v []Fixed) Fixed { return fixedBool(q, a(v) != b(v)) }
+    case "<":
+        fx = func(v []Fixed) Fixed { return fixedBool(q, a(v) < b(v)) }
+    case "<=":
+        fx = func(v []Fixed) Fixed { return fixedBool(q, a(v) <= b(v)) }
+    case ">":
+        fx = func(v []Fixed) Fixed { return fixedBool(q, a(v) > b(v)) }
+    case ">=":
+        fx = func(v []Fixed) Fixed { return fixedBool(q, a(v) >= b(v)) }
+    case "&&":
+        fx = func(v []Fixed) Fixed {
+            return fixedBool(q, a(v) != 0 && b(v) != 0)
+        }
+    case "||":
+        fx = func(v []Fixed) Fixed {
+            return fixedBool(q, a(v) != 0 || b(v) != 0)
+        }
+    default:
+        // Bitwise operators
+        return exprNode{}, notFixed(tok)
+    }
+    if p.checked {
+        l, r, op := left.fixed(q), right.fixed(q), fx
+        fx = func(v []Fixed) Fixed {
+            x, y = l(v), r(v)
+            result := op(v)
+            exact := binaryOp(tok.text, q.Float(x), q.Float(y))
+            if !q.Holds(exact) {
+                st.fail(&EquationError{tok.pos,
+                    fmt.Sprintf("%g overflows %s", exact, q)})
+            }
+            return result
+        }
+    }
+    return exprNode{fx: fx}, nil
+}
+
+func fixedBool(q QFormat, b bool) Fixed {
+    if b {
+        return q.One()
+    }
+    return 0
+}
+
+// fixedFunctions are the functions equations may call in fixed point.
+var fixedFunctions = map[string]func(q QFormat, args []Fixed) Fixed{
+    "abs":   func(q QFormat, args []Fixed) Fixed { return q.Abs(args[0]) },
+    "floor": func(q QFormat, args []Fixed) Fixed { return q.Floor(args[0]) },
+    "ceil":  func(q QFormat, args []Fixed) Fixed { return q.Ceil(args[0]) },
+    "round": func(q QFormat, args []Fixed) Fixed { return q.Round(args[0]) },
+    "sin":   func(q QFormat, args []Fixed) Fixed { return q.Sin(args[0]) },
+    "cos":   func(q QFormat, args []Fixed) Fixed { return q.Cos(args[0]) },
+    // Its check rejects negative arguments first
+    "sqrt": func(q QFormat, args []Fixed) Fixed {
+        r, _ := q.Sqrt(args[0])
+        return r
+    },
+    "min": func(_ QFormat, args []Fixed) Fixed {
+        m := args[0]
+        for _, x := range args[1:] {
+            m = min(m, x)
+        }
+        return m
+    },
+    "max": func(_ QFormat, args []Fixed) Fixed {
+        m := args[0]
+        for _, x := range args[1:] {
+            m = max(m, x)
+        }
+        return m
+    },
+    "clamp": func(_ QFormat, args []Fixed) Fixed {
+        return max(args[1], min(args[2], args[0]))
+    },
+}
+
+// fixedCall compiles a call of the function named by name in fixed point,
+// with its argument check made on the converted arguments.
+func (f equationFunction) fixedCall(p *equationParser,
+                                    name token,
+                                    args []exprNode) (exprNode, error) {
+    fn, ok := fixedFunctions[name.text]
+    if !ok {
+        return exprNode{}, notFixed(name)
+    }
+    q, st, check := *p.fixed, p.state, f.check
+    evals := make([]fixedNode, len(args))
+    for i, a := range args {
+        evals[i] = a.fixed(q)
+    }
+    buf := make([]Fixed, len(args))
+    values := make([]float64, len(args))
+    return exprNode{fx: func(v []Fixed) Fixed {
+        for i, e := range evals {
+            buf[i] = e(v)
+        }
+        if check != nil {
+            for i, x := range buf {
+                values[i] = q.Float(x)
+            }
+            if err := check(values); err != nil {
+                st.fail(callError(name, err))
+                return 0
+            }
+        }
+        return fn(q, buf)
+    }}, nil
+}
+
+func notFixed(name token) error {
+    return &EquationError{name.pos,
+        fmt.Sprintf("%s isn't available in fixed point", name.text)}
+}
+
+// FixedComparison accumulates the deviation of the fixed-point results of
+// the flow equation from the float64 ones over a run.
+type FixedComparison struct {
+    Format    QFormat
+    // Samples both paths evaluated
+    Samples   int64
+    // Largest absolute deviation, and relative to the float64 result
+    MaxAbs    float64
+    MaxRel    float64
+    // Fixed-point results at an end of the format's range
+    Saturated int64
+    // Samples only one of the paths could evaluate
+    Failed    int64
+    sumAbs    float64
+    sumSquare float64
+}
+
+// Add records the results of a sample; an error of either path counts it
+// as failed, unless both failed.
+func (c *FixedComparison) Add(fixed Fixed,
+                              fixedErr error,
+                              float float64,
+                              floatErr error) {
+    if fixedErr != nil || floatErr != nil {
+        if (fixedErr == nil) != (floatErr == nil) {
+            c.Failed++
+        }
+        return
+    }
+    if fixed == c.Format.Max() || fixed == c.Format.Min() {
+        c.Saturated++
+    }
+    deviation := math.Abs(c.Format.Float(fixed) - float)
+    c.Samples++
+    c.sumAbs += deviation
+    c.sumSquare += deviation * deviation
+    c.MaxAbs = math.Max(c.MaxAbs, deviation)
+    if float != 0 {
+        c.MaxRel = math.Max(c.MaxRel, deviation/math.Abs(float))
+    }
+}
+
+// Mean returns the mean absolute deviation.
+func (c *FixedComparison) Mean() float64 {
+    if c.Samples == 0 {
+        return 0
+    }
+    return c.sumAbs / float64(c.Samples)
+}
+
+// RMS returns the root mean square deviation.
+func (c *FixedComparison) RMS() float64 {
+    if c.Samples == 0 {
+        return 0
+    }
+    return math.Sqrt(c.sumSquare / float64(c.Samples))
+}
+
+// String reports the comparison on one line.
+func (c *FixedComparison) String() string {
+    return fmt.Sprintf("flow equation in %s vs float64 over %d samples: "+
+        "max deviation %.6g (%.3g%%), mean %.6g, RMS %.6g; %d saturated, "+
+        "%d failed in one path only", c.Format, c.Samples, c.MaxAbs,
+        100*c.MaxRel, c.Mean(), c.RMS(), c.Saturated, c.Failed)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "errors"
+    "math"
+    "strings"
+    "testing"
+)
+
+func TestFixedEquation(t *testing.T) {
+    q := QFormat{FracBits: 16}
+    tests := []struct {
+        equation string
+        x        float64
+        expected float64
+    }{
+        {"x * 2.5 - 1", 3, 6.5},
+        {"-x / 4", 3, -0.75},
+        {"x % 2", 7.5, 1.5},
+        {"x ** 2 + x ** -1", 2, 4.5},
+        {"x > 1 && !(x == 2) ? 10 : 20", 3, 10},
+        {"x > 1 && !(x == 2) ? 10 : 20", 2, 20},
+        {"clamp(x, 0, 1) + max(x, 4) + floor(x) + abs(-x)", 2.5, 9.5},
+        {"sqrt(x) + cos(x - x)", 6.25, 3.5},
+        {"sin(x * 2)", math.Pi / 4, 1 - 1.0/65536},
+        // Constant sub-expressions are folded in float64 first
+        {"x * sqrt(4)", 3, 6},
+        {"x * 1000", 40, 32768 - 1.0/65536},
+    }
+    for _, tc := range tests {
+        eq, err := CompileFixedEquation(tc.equation, []string{"x"}, q)
+        if err != nil {
+            t.Fatalf("%s: %v", tc.equation, err)
+        }
+        got, err := eq.Eval([]Fixed{q.FromFloat(tc.x)})
+        if err != nil {
+            t.Fatalf("%s at x=%g: %v", tc.equation, tc.x, err)
+        }
+        if q.Float(got) != tc.expected {
+            t.Errorf("%s at x=%g: expected %g, got %g", tc.equation, tc.x,
+                tc.expected, q.Float(got))
+        }
+    }
+
+    eq, err := CompileFixedEquation("1 + 1 / x", nil, q)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = eq.Eval([]Fixed{0})
+    if err == nil || err.Error() != "division by zero at position 7" {
+        t.Errorf("Unexpected error %v", err)
+    }
+    if got, err := eq.Eval([]Fixed{q.One()}); err != nil || got != 2<<16 {
+        t.Errorf("Expected 2, got %g (%v)", q.Float(got), err)
+    }
+}
+
+func TestFixedEquationErrors(t *testing.T) {
+    for equation, expected := range map[string]string{
+        "tan(x)":       "tan isn't available in fixed point",
+        "noise(1) + x": "noise isn't available in fixed point",
+        "2 ** x":       "** takes a constant whole exponent",
+        "x ** 0.5":     "** takes a constant whole exponent",
+        "x & 1":        "& isn't available in fixed point",
+        "~x":           "~ isn't available in fixed point",
+        "x > 1 ? 2":    "? isn't available in fixed point",
+        "x ?? 1":       "?? isn't available in fixed point",
+    } {
+        _, err := CompileFixedEquation(equation, []string{"x"},
+                                       QFormat{FracBits: 16})
+        var eqErr *EquationError
+        if !errors.As(err, &eqErr) || !strings.Contains(err.Error(),
+                                                         expected) {
+            t.Errorf("%s: expected %q, got %v", equation, expected, err)
+        }
+    }
+}
+
+func TestFixedPointConfig(t *testing.T) {
+    q, err := FixedPointConfig{Rounding: "nearest",
+                               Overflow: "wrap"}.QFormat()
+    if err != nil || q != (QFormat{16, RoundNearest, OverflowWrap}) {
+        t.Errorf("Unexpected format %+v (%v)", q, err)
+    }
+    for _, fc := range []FixedPointConfig{{Format: "Q16"},
+                                          {Rounding: "up"},
+                                          {Overflow: "clip"}} {
+        if _, err := fc.QFormat(); err == nil {
+            t.Errorf("Expected %+v to be rejected", fc)
+        }
+    }
+}
+
+func TestCalculateFlowFixed(t *testing.T) {
+    config := validTestConfig()
+    config.Processing.FlowEquation = defaultFlowEquation
+    config.Sensors["temperature"] = SensorConfig{FrequencyHz: 10,
+                                                 Equation: "RefT"}
+    config.Processing.FixedPoint = &FixedPointConfig{Format: "Q24.8"}
+    if err := config.Validate(); err != nil {
+        t.Fatal(err)
+    }
+    processor := newTestProcessor(t, config.Processing)
+    processor.Latest["pressure"] = 137
+    processor.Latest["temperature"] = 121
+    float := 1000000 * (1 + 37.0/255*21/255)
+    result, err := processor.CalculateFlow(defaultFlowEquation, 1000000, 0,
+                                           8000000, 100, 100)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 1/255 is 1/256 in 8 fractional bits
+    if math.Abs(float64(result)-float) > 100 || result == int32(float) {
+        t.Errorf("Expected near %g but not equal, got %d", float, result)
+    }
+
+    c := processor.Comparison
+    if c.Samples != 1 || c.MaxAbs == 0 || c.MaxAbs != c.RMS() ||
+        c.Saturated != 0 {
+        t.Errorf("Unexpected comparison %s", c)
+    }
+
+    config.Processing.FixedPoint.Format = "Q8.8"
+    err = config.Validate()
+    if err == nil || !strings.HasPrefix(err.Error(),
+                                        "processing.fixed_point: ") {
+        t.Errorf("Expected a fixed_point error, got %v", err)
+    }
+}
+
+func BenchmarkFlowEquationFixed(b *testing.B) {
+    q := QFormat{FracBits: 8}
+    eq, err := CompileFixedEquation(defaultFlowEquation, nil, q)
+    if err != nil {
+        b.Fatal(err)
+    }
+    values := map[string]float64{
+        "F": 1000, "P": 120, "T": 90, "RefF": 8000000, "RefP": 100,
+        "RefT": 100,
+    }
+    slots := make([]Fixed, len(eq.Vars()))
+    for i, name := range eq.Vars() {
+        slots[i] = q.FromFloat(values[name])
+    }
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        eq.Eval(slots)
+    }
+}
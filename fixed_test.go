@@ -0,0 +1,334 @@
+package main
+
+import (
+    "math"
+    "math/rand"
+    "testing"
+)
+
+func TestParseQFormat(t *testing.T) {
+    for s, bits := range map[string]int{"Q16.16": 16, "Q24.8": 8,
+                                        "Q32.0": 0, "Q2.30": 30} {
+        q, err := ParseQFormat(s)
+        if err != nil || q.FracBits != bits || q.String() != s {
+            t.Errorf("%s: got %v (%v)", s, q, err)
+        }
+    }
+    for _, s := range []string{"16.16", "Q16", "Q16.15", "Q1.31", "Qa.b"} {
+        if _, err := ParseQFormat(s); err == nil {
+            t.Errorf("Expected %s to be rejected", s)
+        }
+    }
+}
+
+func TestQFormatSaturation(t *testing.T) {
+    q := QFormat{FracBits: 16}
+    big := q.FromFloat(30000)
+    tests := []struct {
+        name     string
+        got      Fixed
+        expected Fixed
+    }{
+        {"add", q.Add(big, big), q.Max()},
+        {"sub", q.Sub(q.Neg(big), big), q.Min()},
+        {"mul", q.Mul(big, q.FromFloat(-2)), q.Min()},
+        {"neg", q.Neg(q.Min()), q.Max()},
+        {"from", q.FromFloat(1e9), q.Max()},
+        {"from NaN", q.FromFloat(math.NaN()), 0},
+    }
+    for _, tc := range tests {
+        if tc.got != tc.expected {
+            t.Errorf("%s: expected %d, got %d", tc.name, tc.expected, tc.got)
+        }
+    }
+    if _, err := q.Div(big, 0); err == nil {
+        t.Error("Expected division by zero to fail")
+    }
+}
+
+func TestQFormatMul(t *testing.T) {
+    // Against the exact 64-bit product, floored and saturated
+    rng := rand.New(rand.NewSource(1))
+    for _, bits := range []int{0, 8, 16, 30} {
+        q := QFormat{FracBits: bits}
+        for i := 0; i < 100000; i++ {
+            a, b := Fixed(rng.Uint32()), Fixed(rng.Uint32())
+            if i%2 == 0 {
+                // Small operands, whose products mostly fit
+                a >>= 16
+            }
+            exact := int64(a) * int64(b) >> bits
+            exact = max(math.MinInt32, min(math.MaxInt32, exact))
+            if got := q.Mul(a, b); int64(got) != exact {
+                t.Fatalf("%v: %d * %d: expected %d, got %d", q, a, b,
+                    exact, got)
+            }
+        }
+    }
+}
+
+func TestQFormatArithmetic(t *testing.T) {
+    q := QFormat{FracBits: 16}
+    x := func(v float64) Fixed { return q.FromFloat(v) }
+    div := func(a, b float64) Fixed {
+        r, err := q.Div(x(a), x(b))
+        if err != nil {
+            t.Fatal(err)
+        }
+        return r
+    }
+    pow := func(a float64, n int) Fixed {
+        r, err := q.Pow(x(a), n)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return r
+    }
+    tests := []struct {
+        name     string
+        got      Fixed
+        expected float64
+    }{
+        {"mul", q.Mul(x(1.5), x(-2.25)), -3.375},
+        {"div", div(-7, 2), -3.5},
+        {"pow", pow(1.5, 3), 3.375},
+        {"pow negative", pow(2, -2), 0.25},
+        {"floor", q.Floor(x(-2.5)), -3},
+        {"ceil", q.Ceil(x(-2.5)), -2},
+        {"round", q.Round(x(-2.5)), -3},
+        {"round up", q.Round(x(2.5)), 3},
+        {"abs", q.Abs(x(-0.75)), 0.75},
+    }
+    for _, tc := range tests {
+        if got := q.Float(tc.got); got != tc.expected {
+            t.Errorf("%s: expected %g, got %g", tc.name, tc.expected, got)
+        }
+    }
+    if got := q.Int(x(-2.75)); got != -2 {
+        t.Errorf("Int(-2.75): expected -2, got %d", got)
+    }
+}
+
+// Property tests: every operation against a plain 64-bit reference, over
+// every pair of a grid of small values, powers of two and their
+// neighbours, the ends of the range and random values, in every mode.
+
+// propertyFormats are formats at the extremes of FracBits and common
+// ones, in every mode.
+func propertyFormats() []QFormat {
+    var formats []QFormat
+    for _, bits := range []int{0, 1, 8, 16, 30} {
+        for _, r := range []Rounding{RoundFloor, RoundNearest, RoundZero} {
+            for _, o := range []Overflow{OverflowSaturate, OverflowWrap} {
+                formats = append(formats, QFormat{bits, r, o})
+            }
+        }
+    }
+    return formats
+}
+
+func propertyValues() []Fixed {
+    var values []Fixed
+    for v := -64; v <= 64; v++ {
+        values = append(values, Fixed(v))
+    }
+    for k := 7; k < 31; k++ {
+        for d := int32(-1); d <= 1; d++ {
+            values = append(values, Fixed(1<<k+d), Fixed(-(1<<k)+d))
+        }
+    }
+    values = append(values, math.MaxInt32, math.MaxInt32-1, math.MinInt32,
+                    math.MinInt32+1)
+    rng := rand.New(rand.NewSource(2))
+    for i := 0; i < 100; i++ {
+        values = append(values, Fixed(rng.Uint32()))
+    }
+    return values
+}
+
+// refRound divides num by den exactly, rounded as q says.
+func refRound(q QFormat, num, den int64) int64 {
+    if den < 0 {
+        num, den = -num, -den
+    }
+    quotient, rem := num/den, num%den
+    if rem < 0 {
+        quotient, rem = quotient-1, rem+den
+    }
+    switch {
+    case q.Rounding == RoundNearest && 2*rem >= den:
+        quotient++
+    case q.Rounding == RoundZero && rem != 0 && num < 0:
+        quotient++
+    }
+    return quotient
+}
+
+// refNarrow returns v in 32 bits as q says.
+func refNarrow(q QFormat, v int64) Fixed {
+    switch {
+    case q.Overflow == OverflowWrap:
+        return Fixed(int32(v))
+    case v > math.MaxInt32:
+        return math.MaxInt32
+    case v < math.MinInt32:
+        return math.MinInt32
+    }
+    return Fixed(v)
+}
+
+func TestQFormatProperties(t *testing.T) {
+    values := propertyValues()
+    for _, q := range propertyFormats() {
+        one := int64(1) << q.FracBits
+        for _, a := range values {
+            for _, b := range values {
+                x, y := int64(a), int64(b)
+                check := func(op string, got Fixed, expected int64) {
+                    if got != refNarrow(q, expected) {
+                        t.Fatalf("%v %+v: %d %s %d: expected %d, got %d",
+                            q, q, a, op, b, refNarrow(q, expected), got)
+                    }
+                }
+                check("+", q.Add(a, b), x+y)
+                check("-", q.Sub(a, b), x-y)
+                check("*", q.Mul(a, b), refRound(q, x*y, one))
+                check("mulacc", q.Result(q.MulAcc(q.Wide(a), a, b)),
+                    refRound(q, x*one+x*y, one))
+                if b != 0 {
+                    got, err := q.Div(a, b)
+                    if err != nil {
+                        t.Fatal(err)
+                    }
+                    check("/", got, refRound(q, x*one, y))
+                }
+            }
+        }
+    }
+}
+
+func TestQFormatConversionProperties(t *testing.T) {
+    values := propertyValues()
+    for v := -1 << 16; v < 1<<16; v++ {
+        values = append(values, Fixed(v))
+    }
+    for _, q := range propertyFormats() {
+        coarse := QFormat{q.FracBits / 2, q.Rounding, q.Overflow}
+        for _, a := range values {
+            if got := q.FromFloat(q.Float(a)); got != a {
+                t.Fatalf("%v: %d round trips to %d", q, a, got)
+            }
+            // Narrowing rounds, widening back is exact unless it
+            // overflows
+            shift := int64(1) << (q.FracBits - coarse.FracBits)
+            c := coarse.Convert(a, q)
+            if expected := refRound(q, int64(a), shift); int64(c) != expected {
+                t.Fatalf("%v to %v: %d: expected %d, got %d", q, coarse, a,
+                    expected, c)
+            }
+            if got := q.Convert(c, coarse); got != refNarrow(q,
+                                                             int64(c)*shift) {
+                t.Fatalf("%v to %v: %d: got %d", coarse, q, c, got)
+            }
+        }
+        if got := q.Int(q.FromInt(-7)); q.FracBits < 28 && got != -7 {
+            t.Fatalf("%v: FromInt(-7) gives %d", q, got)
+        }
+    }
+}
+
+func TestQFormatSqrtProperties(t *testing.T) {
+    values := propertyValues()
+    for v := 0; v < 1<<16; v++ {
+        values = append(values, Fixed(v))
+    }
+    for _, q := range propertyFormats() {
+        for _, a := range values {
+            r, err := q.Sqrt(a)
+            if a < 0 {
+                if err == nil {
+                    t.Fatalf("%v: expected sqrt(%d) to fail", q, a)
+                }
+                continue
+            }
+            // The root of v = a * 2^n: floor, or nearest
+            v := uint64(a) << q.FracBits
+            root := uint64(r)
+            ok := root*root <= v && v < (root+1)*(root+1)
+            if q.Rounding == RoundNearest {
+                ok = 4*v+1 >= (2*root-1)*(2*root-1) &&
+                    4*v < (2*root+1)*(2*root+1)
+                if root == 0 {
+                    ok = 4*v < 1
+                }
+            }
+            if err != nil || !ok {
+                t.Fatalf("%v: sqrt(%d) gave %d (%v)", q, a, r, err)
+            }
+        }
+    }
+}
+
+func TestQFormatSinCosProperties(t *testing.T) {
+    // Every angle of +/-8 radians in Q16.16, within half a step to
+    // nearest or a step below for floor
+    for _, q := range []QFormat{{FracBits: 16, Rounding: RoundNearest},
+                                {FracBits: 16}} {
+        ulp := q.Float(1)
+        for a := Fixed(-8 << 16); a < 8<<16; a++ {
+            sin, cos := q.SinCos(a)
+            x := q.Float(a)
+            for _, pair := range [][2]float64{{q.Float(sin), math.Sin(x)},
+                                              {q.Float(cos), math.Cos(x)}} {
+                got, exact := pair[0], pair[1]
+                ok := math.Abs(got-exact) <= ulp/2+1e-12
+                if q.Rounding == RoundFloor {
+                    ok = got <= exact+1e-12 && got > exact-ulp-1e-12
+                }
+                if !ok {
+                    t.Fatalf("%v: sin/cos(%g): got %g, expected %g", q, x,
+                        got, exact)
+                }
+            }
+        }
+    }
+
+    // Random angles of the finest and coarsest formats, to nearest
+    rng := rand.New(rand.NewSource(3))
+    for _, bits := range []int{30, 24, 8, 0} {
+        q := QFormat{FracBits: bits, Rounding: RoundNearest}
+        ulp := q.Float(1)
+        for i := 0; i < 20000; i++ {
+            a := Fixed(rng.Uint32())
+            sin, cos := q.SinCos(a)
+            x := q.Float(a)
+            if math.Abs(q.Float(sin)-math.Sin(x)) > ulp/2+1e-6*ulp ||
+                math.Abs(q.Float(cos)-math.Cos(x)) > ulp/2+1e-6*ulp {
+                t.Fatalf("%v: sin/cos(%g): got %g, %g", q, x,
+                    q.Float(sin), q.Float(cos))
+            }
+        }
+    }
+}
+
+func TestAccSaturation(t *testing.T) {
+    q := QFormat{FracBits: 16}
+    acc := Acc(math.MaxInt64 - 10)
+    if got := q.MulAcc(acc, q.Max(), q.Max()); got != math.MaxInt64 {
+        t.Errorf("Expected the accumulator to saturate, got %d", got)
+    }
+    q.Overflow = OverflowWrap
+    if got := q.MulAcc(acc, 4, 4); got != math.MinInt64+5 {
+        t.Errorf("Expected the accumulator to wrap, got %d", got)
+    }
+    // A sum of products is rounded once: 8 half steps are 4 steps, where
+    // Mul rounds each half step up to a step
+    q = QFormat{FracBits: 8, Rounding: RoundNearest}
+    acc = 0
+    for i := 0; i < 8; i++ {
+        acc = q.MulAcc(acc, q.FromFloat(0.5), 1)
+    }
+    if got := q.Result(acc); got != 4 || q.Mul(q.FromFloat(0.5), 1) != 1 {
+        t.Errorf("Expected 8 half steps to round to 4 steps, got %d", got)
+    }
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+    "fmt"
+    "math"
+)
+
+// Process models of the Kalman filter.
+const (
+    // The value is a random walk
+    KalmanValue = "value"
+    // The value moves at a rate, and the rate is a random walk
+    KalmanRate  = "rate"
+)
+
+// KalmanConfig is a Kalman filter of a sensor sampled at its frequency_hz.
+// The process noise is how far the model's random walk wanders in a second,
+// one standard deviation: of the value in counts for the value model, of
+// the rate in counts per second for the rate model. With condition_noise,
+// a change of the filtered pressure and temperature since the previous
+// step (in their units) widens it, so that the filter follows the value
+// faster while the conditions move.
+type KalmanConfig struct {
+    // "value" (default) or "rate"
+    Model            string  `json:"model,omitempty"`
+    ProcessNoise     float64 `json:"process_noise"`
+    // Standard deviation of a measurement in counts; by default that of
+    // the sensor's noise_amplitude and noise_distribution
+    MeasurementNoise float64 `json:"measurement_noise,omitempty"`
+    // Relative increase of the process noise variance per unit change of
+    // the pressure and temperature over a step
+    ConditionNoise   float64 `json:"condition_noise,omitempty"`
+}
+
+// Validate checks the constraints of the filter of a sensor sampled at
+// rateHz whose noise has the standard deviation noiseSD.
+func (kc KalmanConfig) Validate(rateHz, noiseSD float64) error {
+    switch kc.Model {
+    case "", KalmanValue, KalmanRate:
+    default:
+        return fmt.Errorf("kalman model must be 'value' or 'rate', got %s",
+            kc.Model)
+    }
+    if !(kc.ProcessNoise > 0) || math.IsInf(kc.ProcessNoise, 1) {
+        return fmt.Errorf("kalman process_noise must be positive, got %g",
+            kc.ProcessNoise)
+    }
+    if !(kc.MeasurementNoise >= 0) || math.IsInf(kc.MeasurementNoise, 1) {
+        return fmt.Errorf("kalman measurement_noise must not be negative, "+
+            "got %g", kc.MeasurementNoise)
+    }
+    if !(kc.ConditionNoise >= 0) || math.IsInf(kc.ConditionNoise, 1) {
+        return fmt.Errorf("kalman condition_noise must not be negative, "+
+            "got %g", kc.ConditionNoise)
+    }
+    if kc.MeasurementNoise == 0 && !(noiseSD > 0) {
+        return fmt.Errorf("kalman measurement_noise is needed without the " +
+            "sensor's noise_amplitude")
+    }
+    if !(rateHz > 0) {
+        return fmt.Errorf("kalman filter needs the sensor's frequency_hz")
+    }
+    return nil
+}
+
+// noiseSD returns the standard deviation of a sensor's white noise.
+func (s SensorConfig) noiseSD() float64 {
+    if s.NoiseDistribution == NoiseNormal {
+        return s.NoiseAmplitude
+    }
+    // Uniform on [-amplitude, amplitude]
+    return s.NoiseAmplitude / math.Sqrt(3)
+}
+
+// KalmanState is the latest step of a Kalman filter, logged with each
+// record as a measure of confidence in the filtered value.
+type KalmanState struct {
+    // Measurement minus the predicted value
+    Innovation float64 `json:"innovation"`
+    // Variance of the filtered value, in counts^2
+    Variance   float64 `json:"variance"`
+}
+
+// KalmanFilter is a Kalman filter on a value, or a value and its rate, in
+// float64, rounded to the nearest count at the output.
+type KalmanFilter struct {
+    rate        bool
+    dt          float64
+    q           [2][2]float64 // process noise covariance of a step
+    r           float64       // measurement variance
+    x           [2]float64    // value and rate
+    p           [2][2]float64 // covariance of x
+    initialized bool
+    // Process noise per unit change of the conditions, and the pressure
+    // and temperature of the previous step and of the next one
+    conditionNoise float64
+    conditions     [2]float64
+    next           [2]float64
+    conditioned    bool
+    // Latest innovation and variance
+    KalmanState
+    // Variance of the latest innovation, as predicted
+    InnovationVariance float64
+    // Weight of the latest measurement in the value
+    Gain               float64
+}
+
+// NewKalmanFilter creates the filter of a sensor sampled at rateHz whose
+// noise has the standard deviation noiseSD.
+func NewKalmanFilter(config KalmanConfig,
+                     rateHz, noiseSD float64) (*KalmanFilter, error) {
+    if err := config.Validate(rateHz, noiseSD); err != nil {
+        return nil, err
+    }
+    sd := config.MeasurementNoise
+    if sd == 0 {
+        sd = noiseSD
+    }
+    dt := 1 / rateHz
+    q2 := config.ProcessNoise * config.ProcessNoise
+    f := &KalmanFilter{rate: config.Model == KalmanRate, dt: dt, r: sd * sd,
+                       conditionNoise: config.ConditionNoise}
+    if f.rate {
+        // A white-noise rate change integrated over the step
+        f.q = [2][2]float64{{q2 * dt * dt * dt / 3, q2 * dt * dt / 2},
+                            {q2 * dt * dt / 2, q2 * dt}}
+    } else {
+        f.q[0][0] = q2 * dt
+    }
+    return f, nil
+}
+
+// Covariance returns the covariance of the value and rate estimates; the
+// rate terms are zero for the value model.
+func (f *KalmanFilter) Covariance() [2][2]float64 {
+    return f.p
+}
+
+// Rate returns the estimated rate in counts per second, zero for the value
+// model.
+func (f *KalmanFilter) Rate() float64 {
+    return f.x[1]
+}
+
+// SetConditions gives the filtered pressure and temperature at the next
+// step; their change since the previous one scales its process noise. The
+// first conditions given are the starting point.
+func (f *KalmanFilter) SetConditions(pressure, temperature float64) {
+    f.next = [2]float64{pressure, temperature}
+    if !f.conditioned {
+        f.conditions, f.conditioned = f.next, true
+    }
+}
+
+// Initialize starts the filter on a steady value, known as well as a
+// measurement.
+func (f *KalmanFilter) Initialize(value int32) {
+    f.x = [2]float64{float64(value), 0}
+    f.p = [2][2]float64{{f.r, 0}, {0, 0}}
+    f.KalmanState = KalmanState{Variance: f.r}
+    f.InnovationVariance, f.Gain = 0, 0
+    f.initialized = true
+}
+
+// Process filters a sample; the first call initializes, returning it unchanged.
+func (f *KalmanFilter) Process(value int32) int32 {
+    if !f.initialized {
+        f.Initialize(value)
+        return value
+    }
+    // Predict: x = F x, P = F P F' + Q, with F = [1 dt; 0 1] for the rate
+    // model
+    p := f.p
+    if f.rate {
+        f.x[0] += f.dt * f.x[1]
+        p[0][0] += f.dt * (f.p[0][1] + f.p[1][0] + f.dt*f.p[1][1])
+        p[0][1] += f.dt * f.p[1][1]
+        p[1][0] += f.dt * f.p[1][1]
+    }
+    change := math.Abs(f.next[0]-f.conditions[0]) +
+        math.Abs(f.next[1]-f.conditions[1])
+    scale := 1 + f.conditionNoise*change
+    f.conditions = f.next
+    for i := range p {
+        for j := range p[i] {
+            p[i][j] += scale * f.q[i][j]
+        }
+    }
+
+    // Update with the measurement of the value
+    y := float64(value) - f.x[0]
+    s := p[0][0] + f.r
+    k0, k1 := p[0][0]/s, p[1][0]/s
+    f.x[0] += k0 * y
+    f.x[1] += k1 * y
+    f.p = [2][2]float64{
+        {(1 - k0) * p[0][0], (1 - k0) * p[0][1]},
+        {p[1][0] - k1*p[0][0], p[1][1] - k1*p[0][1]},
+    }
+    // Kept symmetric against rounding
+    f.p[0][1] = (f.p[0][1] + f.p[1][0]) / 2
+    f.p[1][0] = f.p[0][1]
+
+    f.KalmanState = KalmanState{Innovation: y, Variance: f.p[0][0]}
+    f.InnovationVariance, f.Gain = s, k0
+    return int32(math.Max(math.MinInt32, math.Min(math.MaxInt32,
+                                                  math.Round(f.x[0]))))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+    "math"
+    "math/rand"
+    "strings"
+    "testing"
+)
+
+func TestKalmanConfigValidate(t *testing.T) {
+    for _, kc := range []KalmanConfig{
+        {},
+        {ProcessNoise: -1, MeasurementNoise: 1},
+        {ProcessNoise: math.Inf(1), MeasurementNoise: 1},
+        {ProcessNoise: 1, MeasurementNoise: -1},
+        {ProcessNoise: 1, MeasurementNoise: 1, Model: "acceleration"},
+        {ProcessNoise: 1},
+    } {
+        if err := kc.Validate(100, 0); err == nil {
+            t.Errorf("Expected %+v to be rejected", kc)
+        }
+    }
+    kc := KalmanConfig{ProcessNoise: 1}
+    if err := kc.Validate(100, 2); err != nil {
+        t.Errorf("Noise from the sensor rejected: %v", err)
+    }
+    if err := kc.Validate(0, 2); err == nil {
+        t.Error("Expected a filter without a sample rate to be rejected")
+    }
+}
+
+func TestKalmanSteadyState(t *testing.T) {
+    // A random walk of q^2 dt per step measured with variance r settles
+    // on the predicted variance (q + sqrt(q^2 + 4 q r)) / 2
+    f, err := NewKalmanFilter(KalmanConfig{ProcessNoise: 20,
+                                           MeasurementNoise: 10}, 100, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Initialize(1000)
+    for i := 0; i < 1000; i++ {
+        f.Process(1000)
+    }
+    q, r := 400.0/100, 100.0
+    predicted := (q + math.Sqrt(q*q+4*q*r)) / 2
+    if math.Abs(f.InnovationVariance-(predicted+r)) > 1e-9 {
+        t.Errorf("Expected an innovation variance of %g, got %g",
+            predicted+r, f.InnovationVariance)
+    }
+    want := predicted * r / (predicted + r)
+    if math.Abs(f.Variance-want) > 1e-9 || f.Covariance()[0][0] != f.Variance {
+        t.Errorf("Expected a variance of %g, got %g", want, f.Variance)
+    }
+}
+
+func TestKalmanNoise(t *testing.T) {
+    // A steady 5000 with normal noise of 50 counts
+    sensor := SensorConfig{NoiseAmplitude: 50,
+                           NoiseDistribution: NoiseNormal}
+    f, err := NewKalmanFilter(KalmanConfig{ProcessNoise: 5}, 100,
+                              sensor.noiseSD())
+    if err != nil {
+        t.Fatal(err)
+    }
+    rng := rand.New(rand.NewSource(3))
+    var sumSquare, normalized float64
+    const n = 5000
+    f.Initialize(5000)
+    for i := 0; i < n; i++ {
+        y := f.Process(int32(5000 + math.Round(50*rng.NormFloat64())))
+        sumSquare += float64((y - 5000) * (y - 5000))
+        normalized += f.Innovation * f.Innovation / f.InnovationVariance
+    }
+    if rms := math.Sqrt(sumSquare / n); rms > 15 {
+        t.Errorf("Expected the noise of 50 to drop below 15, got %g", rms)
+    }
+    // The innovations are as large as the filter predicts
+    if nis := normalized / n; math.Abs(nis-1) > 0.1 {
+        t.Errorf("Expected a normalized innovation of 1, got %g", nis)
+    }
+
+    uniform := SensorConfig{NoiseAmplitude: 3}
+    if sd := uniform.noiseSD(); math.Abs(sd-math.Sqrt(3)) > 1e-12 {
+        t.Errorf("Expected a uniform sd of sqrt(3), got %g", sd)
+    }
+}
+
+func TestKalmanRate(t *testing.T) {
+    // A ramp of 100 counts/s: the rate model follows it, the value model
+    // lags behind
+    lag := func(model string) (float64, *KalmanFilter) {
+        f, _ := NewKalmanFilter(KalmanConfig{Model: model, ProcessNoise: 10,
+                                             MeasurementNoise: 20}, 10, 0)
+        f.Initialize(0)
+        var last int32
+        for i := 1; i <= 500; i++ {
+            last = f.Process(int32(10 * i))
+        }
+        return 5000 - float64(last), f
+    }
+    rateLag, f := lag(KalmanRate)
+    if math.Abs(rateLag) > 1 || math.Abs(f.Rate()-100) > 0.5 {
+        t.Errorf("Expected the rate model to follow the ramp, lag %g, "+
+            "rate %g", rateLag, f.Rate())
+    }
+    valueLag, f := lag(KalmanValue)
+    if valueLag < 10 || f.Rate() != 0 {
+        t.Errorf("Expected the value model to lag, got %g", valueLag)
+    }
+    p := f.Covariance()
+    if p[0][1] != 0 || p[1][1] != 0 {
+        t.Errorf("Expected no rate covariance in the value model, got %v", p)
+    }
+}
+
+func TestKalmanConditions(t *testing.T) {
+    // The same steady flow, while the pressure steps by 2 a sample in one
+    // run: its gain grows, as the flow is expected to move with P
+    config := validTestConfig()
+    flow := config.Sensors["flow"]
+    flow.NoiseAmplitude = 10
+    config.Sensors["flow"] = flow
+    config.Processing.Filters = []FilterConfig{
+        {Type: "kalman", Target: "flow",
+         Kalman: &KalmanConfig{ProcessNoise: 5, ConditionNoise: 2}},
+    }
+    if err := config.Validate(); err != nil {
+        t.Fatalf("Valid config rejected: %v", err)
+    }
+    gain := func(step int32) float64 {
+        p := newTestProcessor(t, config.Processing)
+        p.InitializeFilters(map[string]int32{"flow": 1000, "pressure": 100})
+        for i := int32(1); i <= 100; i++ {
+            p.Update("pressure", 100+step*i)
+            p.Update("flow", 1000)
+        }
+        return p.Filters["flow"][0].(*KalmanFilter).Gain
+    }
+    steady, moving := gain(0), gain(2)
+    if !(steady > 0) || !(moving > 2*steady) {
+        t.Errorf("Expected the gain to grow from %g when P moves, got %g",
+            steady, moving)
+    }
+
+    kc := KalmanConfig{ProcessNoise: 1, ConditionNoise: -1}
+    if err := kc.Validate(100, 2); err == nil {
+        t.Error("Expected a negative condition_noise to be rejected")
+    }
+}
+
+func TestValidateKalmanFilter(t *testing.T) {
+    config := validTestConfig()
+    flow := config.Sensors["flow"]
+    flow.NoiseAmplitude = 10
+    config.Sensors["flow"] = flow
+    config.Processing.Filters = []FilterConfig{
+        {Type: "kalman", Target: "flow",
+         Kalman: &KalmanConfig{ProcessNoise: 5, Model: KalmanRate}},
+    }
+    if err := config.Validate(); err != nil {
+        t.Fatalf("Valid config rejected: %v", err)
+    }
+    p := newTestProcessor(t, config.Processing)
+    p.InitializeFilters(map[string]int32{"flow": 1000})
+    p.Update("flow", 1030)
+    state, ok := p.KalmanStates()["flow"]
+    if !ok || state.Innovation != 30 || !(state.Variance > 0) {
+        t.Errorf("Expected an innovation of 30, got %+v", state)
+    }
+    if c := NewOutputColumns(&config); len(c.Kalman) != 1 ||
+        c.Kalman[0] != "flow" {
+        t.Errorf("Expected Kalman columns for flow, got %v", c.Kalman)
+    }
+
+    // dp has no noise_amplitude
+    for _, fc := range []FilterConfig{
+        {Type: "kalman", Target: "flow"},
+        {Type: "kalman", Target: "dp", Kalman: &KalmanConfig{ProcessNoise: 5}},
+    } {
+        config := validTestConfig()
+        config.Processing.Filters = []FilterConfig{fc}
+        err := config.Validate()
+        if err == nil || !strings.HasPrefix(err.Error(),
+                                            "processing.filters[0]") {
+            t.Errorf("%+v: expected a filters[0] error, got %v", fc, err)
+        }
+    }
+}
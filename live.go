@@ -0,0 +1,346 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "strings"
+    "sync"
+)
+
+// PrevVariable is the sensor equation variable holding the sensor's own
+// previous noise-free value, e.g. "prev + 0.1 * (flow / 1000 - prev)" for
+// a temperature that lags the flow.
+const PrevVariable = "prev"
+
+// liveHistory is the number of past instants kept per sensor. The sensor
+// goroutines run at most a sample or so apart, so a short window is enough.
+const liveHistory = 1024
+
+// ReferenceParameters are the reference values every equation may read.
+var ReferenceParameters = []string{"RefF", "RefP", "RefT"}
+
+// equationScope returns what a sensor equation may refer to: the variables
+// t, prev, the reference parameters and the sensors, and the tables.
+func (sc SensorsConfig) equationScope(
+    tables map[string]*Table) equationScope {
+    vars := append([]string{"t", PrevVariable}, ReferenceParameters...)
+    return equationScope{
+        variables: append(vars, sc.Names()...),
+        tables:    tables,
+    }
+}
+
+// Dependencies returns, for every equation sensor, the other sensors its
+// equation reads. It fails if an equation doesn't parse, reads a replayed
+// sensor (which has no noise-free value) or an unknown variable, or if the
+// equations form a cycle.
+func (sc SensorsConfig) Dependencies(
+    tables map[string]*Table) (map[string][]string, error) {
+    return sc.dependencies(nil, tables)
+}
+
+// dependencies also counts the extra equations each sensor is switched to
+// during the run (see Scenario), so that no swap can close a cycle.
+func (sc SensorsConfig) dependencies(
+    extra map[string][]string,
+    tables map[string]*Table) (map[string][]string, error) {
+    deps := map[string][]string{}
+    for _, name := range sc.Names() {
+        if sc[name].Replay != nil {
+            continue
+        }
+        seen := map[string]bool{}
+        equations := append([]string{sc[name].Equation}, extra[name]...)
+        for _, equation := range equations {
+            compiled, err := compileEquation(equation,
+                                             sc.equationScope(tables))
+            if err != nil {
+                return nil, fmt.Errorf("sensors.%s.equation: %w", name, err)
+            }
+            reads, err := sc.reads(name, compiled)
+            if err != nil {
+                return nil, err
+            }
+            for _, d := range reads {
+                if !seen[d] {
+                    seen[d] = true
+                    deps[name] = append(deps[name], d)
+                }
+            }
+        }
+    }
+
+    // Depth-first search; a sensor met again while still on the path
+    // closes a cycle.
+    const (
+        unvisited = iota
+        onPath
+        done
+    )
+    state := map[string]int{}
+    var path []string
+    var visit func(name string) error
+    visit = func(name string) error {
+        switch state[name] {
+        case onPath:
+            for i, p := range path {
+                if p == name {
+                    cycle := append(path[i:], name)
+                    hint := ""
+                    if len(cycle) == 2 {
+                        hint = " (use prev for the previous value)"
+                    }
+                    return fmt.Errorf("sensor equations form a cycle: %s%s",
+                        strings.Join(cycle, " -> "), hint)
+                }
+            }
+        case done:
+            return nil
+        }
+        state[name] = onPath
+        path = append(path, name)
+        for _, d := range deps[name] {
+            if err := visit(d); err != nil {
+                return err
+            }
+        }
+        path = path[:len(path)-1]
+        state[name] = done
+        return nil
+    }
+    for _, name := range sc.Names() {
+        if err := visit(name); err != nil {
+            return nil, err
+        }
+    }
+    return deps, nil
+}
+
+// reads returns the sensors an equation of sensor name reads.
+func (sc SensorsConfig) reads(name string,
+                              equation *Equation) ([]string, error) {
+    var reads []string
+    for _, v := range equation.Vars() {
+        other, ok := sc[v]
+        if !ok {
+            continue
+        }
+        if other.Replay != nil {
+            return nil, fmt.Errorf("sensors.%s.equation: reads %q, "+
+                "which is replayed and has no noise-free value", name, v)
+        }
+        reads = append(reads, v)
+    }
+    return reads, nil
+}
+
+// LiveValues computes the noise-free ("true") values of the equation
+// sensors of a run, so that one sensor's equation can read another's.
+//
+// The n-th sample of a sensor is taken at the actual instant t of its
+// Schedule. Its value there is its equation evaluated with t, the reference
+// parameters, prev (its value at the previous sample, or initial_value
+// before the first) and, for every sensor it reads, that sensor's value at
+// its latest sample not after t. Values are computed on demand, in instant order, and
+// memoized, so they depend only on the configuration: the result is the
+// same whichever sensor goroutine asks first, and a sensor read by others
+// doesn't evaluate its equation twice.
+//
+// With a Scenario, the reference parameters and the equation in force are
+// also those of the instant being computed.
+type LiveValues struct {
+    mu       sync.Mutex
+    sensors  map[string]*liveSensor
+    params   map[string]interface{}
+    scenario *Scenario
+}
+
+type liveSensor struct {
+    // Equations in force from their start time on, in time order
+    equations  []liveEquation
+    schedule   *Schedule
+    // Seed of the sensor, for the noise() calls of its equations
+    seed       int64
+    initial    float64
+    // values[i] is the value at instant base+i
+    base       int64
+    values     []float64
+}
+
+type liveEquation struct {
+    fromS    float64
+    equation *Equation
+    // Variable slots, reused for every evaluation (guarded by
+    // LiveValues.mu)
+    slots    []float64
+}
+
+// NewLiveValues prepares the equations of all non-replayed sensors.
+// tables are the lookup tables of the config (see Config.Validate).
+// params are the reference parameters (RefF, RefP, RefT) shared by all;
+// scenario (may be nil) moves them and swaps equations during the run.
+// schedules are the sensors' sampling schedules, shared with StartSensor;
+// a sensor without one samples plainly at its frequency_hz. The noise()
+// calls of sensor i draw from seed+i, its seed (see StartSource).
+func NewLiveValues(sensors SensorsConfig,
+                   tables map[string]*Table,
+                   params map[string]interface{},
+                   scenario *Scenario,
+                   schedules map[string]*Schedule,
+                   seed int64) (*LiveValues, error) {
+    _, err := sensors.dependencies(scenario.equations(), tables)
+    if err != nil {
+        return nil, err
+    }
+    lv := &LiveValues{
+        sensors:  map[string]*liveSensor{},
+        params:   params,
+        scenario: scenario,
+    }
+    for i, name := range sensors.Names() {
+        config := sensors[name]
+        if config.Replay != nil {
+            continue
+        }
+        s := &liveSensor{
+            schedule: schedules[name],
+            seed:     seed + int64(i),
+            base:     1,
+        }
+        if s.schedule == nil {
+            s.schedule = NewSchedule(config.FrequencyHz, nil, 0)
+        }
+        if config.InitialValue != nil {
+            s.initial = float64(*config.InitialValue)
+        }
+        scope := sensors.equationScope(tables)
+        err := s.add(sensors, scope, name, 0, config.Equation)
+        if err != nil {
+            return nil, err
+        }
+        if scenario != nil {
+            for _, ev := range scenario.Events {
+                if ev.Action != ScenarioEquation || ev.Sensor != name {
+                    continue
+                }
+                err := s.add(sensors, scope, name, ev.AtS, ev.Equation)
+                if err != nil {
+                    return nil, err
+                }
+            }
+        }
+        lv.sensors[name] = s
+    }
+    return lv, nil
+}
+
+// add appends an equation taking over at fromS.
+func (s *liveSensor) add(sensors SensorsConfig,
+                         scope equationScope,
+                         name string,
+                         fromS float64,
+                         equation string) error {
+    compiled, err := compileEquation(equation, scope)
+    if err != nil {
+        return fmt.Errorf("sensors.%s.equation: %w", name, err)
+    }
+    if _, err := sensors.reads(name, compiled); err != nil {
+        return err
+    }
+    // An equation swapped in draws its own noise
+    compiled.SetSeed(mixSeed(s.seed, int64(len(s.equations))))
+    s.equations = append(s.equations, liveEquation{
+        fromS:    fromS,
+        equation: compiled,
+        slots:    make([]float64, len(compiled.Vars())),
+    })
+    return nil
+}
+
+// Has reports whether the sensor's value is computed here.
+func (lv *LiveValues) Has(name string) bool {
+    if lv == nil {
+        return false
+    }
+    _, ok := lv.sensors[name]
+    return ok
+}
+
+// Value returns the noise-free value of sample n of a sensor.
+func (lv *LiveValues) Value(name string, n int64) (float64, error) {
+    lv.mu.Lock()
+    defer lv.mu.Unlock()
+    s, ok := lv.sensors[name]
+    if !ok {
+        return 0, fmt.Errorf("sensor %q has no equation", name)
+    }
+    return lv.at(name, s, n)
+}
+
+// at returns the value of a sensor at instant n, computing the instants up
+// to n first. Called with lv.mu held.
+func (lv *LiveValues) at(name string, s *liveSensor, n int64) (float64, error) {
+    if n < 1 {
+        return s.initial, nil
+    }
+    if n < s.base {
+        return 0, fmt.Errorf("instant %d of %s is no longer kept", n, name)
+    }
+    for s.base+int64(len(s.values)) <= n {
+        v, err := lv.eval(s, s.base+int64(len(s.values)))
+        if err != nil {
+            // Kept as NaN, so the instants after it can still be computed
+            s.values = append(s.values, math.NaN())
+            return 0, err
+        }
+        s.values = append(s.values, v)
+        if len(s.values) > 2*liveHistory {
+            drop := len(s.values) - liveHistory
+            s.values = append(s.values[:0], s.values[drop:]...)
+            s.base += int64(drop)
+        }
+    }
+    return s.values[n-s.base], nil
+}
+
+// eval evaluates the equation of s at instant k, all earlier instants
+// being known. Called with lv.mu held.
+func (lv *LiveValues) eval(s *liveSensor, k int64) (float64, error) {
+    t := s.schedule.Actual(k)
+    seconds := t.Seconds()
+    eq := s.equations[0]
+    for _, e := range s.equations[1:] {
+        if e.fromS <= seconds {
+            eq = e
+        }
+    }
+    prev := s.initial
+    if k > s.base {
+        prev = s.values[k-1-s.base]
+    }
+
+    for i, name := range eq.equation.Vars() {
+        switch name {
+        case "t":
+            eq.slots[i] = seconds
+            continue
+        case PrevVariable:
+            eq.slots[i] = prev
+            continue
+        }
+        if ds, ok := lv.sensors[name]; ok {
+            v, err := lv.at(name, ds, ds.schedule.Index(t))
+            if err != nil {
+                return 0, err
+            }
+            eq.slots[i] = v
+            continue
+        }
+        v, ok := toFloat(lv.params[name])
+        if !ok {
+            return 0, fmt.Errorf("no value for variable %q", name)
+        }
+        eq.slots[i] = lv.scenario.Param(name, v, seconds)
+    }
+    return eq.equation.Eval(eq.slots)
+}
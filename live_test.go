@@ -0,0 +1,90 @@
+package main
+
+import (
+    "math"
+    "strings"
+    "testing"
+)
+
+func TestLiveValues(t *testing.T) {
+    five := int32(5)
+    sensors := SensorsConfig{
+        "pressure": {FrequencyHz: 10, Equation: "RefP + 10 * t"},
+        // Reads pressure at its latest 10 Hz instant
+        "flow": {FrequencyHz: 100, Equation: "2 * pressure"},
+        // Counts its own samples from the initial value
+        "temperature": {
+            FrequencyHz:  10,
+            Equation:     "prev + 1",
+            InitialValue: &five,
+        },
+    }
+    lv, err := NewLiveValues(sensors,
+                             nil,
+                             map[string]interface{}{"RefP": 100.0},
+                             nil,
+                             nil,
+                             0)
+    if err != nil {
+        t.Fatalf("NewLiveValues failed: %v", err)
+    }
+
+    tests := []struct {
+        name     string
+        n        int64
+        expected float64
+    }{
+        // Before pressure's first sample it reads its initial value (0)
+        {"flow", 5, 0},
+        {"flow", 10, 2 * 101},
+        {"flow", 19, 2 * 101},
+        {"flow", 20, 2 * 102},
+        {"pressure", 3, 103},
+        {"temperature", 1, 6},
+        {"temperature", 5, 10},
+        // Asking again (or from another goroutine) gives the same value
+        {"temperature", 1, 6},
+    }
+    for _, tc := range tests {
+        v, err := lv.Value(tc.name, tc.n)
+        if err != nil {
+            t.Fatalf("%s sample %d: %v", tc.name, tc.n, err)
+        }
+        if math.Abs(v-tc.expected) > 1e-9 {
+            t.Errorf("%s sample %d: expected %g, got %g",
+                     tc.name, tc.n, tc.expected, v)
+        }
+    }
+}
+
+func TestDependencyCycles(t *testing.T) {
+    tests := []struct {
+        sensors SensorsConfig
+        cycle   string
+    }{
+        {SensorsConfig{
+            "flow":     {FrequencyHz: 10, Equation: "pressure"},
+            "pressure": {FrequencyHz: 10, Equation: "temperature + 1"},
+            "temperature": {FrequencyHz: 10, Equation: "flow / 2"},
+        }, "flow -> pressure -> temperature -> flow"},
+        {SensorsConfig{
+            "flow": {FrequencyHz: 10, Equation: "flow + 1"},
+        }, "flow -> flow"},
+        {SensorsConfig{
+            "flow":     {FrequencyHz: 10, Equation: "pressure + prev"},
+            "pressure": {FrequencyHz: 10, Equation: "RefP"},
+        }, ""},
+    }
+    for _, tc := range tests {
+        _, err := tc.sensors.Dependencies(nil)
+        if tc.cycle == "" {
+            if err != nil {
+                t.Errorf("Unexpected error: %v", err)
+            }
+            continue
+        }
+        if err == nil || !strings.Contains(err.Error(), tc.cycle) {
+            t.Errorf("Expected cycle %q, got %v", tc.cycle, err)
+        }
+    }
+}
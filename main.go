@@ -1,11 +1,16 @@
 package main
 
 import (
+    "context"
     "fmt"
     "log"
     "math/rand"
     "os"
+    "os/signal"
+    "sort"
     "strconv"
+    "strings"
+    "syscall"
     "time"
 
     flag "github.com/spf13/pflag"
@@ -85,6 +90,25 @@ func main() {
         false,
         "Use time-based random seed (default seed 0).")
 
+    // Clock mode flags - Default from Config
+    var clockMode string
+    flag.StringVar(&clockMode,
+        "clock",
+        config.Simulation.ClockMode,
+        "Clock mode: real, accelerated or discrete.")
+
+    var speedFactor float64
+    flag.Float64Var(&speedFactor,
+        "speed",
+        config.Simulation.SpeedFactor,
+        "Speed-up factor for the accelerated clock (e.g. 50).")
+
+    var scenarioPath string
+    flag.StringVar(&scenarioPath,
+        "scenario",
+        config.Simulation.Scenario,
+        "Scenario file of timestamped events to play during the run.")
+
     flag.Parse()
 
     fmt.Println("Project initialized. Starting FlowMeter Simulation...")
@@ -112,23 +136,60 @@ func main() {
 
     // Apply Flow Override by rewriting the equation IF CHANGED from default
     if flag.Lookup("flow-override-value").Changed {
-        config.Sensors.Flow.Equation = strconv.Itoa(flowVal)
-        fmt.Printf("Flow equation overridden to constant: %s\n",
-                   config.Sensors.Flow.Equation)
+        overrideSensor(config.Sensors, "flow", flowVal)
     }
 
     // Apply Temperature Override by rewriting the equation
     if flag.Lookup("temp-override-value").Changed {
-        config.Sensors.Temperature.Equation = strconv.Itoa(tempVal)
-        fmt.Printf("Temperature equation overridden to constant: %s\n",
-                   config.Sensors.Temperature.Equation)
+        overrideSensor(config.Sensors, "temperature", tempVal)
     }
 
     // Apply Pressure Override by rewriting the equation
     if flag.Lookup("pressure-override-value").Changed {
-        config.Sensors.Pressure.Equation = strconv.Itoa(pressureVal)
-        fmt.Printf("Pressure equation overridden to constant: %s\n",
-                   config.Sensors.Pressure.Equation)
+        overrideSensor(config.Sensors, "pressure", pressureVal)
+    }
+
+    // Apply clock overrides; "--speed" alone implies the accelerated clock
+    if flag.Lookup("clock").Changed {
+        config.Simulation.ClockMode = clockMode
+    }
+    if flag.Lookup("speed").Changed {
+        config.Simulation.SpeedFactor = speedFactor
+        if !flag.Lookup("clock").Changed {
+            config.Simulation.ClockMode = ClockAccelerated
+        }
+    }
+    if err := config.Validate(); err != nil {
+        log.Fatalf("Invalid settings: %v", err)
+    }
+
+    // Load the scenario; its fault events become part of the sensors'
+    // fault schedules before any sensor starts
+    var scenario *Scenario
+    if scenarioPath != "" {
+        scenario, err = LoadScenario(scenarioPath)
+        if err != nil {
+            log.Fatalf("Failed to load scenario: %v", err)
+        }
+        if err := scenario.Validate(config); err != nil {
+            log.Fatalf("Invalid scenario %s: %v", scenarioPath, err)
+        }
+        scenario.ApplyFaults(config.Sensors)
+        fmt.Printf("Scenario loaded from %s (%d events).\n",
+                   scenarioPath, len(scenario.Events))
+    }
+    clock, err := NewClock(config.Simulation.ClockMode,
+                           config.Simulation.SpeedFactor)
+    if err != nil {
+        log.Fatalf("Failed to initialize clock: %v", err)
+    }
+    if config.Simulation.ClockMode == ClockAccelerated {
+        fmt.Printf("Using accelerated clock (%gx).\n",
+                   config.Simulation.SpeedFactor)
+    } else if config.Simulation.ClockMode != "" {
+        fmt.Printf("Using %s clock.\n", config.Simulation.ClockMode)
+    } else {
+        fmt.Println("Using real clock.")
     }
 
     // Determine Filter Type
@@ -143,32 +204,92 @@ func main() {
         fmt.Printf("Using configured filter type: %s\n", filterType)
     }
 
-    // Apply filter type to all filters
-    for i := range config.Processing.Filters {
-        config.Processing.Filters[i].Type = filterType
+    // Apply filter type to all low-pass and median filters; the others
+    // keep their type
+    for i, fc := range config.Processing.Filters {
+        switch fc.Type {
+        case "", "low_pass", "median":
+            config.Processing.Filters[i].Type = filterType
+        }
     }
 
     // Initialize Processor
-    processor := NewProcessor(config.Processing)
-    // Pre-populate filters with defaults/overrides
-    processor.InitializeFilters(int32(flowVal),
-                                int32(pressureVal),
-                                int32(tempVal))
-    
-    // Initialize with defaults (which now come from flags/config)
-    processor.LatestTemperature = int32(tempVal)
-    processor.LatestPressure = int32(pressureVal)
+    processor, err := NewProcessor(config.Processing)
+    if err != nil {
+        log.Fatalf("Failed to set up processing: %v", err)
+    }
+    // Pre-populate filters with defaults/overrides; other sensors start
+    // from their configured initial_value, if any
+    initial := map[string]int32{}
+    for _, name := range config.Sensors.Names() {
+        if v := config.Sensors[name].InitialValue; v != nil {
+            initial[name] = *v
+        }
+    }
+    initial["flow"] = int32(flowVal)
+    initial["pressure"] = int32(pressureVal)
+    initial["temperature"] = int32(tempVal)
+    for name := range initial {
+        _, sensor := config.Sensors[name]
+        _, redundant := config.Processing.Redundancy[name]
+        if !sensor && !redundant {
+            delete(initial, name)
+        }
+    }
+    processor.InitializeFilters(initial)
+    // The delay the filters add to each sensor
+    targets := make([]string, 0, len(processor.Filters))
+    for target := range processor.Filters {
+        targets = append(targets, target)
+    }
+    sort.Strings(targets)
+    for _, target := range targets {
+        for _, f := range processor.Filters[target] {
+            d, ok := f.(Delayer)
+            if !ok {
+                continue
+            }
+            name := "Filter"
+            switch f := f.(type) {
+            case *FIRFilter:
+                taps, q := f.Taps()
+                name = fmt.Sprintf("%d-tap %s FIR filter", len(taps), q)
+            case *BiquadFilter:
+                name = fmt.Sprintf("%d-section biquad filter", f.Sections())
+            }
+            fmt.Printf("%s on %s: group delay %.4g samples", name, target,
+                       d.GroupDelay())
+            if rate := config.targetSensor(target).FrequencyHz; rate > 0 {
+                fmt.Printf(" (%.4g s)", d.GroupDelay()/rate)
+            }
+            fmt.Println()
+        }
+    }
+    processor.SetSensors(config.Sensors)
+    // Salted so the flow equation's noise isn't a copy of a sensor's
+    processor.SetSeed(mixSeed(baseSeed, -2))
     fmt.Printf("Initial state: Temperature=%d, Pressure=%d, FlowRef=%d\n",
-               processor.LatestTemperature,
-               processor.LatestPressure,
+               processor.Latest["temperature"],
+               processor.Latest["pressure"],
                flowVal)
 
-    // Initialize Output Handler
-    outputHandler, err := GetOutputHandler(config.Output)
+    // Initialize Output Handler. It is closed explicitly at the end of the
+    // run (not deferred) because main leaves through os.Exit on errors and
+    // signals, which would skip deferred calls.
+    outputHandler, err := GetOutputHandler(config.Output,
+                                          NewOutputColumns(config))
     if err != nil {
         log.Fatalf("Failed to initialize output handler: %v", err)
     }
-    defer outputHandler.Close()
+
+    // The context owns the lifetime of every sensor goroutine. SIGINT and
+    // SIGTERM are delivered on a channel rather than killing the process,
+    // so the run can stop the sensors and flush the output first.
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+    defer signal.Stop(signals)
 
     // Start independent sensor simulations using config
     refParams := map[string]interface{}{
@@ -176,24 +297,95 @@ func main() {
         "RefP": float64(config.Simulation.DefaultPressure),
         "RefT": float64(config.Simulation.DefaultTemperature),
     }
-    flowCh := StartSensor(FlowSensor,
-                          config.Sensors.Flow,
-                          refParams,
-                          baseSeed)
-    pressureCh := StartSensor(PressureSensor,
-                              config.Sensors.Pressure,
-                              refParams,
-                              baseSeed+1)
-    tempCh := StartSensor(TemperatureSensor,
-                          config.Sensors.Temperature,
-                          refParams,
-                          baseSeed+2)
-
-    // Consume data
-    runSecs := time.Duration(config.Simulation.DefaultSamples /
-        config.Sensors.Flow.FrequencyHz)
-    timeout := time.After(runSecs*time.Second + 500*time.Millisecond)
-    startTime := time.Now()
+    env := &SensorEnv{
+        Params:    refParams,
+        Schedules: map[string]*Schedule{},
+    }
+    // Schedules are built once and shared, so the sensor equations reading
+    // a sensor see the same jittered instants as the sensor itself
+    for i, name := range config.Sensors.Names() {
+        sc := config.Sensors[name]
+        if sc.Replay == nil {
+            env.Schedules[name] = NewSchedule(sc.FrequencyHz,
+                                              sc.Schedule,
+                                              baseSeed+int64(i))
+        }
+    }
+    env.Live, err = NewLiveValues(config.Sensors,
+                                  config.tables,
+                                  refParams,
+                                  scenario,
+                                  env.Schedules,
+                                  baseSeed)
+    if err != nil {
+        log.Fatalf("Failed to set up sensor equations: %v", err)
+    }
+    if config.NoiseCorrelation != nil {
+        // Salted so the joint noise isn't a copy of any sensor's stream
+        env.Noise, err = NewCorrelatedNoise(*config.NoiseCorrelation,
+                                            config.Sensors,
+                                            mixSeed(baseSeed, -1))
+        if err != nil {
+            log.Fatalf("Failed to set up correlated noise: %v", err)
+        }
+    }
+    startTime := clock.Now()
+    primary := processor.Primary
+    var channels []<-chan SensorData
+    var primaryChs []<-chan SensorData
+    for i, name := range config.Sensors.Names() {
+        ch, err := StartSource(ctx,
+                               clock,
+                               SensorType(name),
+                               config.Sensors[name],
+                               env,
+                               baseSeed+int64(i))
+        if err != nil {
+            log.Fatalf("Failed to start %s sensor: %v", name, err)
+        }
+        if processor.Logical(name) == primary {
+            primaryChs = append(primaryChs, ch)
+        } else {
+            channels = append(channels, ch)
+        }
+    }
+
+    // Fan the sensors into a single stream. The primary sensor (or its
+    // redundant channels) is listed last so that, in discrete mode, a flow
+    // sample sharing a timestamp with another sensor already sees its
+    // updated value.
+    // The merge has a context of its own: a signal cancels the sensors
+    // only, and the merge keeps forwarding what they already queued until
+    // their channels close.
+    mergeCtx, stopMerge := context.WithCancel(context.Background())
+    defer stopMerge()
+    events := MergeSensors(mergeCtx,
+                           clock,
+                           append(channels, primaryChs...)...)
+
+    // Consume data. A replayed flow sensor has no nominal rate, so its
+    // run is bounded by the sample count and the end of the capture only.
+    // A redundant flow sensor runs at the pace of its channels.
+    var runTime time.Duration
+    var timeout <-chan time.Time
+    pace := primary
+    if rc, ok := config.Processing.Redundancy[primary]; ok {
+        pace = rc.Channels[len(rc.Channels)-1]
+    }
+    if rate := config.Sensors[pace].FrequencyHz; rate > 0 {
+        schedule := env.schedule(SensorType(pace),
+                                 config.Sensors[pace],
+                                 0)
+        // Leave room for the jitter of the last sample of slow sensors
+        margin := 500 * time.Millisecond
+        half := time.Duration(float64(time.Second) / rate / 2)
+        if half > margin {
+            margin = half
+        }
+        runTime = schedule.Nominal(int64(config.Simulation.DefaultSamples)) +
+            margin
+        timeout = clock.After(runTime)
+    }
 
     fmt.Println("Listening for sensor data...")
     var sampleCount int64
@@ -204,38 +396,124 @@ func main() {
     refPressure := config.Simulation.DefaultPressure
     refTemperature := config.Simulation.DefaultTemperature
 
+    // Scenario events for the processing side, applied as the (ordered)
+    // event stream passes their time
+    pending := scenario.Processing()
+
+    // FIFO overflow accounting: totals per sensor for the end-of-run
+    // report, and the losses since the last record, to tag the next one
+    overruns := map[string]int64{}
+    dropped := map[string]int64{}
+    var recordOverruns, recordDropped int64
+
+    status := 0
+    interrupted := false
+loop:
     for {
         select {
-        case data := <-pressureCh:
-            processor.UpdatePressure(data.Value)
+        case sig := <-signals:
+            fmt.Printf("Received %v, stopping sensors...\n", sig)
+            // Conventional shell status for a fatal signal: 128 + signo
+            status = 128 + int(sig.(syscall.Signal))
+            interrupted = true
+            // Stop the sensors but keep consuming: samples already in
+            // flight are still processed until the sensor streams close.
+            cancel()
+            signals = nil
+
+        case data, ok := <-events:
+            if !ok {
+                if interrupted {
+                    fmt.Println("Simulation interrupted.")
+                } else {
+                    fmt.Println("Simulation finished (end of sensor data).")
+                }
+                break loop
+            }
+            // Check the simulated deadline on the event itself: in
+            // discrete mode the timeout and a late event can both be
+            // ready, and select would pick one at random.
+            if timeout != nil && data.Timestamp.Sub(startTime) > runTime {
+                fmt.Println("Simulation finished (timeout).")
+                break loop
+            }
+            elapsed := data.Timestamp.Sub(startTime).Seconds()
+            for len(pending) > 0 && pending[0].AtS <= elapsed {
+                ev := pending[0]
+                pending = pending[1:]
+                if ev.Action == ScenarioEnd {
+                    fmt.Println("Simulation finished (scenario end).")
+                    break loop
+                }
+                if processor.SetAlpha(ev.Sensor, ev.Alpha) == 0 {
+                    log.Printf("Scenario: %s has no low_pass filter",
+                               ev.Sensor)
+                }
+            }
 
-        case data := <-tempCh:
-            processor.UpdateTemperature(data.Value)
+            if data.EndOfStream {
+                if processor.Logical(string(data.Type)) == primary {
+                    fmt.Println("Simulation finished (end of flow data).")
+                    break loop
+                }
+                continue
+            }
+            // A sample the sensor never delivered only moves time along
+            if data.Missing {
+                continue
+            }
+
+            overruns[string(data.Type)] += data.Overruns
+            dropped[string(data.Type)] += data.Dropped
+            recordOverruns += data.Overruns
+            recordDropped += data.Dropped
+
+            // Pulse sensors turn into a rate here, and redundant channels
+            // into their logical sensor's vote
+            name, value, ok := processor.Vote(data, processor.Measure(data))
+            if !ok {
+                continue
+            }
+            if name != primary {
+                processor.Update(name, value)
+                continue
+            }
 
-        case data := <-flowCh:
             sampleCount++
-            elapsed := data.Timestamp.Sub(startTime).Seconds()
+
+            // Reference values as the scenario has moved them by now
+            refF := scenario.Ref("RefF", refFlow, elapsed)
+            refP := scenario.Ref("RefP", refPressure, elapsed)
+            refT := scenario.Ref("RefT", refTemperature, elapsed)
 
             // Calculate Final Flow using updated signature
             calculated, err := processor.CalculateFlow(config.Processing.FlowEquation,
-                                                       data.Value,
+                                                       value,
                                                        elapsed,
-                                                       refFlow,
-                                                       refPressure,
-                                                       refTemperature)
+                                                       refF,
+                                                       refP,
+                                                       refT)
             if err != nil {
                 log.Printf("Error calculating flow: %v", err)
                 continue
             }
 
             // Prepare Output
-        outData := OutputData{
+            outData := OutputData{
                 SampleNumber:   sampleCount,
-                RawFlow:        data.Value,
-                Pressure:       processor.LatestPressure,
-                Temperature:    processor.LatestTemperature,
+                RawFlow:        value,
+                Pressure:       processor.Latest["pressure"],
+                Temperature:    processor.Latest["temperature"],
                 CalculatedFlow: calculated,
+                FlowValue:      processor.Flow,
+                Overruns:       recordOverruns,
+                Dropped:        recordDropped,
+                Values:         processor.Values(),
+                Pulses:         processor.PulseRates(),
+                Votes:          processor.VoteResults(),
+                Kalman:         processor.KalmanStates(),
             }
+            recordOverruns, recordDropped = 0, 0
 
             if err := outputHandler.Write(outData); err != nil {
                 log.Printf("Error writing output: %v", err)
@@ -243,13 +521,55 @@ func main() {
 
             if sampleCount >= maxSamples {
                 fmt.Println("Simulation finished (sample limit reached).")
-                return
+                break loop
             }
 
         case <-timeout:
             fmt.Println("Simulation finished (timeout).")
-            return
+            break loop
+        }
+    }
+
+    // Shut down: stop the sensors, then drain the merged stream until every
+    // sensor goroutine has exited and closed its channel.
+    cancel()
+    for range events {
+    }
+
+    for _, name := range config.Sensors.Names() {
+        if fc := config.Sensors[name].FIFO; fc != nil {
+            fmt.Printf("FIFO %s (depth %d): %d overruns, %d dropped.\n",
+                       name, fc.Depth, overruns[name], dropped[name])
         }
     }
+
+    if processor.Comparison != nil {
+        fmt.Printf("Fixed point: %s.\n", processor.Comparison)
+    }
+
+    // Close flushes buffered output (e.g. the CSV writer).
+    if err := outputHandler.Close(); err != nil {
+        log.Printf("Error closing output: %v", err)
+        if status == 0 {
+            status = 1
+        }
+    }
+    if status != 0 {
+        os.Exit(status)
+    }
 }
 
+// overrideSensor replaces a sensor's equation (or replay) with a constant.
+func overrideSensor(sensors SensorsConfig, name string, value int) {
+    sc, ok := sensors[name]
+    if !ok {
+        fmt.Printf("No %s sensor to override.\n", name)
+        return
+    }
+    sc.Equation = strconv.Itoa(value)
+    sc.Replay = nil
+    sensors[name] = sc
+    fmt.Printf("%s equation overridden to constant: %s\n",
+               strings.ToUpper(name[:1])+name[1:],
+               sc.Equation)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "math/bits"
+    "math/rand"
+)
+
+// Noise models accepted in a sensor's "noise_models" section.
+const (
+    NoiseUniform      = "uniform"
+    NoiseNormal       = "normal"
+    NoisePink         = "pink"
+    NoiseBrownian     = "brownian"
+    NoiseAR1          = "ar1"
+    NoiseMains        = "mains"
+    NoiseQuantization = "quantization"
+    NoiseBurst        = "burst"
+)
+
+// NoiseModel produces the noise added to one sensor reading.
+// Models are stateful (colored and correlated noise depend on the previous
+// samples), so each sensor owns its own instances. t is the simulated time
+// of the sample in seconds, for models tied to physical time like mains hum.
+type NoiseModel interface {
+    Next(t float64) float64
+}
+
+// NoiseConfig configures one additional noise model of a sensor.
+// Amplitude is the RMS (standard deviation) of the model unless noted.
+type NoiseConfig struct {
+    // "uniform", "normal", "pink", "brownian", "ar1", "mains",
+    // "quantization" or "burst"
+    Model            string  `json:"model"`
+    Amplitude        float64 `json:"amplitude"`
+    // ar1: correlation between consecutive samples, 0 <= phi < 1
+    Phi              float64 `json:"phi,omitempty"`
+    // mains: pickup frequency, e.g. 50 or 60 (default 50)
+    FrequencyHz      float64 `json:"frequency_hz,omitempty"`
+    // brownian: fraction pulled back towards zero per sample (0 = pure walk)
+    Leak             float64 `json:"leak,omitempty"`
+    // burst: chance per sample that a burst starts
+    Probability      float64 `json:"probability,omitempty"`
+    // burst: mean burst length in samples (default 10)
+    LengthSamples    float64 `json:"length_samples,omitempty"`
+    // burst: Student-t degrees of freedom, lower is heavier (default 2)
+    DegreesOfFreedom int     `json:"dof,omitempty"`
+}
+
+// Validate checks the constraints of a noise model.
+func (nc NoiseConfig) Validate() error {
+    switch nc.Model {
+    case NoiseUniform, NoiseNormal, NoisePink, NoiseBrownian,
+        NoiseMains, NoiseQuantization:
+    case NoiseAR1:
+        if nc.Phi < 0 || nc.Phi >= 1 {
+            return fmt.Errorf("ar1 phi must be in [0, 1), got %g", nc.Phi)
+        }
+    case NoiseBurst:
+        if nc.Probability < 0 || nc.Probability > 1 {
+            return fmt.Errorf("burst probability must be 0-1, got %g",
+                nc.Probability)
+        }
+        if nc.LengthSamples < 0 || nc.DegreesOfFreedom < 0 {
+            return fmt.Errorf("burst length_samples and dof must not be " +
+                "negative")
+        }
+    default:
+        return fmt.Errorf("unknown noise model %q", nc.Model)
+    }
+    if nc.Amplitude < 0 {
+        return fmt.Errorf("%s noise amplitude must not be negative",
+            nc.Model)
+    }
+    if nc.Leak < 0 || nc.Leak > 1 {
+        return fmt.Errorf("%s noise leak must be 0-1, got %g",
+            nc.Model, nc.Leak)
+    }
+    return nil
+}
+
+// NewSensorNoise builds the noise of a sensor: the classic white noise
+// (noise_amplitude / noise_distribution) plus every configured model.
+// The white noise draws from rand.NewSource(seed) exactly as before, and
+// each extra model gets its own source derived from seed and its position,
+// so adding a model never changes the others' sequences.
+// A non-nil joint model (the sensor's share of a CorrelatedNoise) takes
+// the place of the white noise.
+func NewSensorNoise(config SensorConfig,
+                    seed int64,
+                    joint NoiseModel) NoiseModel {
+    models := SumNoise{joint}
+    if joint == nil {
+        r := rand.New(rand.NewSource(seed))
+        models[0] = newWhiteNoise(config.NoiseDistribution,
+                                  config.NoiseAmplitude,
+                                  r)
+    }
+    for i, nc := range config.NoiseModels {
+        mr := rand.New(rand.NewSource(mixSeed(seed, int64(i+1))))
+        models = append(models, NewNoiseModel(nc, mr))
+    }
+    return models
+}
+
+// NewNoiseModel is a factory function for a single configured model.
+func NewNoiseModel(nc NoiseConfig, r *rand.Rand) NoiseModel {
+    switch nc.Model {
+    case NoisePink:
+        return &PinkNoise{amplitude: nc.Amplitude, r: r}
+    case NoiseBrownian:
+        return &BrownianNoise{amplitude: nc.Amplitude, leak: nc.Leak, r: r}
+    case NoiseAR1:
+        return &AR1Noise{amplitude: nc.Amplitude, phi: nc.Phi, r: r}
+    case NoiseMains:
+        freq := nc.FrequencyHz
+        if freq == 0 {
+            freq = 50
+        }
+        return &MainsNoise{
+            amplitude: nc.Amplitude,
+            frequency: freq,
+            // Pickup starts at an arbitrary (but reproducible) phase
+            phase:     r.Float64() * 2 * math.Pi,
+        }
+    case NoiseQuantization:
+        step := nc.Amplitude
+        if step == 0 {
+            step = 1 // one LSB
+        }
+        return &QuantizationNoise{step: step, r: r}
+    case NoiseBurst:
+        length := nc.LengthSamples
+        if length <= 0 {
+            length = 10
+        }
+        dof := nc.DegreesOfFreedom
+        if dof <= 0 {
+            dof = 2
+        }
+        return &BurstNoise{
+            amplitude:   nc.Amplitude,
+            probability: nc.Probability,
+            exit:        1 / length,
+            dof:         dof,
+            r:           r,
+        }
+    default:
+        return newWhiteNoise(nc.Model, nc.Amplitude, r)
+    }
+}
+
+// SumNoise adds up the output of several independent models.
+type SumNoise []NoiseModel
+
+func (s SumNoise) Next(t float64) float64 {
+    var sum float64
+    for _, m := range s {
+        sum += m.Next(t)
+    }
+    return sum
+}
+
+// WhiteNoise is uncorrelated noise, uniform or normal.
+type WhiteNoise struct {
+    amplitude float64
+    normal    bool
+    r         *rand.Rand
+}
+
+func newWhiteNoise(distribution string,
+                   amplitude float64,
+                   r *rand.Rand) *WhiteNoise {
+    return &WhiteNoise{
+        amplitude: amplitude,
+        normal:    distribution == NoiseNormal,
+        r:         r,
+    }
+}
+
+func (w *WhiteNoise) Next(t float64) float64 {
+    if w.normal {
+        // Normal distribution (Gaussian): Mean 0, StdDev 1 * Amplitude
+        // This treats Amplitude as the standard deviation
+        return w.r.NormFloat64() * w.amplitude
+    }
+    // Default: Uniform distribution [-Amplitude, +Amplitude]
+    return (w.r.Float64()*2 - 1) * w.amplitude
+}
+
+// pinkRows is the number of octaves of the Voss-McCartney generator.
+const pinkRows = 16
+
+// PinkNoise generates 1/f noise with the Voss-McCartney algorithm: row k
+// is redrawn every 2^k samples, so the sum has equal power per octave.
+type PinkNoise struct {
+    amplitude float64
+    rows      [pinkRows]float64
+    sum       float64
+    counter   uint32
+    r         *rand.Rand
+}
+
+func (p *PinkNoise) Next(t float64) float64 {
+    p.counter++
+    // The number of trailing zeros picks the row due for an update;
+    // this redraws row k exactly every 2^k samples.
+    k := bits.TrailingZeros32(p.counter)
+    if k < pinkRows {
+        v := p.r.NormFloat64()
+        p.sum += v - p.rows[k]
+        p.rows[k] = v
+    }
+    white := p.r.NormFloat64()
+    // rows+1 unit-variance terms, normalised back to unit variance
+    return p.amplitude * (p.sum + white) / math.Sqrt(pinkRows+1)
+}
+
+// BrownianNoise is a random walk; amplitude is the step size.
+// A non-zero leak turns it into a bounded (Ornstein-Uhlenbeck like) drift.
+type BrownianNoise struct {
+    amplitude float64
+    leak      float64
+    value     float64
+    r         *rand.Rand
+}
+
+func (b *BrownianNoise) Next(t float64) float64 {
+    b.value = (1-b.leak)*b.value + b.amplitude*b.r.NormFloat64()
+    return b.value
+}
+
+// AR1Noise is first-order autoregressive noise,
+// x[n] = phi*x[n-1] + e[n], scaled so its standard deviation is amplitude.
+type AR1Noise struct {
+    amplitude float64
+    phi       float64
+    value     float64
+    started   bool
+    r         *rand.Rand
+}
+
+func (a *AR1Noise) Next(t float64) float64 {
+    if !a.started {
+        // Start from the stationary distribution, not from zero.
+        a.value = a.amplitude * a.r.NormFloat64()
+        a.started = true
+        return a.value
+    }
+    innovation := a.amplitude * math.Sqrt(1-a.phi*a.phi)
+    a.value = a.phi*a.value + innovation*a.r.NormFloat64()
+    return a.value
+}
+
+// MainsNoise is 50/60 Hz pickup; amplitude is the peak value.
+// It depends only on simulated time, so it aliases exactly like a real
+// sampled hum would.
+type MainsNoise struct {
+    amplitude float64
+    frequency float64
+    phase     float64
+}
+
+func (m *MainsNoise) Next(t float64) float64 {
+    return m.amplitude * math.Sin(2*math.Pi*m.frequency*t+m.phase)
+}
+
+// QuantizationNoise is uniform noise over one quantization step,
+// [-step/2, step/2), e.g. to model an upstream converter or dither.
+type QuantizationNoise struct {
+    step float64
+    r    *rand.Rand
+}
+
+func (q *QuantizationNoise) Next(t float64) float64 {
+    return (q.r.Float64() - 0.5) * q.step
+}
+
+// BurstNoise is silent most of the time and emits heavy-tailed
+// (Student-t) noise during bursts. Bursts start with the configured
+// probability per sample and end with probability 1/length, so their
+// lengths are geometric with the configured mean.
+type BurstNoise struct {
+    amplitude   float64
+    probability float64
+    exit        float64
+    dof         int
+    active      bool
+    r           *rand.Rand
+}
+
+func (b *BurstNoise) Next(t float64) float64 {
+    if b.active {
+        b.active = b.r.Float64() >= b.exit
+    } else {
+        b.active = b.r.Float64() < b.probability
+    }
+    if !b.active {
+        return 0
+    }
+    // Student-t: a normal divided by sqrt(chi-square / dof)
+    var chi2 float64
+    for i := 0; i < b.dof; i++ {
+        v := b.r.NormFloat64()
+        chi2 += v * v
+    }
+    return b.amplitude * b.r.NormFloat64() / math.Sqrt(chi2/float64(b.dof))
+}
+
+// mixSeed derives an independent seed from a base seed and a salt
+// (SplitMix64 finalizer), so neighbouring seeds don't give related streams.
+func mixSeed(seed, salt int64) int64 {
+    z := uint64(seed) + uint64(salt)*0x9E3779B97F4A7C15
+    z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+    z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+    return int64(z ^ (z >> 31))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "math"
+    "math/rand"
+    "testing"
+)
+
+// noiseStats returns the standard deviation and lag-1 autocorrelation of
+// n samples of a model taken at 100 Hz.
+func noiseStats(m NoiseModel, n int) (float64, float64) {
+    xs := make([]float64, n)
+    var mean float64
+    for i := range xs {
+        xs[i] = m.Next(float64(i) / 100)
+        mean += xs[i]
+    }
+    mean /= float64(n)
+    var variance, lag1 float64
+    for i := range xs {
+        variance += (xs[i] - mean) * (xs[i] - mean)
+        if i > 0 {
+            lag1 += (xs[i] - mean) * (xs[i-1] - mean)
+        }
+    }
+    return math.Sqrt(variance / float64(n)), lag1 / variance
+}
+
+func TestNoiseModelsReproducible(t *testing.T) {
+    config := SensorConfig{
+        NoiseAmplitude: 1,
+        NoiseModels: []NoiseConfig{
+            {Model: NoisePink, Amplitude: 2},
+            {Model: NoiseAR1, Amplitude: 1, Phi: 0.9},
+            {Model: NoiseMains, Amplitude: 1, FrequencyHz: 60},
+            {Model: NoiseBurst, Amplitude: 5, Probability: 0.05},
+        },
+    }
+    a := NewSensorNoise(config, 42, nil)
+    b := NewSensorNoise(config, 42, nil)
+    for i := 0; i < 1000; i++ {
+        ta, tb := a.Next(float64(i)), b.Next(float64(i))
+        if ta != tb {
+            t.Fatalf("Sample %d differs for the same seed: %g vs %g",
+                     i, ta, tb)
+        }
+    }
+}
+
+func TestNoiseModelStatistics(t *testing.T) {
+    tests := []struct {
+        config  NoiseConfig
+        std     float64
+        minCorr float64
+        maxCorr float64
+    }{
+        {NoiseConfig{Model: NoiseNormal, Amplitude: 2}, 2, -0.05, 0.05},
+        {NoiseConfig{Model: NoiseAR1, Amplitude: 2, Phi: 0.8}, 2, 0.75, 0.85},
+        // Pink noise is strongly correlated sample to sample
+        {NoiseConfig{Model: NoisePink, Amplitude: 2}, 2, 0.5, 1},
+        // Uniform over one step has std step/sqrt(12)
+        {NoiseConfig{Model: NoiseQuantization, Amplitude: 1},
+            1 / math.Sqrt(12), -0.05, 0.05},
+    }
+    for _, tc := range tests {
+        m := NewNoiseModel(tc.config, rand.New(rand.NewSource(1)))
+        std, corr := noiseStats(m, 50000)
+        if math.Abs(std-tc.std) > 0.15*tc.std {
+            t.Errorf("%s: expected std ~%g, got %g",
+                     tc.config.Model, tc.std, std)
+        }
+        if corr < tc.minCorr || corr > tc.maxCorr {
+            t.Errorf("%s: lag-1 correlation %g outside [%g, %g]",
+                     tc.config.Model, corr, tc.minCorr, tc.maxCorr)
+        }
+    }
+}
+
+func TestMainsNoise(t *testing.T) {
+    m := &MainsNoise{amplitude: 3, frequency: 50}
+    // A quarter period of 50 Hz is 5 ms
+    if v := m.Next(0.005); math.Abs(v-3) > 1e-9 {
+        t.Errorf("Expected peak 3 at 5ms, got %g", v)
+    }
+    if v := m.Next(0.01); math.Abs(v) > 1e-9 {
+        t.Errorf("Expected zero crossing at 10ms, got %g", v)
+    }
+}
+
+func TestBurstNoise(t *testing.T) {
+    config := NoiseConfig{
+        Model:         NoiseBurst,
+        Amplitude:     1,
+        Probability:   0.01,
+        LengthSamples: 20,
+    }
+    m := NewNoiseModel(config, rand.New(rand.NewSource(3)))
+    active := 0
+    for i := 0; i < 100000; i++ {
+        if m.Next(0) != 0 {
+            active++
+        }
+    }
+    // Bursts start at 1% and last 20 samples on average: about 1/6 of
+    // the samples are inside a burst.
+    if active < 12000 || active > 22000 {
+        t.Errorf("Expected ~16700 burst samples, got %d", active)
+    }
+}
+
+func TestNoiseConfigValidate(t *testing.T) {
+    bad := []NoiseConfig{
+        {Model: "violet"},
+        {Model: NoiseAR1, Phi: 1},
+        {Model: NoiseBurst, Probability: 2},
+        {Model: NoiseNormal, Amplitude: -1},
+    }
+    for _, nc := range bad {
+        if err := nc.Validate(); err == nil {
+            t.Errorf("Expected %+v to be rejected", nc)
+        }
+    }
+}
@@ -5,18 +5,37 @@ import (
     "encoding/csv"
     "fmt"
     "github.com/go-json-experiment/json"
+    "math"
     "net/http"
     "os"
+    "sort"
     "strconv"
+    "strings"
 )
 
 // OutputData represents the final calculated packet to be sent to receivers.
+// The sensor fields are (filtered) counts; calibrated sensors also appear
+// in engineering units under Values.
 type OutputData struct {
-    SampleNumber   int64 `json:"sample_number"`
-    RawFlow        int32 `json:"raw_flow"`
-    Pressure       int32 `json:"pressure"`
-    Temperature    int32 `json:"temperature"`
-    CalculatedFlow int32 `json:"calculated_flow"`
+    SampleNumber   int64                  `json:"sample_number"`
+    RawFlow        int32                  `json:"raw_flow"`
+    Pressure       int32                  `json:"pressure"`
+    Temperature    int32                  `json:"temperature"`
+    CalculatedFlow int32                  `json:"calculated_flow"`
+    // The flow equation's result before truncation to CalculatedFlow
+    FlowValue      float64                `json:"flow_value"`
+    // Full-FIFO events and samples lost (all sensors) since the
+    // previous record; see FIFOConfig
+    Overruns       int64                  `json:"overruns,omitzero"`
+    Dropped        int64                  `json:"dropped,omitzero"`
+    // Engineering value of each calibrated sensor, keyed by sensor name
+    Values         map[string]float64     `json:"values,omitempty"`
+    // Rates of each pulse sensor by both measurement methods
+    Pulses         map[string]PulseRates  `json:"pulses,omitempty"`
+    // Channel or vote used by each redundant sensor, and disagreement
+    Votes          map[string]VoteResult  `json:"votes,omitempty"`
+    // Latest step of each Kalman filter, keyed by lower-case sensor name
+    Kalman         map[string]KalmanState `json:"kalman,omitempty"`
 }
 
 // OutputHandler defines the interface for different output destinations.
@@ -29,9 +48,98 @@ type OutputHandler interface {
 type FileOutput struct {
     file   *os.File
     writer *csv.Writer
+    extra  OutputColumns
 }
 
-func NewFileOutput(filename string) (*FileOutput, error) {
+// OutputColumns lists the output beyond the fixed fields: the overruns and
+// drops of the sensor FIFOs, if any sensor has one, the unrounded flow in
+// FlowUnit, if the flow equation has a unit, then in name order
+// the engineering value of each calibrated sensor, the rates of each pulse
+// sensor, the vote of each redundant sensor and the step of each sensor's
+// Kalman filter.
+type OutputColumns struct {
+    // processing.flow_unit, or "value" when the flow equation reads
+    // calibrated sensors without declaring its unit
+    FlowUnit string
+    FIFO     bool
+    Units    map[string]string
+    Values   []string
+    Pulses   []string
+    Votes    []string
+    Kalman   []string
+}
+
+// NewOutputColumns lists the per-sensor output of a configuration.
+func NewOutputColumns(config *Config) OutputColumns {
+    c := OutputColumns{FlowUnit: config.Processing.FlowUnit,
+                       Units:    config.Sensors.Units()}
+    if c.FlowUnit == "" && flowReadsCalibrated(config) {
+        c.FlowUnit = "value"
+    }
+    for name, s := range config.Sensors {
+        if s.Pulse != nil {
+            c.Pulses = append(c.Pulses, name)
+        }
+        if s.FIFO != nil {
+            c.FIFO = true
+        }
+    }
+    for name := range config.Processing.Redundancy {
+        c.Votes = append(c.Votes, name)
+    }
+    kalman := map[string]string{}
+    for _, fc := range config.Processing.Filters {
+        if fc.Type == "kalman" {
+            kalman[strings.ToLower(fc.Target)] = fc.Target
+        }
+    }
+    c.Kalman = sortedKeys(kalman)
+    sort.Strings(c.Pulses)
+    sort.Strings(c.Votes)
+    c.Values = sortedKeys(c.Units)
+    return c
+}
+
+// flowReadsCalibrated reports whether the flow equation reads a calibrated
+// sensor, by name, alias or reference, so that its result is in
+// engineering units rather than counts.
+func flowReadsCalibrated(config *Config) bool {
+    flow := config.Processing.flow
+    if flow == nil {
+        var err error
+        flow, err = CompileEquation(config.Processing.FlowEquation, nil)
+        if err != nil {
+            return false
+        }
+    }
+    primary := config.Processing.PrimarySensor
+    if primary == "" {
+        primary = DefaultPrimarySensor
+    }
+    for _, name := range flow.Vars() {
+        switch name {
+        case "F", "RefF":
+            name = primary
+        case "P", "RefP":
+            name = string(PressureSensor)
+        case "T", "RefT":
+            name = string(TemperatureSensor)
+        }
+        if config.Sensors[name].Calibration != nil {
+            return true
+        }
+    }
+    return false
+}
+
+// NewFileOutput creates the CSV file. Sensor FIFOs add the columns
+// "overruns" and "dropped". A flow unit adds a column such as
+// "calculated_flow_m3/h", calibrated sensors one such as "pressure_kPa",
+// pulse sensors "flow_gate" and "flow_period", redundant sensors
+// "flow_vote" and "flow_discrepancy", and Kalman filters
+// "flow_innovation" and "flow_variance".
+func NewFileOutput(filename string,
+                   extra OutputColumns) (*FileOutput, error) {
     file, err := os.Create(filename)
     if err != nil {
         return nil, err
@@ -44,13 +152,31 @@ func NewFileOutput(filename string) (*FileOutput, error) {
                        "pressure",
                        "temperature",
                        "calculated_flow"}
+    if extra.FIFO {
+        header = append(header, "overruns", "dropped")
+    }
+    if extra.FlowUnit != "" {
+        header = append(header, "calculated_flow_"+extra.FlowUnit)
+    }
+    for _, name := range extra.Values {
+        header = append(header, name+"_"+extra.Units[name])
+    }
+    for _, name := range extra.Pulses {
+        header = append(header, name+"_gate", name+"_period")
+    }
+    for _, name := range extra.Votes {
+        header = append(header, name+"_vote", name+"_discrepancy")
+    }
+    for _, name := range extra.Kalman {
+        header = append(header, name+"_innovation", name+"_variance")
+    }
     if err := writer.Write(header); err != nil {
         file.Close()
         return nil, err
     }
     writer.Flush()
 
-    return &FileOutput{file: file, writer: writer}, nil
+    return &FileOutput{file: file, writer: writer, extra: extra}, nil
 }
 
 func (f *FileOutput) Write(data OutputData) error {
@@ -61,6 +187,35 @@ func (f *FileOutput) Write(data OutputData) error {
         strconv.FormatInt(int64(data.Temperature), 10),
         strconv.FormatInt(int64(data.CalculatedFlow), 10),
     }
+    if f.extra.FIFO {
+        record = append(record,
+                        strconv.FormatInt(data.Overruns, 10),
+                        strconv.FormatInt(data.Dropped, 10))
+    }
+    if f.extra.FlowUnit != "" {
+        record = append(record, formatFloat(data.FlowValue))
+    }
+    for _, name := range f.extra.Values {
+        record = append(record, formatFloat(data.Values[name]))
+    }
+    for _, name := range f.extra.Pulses {
+        rates := data.Pulses[name]
+        record = append(record,
+                        formatFloat(rates.Gate),
+                        formatFloat(rates.Period))
+    }
+    for _, name := range f.extra.Votes {
+        vote := data.Votes[name]
+        record = append(record,
+                        vote.Used,
+                        strconv.FormatBool(vote.Discrepancy))
+    }
+    for _, name := range f.extra.Kalman {
+        state := data.Kalman[name]
+        record = append(record,
+                        formatFloat(state.Innovation),
+                        formatFloat(state.Variance))
+    }
     if err := f.writer.Write(record); err != nil {
         return err
     }
@@ -74,19 +229,56 @@ func (f *FileOutput) Close() error {
 }
 
 // ConsoleOutput implements OutputHandler for stdout printing.
-type ConsoleOutput struct{}
+type ConsoleOutput struct {
+    extra OutputColumns
+}
 
-func NewConsoleOutput() *ConsoleOutput {
-    return &ConsoleOutput{}
+func NewConsoleOutput(extra OutputColumns) *ConsoleOutput {
+    return &ConsoleOutput{extra: extra}
 }
 
 func (c *ConsoleOutput) Write(data OutputData) error {
-    fmt.Printf("[%8d] Flow: %8d | P: %3d | T: %3d | Calc: %d\n",
+    fmt.Printf("[%8d] Flow: %8d | P: %3d | T: %3d | Calc: %d",
         data.SampleNumber,
         data.RawFlow,
         data.Pressure,
         data.Temperature,
         data.CalculatedFlow)
+    if c.extra.FlowUnit != "" {
+        fmt.Printf(" (%.6g %s)", data.FlowValue, c.extra.FlowUnit)
+    }
+    if data.Overruns > 0 || data.Dropped > 0 {
+        fmt.Printf(" | Overruns: %d, Dropped: %d",
+            data.Overruns,
+            data.Dropped)
+    }
+    for _, name := range c.extra.Values {
+        fmt.Printf(" | %s: %.4g %s",
+            name,
+            data.Values[name],
+            c.extra.Units[name])
+    }
+    for _, name := range c.extra.Pulses {
+        fmt.Printf(" | %s: gate %.4g, period %.4g",
+            name,
+            data.Pulses[name].Gate,
+            data.Pulses[name].Period)
+    }
+    for _, name := range c.extra.Votes {
+        vote := data.Votes[name]
+        fmt.Printf(" | %s: %s", name, vote.Used)
+        if vote.Discrepancy {
+            fmt.Print(" (discrepancy)")
+        }
+    }
+    for _, name := range c.extra.Kalman {
+        state := data.Kalman[name]
+        fmt.Printf(" | %s: innovation %.4g, sd %.4g",
+            name,
+            state.Innovation,
+            math.Sqrt(state.Variance))
+    }
+    fmt.Println()
     return nil
 }
 
@@ -134,16 +326,33 @@ func (n *NetworkOutput) Close() error {
 }
 
 // GetOutputHandler is a factory function to create the configured handler.
-func GetOutputHandler(config OutputConfig) (OutputHandler, error) {
+// extra gives the per-sensor columns of file and console output.
+func GetOutputHandler(config OutputConfig,
+                      extra OutputColumns) (OutputHandler, error) {
     switch config.Type {
     case "file":
-        return NewFileOutput(config.Target)
+        return NewFileOutput(config.Target, extra)
     case "console":
-        return NewConsoleOutput(), nil
+        return NewConsoleOutput(extra), nil
     case "network":
         return NewNetworkOutput(config.Target), nil
     default:
-        return NewConsoleOutput(), nil
+        return NewConsoleOutput(extra), nil
+    }
+}
+
+// formatFloat renders a value with as many digits as it needs.
+func formatFloat(v float64) string {
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
     }
+    sort.Strings(keys)
+    return keys
 }
 
@@ -4,6 +4,8 @@ import (
     "encoding/json"
     "net/http"
     "net/http/httptest"
+    "os"
+    "path/filepath"
     "testing"
 )
 
@@ -53,3 +55,77 @@ func TestNetworkOutput(t *testing.T) {
     }
 }
 
+
+func TestFileOutputFIFOColumns(t *testing.T) {
+    // Overruns and drops are only written when a sensor has a FIFO
+    for _, fifo := range []bool{false, true} {
+        config := validTestConfig()
+        if fifo {
+            s := config.Sensors["pressure"]
+            s.FIFO = &FIFOConfig{Depth: 4}
+            config.Sensors["pressure"] = s
+        }
+        path := filepath.Join(t.TempDir(), "out.csv")
+        output, err := NewFileOutput(path, NewOutputColumns(&config))
+        if err != nil {
+            t.Fatalf("NewFileOutput failed: %v", err)
+        }
+        err = output.Write(OutputData{SampleNumber: 1,
+                                      Overruns:     2,
+                                      Dropped:      3})
+        if err != nil {
+            t.Fatalf("Write failed: %v", err)
+        }
+        output.Close()
+        content, err := os.ReadFile(path)
+        if err != nil {
+            t.Fatalf("Failed to read output: %v", err)
+        }
+        expected := "sample_number,raw_flow,pressure,temperature," +
+            "calculated_flow\n1,0,0,0,0\n"
+        if fifo {
+            expected = "sample_number,raw_flow,pressure,temperature," +
+                "calculated_flow,overruns,dropped\n1,0,0,0,0,2,3\n"
+        }
+        if string(content) != expected {
+            t.Errorf("FIFO %v: expected %q, got %q", fifo, expected,
+                content)
+        }
+    }
+}
+
+func TestOutputColumnsFlowUnit(t *testing.T) {
+    // "value" only when the flow equation reads a calibrated sensor
+    tests := []struct {
+        equation string
+        flowUnit string
+        expected string
+    }{
+        {"F", "", ""},
+        {"F * dp", "", "value"},
+        {"F * (P - RefP)", "", "value"},
+        {"F", "L/s", "L/s"},
+    }
+    for _, tc := range tests {
+        config := validTestConfig()
+        config.Sensors["dp"] = SensorConfig{
+            FrequencyHz: 10,
+            Equation:    "50",
+            Calibration: &CalibrationConfig{
+                Type:         "polynomial",
+                Unit:         "kPa",
+                Coefficients: []float64{0, 2},
+            },
+        }
+        config.Sensors["pressure"] = config.Sensors["dp"]
+        config.Processing.FlowEquation = tc.equation
+        config.Processing.FlowUnit = tc.flowUnit
+        if err := config.Validate(); err != nil {
+            t.Fatalf("%s: %v", tc.equation, err)
+        }
+        if c := NewOutputColumns(&config); c.FlowUnit != tc.expected {
+            t.Errorf("%s: expected flow unit %q, got %q", tc.equation,
+                tc.expected, c.FlowUnit)
+        }
+    }
+}
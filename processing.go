@@ -1,16 +1,27 @@
 package main
 
 import (
+    "errors"
+    "fmt"
+    "math"
     "sort"
     "strings"
 )
 
+// ErrFlowNaN reports a flow equation result that is not a number.
+var ErrFlowNaN = errors.New("flow equation result is not a number")
+
 // Filter defines the interface for data filters using int32.
 type Filter interface {
     Process(value int32) int32
     Initialize(value int32) // Pre-populates the filter with a default value
 }
 
+// Delayer is a Filter that reports its group delay, in samples.
+type Delayer interface {
+    GroupDelay() float64
+}
+
 // LowPassFilter implements an Exponential Moving Average (EMA)
 // filter using integer math.
 // It uses fixed-point arithmetic (scaled by 1024) to handle the alpha factor.
@@ -140,27 +151,83 @@ func (f *MedianFilter) Process(value int32) int32 {
 }
 
 // Processor maintains the state of the sensors and applies filters.
+// Sensors are identified by their configured names, so a meter can carry
+// any number of them (differential pressure, density, a second probe...).
 type Processor struct {
-    // Latest filtered values
-    LatestPressure    int32
-    LatestTemperature int32
+    // Latest filtered value of every sensor, keyed by sensor name
+    Latest map[string]int32
+
+    // Filter chain of each sensor, keyed by lower-case sensor name
+    Filters map[string][]Filter
+
+    // Primary is the sensor whose samples drive CalculateFlow
+    Primary string
+
+    // Flow is the latest result of CalculateFlow before it is truncated to
+    // counts, in the units of the flow equation: engineering units when it
+    // reads calibrated sensors
+    Flow float64
+
+    // Calibration of each calibrated sensor, keyed by sensor name. The
+    // filters and Latest stay in counts; see Value.
+    Calibrations map[string]*CalibrationConfig
 
-    // Filters for each sensor type
-    PressureFilters    []Filter
-    TemperatureFilters []Filter
-    FlowFilters        []Filter
+    // Rate measurement of each pulse sensor, keyed by sensor name
+    Pulses map[string]*PulseMeter
+
+    // Vote of each redundant (logical) sensor, keyed by its name, and the
+    // logical sensor and index of each of their channels
+    Votes    map[string]*Voter
+    channels map[string]voteChannel
+
+    // Compiled flow equation and its variable slots, reused every sample,
+    // and the seed of its noise() calls
+    flow  *Equation
+    slots []float64
+    seed  int64
+
+    // With processing.fixed_point, the flow equation in fixed point, whose
+    // results CalculateFlow returns, and their comparison with the float64
+    // ones
+    fixed      *FixedEquation
+    fixedSlots []Fixed
+    Comparison *FixedComparison
 }
 
+type voteChannel struct {
+    logical string
+    index   int
+}
+
+// DefaultPrimarySensor is the sensor driving the flow calculation when
+// processing.primary_sensor is not set.
+const DefaultPrimarySensor = "flow"
+
 // NewProcessor creates a Processor and initializes filters based on config.
-func NewProcessor(config ProcessingConfig) *Processor {
+// A filter it can't build is an error: Config.Validate rejects those
+// configurations first.
+func NewProcessor(config ProcessingConfig) (*Processor, error) {
     p := &Processor{
-        PressureFilters:    []Filter{},
-        TemperatureFilters: []Filter{},
-        FlowFilters:        []Filter{},
+        Latest:       map[string]int32{},
+        Filters:      map[string][]Filter{},
+        Primary:      config.PrimarySensor,
+        Calibrations: map[string]*CalibrationConfig{},
+        Pulses:       map[string]*PulseMeter{},
+        Votes:        map[string]*Voter{},
+        channels:     map[string]voteChannel{},
+        flow:         config.flow,
+        fixed:        config.fixedFlow,
+    }
+    if p.fixed != nil {
+        p.Comparison = &FixedComparison{Format: p.fixed.Format()}
+    }
+    if p.Primary == "" {
+        p.Primary = DefaultPrimarySensor
     }
 
-    for _, fc := range config.Filters {
+    for i, fc := range config.Filters {
         var f Filter
+        var err error
         switch fc.Type {
         case "low_pass":
             f = NewLowPassFilter(fc.Alpha)
@@ -170,68 +237,239 @@ func NewProcessor(config ProcessingConfig) *Processor {
                 winSize = 5 // Default if not specified
             }
             f = NewMedianFilter(winSize)
+        case "fir":
+            if fc.FIR == nil {
+                err = fmt.Errorf("fir filter needs its fir section")
+                break
+            }
+            f, err = NewFIRFilter(*fc.FIR, fc.rateHz)
+        case "biquad":
+            f, err = NewBiquadFilter(fc.Biquads, fc.rateHz)
+        case "kalman":
+            if fc.Kalman == nil {
+                err = fmt.Errorf("kalman filter needs its kalman section")
+                break
+            }
+            f, err = NewKalmanFilter(*fc.Kalman, fc.rateHz, fc.noiseSD)
         default:
-            continue
+            err = fmt.Errorf("unknown filter type %q", fc.Type)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("processing.filters[%d]: %w", i, err)
         }
 
-        switch strings.ToLower(fc.Target) {
-        case "pressure":
-            p.PressureFilters = append(p.PressureFilters, f)
-        case "temperature":
-            p.TemperatureFilters = append(p.TemperatureFilters, f)
-        case "flow":
-            p.FlowFilters = append(p.FlowFilters, f)
+        target := strings.ToLower(fc.Target)
+        p.Filters[target] = append(p.Filters[target], f)
+    }
+
+    for name, rc := range config.Redundancy {
+        p.Votes[name] = NewVoter(rc, nil)
+        for i, ch := range rc.Channels {
+            p.channels[ch] = voteChannel{logical: name, index: i}
         }
     }
-    return p
+    return p, nil
 }
 
-// InitializeFilters pre-populates all filters with reference values.
-func (p *Processor) InitializeFilters(flowRef, pressRef, tempRef int32) {
-    for _, f := range p.FlowFilters {
-        f.Initialize(flowRef)
+// InitializeFilters pre-populates the filters and latest value of each
+// named sensor with its reference value.
+func (p *Processor) InitializeFilters(initial map[string]int32) {
+    for name, value := range initial {
+        for _, f := range p.Filters[strings.ToLower(name)] {
+            f.Initialize(value)
+        }
+        p.Latest[name] = value
     }
-    for _, f := range p.PressureFilters {
-        f.Initialize(pressRef)
+}
+
+// SetSensors records the calibration of every calibrated sensor, sets up
+// the rate measurement of every pulse sensor and gives the votes their
+// channels' sample rates.
+func (p *Processor) SetSensors(sensors SensorsConfig) {
+    for name, v := range p.Votes {
+        p.Votes[name] = NewVoter(v.config, sensors)
     }
-    for _, f := range p.TemperatureFilters {
-        f.Initialize(tempRef)
+    for name, s := range sensors {
+        if s.Calibration != nil {
+            p.Calibrations[name] = s.Calibration
+        }
+        if s.Pulse != nil {
+            p.Pulses[name] = NewPulseMeter(*s.Pulse)
+        }
     }
 }
 
-// UpdatePressure processes a raw pressure value through
-// filters and updates state.
-func (p *Processor) UpdatePressure(raw int32) {
-    val := raw
-    for _, f := range p.PressureFilters {
-        val = f.Process(val)
+// SetSeed seeds the noise() calls of the flow equation.
+func (p *Processor) SetSeed(seed int64) {
+    p.seed = seed
+    if p.flow != nil {
+        p.flow.SetSeed(seed)
     }
-    p.LatestPressure = val
 }
 
-// UpdateTemperature processes a raw temperature value through
-// filters and updates state.
-func (p *Processor) UpdateTemperature(raw int32) {
+// Measure returns the value a sample feeds to the filters: its counts, or
+// for a pulse sensor the measured flow rate in counts of its resolution.
+func (p *Processor) Measure(data SensorData) int32 {
+    m, ok := p.Pulses[string(data.Type)]
+    if !ok {
+        return data.Value
+    }
+    rate := math.Round(m.Update(data) / m.Resolution)
+    return int32(math.Max(math.MinInt32, math.Min(math.MaxInt32, rate)))
+}
+
+// pulseMeter returns the rate measurement behind the named sensor, through
+// the first channel of a redundant one, or nil if it isn't a pulse sensor.
+func (p *Processor) pulseMeter(name string) *PulseMeter {
+    if v, ok := p.Votes[name]; ok {
+        name = v.config.Channels[0]
+    }
+    return p.Pulses[name]
+}
+
+// Vote passes a sample through the vote of its redundant sensor, if it is
+// a channel of one. It returns the sensor the value is for (the logical
+// one for a channel) and false for a channel sample that doesn't pace its
+// vote, which has nothing to deliver yet.
+func (p *Processor) Vote(data SensorData, value int32) (string, int32, bool) {
+    ch, ok := p.channels[string(data.Type)]
+    if !ok {
+        return string(data.Type), value, true
+    }
+    voted, ok := p.Votes[ch.logical].Update(ch.index, data, value)
+    return ch.logical, voted, ok
+}
+
+// Logical returns the logical sensor a physical one backs, or the sensor
+// itself.
+func (p *Processor) Logical(name string) string {
+    if ch, ok := p.channels[name]; ok {
+        return ch.logical
+    }
+    return name
+}
+
+// VoteResults returns how each redundant sensor was last voted, or nil if
+// there are none.
+func (p *Processor) VoteResults() map[string]VoteResult {
+    if len(p.Votes) == 0 {
+        return nil
+    }
+    results := make(map[string]VoteResult, len(p.Votes))
+    for name, v := range p.Votes {
+        results[name] = v.VoteResult
+    }
+    return results
+}
+
+// KalmanStates returns the latest step of the Kalman filter of every
+// sensor that has one (the last, if several), keyed by lower-case sensor
+// name, or nil if there are none.
+func (p *Processor) KalmanStates() map[string]KalmanState {
+    var states map[string]KalmanState
+    for name, filters := range p.Filters {
+        for _, f := range filters {
+            if k, ok := f.(*KalmanFilter); ok {
+                if states == nil {
+                    states = map[string]KalmanState{}
+                }
+                states[name] = k.KalmanState
+            }
+        }
+    }
+    return states
+}
+
+// PulseRates returns the rates of every pulse sensor by both methods, or
+// nil if there are none.
+func (p *Processor) PulseRates() map[string]PulseRates {
+    if len(p.Pulses) == 0 {
+        return nil
+    }
+    rates := make(map[string]PulseRates, len(p.Pulses))
+    for name, m := range p.Pulses {
+        rates[name] = m.PulseRates
+    }
+    return rates
+}
+
+// Value returns the latest filtered value of the named sensor in
+// engineering units, or in counts if it isn't calibrated. The counts of a
+// pulse sensor are scaled back to its flow rate first.
+func (p *Processor) Value(name string) float64 {
+    value := float64(p.Latest[name])
+    if m := p.pulseMeter(name); m != nil {
+        value *= m.Resolution
+    }
+    return p.Calibrations[name].Apply(value)
+}
+
+// Values returns the engineering value of every calibrated sensor, or nil
+// if there are none.
+func (p *Processor) Values() map[string]float64 {
+    if len(p.Calibrations) == 0 {
+        return nil
+    }
+    values := make(map[string]float64, len(p.Calibrations))
+    for name := range p.Calibrations {
+        values[name] = p.Value(name)
+    }
+    return values
+}
+
+// SetAlpha retunes the low-pass filters of the named sensor, e.g. from a
+// scenario event. It returns the number of filters changed.
+func (p *Processor) SetAlpha(name string, alpha float64) int {
+    changed := 0
+    for _, f := range p.Filters[strings.ToLower(name)] {
+        if lp, ok := f.(*LowPassFilter); ok {
+            lp.AlphaScaled = NewLowPassFilter(alpha).AlphaScaled
+            changed++
+        }
+    }
+    return changed
+}
+
+// filter runs a raw value through the named sensor's filter chain. Kalman
+// filters first get the latest filtered pressure and temperature.
+func (p *Processor) filter(name string, raw int32) int32 {
     val := raw
-    for _, f := range p.TemperatureFilters {
+    for _, f := range p.Filters[strings.ToLower(name)] {
+        if k, ok := f.(*KalmanFilter); ok {
+            k.SetConditions(p.condition(string(PressureSensor)),
+                            p.condition(string(TemperatureSensor)))
+        }
         val = f.Process(val)
     }
-    p.LatestTemperature = val
+    return val
+}
+
+// condition returns the value of a sensor the Kalman filters follow, or 0
+// if there is none.
+func (p *Processor) condition(name string) float64 {
+    if _, ok := p.Latest[name]; !ok {
+        return 0
+    }
+    return p.Value(name)
+}
+
+// Update processes a raw value of the named sensor through its
+// filters and updates state.
+func (p *Processor) Update(name string, raw int32) {
+    p.Latest[name] = p.filter(name, raw)
 }
 
 // ProcessFlow processes a raw flow value through
 // filters and returns the filtered flow.
 func (p *Processor) ProcessFlow(raw int32) int32 {
-    val := raw
-    for _, f := range p.FlowFilters {
-        val = f.Process(val)
-    }
-    return val
+    return p.filter(p.Primary, raw)
 }
 
 // CalculateFlow computes the final flow rate using the configured equation.
-// It uses the latest filtered pressure and
-// temperature values from the processor state.
+// It uses the latest filtered value of every sensor from the processor
+// state, each exposed to the equation under its sensor name.
+// The equation compiled by Config.Validate is reused; any other is compiled
+// once, on its first use.
 //
 // Assumptions:
 // 1. Input sensors (Flow, Pressure, Temperature)
@@ -249,29 +487,66 @@ func (p *Processor) CalculateFlow(equation string,
                                   refTemperature int32) (int32, error) {
     // Filter the raw flow first
     filteredFlow := p.ProcessFlow(rawFlow)
+    p.Latest[p.Primary] = filteredFlow
+
+    if p.flow == nil || p.flow.Source() != equation {
+        flow, err := CompileEquation(equation, nil)
+        if err != nil {
+            return 0, err
+        }
+        flow.SetSeed(p.seed)
+        p.flow, p.slots = flow, nil
+    }
+    if p.slots == nil {
+        p.slots = make([]float64, len(p.flow.Vars()))
+    }
 
-    // Prepare parameters
+    // Fill the variable slots
     // We pass values as float64 to the engine to
     // support division scaling (e.g. / 255.0)
-    params := map[string]interface{}{
-        "flow":        float64(filteredFlow),
-        "pressure":    float64(p.LatestPressure),
-        "temperature": float64(p.LatestTemperature),
-        "t":           timeSecs,
-        // Short aliases
-        "F": float64(filteredFlow),
-        "P": float64(p.LatestPressure),
-        "T": float64(p.LatestTemperature),
-        // Reference values
-        "RefF": float64(refFlow),
-        "RefP": float64(refPressure),
-        "RefT": float64(refTemperature),
-    }
-
-    resultFloat, err := EvaluateEquation(equation, params)
+    // Calibrated sensors appear in engineering units.
+    for i, name := range p.flow.Vars() {
+        var v float64
+        switch name {
+        case "t":
+            v = timeSecs
+        // Short aliases of the classic sensors
+        case "F":
+            v = p.Value(p.Primary)
+        // Reference values, in the units of the sensor they refer to
+        case "RefF":
+            v = p.Calibrations[p.Primary].Apply(float64(refFlow))
+        case "RefP":
+            v = p.Calibrations["pressure"].Apply(float64(refPressure))
+        case "RefT":
+            v = p.Calibrations["temperature"].Apply(float64(refTemperature))
+        default:
+            sensor := name
+            switch name {
+            case "P":
+                sensor = string(PressureSensor)
+            case "T":
+                sensor = string(TemperatureSensor)
+            }
+            if _, ok := p.Latest[sensor]; !ok {
+                return 0, fmt.Errorf("no value for variable %q", name)
+            }
+            v = p.Value(sensor)
+        }
+        p.slots[i] = v
+    }
+
+    resultFloat, err := p.flow.Eval(p.slots)
+    if p.fixed != nil {
+        return p.calculateFixed(equation, resultFloat, err)
+    }
     if err != nil {
         return 0, err
     }
+    // NaN passes any range check
+    if math.IsNaN(resultFloat) {
+        return 0, ErrFlowNaN
+    }
 
     // Explicit Overflow Check for int32
     // MaxInt32 = 2147483647
@@ -280,6 +555,36 @@ func (p *Processor) CalculateFlow(equation string,
         return 0, ErrOverflow
     }
 
+    p.Flow = resultFloat
     return int32(resultFloat), nil
 }
 
+// calculateFixed evaluates the flow equation in fixed point, from the
+// variable slots CalculateFlow filled, and compares the result with the
+// float64 one.
+func (p *Processor) calculateFixed(equation string,
+                                   float float64,
+                                   floatErr error) (int32, error) {
+    if p.fixed.Source() != equation {
+        fixed, err := CompileFixedEquation(equation, nil, p.fixed.Format())
+        if err != nil {
+            return 0, err
+        }
+        p.fixed, p.fixedSlots = fixed, nil
+    }
+    if p.fixedSlots == nil {
+        p.fixedSlots = make([]Fixed, len(p.fixed.Vars()))
+    }
+    // Compiled from the same source, the two have the same slots
+    q := p.fixed.Format()
+    for i, v := range p.slots {
+        p.fixedSlots[i] = q.FromFloat(v)
+    }
+    result, err := p.fixed.Eval(p.fixedSlots)
+    p.Comparison.Add(result, err, float, floatErr)
+    if err != nil {
+        return 0, err
+    }
+    p.Flow = q.Float(result)
+    return q.Int(result), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "time"
+)
+
+// Pulse measurement methods of the Processor.
+const (
+    PulseGate   = "gate"   // pulses counted over a fixed gate time
+    PulsePeriod = "period" // time between pulse edges (reciprocal counting)
+)
+
+// pulseSalt separates the pulse stream from the sensor's other streams.
+const pulseSalt = 0x9015e
+
+// PulseConfig makes a sensor a pulse output, like a turbine or
+// positive-displacement meter: its equation is the flow profile and the
+// meter emits k_factor pulses per unit of flow and second. Each sample is
+// then the pulse counter register, with the instant of its latest edge
+// (SensorData.Edge); the Processor turns those back into a flow rate.
+type PulseConfig struct {
+    // Pulses per unit of flow and second, e.g. pulses per litre with an
+    // equation in L/s
+    KFactor            float64 `json:"k_factor"`
+    // Edge timing jitter, uniform within +/- jitter_s
+    JitterS            float64 `json:"jitter_s,omitempty"`
+    // Probability that a pulse is lost
+    MissingProbability float64 `json:"missing_probability,omitempty"`
+    // "gate" (default) or "period"
+    Measurement        string  `json:"measurement,omitempty"`
+    // Gate time of the gate method, 1 second by default
+    GateS              float64 `json:"gate_s,omitempty"`
+    // Flow units per count of the measured rate through the filters,
+    // 0.001 by default
+    Resolution         float64 `json:"resolution,omitempty"`
+}
+
+// DefaultPulseResolution is the flow per count of a pulse sensor's rate
+// unless its resolution is set.
+const DefaultPulseResolution = 0.001
+
+// Validate checks the constraints of a pulse output.
+func (pc PulseConfig) Validate() error {
+    if !(pc.KFactor > 0) || math.IsInf(pc.KFactor, 1) {
+        return fmt.Errorf("pulse k_factor must be positive, got %g",
+            pc.KFactor)
+    }
+    if pc.JitterS < 0 || pc.GateS < 0 {
+        return fmt.Errorf("pulse jitter_s and gate_s must not be negative")
+    }
+    if !(pc.Resolution >= 0) || math.IsInf(pc.Resolution, 1) {
+        return fmt.Errorf("pulse resolution must not be negative, got %g",
+            pc.Resolution)
+    }
+    if pc.MissingProbability < 0 || pc.MissingProbability >= 1 {
+        return fmt.Errorf("pulse missing_probability must be in [0, 1), "+
+            "got %g", pc.MissingProbability)
+    }
+    switch pc.Measurement {
+    case "", PulseGate, PulsePeriod:
+    default:
+        return fmt.Errorf("pulse measurement must be 'gate' or 'period', "+
+            "got %s", pc.Measurement)
+    }
+    return nil
+}
+
+// pulseTrain generates the pulse edges of a sensor from its flow profile.
+// Edges are a pure function of the profile and the seed, so a run is
+// reproducible whatever the clock.
+type pulseTrain struct {
+    config PulseConfig
+    seed   int64
+    // Pulses owed so far (fractional), and the flow at the previous sample
+    phase  float64
+    flow   float64
+    at     time.Duration
+    // Counter register and the instant of the latest counted edge
+    count  int32
+    edge   time.Duration
+}
+
+func newPulseTrain(config PulseConfig, seed int64) *pulseTrain {
+    return &pulseTrain{config: config, seed: mixSeed(seed, pulseSalt)}
+}
+
+// advance moves the train to the sample taken at t, where the flow profile
+// is flow, and returns the counter and the latest edge. The pulse rate is
+// held at the mean flow of the interval, so the sensor's frequency should
+// resolve the profile; negative flow gives no pulses.
+func (p *pulseTrain) advance(t time.Duration,
+                             flow float64) (int32, time.Duration) {
+    if p.at == 0 {
+        p.flow = flow
+    }
+    dt := (t - p.at).Seconds()
+    rate := p.config.KFactor * math.Max(0, (p.flow+flow)/2)
+    next := p.phase + rate*dt
+    for k := math.Floor(p.phase) + 1; k <= next; k++ {
+        h := mixSeed(p.seed, int64(k))
+        if unitFloat(h) < p.config.MissingProbability {
+            continue
+        }
+        s := p.at.Seconds() + (k-p.phase)/rate
+        if p.config.JitterS > 0 {
+            s += (2*unitFloat(mixSeed(h, 1)) - 1) * p.config.JitterS
+        }
+        // Jitter can't move an edge out of this sample's window
+        edge := time.Duration(math.Round(s * 1e9))
+        edge = max(p.at+1, min(t, edge))
+        p.count++
+        p.edge = max(p.edge, edge)
+    }
+    p.phase, p.flow, p.at = next, flow, t
+    return p.count, p.edge
+}
+
+// readPulses advances the pulse train of a pulse sensor to sample n, taken
+// at now, and returns the counter and the instant of the latest edge (zero
+// before the first). The sensor's noise applies to the flow profile.
+func readPulses(sType SensorType,
+                config SensorConfig,
+                n int64,
+                startTime time.Time,
+                now time.Time,
+                env *SensorEnv,
+                noise NoiseModel,
+                train *pulseTrain) (int32, time.Time, error) {
+    elapsed := now.Sub(startTime)
+    flow, err := env.trueValue(sType, config, n, elapsed)
+    if err != nil {
+        return 0, time.Time{}, err
+    }
+    flow += noise.Next(elapsed.Seconds())
+
+    count, at := train.advance(elapsed, flow)
+    var edge time.Time
+    if at > 0 {
+        edge = startTime.Add(at)
+    }
+    return count, edge, nil
+}
+
+// PulseMeter turns the counter and edge samples of a pulse sensor back
+// into a flow rate, by both methods: the configured one feeds the filters
+// and the other is kept for comparison.
+type PulseMeter struct {
+    kFactor     float64
+    measurement string
+    gate        time.Duration
+    // Flow units per count of the rate through the filters
+    Resolution  float64
+    started     bool
+    // Gate method: the window open since gateStart at gateCount
+    gateStart   time.Time
+    gateCount   int32
+    // Period method: count and instant of the latest edge seen
+    edgeCount   int32
+    edge        time.Time
+    // Latest estimates of both methods
+    PulseRates
+}
+
+// PulseRates are the flow rates measured from a pulse sensor, in the units
+// of its flow profile.
+type PulseRates struct {
+    Gate   float64 `json:"gate"`
+    Period float64 `json:"period"`
+}
+
+// NewPulseMeter creates the measurement of a pulse sensor.
+func NewPulseMeter(config PulseConfig) *PulseMeter {
+    m := &PulseMeter{
+        kFactor:     config.KFactor,
+        measurement: config.Measurement,
+        gate:        time.Second,
+        Resolution:  config.Resolution,
+    }
+    if m.measurement == "" {
+        m.measurement = PulseGate
+    }
+    if config.GateS > 0 {
+        m.gate = time.Duration(config.GateS * 1e9)
+    }
+    if m.Resolution == 0 {
+        m.Resolution = DefaultPulseResolution
+    }
+    return m
+}
+
+// Update takes a sample of the pulse sensor and returns the rate of the
+// configured method.
+func (m *PulseMeter) Update(data SensorData) float64 {
+    if !m.started {
+        m.started = true
+        m.gateStart, m.gateCount = data.Timestamp, data.Value
+        m.edgeCount, m.edge = data.Value, data.Edge
+        return m.rate()
+    }
+
+    // Gate: the count over the window, once the window has elapsed. The
+    // counter wraps like a register, so differences are taken in int32.
+    if window := data.Timestamp.Sub(m.gateStart); window >= m.gate {
+        pulses := float64(data.Value - m.gateCount)
+        m.Gate = pulses / window.Seconds() / m.kFactor
+        m.gateStart, m.gateCount = data.Timestamp, data.Value
+    }
+
+    // Period: whole pulses over the time between their edges. With no new
+    // pulse, the rate can't be above one pulse since the latest edge.
+    if pulses := data.Value - m.edgeCount; pulses > 0 {
+        if !m.edge.IsZero() {
+            span := data.Edge.Sub(m.edge).Seconds()
+            m.Period = float64(pulses) / span / m.kFactor
+        }
+        m.edgeCount, m.edge = data.Value, data.Edge
+    } else if !m.edge.IsZero() {
+        bound := 1 / data.Timestamp.Sub(m.edge).Seconds() / m.kFactor
+        m.Period = math.Min(m.Period, bound)
+    }
+    return m.rate()
+}
+
+func (m *PulseMeter) rate() float64 {
+    if m.measurement == PulsePeriod {
+        return m.Period
+    }
+    return m.Gate
+}
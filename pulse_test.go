@@ -0,0 +1,114 @@
+package main
+
+import (
+    "math"
+    "testing"
+    "time"
+)
+
+func TestPulseTrain(t *testing.T) {
+    config := PulseConfig{KFactor: 10, JitterS: 0.002,
+        MissingProbability: 0.1}
+    train := newPulseTrain(config, 3)
+    again := newPulseTrain(config, 3)
+    var count int32
+    for n := 1; n <= 1000; n++ {
+        at := time.Duration(n) * 10 * time.Millisecond
+        // 5 units/s, 50 pulses/s
+        c, edge := train.advance(at, 5)
+        if c2, edge2 := again.advance(at, 5); c2 != c || edge2 != edge {
+            t.Fatalf("Sample %d is not reproducible", n)
+        }
+        if edge > at {
+            t.Fatalf("Sample %d: edge %v after the sample", n, edge)
+        }
+        count = c
+    }
+    // 500 pulses over 10 s, about a tenth of them lost
+    if count < 420 || count > 480 {
+        t.Errorf("Expected about 450 pulses, got %d", count)
+    }
+}
+
+func TestPulseMeterLowFlow(t *testing.T) {
+    // One pulse every 2 s, sampled at 10 Hz: a 1 s gate sees 0 or 1
+    // pulses, while the period method recovers the rate
+    config := PulseConfig{KFactor: 1, Measurement: PulsePeriod}
+    train := newPulseTrain(config, 0)
+    meter := NewPulseMeter(config)
+    start := time.Unix(0, 0)
+    gates := map[float64]bool{}
+    var rate float64
+    for n := 1; n <= 200; n++ {
+        at := time.Duration(n) * 100 * time.Millisecond
+        count, edge := train.advance(at, 0.5)
+        data := SensorData{Value: count, Timestamp: start.Add(at)}
+        if edge > 0 {
+            data.Edge = start.Add(edge)
+        }
+        rate = meter.Update(data)
+        gates[meter.Gate] = true
+    }
+    if math.Abs(rate-0.5) > 1e-6 || meter.Period != rate {
+        t.Errorf("Expected a period rate of 0.5, got %g", rate)
+    }
+    if !gates[0] || !gates[1] {
+        t.Errorf("Expected gate rates of 0 and 1, got %v", gates)
+    }
+}
+
+func TestProcessorPulseResolution(t *testing.T) {
+    // 0.4 L/s would round to 0 as a whole count: it reaches the flow
+    // equation in counts of 0.001
+    config := validTestConfig()
+    pc := PulseConfig{KFactor: 1, Measurement: PulsePeriod}
+    config.Sensors["flow"] = SensorConfig{FrequencyHz: 10, Equation: "0.4",
+                                          Pulse: &pc}
+    if err := config.Validate(); err != nil {
+        t.Fatalf("Valid config rejected: %v", err)
+    }
+    p := newTestProcessor(t, config.Processing)
+    p.InitializeFilters(map[string]int32{"flow": 0})
+    p.SetSensors(config.Sensors)
+    train := newPulseTrain(pc, 0)
+    start := time.Unix(0, 0)
+    var raw int32
+    for n := 1; n <= 300; n++ {
+        at := time.Duration(n) * 100 * time.Millisecond
+        count, edge := train.advance(at, 0.4)
+        data := SensorData{Type: "flow", Value: count,
+                           Timestamp: start.Add(at)}
+        if edge > 0 {
+            data.Edge = start.Add(edge)
+        }
+        raw = p.Measure(data)
+        if _, err := p.CalculateFlow("F", raw, at.Seconds(),
+                                     0, 0, 0); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if raw != 400 || math.Abs(p.Flow-0.4) > 1e-9 {
+        t.Errorf("Expected 400 counts and a flow of 0.4, got %d and %g",
+            raw, p.Flow)
+    }
+
+    pc.Resolution = 0.5
+    if NewPulseMeter(pc).Resolution != 0.5 ||
+        NewPulseMeter(PulseConfig{}).Resolution != DefaultPulseResolution {
+        t.Error("Expected the resolution to default to 0.001")
+    }
+}
+
+func TestPulseConfigValidate(t *testing.T) {
+    for _, pc := range []PulseConfig{
+        {KFactor: 0},
+        {KFactor: 1, MissingProbability: 1},
+        {KFactor: 1, JitterS: -1},
+        {KFactor: 1, Measurement: "zero_crossing"},
+        {KFactor: 1, Resolution: -0.001},
+    } {
+        if err := pc.Validate(); err == nil {
+            t.Errorf("Expected %+v to be rejected", pc)
+        }
+    }
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "bytes"
+    "encoding/csv"
+    "fmt"
+    "io"
+    "math"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/go-json-experiment/json"
+)
+
+// Replay timing modes.
+const (
+    ReplayOriginal = "original" // keep the recorded sample spacing
+    ReplayScaled   = "scaled"   // recorded spacing multiplied by time_scale
+    ReplayFast     = "fast"     // emit as fast as the consumer reads, stamped
+                                // when sent unless the clock is discrete
+)
+
+// ReplayConfig selects a recorded capture as a sensor source, in place of
+// the sensor's equation.
+type ReplayConfig struct {
+    // Capture file: CSV (t,value) or JSON Lines ({"t":..,"value":..})
+    File      string  `json:"file"`
+    // "csv" or "jsonl"; defaults from the file extension
+    Format    string  `json:"format,omitempty"`
+    // "original" (default), "scaled" or "fast"
+    Timing    string  `json:"timing,omitempty"`
+    // Multiplier applied to recorded times in "scaled" mode
+    TimeScale float64 `json:"time_scale,omitempty"`
+    // Restart from the beginning at the end of the capture
+    Loop      bool    `json:"loop,omitempty"`
+}
+
+// Validate checks the constraints of a replay source.
+func (rc ReplayConfig) Validate() error {
+    if rc.File == "" {
+        return fmt.Errorf("replay file is required")
+    }
+    switch rc.format() {
+    case "csv", "jsonl":
+    default:
+        return fmt.Errorf("replay format must be 'csv' or 'jsonl', got %s",
+            rc.format())
+    }
+    switch rc.Timing {
+    case "", ReplayOriginal, ReplayFast:
+    case ReplayScaled:
+        if rc.TimeScale <= 0 {
+            return fmt.Errorf("replay time_scale must be positive, got %g",
+                rc.TimeScale)
+        }
+    default:
+        return fmt.Errorf("replay timing must be 'original', 'scaled' or "+
+            "'fast', got %s", rc.Timing)
+    }
+    return nil
+}
+
+func (rc ReplayConfig) format() string {
+    if rc.Format != "" {
+        return rc.Format
+    }
+    switch strings.ToLower(filepath.Ext(rc.File)) {
+    case ".jsonl", ".ndjson":
+        return "jsonl"
+    default:
+        return "csv"
+    }
+}
+
+// ReplaySample is one recorded reading, Offset from the first sample.
+type ReplaySample struct {
+    Offset time.Duration
+    Value  int32
+}
+
+// LoadReplay reads a capture file into memory.
+// Loading up front means a bad file is reported before the run starts,
+// rather than as a silent gap in the middle of it.
+func LoadReplay(config ReplayConfig) ([]ReplaySample, error) {
+    file, err := os.Open(config.File)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var samples []ReplaySample
+    if config.format() == "jsonl" {
+        samples, err = parseReplayJSONL(file)
+    } else {
+        samples, err = parseReplayCSV(file)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", config.File, err)
+    }
+    if len(samples) == 0 {
+        return nil, fmt.Errorf("%s: no samples", config.File)
+    }
+    return samples, nil
+}
+
+// replayRecord is the JSON Lines form of a sample.
+type replayRecord struct {
+    T     *float64 `json:"t"`
+    Value *float64 `json:"value"`
+}
+
+func parseReplayJSONL(r io.Reader) ([]ReplaySample, error) {
+    var times, values []float64
+    scanner := bufio.NewScanner(r)
+    for line := 1; scanner.Scan(); line++ {
+        text := bytes.TrimSpace(scanner.Bytes())
+        if len(text) == 0 {
+            continue
+        }
+        var rec replayRecord
+        if err := json.Unmarshal(text, &rec); err != nil {
+            return nil, fmt.Errorf("line %d: %w", line, err)
+        }
+        if rec.T == nil || rec.Value == nil {
+            return nil, fmt.Errorf("line %d: need both \"t\" and \"value\"",
+                line)
+        }
+        times = append(times, *rec.T)
+        values = append(values, *rec.Value)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    return newReplaySamples(times, values)
+}
+
+func parseReplayCSV(r io.Reader) ([]ReplaySample, error) {
+    reader := csv.NewReader(r)
+    reader.FieldsPerRecord = -1
+    var times, values []float64
+    for line := 1; ; line++ {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        if len(record) < 2 {
+            return nil, fmt.Errorf("line %d: need t,value columns", line)
+        }
+        t, errT := strconv.ParseFloat(strings.TrimSpace(record[0]), 64)
+        v, errV := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+        if errT != nil || errV != nil {
+            if line == 1 {
+                // Header row, e.g. "t,value"
+                continue
+            }
+            return nil, fmt.Errorf("line %d: invalid sample %v", line, record)
+        }
+        times = append(times, t)
+        values = append(values, v)
+    }
+    return newReplaySamples(times, values)
+}
+
+// newReplaySamples converts recorded seconds into offsets from the first
+// sample, rejecting captures that go back in time.
+func newReplaySamples(times, values []float64) ([]ReplaySample, error) {
+    samples := make([]ReplaySample, 0, len(times))
+    for i := range times {
+        if i > 0 && times[i] < times[i-1] {
+            return nil, fmt.Errorf("sample %d: timestamp %g before %g",
+                i+1, times[i], times[i-1])
+        }
+        offset := time.Duration((times[i] - times[0]) * float64(time.Second))
+        samples = append(samples, ReplaySample{
+            Offset: offset,
+            Value:  int32(math.Floor(values[i])),
+        })
+    }
+    return samples, nil
+}
+
+// StartReplay replays recorded samples on the same channel contract as
+// StartSensor, so the Processor and OutputHandler can't tell them apart.
+// Samples still pass through the sensor's ADC range, fault injection and
+// FIFO.
+// Unless it loops, the capture ends with an EndOfStream message and the
+// channel is closed; cancelling ctx stops the replay early.
+func StartReplay(ctx context.Context,
+                 clock Clock,
+                 sType SensorType,
+                 config SensorConfig,
+                 samples []ReplaySample,
+                 seed int64) <-chan SensorData {
+    fifo := newSampleFIFO(config.FIFO, clock)
+    startTime := clock.Now()
+    faults := NewFaultInjector(config.Faults, seed)
+    adc := NewADC(config.ResolutionBits, config.ADC)
+
+    scale := 1.0
+    if config.Replay.Timing == ReplayScaled {
+        scale = config.Replay.TimeScale
+    }
+    // A discrete clock never sleeps; the ordered merge provides pacing.
+    // A fast replay on a wall clock is stamped when it is sent: the
+    // recorded offsets would run ahead of the rest of the run.
+    _, discrete := clock.(*DiscreteClock)
+    fast := config.Replay.Timing == ReplayFast
+    wait := !discrete && !fast
+
+    // The length of one pass, so looped passes keep advancing in time.
+    // One mean sample interval is added so the wrap-around isn't a
+    // duplicate timestamp.
+    period := time.Second
+    if n := len(samples); n > 1 && samples[n-1].Offset > 0 {
+        span := samples[n-1].Offset
+        period = span + span/time.Duration(n-1)
+    }
+
+    go func() {
+        defer close(fifo.ch)
+        var last time.Time
+        for pass := int64(0); ; pass++ {
+            for _, s := range samples {
+                recorded := time.Duration(pass)*period + s.Offset
+                offset := time.Duration(float64(recorded) * scale)
+                when := startTime.Add(offset)
+                if fast && !discrete {
+                    when = clock.Now()
+                }
+                if wait {
+                    if d := when.Sub(clock.Now()); d > 0 {
+                        select {
+                        case <-clock.After(d):
+                        case <-ctx.Done():
+                            return
+                        }
+                    }
+                }
+
+                val, sat := adc.Clamp(float64(s.Value))
+                at := when.Sub(startTime).Seconds()
+                val, sat, fault, emit := faults.Apply(at,
+                                                      val,
+                                                      sat,
+                                                      adc)
+                last = when
+                if !emit {
+                    // Dropout; see StartSensor for the discrete clock
+                    if discrete && !fifo.push(ctx, SensorData{
+                        Type:      sType,
+                        Timestamp: when,
+                        Nominal:   when,
+                        Missing:   true,
+                    }) {
+                        return
+                    }
+                    continue
+                }
+                data := SensorData{
+                    Type:       sType,
+                    Value:      val,
+                    Timestamp:  when,
+                    Nominal:    when,
+                    Saturation: sat,
+                    Fault:      fault,
+                }
+                if !fifo.push(ctx, data) {
+                    return
+                }
+            }
+            if !config.Replay.Loop {
+                // Tell the consumer the capture is over; a closed channel
+                // alone would be lost in the fan-in of all sensors.
+                fifo.push(ctx, SensorData{
+                    Type:        sType,
+                    Timestamp:   last,
+                    EndOfStream: true,
+                })
+                return
+            }
+        }
+    }()
+    return fifo.ch
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func writeCapture(t *testing.T, name, content string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), name)
+    if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatalf("Failed to write capture: %v", err)
+    }
+    return path
+}
+
+func TestLoadReplayFormats(t *testing.T) {
+    csvPath := writeCapture(t, "p.csv",
+        "t,value\n10.0,100\n10.1,101\n10.25,99\n")
+    jsonlPath := writeCapture(t, "p.jsonl",
+        "{\"t\": 10.0, \"value\": 100}\n\n"+
+        "{\"t\": 10.1, \"value\": 101}\n"+
+        "{\"t\": 10.25, \"value\": 99}\n")
+
+    for _, path := range []string{csvPath, jsonlPath} {
+        samples, err := LoadReplay(ReplayConfig{File: path})
+        if err != nil {
+            t.Fatalf("LoadReplay(%s) failed: %v", path, err)
+        }
+        if len(samples) != 3 {
+            t.Fatalf("Expected 3 samples, got %d", len(samples))
+        }
+        // Offsets are relative to the first recorded sample
+        if samples[2].Offset != 250*time.Millisecond ||
+            samples[2].Value != 99 {
+            t.Errorf("%s: unexpected last sample %+v", path, samples[2])
+        }
+    }
+}
+
+func TestLoadReplayRejectsBadCaptures(t *testing.T) {
+    backwards := writeCapture(t, "b.csv", "0.2,1\n0.1,2\n")
+    if _, err := LoadReplay(ReplayConfig{File: backwards}); err == nil {
+        t.Error("Expected error for decreasing timestamps")
+    }
+    missing := writeCapture(t, "m.jsonl", "{\"t\": 1}\n")
+    _, err := LoadReplay(ReplayConfig{File: missing})
+    if err == nil || !strings.Contains(err.Error(), "line 1") {
+        t.Errorf("Expected line 1 error, got %v", err)
+    }
+}
+
+func TestStartReplay(t *testing.T) {
+    config := SensorConfig{
+        ResolutionBits: 8,
+        Replay:         &ReplayConfig{Timing: ReplayScaled, TimeScale: 2},
+    }
+    samples := []ReplaySample{
+        {Offset: 0, Value: 100},
+        {Offset: 100 * time.Millisecond, Value: 300},
+    }
+    clock := NewDiscreteClock()
+    start := clock.Now()
+    ch := StartReplay(context.Background(),
+                      clock,
+                      PressureSensor,
+                      config,
+                      samples,
+                      0)
+
+    first := <-ch
+    if first.Value != 100 || !first.Timestamp.Equal(start) {
+        t.Errorf("Unexpected first sample %+v", first)
+    }
+    // Time scale 2 doubles the spacing; 300 saturates the 8-bit range
+    second := <-ch
+    if second.Value != 255 || second.Saturation != SaturatedHigh ||
+        second.Timestamp.Sub(start) != 200*time.Millisecond {
+        t.Errorf("Unexpected second sample %+v", second)
+    }
+    if end := <-ch; !end.EndOfStream {
+        t.Errorf("Expected end of stream, got %+v", end)
+    }
+    if _, open := <-ch; open {
+        t.Error("Expected channel to be closed")
+    }
+}
+
+func TestStartReplayFastWallClock(t *testing.T) {
+    // A fast replay of a non-primary sensor spanning an hour: on a wall
+    // clock it is stamped when sent, so it can't end the run by looking
+    // an hour late to the deadline check
+    config := SensorConfig{Replay: &ReplayConfig{Timing: ReplayFast}}
+    var samples []ReplaySample
+    for i := 0; i < 100; i++ {
+        samples = append(samples, ReplaySample{
+            Offset: time.Duration(i) * 36 * time.Second,
+            Value:  int32(i),
+        })
+    }
+    clock := NewRealClock()
+    start := clock.Now()
+    ch := StartReplay(context.Background(),
+                      clock,
+                      PressureSensor,
+                      config,
+                      samples,
+                      0)
+    n := 0
+    for data := range ch {
+        if data.Timestamp.Sub(start) > time.Second {
+            t.Fatalf("Sample %d stamped %v after the start", n,
+                data.Timestamp.Sub(start))
+        }
+        if !data.EndOfStream {
+            n++
+        }
+    }
+    if n != len(samples) {
+        t.Errorf("Expected %d samples, got %d", len(samples), n)
+    }
+}
@@ -59,3 +59,44 @@ func SafeDiv32(a, b int32) (int32, error) {
     return a / b, nil
 }
 
+
+// SafeAdd64 adds two int64 numbers and checks for overflow.
+func SafeAdd64(a, b int64) (int64, error) {
+    if b > 0 {
+        if a > math.MaxInt64-b {
+            return 0, ErrOverflow
+        }
+    } else {
+        if a < math.MinInt64-b {
+            return 0, ErrOverflow
+        }
+    }
+    return a + b, nil
+}
+
+// SafeSub64 subtracts two int64 numbers and checks for overflow.
+func SafeSub64(a, b int64) (int64, error) {
+    if b > 0 {
+        if a < math.MinInt64+b {
+            return 0, ErrOverflow
+        }
+    } else {
+        if a > math.MaxInt64+b {
+            return 0, ErrOverflow
+        }
+    }
+    return a - b, nil
+}
+
+// SafeMul64 multiplies two int64 numbers and checks for overflow.
+func SafeMul64(a, b int64) (int64, error) {
+    if a == 0 || b == 0 {
+        return 0, nil
+    }
+    result := a * b
+    if result/b != a || (a == -1 && b == math.MinInt64) ||
+        (b == -1 && a == math.MinInt64) {
+        return 0, ErrOverflow
+    }
+    return result, nil
+}
@@ -23,3 +23,27 @@ func TestSafeMul32(t *testing.T) {
     }
 }
 
+
+func TestSafeMath64(t *testing.T) {
+    if _, err := SafeAdd64(math.MaxInt64, 1); err != ErrOverflow {
+        t.Error("Expected overflow for MaxInt64 + 1")
+    }
+    if _, err := SafeSub64(math.MinInt64, 1); err != ErrOverflow {
+        t.Error("Expected overflow for MinInt64 - 1")
+    }
+    if v, err := SafeSub64(-1, math.MaxInt64); err != nil ||
+        v != math.MinInt64 {
+        t.Error("-1 - MaxInt64 failed")
+    }
+    for _, pair := range [][2]int64{{math.MaxInt64/2 + 1, 2},
+                                    {math.MinInt64, -1},
+                                    {-1, math.MinInt64},
+                                    {1 << 32, 1 << 31}} {
+        if _, err := SafeMul64(pair[0], pair[1]); err != ErrOverflow {
+            t.Errorf("Expected overflow for %d * %d", pair[0], pair[1])
+        }
+    }
+    if v, err := SafeMul64(-1<<31, 1<<32); err != nil || v != -1<<63 {
+        t.Error("-2^31 * 2^32 failed")
+    }
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "os"
+    "sort"
+
+    "github.com/go-json-experiment/json"
+)
+
+// Scenario event actions.
+const (
+    ScenarioSet         = "set"          // step a reference parameter
+    ScenarioRamp        = "ramp"         // ramp a reference parameter
+    ScenarioEquation    = "equation"     // swap a sensor's equation
+    ScenarioInjectFault = "inject_fault" // start a fault on a sensor
+    ScenarioClearFault  = "clear_fault"  // stop a sensor's faults
+    ScenarioFilterAlpha = "filter_alpha" // retune a sensor's low-pass filters
+    ScenarioEnd         = "end"          // end the run
+)
+
+// scenarioParams are the reference parameters a scenario can move.
+var scenarioParams = map[string]bool{"RefF": true, "RefP": true, "RefT": true}
+
+// ScenarioEvent is one timestamped change applied during a run.
+type ScenarioEvent struct {
+    // Simulated time of the event, in seconds from the start of the run
+    AtS       float64      `json:"at_s"`
+    // "set", "ramp", "equation", "inject_fault", "clear_fault",
+    // "filter_alpha" or "end"
+    Action    string       `json:"action"`
+    // set/ramp: "RefF", "RefP" or "RefT"
+    Param     string       `json:"param,omitempty"`
+    // set/ramp: new value (reached at the end of a ramp)
+    Value     float64      `json:"value,omitempty"`
+    // ramp: seconds to go linearly from the current value to value
+    DurationS float64      `json:"duration_s,omitempty"`
+    // equation, inject_fault, clear_fault, filter_alpha: target sensor
+    Sensor    string       `json:"sensor,omitempty"`
+    // equation: the new equation
+    Equation  string       `json:"equation,omitempty"`
+    // inject_fault: the fault, its start_s counted from at_s
+    Fault     *FaultConfig `json:"fault,omitempty"`
+    // clear_fault: only faults of this type (all when empty)
+    FaultType string       `json:"fault_type,omitempty"`
+    // filter_alpha: new low-pass alpha, 0-1
+    Alpha     float64      `json:"alpha,omitempty"`
+}
+
+// Scenario is a timeline of events scripted for a run.
+//
+// Every event is a function of simulated time, not of when a goroutine
+// happens to see it: reference parameters and equations are looked up at
+// each sample's own instant, faults are folded into the sensors' fault
+// schedules before the run, and processing events apply as the (ordered)
+// event stream passes their time. A scenario played on the discrete clock
+// is therefore exactly reproducible.
+type Scenario struct {
+    Events []ScenarioEvent `json:"events"`
+}
+
+// LoadScenario reads a scenario file and sorts its events by time
+// (events at the same time keep their file order).
+func LoadScenario(filename string) (*Scenario, error) {
+    file, err := os.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+    var s Scenario
+    if err := json.Unmarshal(file, &s); err != nil {
+        return nil, fmt.Errorf("%s: %w", filename, err)
+    }
+    sort.SliceStable(s.Events, func(i, j int) bool {
+        return s.Events[i].AtS < s.Events[j].AtS
+    })
+    return &s, nil
+}
+
+// Validate checks every event against the configuration it will run with.
+func (s *Scenario) Validate(config *Config) error {
+    for i, ev := range s.Events {
+        if err := ev.validate(config.Sensors, config.tables); err != nil {
+            return fmt.Errorf("events[%d] (%s at %gs): %w",
+                i, ev.Action, ev.AtS, err)
+        }
+    }
+    // A swapped-in equation may read other sensors too, so the dependency
+    // graph is checked with every equation a sensor will ever have.
+    _, err := config.Sensors.dependencies(s.equations(), config.tables)
+    if err != nil {
+        return fmt.Errorf("scenario: %w", err)
+    }
+    return nil
+}
+
+func (ev ScenarioEvent) validate(sensors SensorsConfig,
+                                 tables map[string]*Table) error {
+    if ev.AtS < 0 {
+        return fmt.Errorf("at_s must not be negative")
+    }
+    switch ev.Action {
+    case ScenarioSet, ScenarioRamp:
+        if !scenarioParams[ev.Param] {
+            return fmt.Errorf("param must be RefF, RefP or RefT, got %q",
+                ev.Param)
+        }
+        if ev.DurationS < 0 {
+            return fmt.Errorf("duration_s must not be negative")
+        }
+        return nil
+    case ScenarioEnd:
+        return nil
+    case ScenarioEquation, ScenarioInjectFault, ScenarioClearFault,
+        ScenarioFilterAlpha:
+    default:
+        return fmt.Errorf("unknown action %q", ev.Action)
+    }
+
+    sc, ok := sensors[ev.Sensor]
+    if !ok {
+        return fmt.Errorf("unknown sensor %q", ev.Sensor)
+    }
+    switch ev.Action {
+    case ScenarioEquation:
+        if sc.Replay != nil {
+            return fmt.Errorf("sensor %q is replayed and has no equation",
+                ev.Sensor)
+        }
+        _, err := compileEquation(ev.Equation, sensors.equationScope(tables))
+        if err != nil {
+            return fmt.Errorf("equation: %w", err)
+        }
+    case ScenarioInjectFault:
+        if ev.Fault == nil {
+            return fmt.Errorf("fault is required")
+        }
+        // Like its configured faults (see SensorConfig.Validate)
+        if sc.Pulse != nil {
+            return fmt.Errorf("sensor %q is a pulse sensor and takes no "+
+                "faults", ev.Sensor)
+        }
+        return ev.Fault.Validate()
+    case ScenarioClearFault:
+        if ev.FaultType != "" {
+            return FaultConfig{Type: ev.FaultType}.Validate()
+        }
+    case ScenarioFilterAlpha:
+        if ev.Alpha < 0 || ev.Alpha > 1 {
+            return fmt.Errorf("alpha must be 0-1, got %g", ev.Alpha)
+        }
+    }
+    return nil
+}
+
+// equations returns the equations each sensor is switched to, in order.
+func (s *Scenario) equations() map[string][]string {
+    eqs := map[string][]string{}
+    if s == nil {
+        return eqs
+    }
+    for _, ev := range s.Events {
+        if ev.Action == ScenarioEquation {
+            eqs[ev.Sensor] = append(eqs[ev.Sensor], ev.Equation)
+        }
+    }
+    return eqs
+}
+
+// ApplyFaults folds the fault events into the sensors' fault schedules:
+// an injected fault starts at_s later than its own start_s, and a clear
+// ends every matching fault (configured or injected) active by then.
+// Faults thus stay on simulated time like the configured ones.
+func (s *Scenario) ApplyFaults(sensors SensorsConfig) {
+    if s == nil {
+        return
+    }
+    for _, ev := range s.Events {
+        if ev.Action != ScenarioInjectFault {
+            continue
+        }
+        sc := sensors[ev.Sensor]
+        f := *ev.Fault
+        f.StartS += ev.AtS
+        sc.Faults = append(sc.Faults, f)
+        sensors[ev.Sensor] = sc
+    }
+
+    for _, ev := range s.Events {
+        if ev.Action != ScenarioClearFault {
+            continue
+        }
+        faults := sensors[ev.Sensor].Faults
+        for i, f := range faults {
+            if ev.FaultType != "" && f.Type != ev.FaultType {
+                continue
+            }
+            // Faults due only after the clear are left alone
+            if f.StartS < ev.AtS && (f.EndS == 0 || f.EndS > ev.AtS) {
+                faults[i].EndS = ev.AtS
+            }
+        }
+    }
+}
+
+// Param returns the value of a reference parameter t seconds into the
+// run, base being its configured value. A ramp starts from whatever value
+// the parameter has at its at_s, and a later event interrupts it.
+func (s *Scenario) Param(name string, base, t float64) float64 {
+    if s == nil {
+        return base
+    }
+    value := base
+    var ramp *ScenarioEvent
+    var from float64
+    for i := range s.Events {
+        ev := &s.Events[i]
+        if ev.AtS > t {
+            break
+        }
+        if ev.Param != name ||
+            (ev.Action != ScenarioSet && ev.Action != ScenarioRamp) {
+            continue
+        }
+        if ramp != nil {
+            value = ramp.rampValue(from, ev.AtS)
+            ramp = nil
+        }
+        if ev.Action == ScenarioRamp && ev.DurationS > 0 {
+            ramp, from = ev, value
+        } else {
+            value = ev.Value
+        }
+    }
+    if ramp != nil {
+        value = ramp.rampValue(from, t)
+    }
+    return value
+}
+
+// Ref is Param for the integer reference values of the flow equation.
+func (s *Scenario) Ref(name string, base int32, t float64) int32 {
+    return int32(math.Round(s.Param(name, float64(base), t)))
+}
+
+// rampValue is the value of a ramp started from from, at time t.
+func (ev *ScenarioEvent) rampValue(from, t float64) float64 {
+    progress := (t - ev.AtS) / ev.DurationS
+    if progress >= 1 {
+        return ev.Value
+    }
+    return from + (ev.Value-from)*progress
+}
+
+// Processing returns the events the processing loop applies (filter
+// changes and the end of the run), in time order.
+func (s *Scenario) Processing() []ScenarioEvent {
+    if s == nil {
+        return nil
+    }
+    var events []ScenarioEvent
+    for _, ev := range s.Events {
+        if ev.Action == ScenarioFilterAlpha || ev.Action == ScenarioEnd {
+            events = append(events, ev)
+        }
+    }
+    return events
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "math"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestLoadScenario(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "scenario.json")
+    data := `{"events": [
+        {"at_s": 30, "action": "end"},
+        {"at_s": 10, "action": "set", "param": "RefP", "value": 150}
+    ]}`
+    if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    s, err := LoadScenario(path)
+    if err != nil {
+        t.Fatalf("LoadScenario failed: %v", err)
+    }
+    if len(s.Events) != 2 || s.Events[0].Action != ScenarioSet {
+        t.Errorf("Expected events sorted by time, got %+v", s.Events)
+    }
+    if p := s.Processing(); len(p) != 1 || p[0].Action != ScenarioEnd {
+        t.Errorf("Expected only the end event for processing, got %+v", p)
+    }
+}
+
+func TestScenarioParam(t *testing.T) {
+    s := &Scenario{Events: []ScenarioEvent{
+        {AtS: 10, Action: ScenarioSet, Param: "RefP", Value: 150},
+        {AtS: 20, Action: ScenarioRamp, Param: "RefP", Value: 250,
+            DurationS: 10},
+        // Interrupts the ramp halfway, from 200
+        {AtS: 25, Action: ScenarioRamp, Param: "RefP", Value: 100,
+            DurationS: 10},
+    }}
+    tests := []struct {
+        t        float64
+        expected float64
+    }{
+        {0, 100},
+        {10, 150},
+        {20, 150},
+        {22, 170},
+        {25, 200},
+        {30, 150},
+        {40, 100},
+    }
+    for _, tc := range tests {
+        if v := s.Param("RefP", 100, tc.t); math.Abs(v-tc.expected) > 1e-9 {
+            t.Errorf("RefP at %gs: expected %g, got %g", tc.t, tc.expected, v)
+        }
+    }
+    if v := s.Param("RefT", 80, 40); v != 80 {
+        t.Errorf("Untouched RefT should stay 80, got %g", v)
+    }
+}
+
+func TestScenarioApplyFaults(t *testing.T) {
+    sensors := SensorsConfig{
+        "pressure": {
+            FrequencyHz: 10,
+            Equation:    "RefP",
+            Faults:      []FaultConfig{{Type: FaultDrift, RatePerS: 1}},
+        },
+    }
+    s := &Scenario{Events: []ScenarioEvent{
+        {AtS: 10, Action: ScenarioInjectFault, Sensor: "pressure",
+            Fault: &FaultConfig{Type: FaultStuck, StartS: 2}},
+        {AtS: 20, Action: ScenarioClearFault, Sensor: "pressure",
+            FaultType: FaultStuck},
+        {AtS: 30, Action: ScenarioClearFault, Sensor: "pressure"},
+    }}
+    s.ApplyFaults(sensors)
+
+    faults := sensors["pressure"].Faults
+    if len(faults) != 2 {
+        t.Fatalf("Expected 2 faults, got %+v", faults)
+    }
+    if faults[0].EndS != 30 {
+        t.Errorf("Drift should end at 30s, got %g", faults[0].EndS)
+    }
+    if faults[1].StartS != 12 || faults[1].EndS != 20 {
+        t.Errorf("Stuck should run 12-20s, got %g-%g",
+                 faults[1].StartS, faults[1].EndS)
+    }
+}
+
+func TestScenarioValidate(t *testing.T) {
+    config := validTestConfig()
+    bad := []ScenarioEvent{
+        {Action: "explode"},
+        {Action: ScenarioSet, Param: "RefX"},
+        {Action: ScenarioEquation, Sensor: "nope", Equation: "1"},
+        {Action: ScenarioInjectFault, Sensor: "dp"},
+        {Action: ScenarioFilterAlpha, Sensor: "dp", Alpha: 2},
+        // dp reading flow while flow reads dp closes a cycle
+        {Action: ScenarioEquation, Sensor: "flow", Equation: "dp"},
+    }
+    config.Sensors["dp"] = SensorConfig{FrequencyHz: 10, Equation: "flow"}
+    for _, ev := range bad {
+        s := &Scenario{Events: []ScenarioEvent{ev}}
+        if err := s.Validate(&config); err == nil {
+            t.Errorf("Expected %+v to be rejected", ev)
+        }
+    }
+
+    // A pulse sensor takes no faults, the event's index says which
+    config.Sensors["gate"] = SensorConfig{FrequencyHz: 10,
+                                          Equation:    "1",
+                                          Pulse:       &PulseConfig{KFactor: 1}}
+    s := &Scenario{Events: []ScenarioEvent{
+        {Action: ScenarioSet, Param: "RefF", Value: 1},
+        {Action: ScenarioInjectFault, Sensor: "gate",
+         Fault: &FaultConfig{Type: FaultStuck}},
+    }}
+    err := s.Validate(&config)
+    if err == nil || !strings.HasPrefix(err.Error(), "events[1]") ||
+        !strings.Contains(err.Error(), "pulse sensor") {
+        t.Errorf("Expected a pulse sensor error on events[1], got %v", err)
+    }
+}
+
+func TestLiveValuesScenario(t *testing.T) {
+    sensors := SensorsConfig{
+        "pressure": {FrequencyHz: 10, Equation: "RefP"},
+    }
+    s := &Scenario{Events: []ScenarioEvent{
+        {AtS: 1, Action: ScenarioSet, Param: "RefP", Value: 150},
+        {AtS: 2, Action: ScenarioEquation, Sensor: "pressure",
+            Equation: "RefP + 1"},
+    }}
+    lv, err := NewLiveValues(sensors,
+                             nil,
+                             map[string]interface{}{"RefP": 100.0},
+                             s,
+                             nil,
+                             0)
+    if err != nil {
+        t.Fatalf("NewLiveValues failed: %v", err)
+    }
+    // Samples 9, 10 and 20 are at 0.9, 1 and 2 seconds
+    for _, tc := range []struct {
+        n        int64
+        expected float64
+    }{
+        {9, 100},
+        {10, 150},
+        {20, 151},
+    } {
+        v, err := lv.Value("pressure", tc.n)
+        if err != nil || v != tc.expected {
+            t.Errorf("Sample %d: expected %g, got %g (%v)",
+                     tc.n, tc.expected, v, err)
+        }
+    }
+
+    s.Events = append(s.Events, ScenarioEvent{
+        Action: ScenarioEquation, Sensor: "pressure", Equation: "pressure",
+    })
+    _, err = NewLiveValues(sensors, nil, nil, s, nil, 0)
+    if err == nil || !strings.Contains(err.Error(), "cycle") {
+        t.Errorf("Expected a cycle error, got %v", err)
+    }
+}
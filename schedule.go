@@ -0,0 +1,155 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "time"
+)
+
+// Jitter distributions of a sampling schedule.
+const (
+    JitterUniform     = "uniform"     // uniform in [-jitter_s, +jitter_s]
+    JitterNormal      = "normal"      // Gaussian, standard deviation jitter_s
+    JitterExponential = "exponential" // latency only, mean jitter_s
+)
+
+// maxJitterPeriods bounds the jitter of a sample to this fraction of a
+// period, so samples of a sensor never swap places.
+const maxJitterPeriods = 0.45
+
+// scheduleSalt separates the jitter stream from the sensor's noise streams,
+// which are derived from the same seed.
+const scheduleSalt = 0x5c4ed
+
+// ScheduleConfig refines when a sensor samples, beyond its frequency_hz.
+type ScheduleConfig struct {
+    // Delay of every sample instant, e.g. to stagger sensors of one rate
+    PhaseS             float64 `json:"phase_s,omitempty"`
+    // Interrupt jitter, see jitter_distribution
+    JitterS            float64 `json:"jitter_s,omitempty"`
+    // "uniform" (default), "normal" or "exponential"
+    JitterDistribution string  `json:"jitter_distribution,omitempty"`
+    // Error of the sensor's ADC clock in parts per million;
+    // a positive drift runs fast, so samples come early
+    DriftPPM           float64 `json:"drift_ppm,omitempty"`
+}
+
+// Validate checks the constraints of a sampling schedule.
+func (sc ScheduleConfig) Validate() error {
+    if sc.PhaseS < 0 || sc.JitterS < 0 {
+        return fmt.Errorf("schedule phase_s and jitter_s must not be " +
+            "negative")
+    }
+    switch sc.JitterDistribution {
+    case "", JitterUniform, JitterNormal, JitterExponential:
+    default:
+        return fmt.Errorf("schedule jitter_distribution must be 'uniform', "+
+            "'normal' or 'exponential', got %s", sc.JitterDistribution)
+    }
+    if math.Abs(sc.DriftPPM) >= 1e5 {
+        return fmt.Errorf("schedule drift_ppm must be within +/-100000, "+
+            "got %g", sc.DriftPPM)
+    }
+    return nil
+}
+
+// Schedule gives the instants of a sensor's samples n = 1, 2, ... as
+// offsets from the start of the run.
+//
+// The nominal instant is phase + n/frequency, where the sample should be.
+// The actual instant is where the sensor's drifting clock and interrupt
+// latency put it. Jitter is a pure function of the seed and n (like the
+// DNL pattern), so the schedule can be queried in any order, by the sensor
+// itself and by the equations of the sensors reading it.
+type Schedule struct {
+    frequency    float64
+    phase        float64
+    jitter       float64
+    distribution string
+    drift        float64
+    maxJitter    float64
+    seed         int64
+}
+
+// NewSchedule builds the schedule of a sensor. config may be nil for
+// plain periodic sampling.
+func NewSchedule(frequencyHz float64,
+                 config *ScheduleConfig,
+                 seed int64) *Schedule {
+    s := &Schedule{
+        frequency: frequencyHz,
+        drift:     1,
+        seed:      mixSeed(seed, scheduleSalt),
+    }
+    if config != nil {
+        s.phase = config.PhaseS
+        s.jitter = config.JitterS
+        s.distribution = config.JitterDistribution
+        s.drift = 1 + config.DriftPPM*1e-6
+    }
+    // Bound against the shorter, drifted period
+    s.maxJitter = maxJitterPeriods / frequencyHz / math.Max(s.drift, 1)
+    return s
+}
+
+// Nominal returns the nominal instant of sample n.
+func (s *Schedule) Nominal(n int64) time.Duration {
+    ns := s.phase*1e9 + float64(n)*1e9/s.frequency
+    return time.Duration(math.Round(ns))
+}
+
+// Actual returns the instant sample n is really taken.
+func (s *Schedule) Actual(n int64) time.Duration {
+    if s.drift == 1 && s.jitter == 0 {
+        return s.Nominal(n)
+    }
+    ns := float64(s.Nominal(n))/s.drift + s.jitterAt(n)*1e9
+    return time.Duration(math.Round(ns))
+}
+
+// Index returns the latest sample taken at or before t, or 0 if none.
+func (s *Schedule) Index(t time.Duration) int64 {
+    if t < s.Actual(1) {
+        return 0
+    }
+    // Start from the nominal estimate; jitter moves it by less than half a
+    // period, so only a step or two is needed.
+    n := int64((t.Seconds()*s.drift - s.phase) * s.frequency)
+    if n < 1 {
+        n = 1
+    }
+    for s.Actual(n+1) <= t {
+        n++
+    }
+    for n > 1 && s.Actual(n) > t {
+        n--
+    }
+    return n
+}
+
+// jitterAt returns the jitter of sample n in seconds.
+func (s *Schedule) jitterAt(n int64) float64 {
+    if s.jitter == 0 {
+        return 0
+    }
+    h := mixSeed(s.seed, n)
+    u := unitFloat(h)
+    var j float64
+    switch s.distribution {
+    case JitterNormal:
+        // Box-Muller on two hashed uniforms, u1 in (0, 1]
+        u1 := 1 - u
+        u2 := unitFloat(mixSeed(h, 1))
+        j = s.jitter * math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2)
+    case JitterExponential:
+        j = -s.jitter * math.Log(1-u)
+    default:
+        j = (2*u - 1) * s.jitter
+    }
+    return math.Max(-s.maxJitter, math.Min(s.maxJitter, j))
+}
+
+// unitFloat maps a hash onto [0, 1).
+func unitFloat(h int64) float64 {
+    return float64(uint64(h)>>11) / (1 << 53)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+    "context"
+    "math"
+    "testing"
+    "time"
+)
+
+func TestScheduleNominal(t *testing.T) {
+    s := NewSchedule(0.5, &ScheduleConfig{PhaseS: 0.25}, 0)
+    if got := s.Nominal(3); got != 6250*time.Millisecond {
+        t.Errorf("Expected 6.25s, got %v", got)
+    }
+    s = NewSchedule(12.5, nil, 0)
+    if got := s.Actual(5); got != 400*time.Millisecond {
+        t.Errorf("Expected 400ms, got %v", got)
+    }
+}
+
+func TestScheduleDrift(t *testing.T) {
+    s := NewSchedule(100, &ScheduleConfig{DriftPPM: 100}, 0)
+    // A fast clock reaches its 100th second early
+    want := 100 / 1.0001
+    if got := s.Actual(10000).Seconds(); math.Abs(got-want) > 1e-9 {
+        t.Errorf("Expected %.9fs, got %.9fs", want, got)
+    }
+}
+
+func TestScheduleJitter(t *testing.T) {
+    for _, dist := range []string{JitterUniform, JitterNormal,
+        JitterExponential} {
+        config := &ScheduleConfig{JitterS: 0.004, JitterDistribution: dist}
+        s := NewSchedule(100, config, 7)
+        again := NewSchedule(100, config, 7)
+        var sum float64
+        prev := time.Duration(0)
+        for n := int64(1); n <= 10000; n++ {
+            actual := s.Actual(n)
+            if actual <= prev {
+                t.Fatalf("%s: sample %d at %v is not after %v",
+                         dist, n, actual, prev)
+            }
+            if actual != again.Actual(n) {
+                t.Fatalf("%s: sample %d is not reproducible", dist, n)
+            }
+            if s.Index(actual) != n || s.Index(actual-1) != n-1 {
+                t.Fatalf("%s: Index does not invert sample %d", dist, n)
+            }
+            off := (actual - s.Nominal(n)).Seconds()
+            if math.Abs(off) > 0.0045+1e-9 {
+                t.Fatalf("%s: jitter %g beyond the bound", dist, off)
+            }
+            sum += off
+            prev = actual
+        }
+        // Only interrupt latency is biased
+        mean := sum / 10000
+        if dist == JitterExponential && mean < 0.002 {
+            t.Errorf("%s: expected a late bias, got mean %g", dist, mean)
+        }
+        if dist != JitterExponential && math.Abs(mean) > 0.0002 {
+            t.Errorf("%s: expected no bias, got mean %g", dist, mean)
+        }
+    }
+}
+
+func TestStartSensorSchedule(t *testing.T) {
+    config := SensorConfig{
+        FrequencyHz: 2.5,
+        Equation:    "1",
+        Schedule:    &ScheduleConfig{PhaseS: 0.1, JitterS: 0.05},
+    }
+    clock := NewDiscreteClock()
+    start := clock.Now()
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    ch := StartSensor(ctx, clock, PressureSensor, config, nil, 3)
+
+    for n := 1; n <= 3; n++ {
+        data := <-ch
+        nominal := time.Duration(n)*400*time.Millisecond +
+            100*time.Millisecond
+        if got := data.Nominal.Sub(start); got != nominal {
+            t.Errorf("Sample %d: expected nominal %v, got %v",
+                     n, nominal, got)
+        }
+        off := data.Timestamp.Sub(data.Nominal)
+        if off == 0 || off > 50*time.Millisecond ||
+            off < -50*time.Millisecond {
+            t.Errorf("Sample %d: unexpected jitter %v", n, off)
+        }
+    }
+}
@@ -1,97 +1,275 @@
 package main
 
 import (
+    "context"
     "fmt"
-    "math/rand"
     "time"
 )
 
-// SensorType defines the category of the sensor.
+// SensorType identifies a sensor by its configured name.
 type SensorType string
 
+// Names of the classic flow meter sensors.
 const (
-    FlowSensor        SensorType = "Flow"
-    PressureSensor    SensorType = "Pressure"
-    TemperatureSensor SensorType = "Temperature"
+    FlowSensor        SensorType = "flow"
+    PressureSensor    SensorType = "pressure"
+    TemperatureSensor SensorType = "temperature"
 )
 
 // SensorData represents a standardized data structure for a sensor reading.
 type SensorData struct {
-    Type      SensorType
-    Value     int32
-    Timestamp time.Time
+    Type        SensorType
+    Value       int32
+    // Timestamp is the instant the sample was actually taken; Nominal is
+    // the instant it was scheduled for (they differ by jitter and drift)
+    Timestamp   time.Time
+    Nominal     time.Time
+    // Saturation reports whether the ADC clipped this sample
+    Saturation  Saturation
+    // Fault names the injected fault(s) active for this sample, if any
+    Fault       string
+    // EndOfStream marks the last message of a finite source (no Value)
+    EndOfStream bool
+    // Missing marks a sample that was never delivered (a dropout or a
+    // read error; no Value). Only discrete clocks send it, so the ordered
+    // merge can move past the sensor
+    Missing     bool
+    // Overruns and Dropped count the full-FIFO events and the samples of
+    // this sensor lost just before this one was queued (see FIFOConfig)
+    Overruns    int64
+    Dropped     int64
+    // Edge is the instant of the latest pulse counted in Value, for pulse
+    // sensors (see PulseConfig)
+    Edge        time.Time
 }
 
-// readSensorValue calculates the sensor value based on the equation and noise.
-func readSensorValue(config SensorConfig,
-                     startTime time.Time,
-                     params map[string]interface{},
-                     r *rand.Rand) (int32, error) {
-    elapsed := time.Since(startTime).Seconds()
-    
+// SensorEnv is the state shared by all the sensors of a run.
+type SensorEnv struct {
+    // Reference parameters (RefF, RefP, RefT) visible to the equations
+    Params    map[string]interface{}
+    // Jointly distributed noise of correlated sensors (may be nil)
+    Noise     *CorrelatedNoise
+    // Noise-free values the sensor equations read from each other
+    // (may be nil, then equations see only t and Params)
+    Live      *LiveValues
+    // Sampling schedule of each sensor, shared with Live
+    Schedules map[string]*Schedule
+}
+
+// schedule returns the sampling schedule of a sensor, building it from
+// the sensor's config when the env doesn't hold one.
+func (e *SensorEnv) schedule(sType SensorType,
+                             config SensorConfig,
+                             seed int64) *Schedule {
+    if e != nil {
+        if s, ok := e.Schedules[string(sType)]; ok {
+            return s
+        }
+    }
+    return NewSchedule(config.FrequencyHz, config.Schedule, seed)
+}
+
+// trueValue returns the noise-free value of sample n of a sensor, taken
+// elapsed after the start of the run.
+func (e *SensorEnv) trueValue(sType SensorType,
+                              config SensorConfig,
+                              n int64,
+                              elapsed time.Duration) (float64, error) {
+    if e != nil && e.Live.Has(string(sType)) {
+        return e.Live.Value(string(sType), n)
+    }
+
     // Prepare parameters for the equation
     parameters := make(map[string]interface{})
-    for k, v := range params {
-        parameters[k] = v
+    if e != nil {
+        for k, v := range e.Params {
+            parameters[k] = v
+        }
     }
-    parameters["t"] = elapsed
-    
-    baseValue, err := EvaluateEquation(config.Equation, parameters)
+    parameters["t"] = elapsed.Seconds()
+    return EvaluateEquation(config.Equation, parameters)
+}
+
+// readSensorValue calculates the sensor value based on the equation and noise,
+// then converts it with the sensor's adc (see ADC.Convert).
+// now is the simulated instant sample n is taken (see Schedule), so the
+// equation sees simulated time whatever the clock mode.
+// noise is the sensor's own (stateful) noise model, see NewSensorNoise.
+func readSensorValue(sType SensorType,
+                     config SensorConfig,
+                     n int64,
+                     startTime time.Time,
+                     now time.Time,
+                     env *SensorEnv,
+                     noise NoiseModel,
+                     adc ADC) (int32, Saturation, error) {
+    elapsed := now.Sub(startTime)
+
+    baseValue, err := env.trueValue(sType, config, n, elapsed)
     if err != nil {
-        return 0, err
+        return 0, NotSaturated, err
     }
 
     // Add random noise
-    var noise float64
-    if config.NoiseDistribution == "normal" {
-        // Normal distribution (Gaussian): Mean 0, StdDev 1 * Amplitude
-        // This treats Amplitude as the standard deviation
-        noise = r.NormFloat64() * config.NoiseAmplitude
-    } else {
-        // Default: Uniform distribution [-Amplitude, +Amplitude]
-        noise = (r.Float64()*2 - 1) * config.NoiseAmplitude
-    }
-    finalValue := baseValue + noise
-
-    // The values are derived from sensor inputs,
-    // which by design can only produce 
-    // values within the specific range configured for that sensor's bit-depth.
-    // Therefore, explicit clamping here is unnecessary as the simulation 
-    // equations and noise distribution are calibrated to the
-    // sensor's physical limits.
-    return int32(finalValue), nil
+    finalValue := baseValue + noise.Next(elapsed.Seconds())
+
+    // Noise can push a reading past the converter's range, e.g. an 8-bit
+    // pressure channel near 255. A real ADC then saturates at its rails
+    // rather than wrapping, so the value is quantized and clamped to
+    // [0, 2^bits-1] and the clipping is reported to the caller.
+    return adc.Convert(finalValue)
 }
 
 // StartSensor starts a generic sensor simulation.
 // It returns a channel for that specific sensor type.
-func StartSensor(sType SensorType,
+// The sample instants come from the sensor's Schedule, paced by clock, so
+// the same sensor runs in real time, accelerated, or as a discrete-event
+// source.
+// The goroutine runs until ctx is cancelled, then closes the channel. Every
+// channel operation also watches ctx, so a consumer that stops reading
+// never leaves the sensor blocked on a send.
+func StartSensor(ctx context.Context,
+                 clock Clock,
+                 sType SensorType,
                  config SensorConfig,
-                 params map[string]interface{},
+                 env *SensorEnv,
                  seed int64) <-chan SensorData {
-    ch := make(chan SensorData)
-    startTime := time.Now()
-    // Create local random source
-    r := rand.New(rand.NewSource(seed))
+    fifo := newSampleFIFO(config.FIFO, clock)
+    startTime := clock.Now()
+    schedule := env.schedule(sType, config, seed)
+    // Noise models are seeded from the sensor's own seed, so every sensor
+    // is reproducible on its own whatever the other sensors do
+    var joint NoiseModel
+    if env != nil {
+        joint = env.Noise.Model(string(sType))
+    }
+    noise := NewSensorNoise(config, seed, joint)
+    // Faults are applied after the ADC, on the code a consumer would see
+    faults := NewFaultInjector(config.Faults, seed)
+    adc := NewADC(config.ResolutionBits, config.ADC)
+    // Pulse sensors count pulse edges instead of converting a value
+    var pulses *pulseTrain
+    if config.Pulse != nil {
+        pulses = newPulseTrain(*config.Pulse, seed)
+    }
+    // A discrete clock never sleeps; the ordered merge provides pacing.
+    _, discrete := clock.(*DiscreteClock)
 
     go func() {
-        ticker := time.NewTicker(time.Second /
-            time.Duration(config.FrequencyHz))
-        defer ticker.Stop()
+        defer close(fifo.ch)
+        for n := int64(1); ; n++ {
+            now := startTime.Add(schedule.Actual(n))
+            nominal := startTime.Add(schedule.Nominal(n))
+            // A sample that is never delivered; a discrete clock still
+            // hears of it, or the ordered merge would wait on this sensor
+            // forever. It returns false once ctx is cancelled.
+            miss := func() bool {
+                return !discrete || fifo.push(ctx, SensorData{
+                    Type:      sType,
+                    Timestamp: now,
+                    Nominal:   nominal,
+                    Missing:   true,
+                })
+            }
+            if !discrete {
+                if d := now.Sub(clock.Now()); d > 0 {
+                    select {
+                    case <-clock.After(d):
+                    case <-ctx.Done():
+                        return
+                    }
+                }
+            }
+            if ctx.Err() != nil {
+                return
+            }
 
-        for range ticker.C {
-            val, err := readSensorValue(config, startTime, params, r)
+            if pulses != nil {
+                count, edge, err := readPulses(sType,
+                                               config,
+                                               n,
+                                               startTime,
+                                               now,
+                                               env,
+                                               noise,
+                                               pulses)
+                if err != nil {
+                    fmt.Printf("Error reading %s: %v\n", sType, err)
+                    if !miss() {
+                        return
+                    }
+                    continue
+                }
+                data := SensorData{
+                    Type:      sType,
+                    Value:     count,
+                    Timestamp: now,
+                    Nominal:   nominal,
+                    Edge:      edge,
+                }
+                if !fifo.push(ctx, data) {
+                    return
+                }
+                continue
+            }
+
+            val, sat, err := readSensorValue(sType,
+                                             config,
+                                             n,
+                                             startTime,
+                                             now,
+                                             env,
+                                             noise,
+                                             adc)
             if err != nil {
                 fmt.Printf("Error reading %s: %v\n", sType, err)
+                if !miss() {
+                    return
+                }
+                continue
+            }
+
+            elapsed := now.Sub(startTime).Seconds()
+            val, sat, fault, emit := faults.Apply(elapsed, val, sat, adc)
+            if !emit {
+                // Dropout: the interrupt never fires for this sample
+                if !miss() {
+                    return
+                }
                 continue
             }
 
-            ch <- SensorData{
-                Type:      sType,
-                Value:     val,
-                Timestamp: time.Now(),
+            data := SensorData{
+                Type:       sType,
+                Value:      val,
+                Timestamp:  now,
+                Nominal:    nominal,
+                Saturation: sat,
+                Fault:      fault,
+            }
+            if !fifo.push(ctx, data) {
+                return
             }
         }
     }()
-    return ch
+    return fifo.ch
 }
 
+// StartSource starts the configured source for a sensor: a recorded
+// capture when the sensor has a "replay" section, else the simulated
+// equation. Both deliver SensorData on the same channel contract.
+func StartSource(ctx context.Context,
+                 clock Clock,
+                 sType SensorType,
+                 config SensorConfig,
+                 env *SensorEnv,
+                 seed int64) (<-chan SensorData, error) {
+    if config.Replay == nil {
+        return StartSensor(ctx, clock, sType, config, env, seed), nil
+    }
+    samples, err := LoadReplay(*config.Replay)
+    if err != nil {
+        return nil, err
+    }
+    return StartReplay(ctx, clock, sType, config, samples, seed), nil
+}
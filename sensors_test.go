@@ -1,8 +1,8 @@
 package main
 
 import (
+    "context"
     "math"
-    "math/rand"
     "testing"
     "time"
 )
@@ -37,9 +37,17 @@ func TestReadSensorValue(t *testing.T) {
         NoiseAmplitude: 0.0,
         ResolutionBits: 8,
     }
-    r := rand.New(rand.NewSource(0))
+    noise := NewSensorNoise(config, 0, nil)
+    start := time.Now()
 
-    val, err := readSensorValue(config, time.Now(), nil, r)
+    val, sat, err := readSensorValue(FlowSensor,
+                                     config,
+                                     1,
+                                     start,
+                                     start,
+                                     nil,
+                                     noise,
+                                     NewADC(8, nil))
     if err != nil {
         t.Fatalf("readSensorValue failed: %v", err)
     }
@@ -47,6 +55,33 @@ func TestReadSensorValue(t *testing.T) {
     if val != 100 {
         t.Errorf("Expected 100, got %d", val)
     }
+    if sat != NotSaturated {
+        t.Errorf("Expected no saturation, got %s", sat)
+    }
+}
+
+func TestReadSensorValueSaturates(t *testing.T) {
+    config := SensorConfig{
+        Equation:       "300",
+        ResolutionBits: 8,
+    }
+    noise := NewSensorNoise(config, 0, nil)
+    start := time.Now()
+
+    val, sat, err := readSensorValue(FlowSensor,
+                                     config,
+                                     1,
+                                     start,
+                                     start,
+                                     nil,
+                                     noise,
+                                     NewADC(8, nil))
+    if err != nil {
+        t.Fatalf("readSensorValue failed: %v", err)
+    }
+    if val != 255 || sat != SaturatedHigh {
+        t.Errorf("Expected 255 (high), got %d (%s)", val, sat)
+    }
 }
 
 func TestStartSensor(t *testing.T) {
@@ -57,7 +92,12 @@ func TestStartSensor(t *testing.T) {
         NoiseAmplitude: 0.0,
     }
 
-    ch := StartSensor(FlowSensor, config, nil, 0)
+    ch := StartSensor(context.Background(),
+                      NewRealClock(),
+                      FlowSensor,
+                      config,
+                      nil,
+                      0)
 
     select {
     case data := <-ch:
@@ -72,3 +112,29 @@ func TestStartSensor(t *testing.T) {
     }
 }
 
+
+func TestStartSensorStopsOnCancel(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    clock := NewDiscreteClock()
+    config := SensorConfig{FrequencyHz: 100, Equation: "1"}
+    flow := StartSensor(ctx, clock, FlowSensor, config, nil, 0)
+    pressure := StartSensor(ctx, clock, PressureSensor, config, nil, 1)
+    events := MergeSensors(ctx, clock, flow, pressure)
+
+    <-events
+    cancel()
+
+    // Nobody reads the sensors after the cancel; the merged stream must
+    // still close, proving every goroutine behind it has returned.
+    done := make(chan struct{})
+    go func() {
+        for range events {
+        }
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(1 * time.Second):
+        t.Error("Sensors did not stop after cancel")
+    }
+}
@@ -0,0 +1,114 @@
+package main
+
+import "fmt"
+
+// Functions with state: each call site keeps the history of its argument
+// across the evaluations of its Equation, so an equation compiled once per
+// sensor, or for the flow calculation, sees dP/dt or a running integral
+// of its own samples. A call in the untaken branch of ?: is not evaluated,
+// and its state doesn't advance.
+
+// prevSite returns x as of the previous evaluation (x itself the first
+// time).
+func prevSite(*equationState, int) siteFunc {
+    var last float64
+    started := false
+    return func(_ float64, args []float64) float64 {
+        x := args[0]
+        if !started {
+            last, started = x, true
+        }
+        prev := last
+        last = x
+        return prev
+    }
+}
+
+// derivSite returns the rate of change of x, per second, since the
+// previous evaluation; 0 the first time. Evaluations at the same t keep
+// the previous rate.
+func derivSite(*equationState, int) siteFunc {
+    var lastT, lastX, rate float64
+    started := false
+    return func(t float64, args []float64) float64 {
+        x := args[0]
+        if started && t > lastT {
+            rate = (x - lastX) / (t - lastT)
+        }
+        if !started || t > lastT {
+            lastT, lastX, started = t, x, true
+        }
+        return rate
+    }
+}
+
+// integSite returns the integral of x over t since the first evaluation,
+// by the trapezoidal rule.
+func integSite(*equationState, int) siteFunc {
+    var lastT, lastX, sum float64
+    started := false
+    return func(t float64, args []float64) float64 {
+        x := args[0]
+        if started && t > lastT {
+            sum += (x + lastX) / 2 * (t - lastT)
+        }
+        if !started || t > lastT {
+            lastT, lastX, started = t, x, true
+        }
+        return sum
+    }
+}
+
+// delaySite returns x as it was the given seconds ago, interpolated
+// between evaluations; the oldest value kept until the history is long
+// enough. Only the history the delay needs is kept.
+func delaySite(*equationState, int) siteFunc {
+    var times, values []float64
+    return func(t float64, args []float64) float64 {
+        x, d := args[0], args[1]
+        if n := len(times); n == 0 || t > times[n-1] {
+            times, values = append(times, t), append(values, x)
+        } else {
+            values[n-1] = x
+        }
+        at := t - d
+        // Drop what is older than the instant before at
+        drop := 0
+        for drop+1 < len(times) && times[drop+1] <= at {
+            drop++
+        }
+        if drop > 0 {
+            times = append(times[:0], times[drop:]...)
+            values = append(values[:0], values[drop:]...)
+        }
+        if at <= times[0] || len(times) == 1 {
+            return values[0]
+        }
+        // times[0] < at < times[1]
+        f := (at - times[0]) / (times[1] - times[0])
+        return values[0] + f*(values[1]-values[0])
+    }
+}
+
+// emaSite returns the exponential moving average of x: each evaluation
+// moves it by alpha of the way to x.
+func emaSite(*equationState, int) siteFunc {
+    var y float64
+    started := false
+    return func(_ float64, args []float64) float64 {
+        x, alpha := args[0], args[1]
+        if !started {
+            y, started = x, true
+        } else {
+            y += alpha * (x - y)
+        }
+        return y
+    }
+}
+
+func checkAlpha(args []float64) error {
+    if !(args[1] > 0 && args[1] <= 1) {
+        return fmt.Errorf("alpha must be in (0, 1], got %g", args[1])
+    }
+    return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "math"
+    "testing"
+)
+
+func TestStatefulFunctions(t *testing.T) {
+    // x = 2t, sampled every 0.5 s
+    tests := []struct {
+        equation string
+        expected []float64
+    }{
+        {"prev(x)", []float64{0, 0, 1, 2, 3}},
+        {"deriv(x)", []float64{0, 2, 2, 2, 2}},
+        {"integ(x)", []float64{0, 0.25, 1, 2.25, 4}},
+        {"delay(x, 0.75)", []float64{0, 0, 0.5, 1.5, 2.5}},
+        {"ema(x, 0.5)", []float64{0, 0.5, 1.25, 2.125, 3.0625}},
+        // Each call site has its own state
+        {"prev(x) + prev(prev(x))", []float64{0, 0, 1, 3, 5}},
+    }
+    for _, tc := range tests {
+        eq, err := CompileEquation(tc.equation, []string{"t", "x"})
+        if err != nil {
+            t.Fatalf("%s: %v", tc.equation, err)
+        }
+        for i, expected := range tc.expected {
+            seconds := float64(i) / 2
+            got, err := eq.Evaluate(map[string]interface{}{
+                "t": seconds,
+                "x": 2 * seconds,
+            })
+            if err != nil {
+                t.Fatalf("%s: %v", tc.equation, err)
+            }
+            if math.Abs(got-expected) > 1e-12 {
+                t.Errorf("%s at t=%g: expected %g, got %g", tc.equation,
+                    seconds, expected, got)
+            }
+        }
+    }
+
+    // deriv, integ and delay read the time from t
+    if _, err := CompileEquation("deriv(x)", []string{"x"}); err == nil {
+        t.Error("Expected deriv to need t")
+    }
+}
+
+func TestCalculateFlowStateful(t *testing.T) {
+    processor := newTestProcessor(t, ProcessingConfig{})
+    processor.Latest["pressure"] = 100
+    equation := "F + deriv(P)"
+    for i, p := range []int32{100, 110, 130} {
+        processor.Latest["pressure"] = p
+        got, err := processor.CalculateFlow(equation, 1000, float64(i),
+                                            0, 0, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        expected := []int32{1000, 1010, 1020}[i]
+        if got != expected {
+            t.Errorf("Sample %d: expected %d, got %d", i, expected, got)
+        }
+    }
+}
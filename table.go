@@ -0,0 +1,318 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "sort"
+)
+
+// Interpolation methods of a lookup table.
+const (
+    InterpolationLinear = "linear" // straight lines between breakpoints
+    InterpolationCubic  = "cubic"  // natural cubic spline
+)
+
+// Edge behaviours of a lookup table, outside its breakpoints.
+const (
+    EdgeClamp       = "clamp"       // the value at the nearest breakpoint
+    EdgeExtrapolate = "extrapolate" // continue the end segment (or slope)
+    EdgeError       = "error"       // the evaluation fails
+)
+
+// TableConfig is a measured characterization, e.g. the discharge
+// coefficient against the Reynolds number, or the density against the
+// pressure and temperature, that equations look up with
+// interp1("name", x) or interp2("name", x, y).
+type TableConfig struct {
+    // Breakpoints of the first input, strictly increasing
+    X             []float64   `json:"x"`
+    // 1-D: the values at X. 2-D: breakpoints of the second input,
+    // strictly increasing
+    Y             []float64   `json:"y"`
+    // 2-D only: Z[i][j] is the value at (X[i], Y[j])
+    Z             [][]float64 `json:"z,omitempty"`
+    // "linear" (default) or "cubic"
+    Interpolation string      `json:"interpolation,omitempty"`
+    // "clamp" (default), "extrapolate" or "error"
+    Edge          string      `json:"edge,omitempty"`
+}
+
+// Validate checks the constraints of a lookup table.
+func (tc TableConfig) Validate() error {
+    if err := checkBreakpoints("x", tc.X); err != nil {
+        return err
+    }
+    if tc.Z == nil {
+        if len(tc.Y) != len(tc.X) {
+            return fmt.Errorf("y needs a value per x, got %d for %d",
+                len(tc.Y), len(tc.X))
+        }
+        if err := checkFinite("y", tc.Y); err != nil {
+            return err
+        }
+    } else {
+        if err := checkBreakpoints("y", tc.Y); err != nil {
+            return err
+        }
+        if len(tc.Z) != len(tc.X) {
+            return fmt.Errorf("z needs a row per x, got %d for %d",
+                len(tc.Z), len(tc.X))
+        }
+        for i, row := range tc.Z {
+            if len(row) != len(tc.Y) {
+                return fmt.Errorf("z[%d] needs a value per y, got %d for %d",
+                    i, len(row), len(tc.Y))
+            }
+            if err := checkFinite(fmt.Sprintf("z[%d]", i), row); err != nil {
+                return err
+            }
+        }
+    }
+    switch tc.Interpolation {
+    case "", InterpolationLinear, InterpolationCubic:
+    default:
+        return fmt.Errorf("interpolation must be 'linear' or 'cubic', "+
+            "got %s", tc.Interpolation)
+    }
+    switch tc.Edge {
+    case "", EdgeClamp, EdgeExtrapolate, EdgeError:
+    default:
+        return fmt.Errorf("edge must be 'clamp', 'extrapolate' or "+
+            "'error', got %s", tc.Edge)
+    }
+    return nil
+}
+
+func checkBreakpoints(name string, x []float64) error {
+    if len(x) < 2 {
+        return fmt.Errorf("%s needs at least 2 breakpoints, got %d", name,
+            len(x))
+    }
+    if err := checkFinite(name, x); err != nil {
+        return err
+    }
+    for i := 1; i < len(x); i++ {
+        if !(x[i] > x[i-1]) {
+            return fmt.Errorf("%s must be strictly increasing at %d", name,
+                i)
+        }
+    }
+    return nil
+}
+
+func checkFinite(name string, values []float64) error {
+    for i, v := range values {
+        if !isFinite(v) {
+            return fmt.Errorf("%s[%d] is not finite", name, i)
+        }
+    }
+    return nil
+}
+
+// Table is a validated lookup table, with its spline prepared.
+type Table struct {
+    config TableConfig
+    cubic  bool
+    // Spline second derivatives: 1-D along X, 2-D along Y for each row
+    m      [][]float64
+}
+
+// NewTable prepares a validated table for lookups.
+func NewTable(config TableConfig) *Table {
+    t := &Table{
+        config: config,
+        cubic:  config.Interpolation == InterpolationCubic,
+    }
+    if !t.cubic {
+        return t
+    }
+    if t.Dims() == 1 {
+        t.m = [][]float64{splineSecond(config.X, config.Y, nil, nil)}
+        return t
+    }
+    for _, row := range config.Z {
+        t.m = append(t.m, splineSecond(config.Y, row, nil, nil))
+    }
+    return t
+}
+
+// Dims returns the number of inputs of the table, 1 or 2.
+func (t *Table) Dims() int {
+    if t.config.Z != nil {
+        return 2
+    }
+    return 1
+}
+
+// tableNode compiles a lookup of table, with the numeric arguments args.
+// Each call site gets its own scratch space, as equations of different
+// sensors evaluate concurrently.
+func (p *equationParser) tableNode(name token,
+                                   table *Table,
+                                   args []exprNode) (exprNode, error) {
+    lookup := table.lookup()
+    constant := true
+    values := make([]float64, len(args))
+    for i, a := range args {
+        constant = constant && a.constant
+        values[i] = a.value
+    }
+    if constant {
+        v, err := lookup(values)
+        if err != nil {
+            return exprNode{}, callError(name, err)
+        }
+        return constNode(v), nil
+    }
+    if p.fixed != nil {
+        return exprNode{}, notFixed(name)
+    }
+
+    evals := make([]evalNode, len(args))
+    for i, a := range args {
+        evals[i] = a.eval()
+    }
+    st := p.state
+    return exprNode{fn: func(v []float64) float64 {
+        for i, e := range evals {
+            values[i] = e(v)
+        }
+        x, err := lookup(values)
+        if err != nil {
+            st.fail(callError(name, err))
+            return math.NaN()
+        }
+        return x
+    }}, nil
+}
+
+// lookup returns a lookup of the table with its own scratch space.
+func (t *Table) lookup() func(args []float64) (float64, error) {
+    c := t.config
+    extrapolate := c.Edge == EdgeExtrapolate
+    if t.Dims() == 1 {
+        var m []float64
+        if t.cubic {
+            m = t.m[0]
+        }
+        return func(args []float64) (float64, error) {
+            if err := t.inRange("x", c.X, args[0]); err != nil {
+                return 0, err
+            }
+            return interpolate(c.X, c.Y, m, args[0], extrapolate), nil
+        }
+    }
+
+    // Interpolate each row at y, then along X
+    rows := make([]float64, len(c.X))
+    var mx, scratch []float64
+    if t.cubic {
+        mx = make([]float64, len(c.X))
+        scratch = make([]float64, len(c.X))
+    }
+    return func(args []float64) (float64, error) {
+        x, y := args[0], args[1]
+        if err := t.inRange("x", c.X, x); err != nil {
+            return 0, err
+        }
+        if err := t.inRange("y", c.Y, y); err != nil {
+            return 0, err
+        }
+        for i, row := range c.Z {
+            var m []float64
+            if t.cubic {
+                m = t.m[i]
+            }
+            rows[i] = interpolate(c.Y, row, m, y, extrapolate)
+        }
+        if t.cubic {
+            splineSecond(c.X, rows, mx, scratch)
+        }
+        return interpolate(c.X, rows, mx, x, extrapolate), nil
+    }
+}
+
+// inRange fails a lookup outside the breakpoints of a table whose edge is
+// "error".
+func (t *Table) inRange(axis string, x []float64, v float64) error {
+    if t.config.Edge != EdgeError {
+        return nil
+    }
+    if !(v >= x[0] && v <= x[len(x)-1]) {
+        return fmt.Errorf("%s %g is outside the table's [%g, %g]", axis, v,
+            x[0], x[len(x)-1])
+    }
+    return nil
+}
+
+// interpolate evaluates the curve through (x, y) at v: linear, or the
+// natural cubic spline with second derivatives m when m is set. Outside
+// the breakpoints it clamps, or extrapolates the end segment (the end
+// slope of a spline).
+func interpolate(x, y, m []float64, v float64, extrapolate bool) float64 {
+    n := len(x)
+    if v < x[0] || v > x[n-1] {
+        end, i := 0, 0
+        if v > x[n-1] {
+            end, i = n-1, n-2
+        }
+        if !extrapolate {
+            return y[end]
+        }
+        h := x[i+1] - x[i]
+        slope := (y[i+1] - y[i]) / h
+        if m != nil {
+            if end == 0 {
+                slope -= h * (2*m[0] + m[1]) / 6
+            } else {
+                slope += h * (m[i] + 2*m[i+1]) / 6
+            }
+        }
+        return y[end] + slope*(v-x[end])
+    }
+
+    // Segment [x[i], x[i+1]] holding v
+    i := sort.SearchFloat64s(x, v) - 1
+    i = max(0, min(i, n-2))
+    h := x[i+1] - x[i]
+    a, b := (x[i+1]-v)/h, (v-x[i])/h
+    value := a*y[i] + b*y[i+1]
+    if m != nil {
+        value += ((a*a*a-a)*m[i] + (b*b*b-b)*m[i+1]) * h * h / 6
+    }
+    return value
+}
+
+// splineSecond computes the second derivatives of the natural cubic
+// spline through (x, y) into m, solving the tridiagonal system with the
+// scratch space c; both are allocated if nil.
+func splineSecond(x, y, m, c []float64) []float64 {
+    n := len(x)
+    if m == nil {
+        m = make([]float64, n)
+    }
+    if c == nil {
+        c = make([]float64, n)
+    }
+    m[0], m[n-1] = 0, 0
+    if n < 3 {
+        return m
+    }
+    // Thomas algorithm: the forward sweep leaves the modified upper
+    // diagonal in c and right-hand side in m
+    for i := 1; i < n-1; i++ {
+        h0, h1 := x[i]-x[i-1], x[i+1]-x[i]
+        d := 6 * ((y[i+1]-y[i])/h1 - (y[i]-y[i-1])/h0)
+        diag := 2 * (h0 + h1)
+        if i > 1 {
+            diag -= h0 * c[i-1]
+            d -= h0 * m[i-1]
+        }
+        c[i] = h1 / diag
+        m[i] = d / diag
+    }
+    for i := n - 3; i >= 1; i-- {
+        m[i] -= c[i] * m[i+1]
+    }
+    return m
+}
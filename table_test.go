@@ -0,0 +1,171 @@
+package main
+
+import (
+    "math"
+    "strings"
+    "testing"
+)
+
+func TestTableConfigValidate(t *testing.T) {
+    tests := []struct {
+        config   TableConfig
+        expected string
+    }{
+        {TableConfig{X: []float64{1}, Y: []float64{1}},
+         "x needs at least 2 breakpoints"},
+        {TableConfig{X: []float64{1, 1}, Y: []float64{1, 2}},
+         "x must be strictly increasing at 1"},
+        {TableConfig{X: []float64{1, 2}, Y: []float64{1}},
+         "y needs a value per x"},
+        {TableConfig{X: []float64{1, 2}, Y: []float64{1, math.NaN()}},
+         "y[1] is not finite"},
+        {TableConfig{X: []float64{1, 2}, Y: []float64{1, 2},
+                     Z: [][]float64{{1, 2}, {3}}},
+         "z[1] needs a value per y"},
+        {TableConfig{X: []float64{1, 2}, Y: []float64{1, 2},
+                     Interpolation: "spline"},
+         "interpolation must be"},
+        {TableConfig{X: []float64{1, 2}, Y: []float64{1, 2}, Edge: "wrap"},
+         "edge must be"},
+    }
+    for _, tc := range tests {
+        err := tc.config.Validate()
+        if err == nil || !strings.Contains(err.Error(), tc.expected) {
+            t.Errorf("Expected %q, got %v", tc.expected, err)
+        }
+    }
+}
+
+func TestTableLookup(t *testing.T) {
+    line := TableConfig{X: []float64{0, 1, 2}, Y: []float64{0, 10, 40}}
+    extrapolated := line
+    extrapolated.Edge = EdgeExtrapolate
+    // A spline through a straight line is the line
+    straight := TableConfig{X: []float64{0, 1, 3, 4},
+                            Y: []float64{1, 3, 7, 9},
+                            Interpolation: InterpolationCubic,
+                            Edge: EdgeExtrapolate}
+    grid := TableConfig{X: []float64{0, 1},
+                        Y: []float64{0, 10},
+                        Z: [][]float64{{0, 10}, {100, 110}}}
+
+    tests := []struct {
+        config   TableConfig
+        args     []float64
+        expected float64
+    }{
+        {line, []float64{0.5}, 5},
+        {line, []float64{1.5}, 25},
+        {line, []float64{2}, 40},
+        {line, []float64{-1}, 0},
+        {line, []float64{3}, 40},
+        {extrapolated, []float64{3}, 70},
+        {extrapolated, []float64{-1}, -10},
+        {straight, []float64{2.2}, 5.4},
+        {straight, []float64{5}, 11},
+        {straight, []float64{-1}, -1},
+        {grid, []float64{0.5, 5}, 55},
+        {grid, []float64{0.25, 10}, 35},
+        {grid, []float64{2, -5}, 100},
+    }
+    for _, tc := range tests {
+        got, err := NewTable(tc.config).lookup()(tc.args)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if math.Abs(got-tc.expected) > 1e-9 {
+            t.Errorf("%v at %v: expected %g, got %g", tc.config, tc.args,
+                tc.expected, got)
+        }
+    }
+}
+
+func TestTableSpline(t *testing.T) {
+    // Through the breakpoints, and close to the sine they sample
+    config := TableConfig{Interpolation: InterpolationCubic}
+    for i := 0; i <= 20; i++ {
+        x := float64(i) * math.Pi / 20
+        config.X = append(config.X, x)
+        config.Y = append(config.Y, math.Sin(x))
+    }
+    lookup := NewTable(config).lookup()
+    for i, x := range config.X {
+        if got, _ := lookup([]float64{x}); math.Abs(got-config.Y[i]) > 1e-12 {
+            t.Errorf("At breakpoint %g: expected %g, got %g", x,
+                config.Y[i], got)
+        }
+    }
+    for x := 0.1; x < math.Pi; x += 0.1 {
+        if got, _ := lookup([]float64{x}); math.Abs(got-math.Sin(x)) > 1e-4 {
+            t.Errorf("At %g: expected %g, got %g", x, math.Sin(x), got)
+        }
+    }
+}
+
+func TestTableEquations(t *testing.T) {
+    tables := map[string]*Table{
+        "cd": NewTable(TableConfig{X: []float64{0, 10},
+                                   Y: []float64{0.6, 0.7},
+                                   Edge: EdgeError}),
+        "rho": NewTable(TableConfig{X: []float64{0, 1},
+                                    Y: []float64{0, 1},
+                                    Z: [][]float64{{1, 2}, {3, 4}}}),
+    }
+    scope := equationScope{variables: []string{"x"}, tables: tables}
+
+    eq, err := compileEquation(`interp1("cd", x) * interp2('rho', 1, 0.5)`,
+                               scope)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got, err := eq.Eval([]float64{5}); err != nil ||
+        math.Abs(got-0.65*3.5) > 1e-12 {
+        t.Errorf("Expected %g, got %g (%v)", 0.65*3.5, got, err)
+    }
+    _, err = eq.Eval([]float64{11})
+    if err == nil || err.Error() !=
+        "interp1: x 11 is outside the table's [0, 10] at position 1" {
+        t.Errorf("Unexpected error %v", err)
+    }
+
+    for equation, expected := range map[string]string{
+        `interp1("cp", x)`:     `unknown table "cp"`,
+        `interp1("rho", x)`:    `table "rho" is 2-D, interp1 takes a 1-D one`,
+        `interp1(x)`:           "takes a table name first, in quotes",
+        `interp2("rho", x)`:    "a table name and 2 arguments",
+        `x + interp1("cd", 12)`: "x 12 is outside the table's",
+    } {
+        _, err := compileEquation(equation, scope)
+        if err == nil || !strings.Contains(err.Error(), expected) {
+            t.Errorf("%s: expected %q, got %v", equation, expected, err)
+        }
+    }
+}
+
+func TestValidateTables(t *testing.T) {
+    config := validTestConfig()
+    config.Tables = map[string]TableConfig{
+        "cd": {X: []float64{0, 2000}, Y: []float64{0.6, 0.7}},
+    }
+    config.Processing.FlowEquation = `F * interp1("cd", dp)`
+    if err := config.Validate(); err != nil {
+        t.Fatalf("Valid config rejected: %v", err)
+    }
+
+    config.Tables["bad"] = TableConfig{X: []float64{0}}
+    err := config.Validate()
+    if err == nil || !strings.HasPrefix(err.Error(), "tables.bad: ") {
+        t.Errorf("Expected a tables.bad error, got %v", err)
+    }
+
+    // The trial finds dp outside a table that won't extrapolate
+    delete(config.Tables, "bad")
+    config.Tables["cd"] = TableConfig{X: []float64{0, 10},
+                                      Y: []float64{0.6, 0.7},
+                                      Edge: EdgeError}
+    err = config.Validate()
+    if err == nil || !strings.Contains(err.Error(),
+                                       "x 50 is outside the table's") {
+        t.Errorf("Expected an out of range error, got %v", err)
+    }
+}
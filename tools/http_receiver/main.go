@@ -6,7 +6,9 @@ import (
     "log"
     "net/http"
     "os"
+    "sort"
     "strconv"
+    "strings"
     "sync"
 
     "github.com/go-json-experiment/json"
@@ -14,11 +16,41 @@ import (
 
 // OutputData matches the structure sent by flowMeter
 type OutputData struct {
-    SampleNumber   int64 `json:"sample_number"`
-    RawFlow        int32 `json:"raw_flow"`
-    Pressure       int32 `json:"pressure"`
-    Temperature    int32 `json:"temperature"`
-    CalculatedFlow int32 `json:"calculated_flow"`
+    SampleNumber   int64                  `json:"sample_number"`
+    RawFlow        int32                  `json:"raw_flow"`
+    Pressure       int32                  `json:"pressure"`
+    Temperature    int32                  `json:"temperature"`
+    CalculatedFlow int32                  `json:"calculated_flow"`
+    // Flow equation result before truncation to calculated_flow
+    FlowValue      float64                `json:"flow_value"`
+    Overruns       int64                  `json:"overruns"`
+    Dropped        int64                  `json:"dropped"`
+    // Engineering values of the calibrated sensors
+    Values         map[string]float64     `json:"values"`
+    // Gate and period rates of the pulse sensors
+    Pulses         map[string]PulseRates  `json:"pulses"`
+    // Channel or vote used by the redundant sensors
+    Votes          map[string]VoteResult  `json:"votes"`
+    // Latest step of the Kalman filters
+    Kalman         map[string]KalmanState `json:"kalman"`
+}
+
+// PulseRates matches the rates flowMeter measures from a pulse sensor
+type PulseRates struct {
+    Gate   float64 `json:"gate"`
+    Period float64 `json:"period"`
+}
+
+// KalmanState matches the latest step of a flowMeter Kalman filter
+type KalmanState struct {
+    Innovation float64 `json:"innovation"`
+    Variance   float64 `json:"variance"`
+}
+
+// VoteResult matches how flowMeter voted a redundant sensor
+type VoteResult struct {
+    Used        string `json:"used"`
+    Discrepancy bool   `json:"discrepancy"`
 }
 
 func main() {
@@ -40,7 +72,14 @@ func main() {
                        "raw_flow",
                        "pressure",
                        "temperature",
-                       "calculated_flow"}
+                       "calculated_flow",
+                       "flow_value",
+                       "overruns",
+                       "dropped",
+                       "values",
+                       "pulses",
+                       "votes",
+                       "kalman"}
     if err := writer.Write(header); err != nil {
         log.Fatalf("Failed to write CSV header: %v", err)
     }
@@ -69,6 +108,13 @@ func main() {
             strconv.FormatInt(int64(data.Pressure), 10),
             strconv.FormatInt(int64(data.Temperature), 10),
             strconv.FormatInt(int64(data.CalculatedFlow), 10),
+            strconv.FormatFloat(data.FlowValue, 'g', -1, 64),
+            strconv.FormatInt(data.Overruns, 10),
+            strconv.FormatInt(data.Dropped, 10),
+            formatValues(data.Values),
+            formatPulses(data.Pulses),
+            formatVotes(data.Votes),
+            formatKalman(data.Kalman),
         }
         if err := writer.Write(record); err != nil {
             log.Printf("Error writing to CSV: %v", err)
@@ -95,3 +141,70 @@ func main() {
     }
 }
 
+// formatValues renders the engineering values as "name=value" pairs in
+// name order, e.g. "pressure=101.3;temperature=21.5".
+func formatValues(values map[string]float64) string {
+    names := make([]string, 0, len(values))
+    for name := range values {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    pairs := make([]string, len(names))
+    for i, name := range names {
+        pairs[i] = name + "=" + strconv.FormatFloat(values[name], 'g', -1, 64)
+    }
+    return strings.Join(pairs, ";")
+}
+
+// formatPulses renders the pulse rates as "name=gate/period" pairs in name
+// order, e.g. "flow=12.5/12.48".
+func formatPulses(pulses map[string]PulseRates) string {
+    names := make([]string, 0, len(pulses))
+    for name := range pulses {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    pairs := make([]string, len(names))
+    for i, name := range names {
+        r := pulses[name]
+        pairs[i] = name + "=" + strconv.FormatFloat(r.Gate, 'g', -1, 64) +
+            "/" + strconv.FormatFloat(r.Period, 'g', -1, 64)
+    }
+    return strings.Join(pairs, ";")
+}
+
+// formatVotes renders the votes as "name=used" pairs in name order, with
+// a "!" after a discrepancy, e.g. "flow=flow_b!".
+func formatVotes(votes map[string]VoteResult) string {
+    names := make([]string, 0, len(votes))
+    for name := range votes {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    pairs := make([]string, len(names))
+    for i, name := range names {
+        pairs[i] = name + "=" + votes[name].Used
+        if votes[name].Discrepancy {
+            pairs[i] += "!"
+        }
+    }
+    return strings.Join(pairs, ";")
+}
+
+// formatKalman renders the Kalman filter steps as "name=innovation/variance"
+// pairs in name order, e.g. "flow=-3.2/41.7".
+func formatKalman(states map[string]KalmanState) string {
+    names := make([]string, 0, len(states))
+    for name := range states {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    pairs := make([]string, len(names))
+    for i, name := range names {
+        s := states[name]
+        pairs[i] = name + "=" +
+            strconv.FormatFloat(s.Innovation, 'g', -1, 64) + "/" +
+            strconv.FormatFloat(s.Variance, 'g', -1, 64)
+    }
+    return strings.Join(pairs, ";")
+}
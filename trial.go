@@ -0,0 +1,323 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "strings"
+)
+
+// trialBudget bounds the number of points an equation is tried at. Past
+// it, each variable is swept alone with the others at mid-range.
+const trialBudget = 4096
+
+// trialVar is a variable of a trial evaluation and the values it is tried
+// at.
+type trialVar struct {
+    name   string
+    values []float64
+}
+
+// trialEquations evaluates the sensor equations and the flow equation over
+// the declared ranges of what they read, so that a division by zero, a NaN
+// or a flow overflowing int32 is reported when the config is loaded, with
+// its JSON path and position, rather than as errors during the run.
+//
+// Times are the start, middle and end of the run. A sensor with a
+// resolution ranges over its ADC codes (calibrated, in the flow equation);
+// one without over the values its equation gives. Each sensor is also
+// tried at its reference value, where terms like (P - RefP) vanish.
+func (c *Config) trialEquations() error {
+    times := []float64{0}
+    if hz := c.primaryFrequency(); hz > 0 && c.Simulation.DefaultSamples > 0 {
+        end := float64(c.Simulation.DefaultSamples) / hz
+        times = append(times, end/2, end)
+    }
+    refs := map[string]float64{
+        "RefF": float64(c.Simulation.DefaultFlow),
+        "RefP": float64(c.Simulation.DefaultPressure),
+        "RefT": float64(c.Simulation.DefaultTemperature),
+    }
+
+    deps, err := c.Sensors.Dependencies(c.tables)
+    if err != nil {
+        return err
+    }
+    // Candidate counts of each sensor, in dependency order
+    ranges := map[string][]float64{}
+    for len(ranges) < len(c.Sensors) {
+        for _, name := range c.Sensors.Names() {
+            if _, ok := ranges[name]; ok || !resolved(deps[name], ranges) {
+                continue
+            }
+            values, err := c.trialSensor(name, times, refs, ranges)
+            if err != nil {
+                return fmt.Errorf("sensors.%s.equation: %w", name, err)
+            }
+            ranges[name] = values
+        }
+    }
+
+    return c.trialFlow(times, refs, ranges)
+}
+
+// primaryFrequency returns the sample rate of the primary sensor, or of
+// the first channel of a redundant one.
+func (c *Config) primaryFrequency() float64 {
+    primary := c.Processing.PrimarySensor
+    if primary == "" {
+        primary = DefaultPrimarySensor
+    }
+    if rc, ok := c.Processing.Redundancy[primary]; ok {
+        primary = rc.Channels[0]
+    }
+    return c.Sensors[primary].FrequencyHz
+}
+
+func resolved(deps []string, ranges map[string][]float64) bool {
+    for _, d := range deps {
+        if _, ok := ranges[d]; !ok {
+            return false
+        }
+    }
+    return true
+}
+
+// trialSensor tries a sensor's equation and returns the candidate counts
+// of the sensor.
+func (c *Config) trialSensor(name string,
+                             times []float64,
+                             refs map[string]float64,
+                             ranges map[string][]float64) ([]float64,
+                                                           error) {
+    sc := c.Sensors[name]
+    adc := sc.ResolutionBits > 0 && sc.Pulse == nil
+    if sc.Replay != nil {
+        if adc {
+            a := NewADC(sc.ResolutionBits, sc.ADC)
+            return candidates(float64(a.ZeroScale()),
+                              float64(a.FullScale())), nil
+        }
+        return []float64{0}, nil
+    }
+
+    scope := c.Sensors.equationScope(c.tables)
+    scope.checked = true
+    eq, err := compileEquation(sc.Equation, scope)
+    if err != nil {
+        return nil, err
+    }
+    var own []float64
+    if adc {
+        a := NewADC(sc.ResolutionBits, sc.ADC)
+        own = candidates(float64(a.ZeroScale()), float64(a.FullScale()))
+    }
+    vars := make([]trialVar, len(eq.Vars()))
+    for i, v := range eq.Vars() {
+        values, ok := ranges[v]
+        switch {
+        case v == "t":
+            values = times
+        case v == PrevVariable && own != nil:
+            values = own
+        case v == PrevVariable && sc.InitialValue != nil:
+            values = []float64{float64(*sc.InitialValue)}
+        case v == PrevVariable:
+            values = []float64{0}
+        case !ok:
+            values = []float64{refs[v]}
+        }
+        vars[i] = trialVar{v, values}
+    }
+
+    lo, hi := math.Inf(1), math.Inf(-1)
+    err = tryPoints(vars, func(values []float64) error {
+        x, err := eq.Eval(values)
+        if err != nil {
+            return err
+        }
+        if math.IsNaN(x) {
+            return fmt.Errorf("result is NaN")
+        }
+        lo, hi = math.Min(lo, x), math.Max(hi, x)
+        return nil
+    })
+    if err != nil || own != nil {
+        return own, err
+    }
+    return candidates(lo, hi), nil
+}
+
+// trialFlow tries the flow equation, with the sensors as the Processor
+// gives them to it, and with processing.fixed_point in its format too, where
+// a variable or operator that saturates is an error.
+func (c *Config) trialFlow(times []float64,
+                           refs map[string]float64,
+                           ranges map[string][]float64) error {
+    scope := equationScope{
+        variables: c.flowVariables(),
+        tables:    c.tables,
+        checked:   true,
+    }
+    eq, err := compileEquation(c.Processing.FlowEquation, scope)
+    if err != nil {
+        return fmt.Errorf("processing.flow_equation: %w", err)
+    }
+    primary := c.Processing.PrimarySensor
+    if primary == "" {
+        primary = DefaultPrimarySensor
+    }
+    // Candidate values of a sensor or redundant sensor, in its units
+    sensor := func(name string, ref float64, withRef bool) []float64 {
+        counts := ranges[name]
+        if rc, ok := c.Processing.Redundancy[name]; ok {
+            lo, hi := math.Inf(1), math.Inf(-1)
+            for _, ch := range rc.Channels {
+                for _, x := range ranges[ch] {
+                    lo, hi = math.Min(lo, x), math.Max(hi, x)
+                }
+            }
+            counts = candidates(lo, hi)
+        }
+        if withRef {
+            counts = append(counts[:len(counts):len(counts)], ref)
+        }
+        calibration := c.Sensors[name].Calibration
+        values := make([]float64, len(counts))
+        for i, x := range counts {
+            values[i] = calibration.Apply(x)
+        }
+        return values
+    }
+    reference := func(name, ref string) float64 {
+        return c.Sensors[name].Calibration.Apply(refs[ref])
+    }
+
+    vars := make([]trialVar, len(eq.Vars()))
+    for i, v := range eq.Vars() {
+        var values []float64
+        switch v {
+        case "t":
+            values = times
+        case "F":
+            values = sensor(primary, refs["RefF"], true)
+        case "P":
+            values = sensor(string(PressureSensor), refs["RefP"], true)
+        case "T":
+            values = sensor(string(TemperatureSensor), refs["RefT"], true)
+        case "RefF":
+            values = []float64{reference(primary, v)}
+        case "RefP":
+            values = []float64{reference(string(PressureSensor), v)}
+        case "RefT":
+            values = []float64{reference(string(TemperatureSensor), v)}
+        default:
+            values = sensor(v, 0, false)
+        }
+        vars[i] = trialVar{v, values}
+    }
+
+    err = tryPoints(vars, func(values []float64) error {
+        x, err := eq.Eval(values)
+        if err != nil {
+            return err
+        }
+        if !(x >= math.MinInt32 && x <= math.MaxInt32) {
+            return fmt.Errorf("result %g overflows int32", x)
+        }
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("processing.flow_equation: %w", err)
+    }
+
+    fc := c.Processing.FixedPoint
+    if fc == nil {
+        return nil
+    }
+    q, err := fc.QFormat()
+    if err != nil {
+        return fmt.Errorf("processing.fixed_point: %w", err)
+    }
+    scope.fixed = &q
+    fixed, err := compileFixedEquation(c.Processing.FlowEquation, scope)
+    if err != nil {
+        return fmt.Errorf("processing.fixed_point: %w", err)
+    }
+    slots := make([]Fixed, len(vars))
+    err = tryPoints(vars, func(values []float64) error {
+        for i, x := range values {
+            slots[i] = q.FromFloat(x)
+        }
+        _, err := fixed.Eval(slots)
+        return err
+    })
+    if err != nil {
+        return fmt.Errorf("processing.fixed_point: %w", err)
+    }
+    return nil
+}
+
+// candidates returns the values a range is tried at: its ends and middle.
+func candidates(lo, hi float64) []float64 {
+    if lo == hi {
+        return []float64{lo}
+    }
+    return []float64{lo, lo + (hi-lo)/2, hi}
+}
+
+// tryPoints calls try at every combination of the variables' values, or
+// sweeps each variable alone past trialBudget combinations. A failure is
+// reported with the values it was found at.
+func tryPoints(vars []trialVar, try func(values []float64) error) error {
+    values := make([]float64, len(vars))
+    at := func(err error) error {
+        parts := make([]string, len(vars))
+        for i, v := range vars {
+            parts[i] = fmt.Sprintf("%s=%g", v.name, values[i])
+        }
+        return fmt.Errorf("%w (with %s)", err, strings.Join(parts, ", "))
+    }
+
+    points := 1
+    for _, v := range vars {
+        points *= len(v.values)
+        if points > trialBudget {
+            break
+        }
+    }
+    if points <= trialBudget {
+        // Odometer over all combinations
+        index := make([]int, len(vars))
+        for {
+            for i, v := range vars {
+                values[i] = v.values[index[i]]
+            }
+            if err := try(values); err != nil {
+                return at(err)
+            }
+            i := 0
+            for ; i < len(vars); i++ {
+                if index[i]++; index[i] < len(vars[i].values) {
+                    break
+                }
+                index[i] = 0
+            }
+            if i == len(vars) {
+                return nil
+            }
+        }
+    }
+
+    for i, v := range vars {
+        for j := range vars {
+            values[j] = vars[j].values[len(vars[j].values)/2]
+        }
+        for _, x := range v.values {
+            values[i] = x
+            if err := try(values); err != nil {
+                return at(err)
+            }
+        }
+    }
+    return nil
+}
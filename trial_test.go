@@ -0,0 +1,103 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestTrialEquations(t *testing.T) {
+    trialConfig := func() Config {
+        config := validTestConfig()
+        config.Simulation.DefaultSamples = 1000
+        config.Sensors["flow"] = SensorConfig{FrequencyHz: 100,
+                                              ResolutionBits: 24,
+                                              Equation: "RefF"}
+        config.Sensors["pressure"] = SensorConfig{FrequencyHz: 10,
+                                                  ResolutionBits: 8,
+                                                  Equation: "RefP"}
+        return config
+    }
+
+    for _, equation := range []string{
+        "F + F * ((P - RefP) / 255)",
+        "P > 0 ? F / P : F",
+        "F * alpha / dp",
+    } {
+        config := trialConfig()
+        config.Processing.FlowEquation = equation
+        if err := config.Validate(); err != nil {
+            t.Errorf("%s rejected: %v", equation, err)
+        }
+    }
+
+    tests := []struct {
+        sensor   string // sensor whose equation is set, or the flow's
+        equation string
+        expected string
+    }{
+        {"", "F / P", "processing.flow_equation: division by zero at " +
+            "position 3 (with F=0, P=0)"},
+        {"", "F / (P - RefP)", "division by zero at position 3 " +
+            "(with F=0, P=100, RefP=100)"},
+        {"", "F * 1000", "overflows int32"},
+        {"", "exp(F)", "exp(8.3886075e+06) is +Inf at position 1"},
+        // dp has no resolution, so it ranges over its equation's values
+        {"dp", "50 * sin(t / 10)", "processing.flow_equation: division " +
+            "by zero at position 11 (with F=0, alpha=1, dp=0)"},
+        {"alpha", "sqrt(pressure - 1)",
+            "sensors.alpha.equation: sqrt: first argument must be at " +
+            "least 0, got -1 at position 1 (with pressure=0)"},
+        {"alpha", "1 % (t - 5)", "sensors.alpha.equation: modulo by zero " +
+            "at position 3 (with t=5)"},
+    }
+    for _, tc := range tests {
+        config := trialConfig()
+        config.Processing.FlowEquation = "F * alpha / dp"
+        if tc.sensor == "" {
+            config.Processing.FlowEquation = tc.equation
+        } else {
+            sc := config.Sensors[tc.sensor]
+            sc.Equation = tc.equation
+            config.Sensors[tc.sensor] = sc
+        }
+        err := config.Validate()
+        if err == nil || !strings.Contains(err.Error(), tc.expected) {
+            t.Errorf("%s: expected %q, got %v", tc.equation, tc.expected,
+                err)
+        }
+    }
+
+    // processing.fixed_point is tried in its format, the default Q16.16
+    // included
+    fixedTests := []struct {
+        format   string
+        equation string
+        expected string
+    }{
+        {"Q26.6", "F + F * ((P - RefP) / 255)", ""},
+        {"", "F", "processing.fixed_point: F overflows Q16.16 at " +
+            "position 1 (with F=8.3886075e+06)"},
+        {"Q24.8", "F + F * ((P - RefP) / 255)", "F overflows Q24.8 at " +
+            "position 1 (with F=1.6777215e+07, P=0, RefP=100)"},
+        {"Q26.6", "F * 4", "6.710886e+07 overflows Q26.6 at position 3 " +
+            "(with F=1.6777215e+07)"},
+        {"Q24.8", "F / 1000 + 10000000", "constant 1e+07 overflows Q24.8 " +
+            "at position 10"},
+    }
+    for _, tc := range fixedTests {
+        config := trialConfig()
+        config.Processing.FlowEquation = tc.equation
+        config.Processing.FixedPoint = &FixedPointConfig{Format: tc.format}
+        err := config.Validate()
+        if tc.expected == "" {
+            if err != nil {
+                t.Errorf("%s in %s rejected: %v", tc.equation, tc.format, err)
+            }
+            continue
+        }
+        if err == nil || !strings.Contains(err.Error(), tc.expected) {
+            t.Errorf("%s in %s: expected %q, got %v", tc.equation, tc.format,
+                tc.expected, err)
+        }
+    }
+}
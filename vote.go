@@ -0,0 +1,259 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Voting methods of a redundant sensor.
+const (
+    VoteMedian        = "median"         // median of three
+    VoteMean          = "mean"           // mean, rejecting outliers
+    VotePrimaryBackup = "primary_backup" // first channel until it fails
+)
+
+// RedundancyConfig backs a logical sensor with 2 or 3 physical ones, e.g.
+// dual or triple flow transmitters, and votes their samples into one
+// value. The logical name is what the filters, the flow equation and
+// primary_sensor refer to; the channels are ordinary sensors, so each can
+// carry its own noise, schedule or faults.
+type RedundancyConfig struct {
+    // Physical sensors; the first is the primary of primary_backup
+    Channels  []string `json:"channels"`
+    // "median" (3 channels), "mean" or "primary_backup"
+    Vote      string   `json:"vote"`
+    // Largest deviation (counts) between channels before they disagree
+    Tolerance float64  `json:"tolerance"`
+}
+
+// Validate checks a redundant sensor against the declared sensors.
+func (rc RedundancyConfig) Validate(sensors SensorsConfig) error {
+    if len(rc.Channels) < 2 || len(rc.Channels) > 3 {
+        return fmt.Errorf("redundancy needs 2 or 3 channels, got %d",
+            len(rc.Channels))
+    }
+    seen := map[string]bool{}
+    for _, ch := range rc.Channels {
+        if _, ok := sensors[ch]; !ok {
+            return fmt.Errorf("channel %q is not declared in sensors", ch)
+        }
+        if seen[ch] {
+            return fmt.Errorf("channel %q is listed twice", ch)
+        }
+        seen[ch] = true
+    }
+    switch rc.Vote {
+    case VoteMedian:
+        if len(rc.Channels) != 3 {
+            return fmt.Errorf("median vote needs 3 channels")
+        }
+    case VoteMean, VotePrimaryBackup:
+    default:
+        return fmt.Errorf("vote must be 'median', 'mean' or "+
+            "'primary_backup', got %s", rc.Vote)
+    }
+    if !(rc.Tolerance > 0) {
+        return fmt.Errorf("tolerance must be positive, got %g", rc.Tolerance)
+    }
+    return nil
+}
+
+// VoteResult reports how a redundant sensor's latest value was voted.
+type VoteResult struct {
+    // The channel used, or the vote ("mean", "mean(flow_a,flow_c)")
+    Used        string `json:"used"`
+    // The channels disagree beyond the tolerance, or one is silent
+    Discrepancy bool   `json:"discrepancy"`
+}
+
+// Voter votes the channels of a redundant sensor.
+//
+// Channels sample independently, so the vote runs on the latest value of
+// each. A channel that has been silent for a few sample periods (e.g. a
+// dropout fault) is left out. The vote is paced by the last channel still
+// sampling, so the logical sensor delivers one value per channel period
+// and, on shared instants, after all of its channels have updated.
+type Voter struct {
+    config RedundancyConfig
+    // Silence after which a channel is left out; 0 never
+    stale  time.Duration
+    last   []channelSample
+    // Channel in use by primary_backup; failover is latched
+    active int
+    VoteResult
+}
+
+type channelSample struct {
+    value int32
+    at    time.Time
+    sat   Saturation
+    seen  bool
+}
+
+// staleAfter is how many of its slowest channel's periods a channel may be
+// silent before it is left out of the vote.
+const staleAfter = 2.5
+
+// NewVoter creates the vote of a redundant sensor. Sample rates come from
+// sensors; without them (or for replayed channels) a channel never goes
+// stale.
+func NewVoter(config RedundancyConfig, sensors SensorsConfig) *Voter {
+    v := &Voter{
+        config: config,
+        last:   make([]channelSample, len(config.Channels)),
+    }
+    var slowest float64
+    for _, ch := range config.Channels {
+        if hz := sensors[ch].FrequencyHz; hz > 0 {
+            if slowest == 0 || hz < slowest {
+                slowest = hz
+            }
+        }
+    }
+    if slowest > 0 {
+        v.stale = time.Duration(staleAfter / slowest * 1e9)
+    }
+    return v
+}
+
+// Update records a sample of channel i and, when that channel paces the
+// vote, returns the voted value.
+func (v *Voter) Update(i int, data SensorData, value int32) (int32, bool) {
+    v.last[i] = channelSample{
+        value: value,
+        at:    data.Timestamp,
+        sat:   data.Saturation,
+        seen:  true,
+    }
+    var fresh []int
+    seen := 0
+    for j, s := range v.last {
+        if !s.seen {
+            continue
+        }
+        seen++
+        if v.stale == 0 || data.Timestamp.Sub(s.at) <= v.stale {
+            fresh = append(fresh, j)
+        }
+    }
+    if fresh[len(fresh)-1] != i {
+        return 0, false
+    }
+
+    values := make([]float64, len(fresh))
+    for k, j := range fresh {
+        values[k] = float64(v.last[j].value)
+    }
+    lo, hi := values[0], values[0]
+    for _, x := range values {
+        lo, hi = math.Min(lo, x), math.Max(hi, x)
+    }
+    v.Discrepancy = hi-lo > v.config.Tolerance || len(fresh) < seen
+
+    switch v.config.Vote {
+    case VoteMedian:
+        return v.median(fresh), true
+    case VoteMean:
+        return v.mean(fresh, values), true
+    default:
+        return v.primaryBackup(fresh), true
+    }
+}
+
+// median uses the middle channel, or the mean of two when one is out.
+func (v *Voter) median(fresh []int) int32 {
+    if len(fresh) == 2 {
+        values := []float64{float64(v.last[fresh[0]].value),
+                            float64(v.last[fresh[1]].value)}
+        return v.mean(fresh, values)
+    }
+    sorted := append([]int(nil), fresh...)
+    sort.SliceStable(sorted, func(a, b int) bool {
+        return v.last[sorted[a]].value < v.last[sorted[b]].value
+    })
+    mid := sorted[len(sorted)/2]
+    v.Used = v.config.Channels[mid]
+    return v.last[mid].value
+}
+
+// mean averages the channels within tolerance of their median. When none
+// is (two channels far apart) it averages them all.
+func (v *Voter) mean(fresh []int, values []float64) int32 {
+    m := medianOf(values)
+    var kept []string
+    var within []float64
+    for k, x := range values {
+        if math.Abs(x-m) <= v.config.Tolerance {
+            kept = append(kept, v.config.Channels[fresh[k]])
+            within = append(within, x)
+        }
+    }
+    if len(within) == 0 {
+        within = values
+    }
+    if len(kept) == 0 || len(kept) == len(v.last) {
+        v.Used = VoteMean
+    } else {
+        v.Used = VoteMean + "(" + strings.Join(kept, ",") + ")"
+    }
+    var sum float64
+    for _, x := range within {
+        sum += x
+    }
+    return int32(math.Round(sum / float64(len(within))))
+}
+
+// primaryBackup uses the active channel until it goes silent, saturates
+// or deviates from the median of the channels, then fails over to the next
+// one still sampling. With two channels a deviation can't tell which one
+// is wrong; the backup is trusted.
+func (v *Voter) primaryBackup(fresh []int) int32 {
+    active := v.last[v.active]
+    if !active.seen {
+        // Starting up: stand in with a channel that is sampling
+        v.Used = v.config.Channels[fresh[0]]
+        return v.last[fresh[0]].value
+    }
+    isFresh := map[int]bool{}
+    var all, others []float64
+    for _, j := range fresh {
+        isFresh[j] = true
+        all = append(all, float64(v.last[j].value))
+        if j != v.active {
+            others = append(others, float64(v.last[j].value))
+        }
+    }
+    reference := others
+    if len(all) >= 3 {
+        reference = all
+    }
+    failed := !isFresh[v.active] || active.sat != NotSaturated ||
+        (len(reference) > 0 &&
+            math.Abs(float64(active.value)-medianOf(reference)) >
+                v.config.Tolerance)
+    if failed {
+        for j := v.active + 1; j < len(v.last); j++ {
+            if isFresh[j] && v.last[j].sat == NotSaturated {
+                v.active = j
+                break
+            }
+        }
+    }
+    v.Used = v.config.Channels[v.active]
+    return v.last[v.active].value
+}
+
+// medianOf returns the median of values (the mean of the middle two for
+// an even count).
+func medianOf(values []float64) float64 {
+    sorted := append([]float64(nil), values...)
+    sort.Float64s(sorted)
+    n := len(sorted)
+    if n%2 == 0 {
+        return (sorted[n/2-1] + sorted[n/2]) / 2
+    }
+    return sorted[n/2]
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+// voteAt feeds one sample of channel i at tenths of a second since start.
+func voteAt(v *Voter, i int, tenths int, value int32) (int32, bool) {
+    at := time.Unix(0, 0).Add(time.Duration(tenths) * 100 * time.Millisecond)
+    return v.Update(i, SensorData{Timestamp: at}, value)
+}
+
+func TestVoterMedianAndMean(t *testing.T) {
+    sensors := SensorsConfig{
+        "a": {FrequencyHz: 10}, "b": {FrequencyHz: 10}, "c": {FrequencyHz: 10},
+    }
+    median := NewVoter(RedundancyConfig{Channels: []string{"a", "b", "c"},
+        Vote: VoteMedian, Tolerance: 5}, sensors)
+    mean := NewVoter(RedundancyConfig{Channels: []string{"a", "b", "c"},
+        Vote: VoteMean, Tolerance: 5}, sensors)
+    for _, v := range []*Voter{median, mean} {
+        for tenths := 1; tenths <= 2; tenths++ {
+            // Once all are sampling, only the last channel delivers
+            if _, ok := voteAt(v, 0, tenths, 100); ok && tenths > 1 {
+                t.Errorf("%s: channel a should not pace the vote",
+                         v.config.Vote)
+            }
+            voteAt(v, 1, tenths, 104)
+            voteAt(v, 2, tenths, 180)
+        }
+    }
+    if median.Used != "b" || !median.Discrepancy {
+        t.Errorf("median: expected b with a discrepancy, got %+v",
+                 median.VoteResult)
+    }
+    value, _ := voteAt(mean, 2, 3, 180)
+    if value != 102 || mean.Used != "mean(a,b)" {
+        t.Errorf("mean: expected 102 from a and b, got %d from %s",
+                 value, mean.Used)
+    }
+}
+
+func TestVoterFailover(t *testing.T) {
+    sensors := SensorsConfig{"a": {FrequencyHz: 10}, "b": {FrequencyHz: 10}}
+    v := NewVoter(RedundancyConfig{Channels: []string{"a", "b"},
+        Vote: VotePrimaryBackup, Tolerance: 5}, sensors)
+    voteAt(v, 0, 1, 100)
+    if value, ok := voteAt(v, 1, 1, 102); !ok || value != 100 ||
+        v.Used != "a" || v.Discrepancy {
+        t.Errorf("Expected the primary, got %d from %+v", value, v.VoteResult)
+    }
+    // The primary drifts off: fail over to the backup, and stay there
+    voteAt(v, 0, 2, 150)
+    if value, _ := voteAt(v, 1, 2, 102); value != 102 || v.Used != "b" {
+        t.Errorf("Expected the backup, got %d from %s", value, v.Used)
+    }
+    voteAt(v, 0, 3, 100)
+    voteAt(v, 1, 3, 101)
+    if v.Used != "b" {
+        t.Errorf("Failover should latch, got %s", v.Used)
+    }
+
+    // A silent channel is left out and flagged
+    v = NewVoter(v.config, sensors)
+    voteAt(v, 0, 1, 100)
+    voteAt(v, 1, 1, 100)
+    if value, ok := voteAt(v, 1, 5, 101); !ok || value != 101 ||
+        v.Used != "b" || !v.Discrepancy {
+        t.Errorf("Expected b after a dropout, got %d from %+v",
+                 value, v.VoteResult)
+    }
+}
+
+func TestRedundancyConfigValidate(t *testing.T) {
+    config := validTestConfig()
+    config.Sensors["flow_b"] = config.Sensors["flow"]
+    bad := []map[string]RedundancyConfig{
+        {"total": {Channels: []string{"flow"}, Vote: VoteMean,
+            Tolerance: 1}},
+        {"total": {Channels: []string{"flow", "flow_b"}, Vote: VoteMedian,
+            Tolerance: 1}},
+        {"total": {Channels: []string{"flow", "nope"}, Vote: VoteMean,
+            Tolerance: 1}},
+        {"total": {Channels: []string{"flow", "flow_b"}, Vote: VoteMean}},
+        {"pressure": {Channels: []string{"flow", "flow_b"}, Vote: VoteMean,
+            Tolerance: 1}},
+        // flow is a channel, so it can't stay the primary sensor
+        {"total": {Channels: []string{"flow", "flow_b"}, Vote: VoteMean,
+            Tolerance: 1}},
+    }
+    for _, r := range bad {
+        config.Processing.Redundancy = r
+        if err := config.Validate(); err == nil {
+            t.Errorf("Expected %+v to be rejected", r)
+        }
+    }
+    config.Processing.PrimarySensor = "total"
+    if err := config.Validate(); err != nil {
+        t.Errorf("Expected a voted primary to be valid, got %v", err)
+    }
+}